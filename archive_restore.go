@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Objects moved by a lifecycle rule to an archive tier, like Glacier Flexible
+// Retrieval or Deep Archive, can't be downloaded until a restore makes a
+// temporary copy of them available. A download failing that way requests the
+// restore, and the file is retried every restorePollDelay until the copy is
+// there, which takes minutes to hours depending on the tier.
+const (
+	restoreTier      = "Standard"
+	restoreDays      = 7
+	restorePollDelay = 15 * time.Minute
+)
+
+// Returned by a download of objects in an archive tier
+type archivedError struct {
+	Keys []string
+}
+
+func (err *archivedError) Error() string {
+	return fmt.Sprintf("%s is in an archive tier and must be restored first", strings.Join(err.Keys, ", "))
+}
+
+// Returned by a download while the restore of its objects is running
+type restorePendingError struct {
+	Keys []string
+}
+
+func (err *restorePendingError) Error() string {
+	return fmt.Sprintf("waiting for the restore of %s from its archive tier", strings.Join(err.Keys, ", "))
+}
+
+// RestoreProgress is the restore from an archive tier a file waits for
+type RestoreProgress struct {
+	Keys        []string  `json:"keys"`
+	Tier        string    `json:"tier"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// Whether a failed GET was of an object in an archive tier
+func isArchived(resp *httpResponse) bool {
+	return resp.StatusCode == 403 && strings.Contains(string(resp.Body), "<Code>InvalidObjectState</Code>")
+}
+
+// RestoreObject asks for a temporary copy of an object in an archive tier,
+// and reports whether the copy is available already
+func (s3 *S3Client) RestoreObject(key string) (bool, error) {
+	body := fmt.Sprintf(`<RestoreRequest xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Days>%d</Days><GlacierJobParameters><Tier>%s</Tier></GlacierJobParameters></RestoreRequest>`, restoreDays, restoreTier)
+	resp, err := s3.request("POST", key, []byte(body), nil, map[string]string{"restore": ""})
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case 200:
+		// Restored already
+		return true, nil
+	case 202:
+		return false, nil
+	case 409:
+		// RestoreAlreadyInProgress
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to restore %s: %s", key, resp.Body)
+	}
+}
+
+// Requests the restore of the archived objects of a file, returning an error
+// for the download to be retried once they are available
+func (repo *Repository) requestRestore(slashPath string, archived *archivedError) error {
+	restorer, ok := repo.Client.(interface {
+		RestoreObject(key string) (bool, error)
+	})
+	if !ok {
+		return archived
+	}
+	pending := make([]string, 0, len(archived.Keys))
+	for _, key := range archived.Keys {
+		available, err := restorer.RestoreObject(key)
+		if err != nil {
+			return err
+		}
+		if !available {
+			pending = append(pending, key)
+		}
+	}
+	if len(pending) == 0 {
+		// Restored between the download and the request, e.g. by someone else
+		return fmt.Errorf("%s was restored from its archive tier while it was downloaded", slashPath)
+	}
+	repo.logger.Info("Requested restore of file from its archive tier", "file", slashPath, "objects", len(pending), "tier", restoreTier)
+	return &restorePendingError{Keys: pending}
+}
+
+// Records the restore a file waits for in its retry item
+func (item *RetryItem) trackRestore(err error) bool {
+	var pending *restorePendingError
+	if !errors.As(err, &pending) {
+		item.Restore = nil
+		return false
+	}
+	if item.Restore == nil {
+		item.Restore = &RestoreProgress{Tier: restoreTier, RequestedAt: time.Now()}
+	}
+	item.Restore.Keys = pending.Keys
+	item.NextRetry = time.Now().Add(restorePollDelay)
+	return true
+}
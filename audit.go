@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	AuditUpload     = "upload"
+	AuditTombstone  = "tombstone"
+	AuditDelete     = "delete"
+	AuditIndexWrite = "index_write"
+)
+
+// AuditEntry is one change made to the remote, successful or not
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Repository string    `json:"repository"`
+	Remote     string    `json:"remote"`
+	Action     string    `json:"action"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size,omitempty"`
+	Reason     string    `json:"reason"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// AuditLog is the append-only record of every change made to remotes,
+// stored as JSON lines in the state directory. It is never truncated.
+const auditLogFile = "audit.jsonl"
+
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+func OpenAuditLog() (*AuditLog, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	return &AuditLog{path: filepath.Join(dir, auditLogFile)}, nil
+}
+
+func (a *AuditLog) Record(entry AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return appendJSONLine(a.path, entry)
+}
+
+// Entries returns the recorded changes, oldest first
+func (a *AuditLog) Entries() ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	lines, err := readJSONLines(a.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	entries := make([]AuditEntry, 0, len(lines))
+	for _, line := range lines {
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			continue // a line cut short by a crash
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Appends a value as one line of JSON to a file only the user can read
+func appendJSONLine(path string, v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Returns the lines of a JSON lines file, none if it doesn't exist
+func readJSONLines(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var lines [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, maxFrameSize)
+	for scanner.Scan() {
+		lines = append(lines, slices.Clone(scanner.Bytes()))
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// A local file whose content changed while its modtime stayed the one it was
+// synced with was most likely damaged on disk rather than edited, so it is
+// reported and kept from being uploaded over the good remote copy.
+
+// Reports whether a file's content differs from the SHA-256 it was synced
+// with though its modtime is the one it was synced with. Files that differ
+// in modtime, or were synced without a SHA-256, aren't checked.
+func (repo *Repository) verifyLocalFile(slashPath string, item *RemoteItem) (damaged bool, err error) {
+	if item.SHA256 == "" {
+		return false, nil
+	}
+	localFilePath := repo.localPath(slashPath)
+	fileInfo, err := os.Stat(localFilePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if fileInfo.IsDir() || !sameModTime(modTimeOf(fileInfo), item.ModTime) {
+		return false, nil
+	}
+	data, err := os.ReadFile(localFilePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", slashPath, err)
+	}
+	if contentSHA256(data) == item.SHA256 {
+		repo.clearDamaged(slashPath)
+		return false, nil
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if repo.damaged == nil {
+		repo.damaged = make(map[string]int64)
+	}
+	repo.damaged[slashPath] = item.ModTime
+	return true, nil
+}
+
+// Whether a file found damaged is unchanged since, and so not to be uploaded
+func (repo *Repository) isDamaged(slashPath string, localItem *FileItem) bool {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	modTime, ok := repo.damaged[slashPath]
+	return ok && modTime == localItem.ModTime
+}
+
+func (repo *Repository) clearDamaged(slashPath string) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	delete(repo.damaged, slashPath)
+}
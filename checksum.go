@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The SHA-256 of a file as it was when hashed. A file whose size,
+// modification time or inode differ is hashed again.
+type cachedChecksum struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"`
+	Inode   uint64 `json:"inode,omitempty"`
+	SHA256  string `json:"sha256"`
+}
+
+// Digests of local files by absolute path, kept in the state directory so
+// that unchanged files aren't hashed again on every sync
+type checksumStore struct {
+	mu        sync.Mutex
+	loaded    bool
+	checksums map[string]cachedChecksum
+}
+
+var fileChecksums = &checksumStore{}
+
+func checksumStatePath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "checksums.json"), nil
+}
+
+// Returns the cached SHA-256 of a file, or "" when it changed since hashed
+func (store *checksumStore) get(filePath string, info os.FileInfo) string {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.load()
+	cached, ok := store.checksums[filePath]
+	if !ok || cached != checksumKey(info, cached.SHA256) {
+		return ""
+	}
+	return cached.SHA256
+}
+
+// Returns the SHA-256 of a file, hashing it unless it is cached
+func (store *checksumStore) sum(filePath string) (string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	if sum := store.get(filePath, info); sum != "" {
+		return sum, nil
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	sum := contentSHA256(data)
+	store.put(filePath, info, sum)
+	return sum, nil
+}
+
+func (store *checksumStore) put(filePath string, info os.FileInfo, sum string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.load()
+	entry := checksumKey(info, sum)
+	if store.checksums[filePath] == entry {
+		return
+	}
+	store.checksums[filePath] = entry
+	if err := store.save(); err != nil {
+		slog.Warn("Failed to save checksum cache", "error", err)
+	}
+}
+
+func checksumKey(info os.FileInfo, sum string) cachedChecksum {
+	return cachedChecksum{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Inode:   fileInode(info),
+		SHA256:  sum,
+	}
+}
+
+func (store *checksumStore) load() {
+	if store.loaded {
+		return
+	}
+	store.loaded = true
+	store.checksums = make(map[string]cachedChecksum)
+	statePath, err := checksumStatePath()
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &store.checksums); err != nil {
+		slog.Warn("Ignoring unreadable checksum cache", "file", statePath, "error", err)
+		store.checksums = make(map[string]cachedChecksum)
+	}
+}
+
+func (store *checksumStore) save() error {
+	statePath, err := checksumStatePath()
+	if err != nil {
+		return err
+	}
+	// Files that no longer exist are dropped
+	for filePath := range store.checksums {
+		if _, err := os.Lstat(filePath); os.IsNotExist(err) {
+			delete(store.checksums, filePath)
+		}
+	}
+	data, err := json.Marshal(store.checksums)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(statePath, data)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// After circuitFailureThreshold requests in a row to a remote fail, its
+// circuit opens: requests fail right away and repositories syncing with it
+// skip their syncs for circuitCooldown, instead of trying a down endpoint on
+// every interval. The first request after the cooldown probes the remote,
+// closing the circuit when it succeeds and opening it again when it fails.
+const (
+	circuitFailureThreshold = 5
+	circuitCooldown         = 5 * time.Minute
+)
+
+var errCircuitOpen = errors.New("remote unavailable after repeated failures, waiting before trying again")
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	host      string
+	failures  int
+	openUntil time.Time
+	// Set while the request probing the remote is in flight
+	probing bool
+}
+
+// Circuits by remote host, shared by the repositories syncing with it
+var circuits = struct {
+	sync.Mutex
+	byHost map[string]*circuitBreaker
+}{byHost: make(map[string]*circuitBreaker)}
+
+func circuitFor(host string) *circuitBreaker {
+	circuits.Lock()
+	defer circuits.Unlock()
+	circuit, ok := circuits.byHost[host]
+	if !ok {
+		circuit = &circuitBreaker{host: host}
+		circuits.byHost[host] = circuit
+	}
+	return circuit
+}
+
+// Whether a request may be sent, which is the probe once the cooldown passed
+func (circuit *circuitBreaker) allow() bool {
+	circuit.mu.Lock()
+	defer circuit.mu.Unlock()
+	if circuit.openUntil.IsZero() {
+		return true
+	}
+	if circuit.probing || time.Now().Before(circuit.openUntil) {
+		return false
+	}
+	circuit.probing = true
+	return true
+}
+
+// Records whether the remote answered a request
+func (circuit *circuitBreaker) record(healthy bool) {
+	circuit.mu.Lock()
+	defer circuit.mu.Unlock()
+	wasOpen := !circuit.openUntil.IsZero()
+	circuit.probing = false
+	if healthy {
+		circuit.failures = 0
+		circuit.openUntil = time.Time{}
+		if wasOpen {
+			slog.Info("Remote is back, closing circuit", "host", circuit.host)
+		}
+		return
+	}
+	circuit.failures++
+	if wasOpen || circuit.failures >= circuitFailureThreshold {
+		circuit.openUntil = time.Now().Add(circuitCooldown)
+		slog.Warn("Remote keeps failing, opening circuit", "host", circuit.host, "failures", circuit.failures, "until", circuit.openUntil)
+	}
+}
+
+// Gives up a request that was cancelled before the remote answered it,
+// without counting it either way, so that the next request probes the remote
+// if this one did
+func (circuit *circuitBreaker) cancelProbe() {
+	circuit.mu.Lock()
+	defer circuit.mu.Unlock()
+	circuit.probing = false
+}
+
+// When the circuit lets requests through again, zero while it is closed or
+// its cooldown passed
+func (circuit *circuitBreaker) OpenUntil() time.Time {
+	circuit.mu.Lock()
+	defer circuit.mu.Unlock()
+	if time.Now().Before(circuit.openUntil) {
+		return circuit.openUntil
+	}
+	return time.Time{}
+}
+
+// When the circuit of a client's remote closes, zero if it isn't open
+func clientCircuitOpenUntil(client Client) time.Time {
+	if breaker, ok := client.(interface{ circuit() *circuitBreaker }); ok {
+		return breaker.circuit().OpenUntil()
+	}
+	return time.Time{}
+}
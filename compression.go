@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strings"
+)
+
+const (
+	// Smaller files gain too little from compression
+	compressMinSize = 512
+	// Bytes sampled to estimate the entropy of a file
+	compressSampleSize = 4096
+	// Samples with more bits of entropy per byte are most likely compressed
+	// or encrypted already
+	compressMaxEntropy = 7.5
+)
+
+// Extensions of formats that are compressed already
+var incompressibleExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp4": true, ".m4v": true, ".mov": true, ".mkv": true, ".webm": true, ".avi": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".opus": true, ".flac": true,
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true,
+	".jar": true, ".apk": true, ".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".epub": true,
+	".pdf": true, ".woff": true, ".woff2": true, ".pack": true,
+}
+
+// Whether a file is worth compressing: neither small, nor of a compressed
+// format, nor random looking in its first bytes
+func compressible(slashPath string, data []byte) bool {
+	if len(data) < compressMinSize {
+		return false
+	}
+	if incompressibleExts[strings.ToLower(path.Ext(slashPath))] {
+		return false
+	}
+	return sampleEntropy(data[:min(len(data), compressSampleSize)]) <= compressMaxEntropy
+}
+
+// Shannon entropy of a sample in bits per byte, 8 for random bytes
+func sampleEntropy(sample []byte) float64 {
+	var counts [256]int
+	for _, b := range sample {
+		counts[b]++
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / float64(len(sample))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// Returns the file gzipped, or false when it isn't worth it
+func compressPayload(slashPath string, data []byte) ([]byte, bool) {
+	if !compressible(slashPath, data) {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	gzWriter := gzip.NewWriter(&buf)
+	if _, err := gzWriter.Write(data); err != nil {
+		return nil, false
+	}
+	if err := gzWriter.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(data) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+func decompressPayload(slashPath string, data []byte) ([]byte, error) {
+	gzReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", slashPath, err)
+	}
+	defer gzReader.Close()
+	content, err := io.ReadAll(gzReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", slashPath, err)
+	}
+	return content, nil
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
 type RepositoryConfig struct {
@@ -13,19 +22,137 @@ type RepositoryConfig struct {
 	Skip       bool	  `json:"skip"`
 	Raw        []byte `json:"raw"`
 	IgnoreCase *bool  `json:"ignore_case"`
+	// Longest a sync of the repository may take, sync_timeout by default
+	SyncTimeout *Interval `json:"sync_timeout"`
+	// When the repository syncs by itself, always when nil
+	Schedule *Schedule `json:"schedule"`
+	// Whether to sync the git metadata of a linked worktree too
+	WorktreeMetadata bool `json:"worktree_metadata"`
+	// Patterns of files in .git not to sync, defaultGitExcludes when nil
+	GitExcludes []string `json:"git_excludes"`
+	// Gitignore patterns of transient working tree files not to sync,
+	// defaultTempExcludes when nil
+	TempExcludes []string `json:"temp_excludes"`
+	// How files are listed, see git_files.go
+	GitBackend string `json:"git_backend"`
+	// Which way files are synced: "push", "pull", "mirror", "archive" or
+	// "both", the default
+	Direction string `json:"direction"`
+	// Syncs deleting more files wait for confirmation, the global
+	// deletion_limit by default
+	DeletionLimit *DeletionLimit `json:"deletion_limit"`
+	// Files uploaded and downloaded at once by a sync, one by default
+	UploadConcurrency   int `json:"upload_concurrency"`
+	DownloadConcurrency int `json:"download_concurrency"`
+	// Bytes of files the uploads in flight may hold in memory, unlimited
+	// when 0
+	MaxInflightBytes int64 `json:"max_inflight_bytes"`
+	// Whether scrubs hash local files too, to find those damaged on disk
+	VerifyLocal bool `json:"verify_local"`
+	// Whether the extended attributes of files are synced, see xattrs.go,
+	// and the POSIX ACLs among them
+	Xattrs     bool `json:"xattrs"`
+	XattrsACLs bool `json:"xattrs_acls"`
+	// How often the daemon takes a snapshot of the repository, none when
+	// empty, and how many of the most recent ones are kept, all when 0. See
+	// snapshot.go.
+	SnapshotSchedule string `json:"snapshot_schedule"`
+	SnapshotKeep     int    `json:"snapshot_keep"`
+	// Modes of the files and directories downloads create, and bits removed
+	// from both, see modes.go
+	FileMode *FileMode `json:"file_mode"`
+	DirMode  *FileMode `json:"dir_mode"`
+	Umask    *FileMode `json:"umask"`
 }
 
 func (repo *RepositoryConfig) UnmarshalJSON(data []byte) error {
 	config := struct {
-		Type string `json:"type"`
-		Skip bool   `json:"skip"`
+		Type                string         `json:"type"`
+		Skip                bool           `json:"skip"`
+		IgnoreCase          *bool          `json:"ignore_case"`
+		SyncTimeout         *Interval      `json:"sync_timeout"`
+		Schedule            *Schedule      `json:"schedule"`
+		WorktreeMetadata    bool           `json:"worktree_metadata"`
+		GitExcludes         []string       `json:"git_excludes"`
+		TempExcludes        []string       `json:"temp_excludes"`
+		GitBackend          string         `json:"git_backend"`
+		Direction           string         `json:"direction"`
+		DeletionLimit       *DeletionLimit `json:"deletion_limit"`
+		UploadConcurrency   int            `json:"upload_concurrency"`
+		DownloadConcurrency int            `json:"download_concurrency"`
+		MaxInflightBytes    int64          `json:"max_inflight_bytes"`
+		VerifyLocal         bool           `json:"verify_local"`
+		Xattrs              bool           `json:"xattrs"`
+		XattrsACLs          bool           `json:"xattrs_acls"`
+		SnapshotSchedule    string         `json:"snapshot_schedule"`
+		SnapshotKeep        int            `json:"snapshot_keep"`
+		FileMode            *FileMode      `json:"file_mode"`
+		DirMode             *FileMode      `json:"dir_mode"`
+		Umask               *FileMode      `json:"umask"`
+		S3Config
 	}{}
-	if err := json.Unmarshal(data, &config); err != nil {
-		return fmt.Errorf("failed to unmarshal repository config: %w", err)
+	if err := decodeStrict(data, &config); err != nil {
+		return err
 	}
 	if config.Type == "s3" {
 		repo.Type = config.Type
 		repo.Skip = config.Skip
+		repo.IgnoreCase = config.IgnoreCase
+		repo.SyncTimeout = config.SyncTimeout
+		repo.Schedule = config.Schedule
+		repo.WorktreeMetadata = config.WorktreeMetadata
+		if err := validateGitExcludes(config.GitExcludes); err != nil {
+			return err
+		}
+		repo.GitExcludes = config.GitExcludes
+		if _, err := compileExcludes(config.TempExcludes); err != nil {
+			return fmt.Errorf("invalid temp_excludes: %w", err)
+		}
+		repo.TempExcludes = config.TempExcludes
+		switch config.GitBackend {
+		case "", GitBackendAuto, GitBackendBinary, GitBackendBuiltin:
+		default:
+			return fmt.Errorf("git_backend must be %q, %q or %q, got %q", GitBackendAuto, GitBackendBinary, GitBackendBuiltin, config.GitBackend)
+		}
+		repo.GitBackend = config.GitBackend
+		switch config.Direction {
+		case "", DirectionBoth, DirectionPush, DirectionPull, DirectionMirror, DirectionArchive:
+		default:
+			return fmt.Errorf("direction must be %q, %q, %q, %q or %q, got %q", DirectionPush, DirectionPull, DirectionMirror, DirectionArchive, DirectionBoth, config.Direction)
+		}
+		repo.Direction = config.Direction
+		if config.DeletionLimit != nil {
+			if err := config.DeletionLimit.validate(); err != nil {
+				return err
+			}
+		}
+		repo.DeletionLimit = config.DeletionLimit
+		if config.UploadConcurrency < 0 || config.DownloadConcurrency < 0 || config.MaxInflightBytes < 0 {
+			return fmt.Errorf("upload_concurrency, download_concurrency and max_inflight_bytes can't be negative")
+		}
+		repo.UploadConcurrency = config.UploadConcurrency
+		repo.DownloadConcurrency = config.DownloadConcurrency
+		repo.MaxInflightBytes = config.MaxInflightBytes
+		repo.VerifyLocal = config.VerifyLocal
+		if config.Xattrs && !xattrsSupported {
+			return fmt.Errorf("xattrs is only supported on Linux and macOS")
+		}
+		repo.Xattrs = config.Xattrs
+		if config.XattrsACLs && !config.Xattrs {
+			return fmt.Errorf("xattrs_acls needs xattrs")
+		}
+		repo.XattrsACLs = config.XattrsACLs
+		if _, err := parseSnapshotSchedule(config.SnapshotSchedule); err != nil {
+			return err
+		}
+		if config.SnapshotKeep < 0 {
+			return fmt.Errorf("snapshot_keep can't be negative")
+		}
+		repo.SnapshotSchedule = config.SnapshotSchedule
+		repo.SnapshotKeep = config.SnapshotKeep
+		repo.FileMode = config.FileMode
+		repo.DirMode = config.DirMode
+		repo.Umask = config.Umask
 		repo.Raw = data
 		return nil
 	} else {
@@ -33,15 +160,114 @@ func (repo *RepositoryConfig) UnmarshalJSON(data []byte) error {
 	}
 }
 
+// Decodes JSON, failing on unknown keys instead of ignoring them
+func decodeStrict(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return describeConfigError(err)
+	}
+	return nil
+}
+
+// Rewrites JSON decoding errors in terms of config keys
+func describeConfigError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return fmt.Errorf("%s: expected %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	}
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return fmt.Errorf("unknown key %s", field)
+	}
+	return err
+}
+
 type Config struct {
-	Version      int                          `json:"version"`
-	SyncInterval int                          `json:"sync_interval"`
-	Repositories map[string]*RepositoryConfig `json:"repositories"`
-	S3           S3Config                     `json:"s3"`
-	IgnoreCase   *bool                        `json:"ignore_case"`
+	Version       int                          `json:"version"`
+	SyncInterval  Interval                     `json:"sync_interval"`
+	SyncTimeout   Interval                     `json:"sync_timeout"`
+	Repositories  map[string]*RepositoryConfig `json:"repositories"`
+	S3            S3Config                     `json:"s3"`
+	IgnoreCase    *bool                        `json:"ignore_case"`
+	LogFormat     string                       `json:"log_format"`
+	LogLevel      string                       `json:"log_level"`
+	HTTP          HTTPConfig                   `json:"http"`
+	Notifications NotificationConfig           `json:"notifications"`
+	Tracing       TracingConfig                `json:"tracing"`
+	Metered       MeteredConfig                `json:"metered_network"`
+	Battery       BatteryConfig                `json:"battery"`
+	Seed          SeedConfig                   `json:"seed"`
+	DeletionLimit DeletionLimit                `json:"deletion_limit"`
+	Trash         TrashConfig                  `json:"trash"`
+	Scrub         ScrubConfig                  `json:"scrub"`
+	Transport     TransportConfig              `json:"transport"`
+	Socket        SocketConfig                 `json:"socket"`
+	// Gitignore patterns of working tree files never synced, whether git
+	// tracks them or not
+	GlobalExcludes []string `json:"global_excludes"`
+	// Separate file holding credentials, merged into the config. Relative
+	// paths are relative to the config file.
+	SecretsFile string `json:"secrets_file"`
+	// Named partial configs, merged into the config when selected
+	Profiles map[string]json.RawMessage `json:"profiles"`
+	// Settings inherited by every repository unless it sets them itself
+	RepositoryDefaults json.RawMessage `json:"repository_defaults"`
+}
+
+// Default and lower bound of sync_interval, and default of sync_timeout
+const (
+	defaultSyncInterval = Interval(10 * time.Second)
+	minSyncInterval     = Interval(10 * time.Second)
+	defaultSyncTimeout  = Interval(time.Hour)
+)
+
+// Interval is a duration given in the config either as a number of seconds
+// or as a string with units, like "90s", "5m" or "1h30m"
+type Interval time.Duration
+
+func (interval *Interval) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		*interval = Interval(seconds * float64(time.Second))
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("expected seconds or a duration like \"5m\", got %s", data)
+	}
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, use units like \"90s\", \"5m\" or \"1h\"", text)
+	}
+	*interval = Interval(duration)
+	return nil
+}
+
+func (interval Interval) MarshalJSON() ([]byte, error) {
+	return json.Marshal(interval.String())
 }
 
+func (interval Interval) String() string {
+	return time.Duration(interval).String()
+}
+
+type HTTPConfig struct {
+	// Loopback address to serve the HTTP API on, e.g. "127.0.0.1:7878".
+	// The API is disabled when empty.
+	Listen string `json:"listen"`
+	Token  string `json:"token"`
+}
+
+// Overrides the default config path when set, e.g. by the --config flag
+var configFile string
+
+// Profile selected by the --profile flag
+var configProfile string
+
 func ConfigPath() (string, error) {
+	if configFile != "" {
+		return configFile, nil
+	}
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		return "", fmt.Errorf("failed to get home directory: %w", err)
@@ -50,26 +276,522 @@ func ConfigPath() (string, error) {
 	if err := os.MkdirAll(confDir, 0755); err != nil {
 		return "", fmt.Errorf("failed to create config directory: %w", err)
 	}
-	return filepath.Join(homeDir, ".config", "reposy.json"), nil
+	for _, name := range configFileNames {
+		configPath := filepath.Join(confDir, instanceFile(name))
+		if _, err := os.Stat(configPath); err == nil {
+			return configPath, nil
+		}
+	}
+	return filepath.Join(homeDir, ".config", instanceFile("reposy.json")), nil
 }
 
-func LoadConfig() (*Config, error) {
+// Config file names looked up in ~/.config, in order of precedence, with the
+// instance name added for named instances, e.g. reposy-work.json
+var configFileNames = []string{"reposy.json", "reposy.yaml", "reposy.yml", "reposy.toml"}
+
+// Converts a YAML or TOML config to JSON, detected by file extension, so
+// that the rest of the config handling only deals with JSON
+func configToJSON(configPath string, data []byte) ([]byte, error) {
+	var document map[string]any
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &document); err != nil {
+			return nil, err
+		}
+	default:
+		return data, nil
+	}
+	return json.Marshal(document)
+}
+
+// Drop-in directory next to the config file, e.g. ~/.config/reposy.d
+func dropInDir(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "reposy.d")
+}
+
+// Merges the drop-in files of the config directory, in lexical order, into
+// the main config
+func mergeDropIns(configPath string, data []byte) ([]byte, error) {
+	dir := dropInDir(configPath)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return data, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read config directory: %w", err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".json" && ext != ".yaml" && ext != ".yml" && ext != ".toml") {
+			continue
+		}
+		files = append(files, filepath.Join(dir, entry.Name()))
+	}
+	sort.Strings(files)
+	return mergeConfigFiles(data, files, false)
+}
+
+// Merges config files into a config. Objects are merged key by key, any
+// other value of a later file replaces the earlier one.
+func mergeConfigFiles(data []byte, files []string, secret bool) ([]byte, error) {
+	if len(files) == 0 {
+		return data, nil
+	}
+
+	var merged map[string]any
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	for _, file := range files {
+		fileData, err := readConfigFile(file, secret)
+		if err != nil {
+			return nil, err
+		}
+		var document map[string]any
+		if err := json.Unmarshal(fileData, &document); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", file, err)
+		}
+		merged = mergeConfigMaps(merged, document)
+	}
+	return json.Marshal(merged)
+}
+
+// Reads a config file as JSON. A file holding credentials, or any secrets
+// file, must not be accessible by other users.
+func readConfigFile(path string, secret bool) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	data, err = configToJSON(path, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	if !secret {
+		var document any
+		if err := json.Unmarshal(data, &document); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+		secret = containsCredentials(document)
+	}
+	if secret {
+		if err := checkPrivateFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Config keys whose values are credentials
+var credentialKeyNames = map[string]bool{"access_key_id": true, "secret_access_key": true, "token": true}
+
+// Reports whether a config document holds credentials literally, rather
+// than as environment or keychain references
+func containsCredentials(document any) bool {
+	switch document := document.(type) {
+	case map[string]any:
+		for key, value := range document {
+			if str, ok := value.(string); ok && credentialKeyNames[key] {
+				if strings.HasPrefix(str, keychainSecretPrefix) {
+					continue
+				}
+				if envVarPattern.ReplaceAllString(str, "") != "" {
+					return true
+				}
+			} else if containsCredentials(value) {
+				return true
+			}
+		}
+	case []any:
+		for _, value := range document {
+			if containsCredentials(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func mergeConfigMaps(base, overlay map[string]any) map[string]any {
+	if base == nil {
+		base = map[string]any{}
+	}
+	for key, value := range overlay {
+		baseMap, baseIsMap := base[key].(map[string]any)
+		overlayMap, overlayIsMap := value.(map[string]any)
+		if baseIsMap && overlayIsMap {
+			base[key] = mergeConfigMaps(baseMap, overlayMap)
+		} else {
+			base[key] = value
+		}
+	}
+	return base
+}
+
+// Resolves a path given in the config: "~/" is the home directory, relative
+// paths are relative to the directory of the config file
+func expandConfigPath(configPath, path string) (string, error) {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get home directory: %w", err)
+		}
+		return filepath.Join(homeDir, rest), nil
+	}
+	if !filepath.IsAbs(path) {
+		return filepath.Join(filepath.Dir(configPath), path), nil
+	}
+	return path, nil
+}
+
+// Decodes the merged config, reporting unknown keys and values of the wrong
+// type along with the repository they belong to
+func parseConfig(data []byte) (*Config, error) {
+	var repositories struct {
+		Repositories map[string]json.RawMessage `json:"repositories"`
+	}
+	if err := json.Unmarshal(data, &repositories); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", describeConfigError(err))
+	}
+	for localPath, repoData := range repositories.Repositories {
+		var repo RepositoryConfig
+		if err := repo.UnmarshalJSON(repoData); err != nil {
+			return nil, fmt.Errorf("invalid config for repository %s: %w", localPath, err)
+		}
+	}
+
+	var config Config
+	if err := decodeStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return &config, nil
+}
+
+// Merges the named profile into the config it is defined in
+func applyProfile(data []byte, profile string) ([]byte, error) {
+	if profile == "" {
+		return data, nil
+	}
+	var document map[string]any
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	profiles, _ := document["profiles"].(map[string]any)
+	overlay, ok := profiles[profile].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("unknown profile: %s", profile)
+	}
+	delete(document, "profiles")
+	return json.Marshal(mergeConfigMaps(document, overlay))
+}
+
+// Merges the repository_defaults section under the settings of every
+// repository, so that each repository's own settings take precedence. Only
+// the keys a repository accepts can be defaulted this way.
+func applyRepositoryDefaults(data []byte) ([]byte, error) {
+	var document map[string]any
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	defaults, _ := document["repository_defaults"].(map[string]any)
+	repositories, _ := document["repositories"].(map[string]any)
+	if len(defaults) == 0 || len(repositories) == 0 {
+		return data, nil
+	}
+	for localPath, repo := range repositories {
+		repoMap, ok := repo.(map[string]any)
+		if !ok {
+			continue // reported by parseConfig
+		}
+		// mergeConfigMaps modifies its base, so every repository gets a copy
+		defaultsData, err := json.Marshal(defaults)
+		if err != nil {
+			return nil, err
+		}
+		var merged map[string]any
+		if err := json.Unmarshal(defaultsData, &merged); err != nil {
+			return nil, err
+		}
+		repositories[localPath] = mergeConfigMaps(merged, repoMap)
+	}
+	return json.Marshal(document)
+}
+
+// Variables a repository prefix may hold, e.g. "{hostname}/{repo_name}", so
+// that one config, or its repository_defaults, serves several machines
+var prefixVariables = map[string]func(localPath string) (string, error){
+	// The host name up to its first dot, e.g. "laptop" for "laptop.local"
+	"hostname": func(string) (string, error) {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("failed to get host name: %w", err)
+		}
+		hostname, _, _ = strings.Cut(hostname, ".")
+		return hostname, nil
+	},
+	// The last element of the repository path
+	"repo_name": func(localPath string) (string, error) {
+		return filepath.Base(filepath.Clean(localPath)), nil
+	},
+	"user": func(string) (string, error) {
+		current, err := user.Current()
+		if err != nil {
+			return "", fmt.Errorf("failed to get user name: %w", err)
+		}
+		// DOMAIN\name on Windows
+		_, name, found := strings.Cut(current.Username, `\`)
+		if !found {
+			name = current.Username
+		}
+		return name, nil
+	},
+	"os": func(string) (string, error) {
+		return runtime.GOOS, nil
+	},
+}
+
+// Expands the variables of the prefix of every repository
+func expandPrefixTemplates(data []byte) ([]byte, error) {
+	var document map[string]any
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	repositories, _ := document["repositories"].(map[string]any)
+	expanded := false
+	for localPath, repo := range repositories {
+		repoMap, ok := repo.(map[string]any)
+		if !ok {
+			continue // reported by parseConfig
+		}
+		prefix, ok := repoMap["prefix"].(string)
+		if !ok || !strings.Contains(prefix, "{") {
+			continue
+		}
+		result, err := expandPrefix(prefix, localPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config for repository %s: %w", localPath, err)
+		}
+		repoMap["prefix"] = result
+		expanded = true
+	}
+	if !expanded {
+		return data, nil
+	}
+	return json.Marshal(document)
+}
+
+func expandPrefix(prefix, localPath string) (string, error) {
+	var sb strings.Builder
+	rest := prefix
+	for {
+		before, after, found := strings.Cut(rest, "{")
+		sb.WriteString(before)
+		if !found {
+			break
+		}
+		name, after, found := strings.Cut(after, "}")
+		if !found {
+			return "", fmt.Errorf("prefix %q has an unclosed {", prefix)
+		}
+		variable, ok := prefixVariables[name]
+		if !ok {
+			return "", fmt.Errorf("prefix %q has unknown variable {%s}, use {hostname}, {repo_name}, {user} or {os}", prefix, name)
+		}
+		value, err := variable(localPath)
+		if err != nil {
+			return "", err
+		}
+		if value == "" || value == "." || value == ".." || strings.ContainsAny(value, `/\`) {
+			return "", fmt.Errorf("prefix %q can't be expanded, {%s} is %q", prefix, name, value)
+		}
+		sb.WriteString(value)
+		rest = after
+	}
+	if strings.Trim(sb.String(), "/") == "" {
+		return "", fmt.Errorf("prefix %q expands to an empty prefix", prefix)
+	}
+	return sb.String(), nil
+}
+
+// Rejects repositories stored under the same prefix of a bucket, or under a
+// prefix inside another's, whose files and indexes would get mixed up, as
+// when {repo_name} is the same for two of them
+func checkRepositoryPrefixes(config *Config) error {
+	type location struct {
+		repoPath, bucket, prefix string
+	}
+	var locations []location
+	for _, localPath := range sortedKeys(config.Repositories) {
+		repo := config.Repositories[localPath]
+		if repo.Type != "s3" {
+			continue
+		}
+		var s3 S3Config
+		if err := json.Unmarshal(repo.Raw, &s3); err != nil {
+			return fmt.Errorf("invalid config for repository %s: %w", localPath, err)
+		}
+		if s3.Endpoint == "" {
+			s3.Endpoint = config.S3.Endpoint
+		}
+		if s3.Bucket == "" {
+			s3.Bucket = config.S3.Bucket
+		}
+		current := location{repoPath: localPath, bucket: s3.Endpoint + "/" + s3.Bucket, prefix: strings.Trim(s3.Prefix, "/")}
+		for _, other := range locations {
+			if other.bucket != current.bucket {
+				continue
+			}
+			switch {
+			case current.prefix == other.prefix:
+				return fmt.Errorf("repositories %s and %s have the same prefix %q in bucket %s", other.repoPath, localPath, current.prefix, s3.Bucket)
+			case prefixWithin(current.prefix, other.prefix):
+				return fmt.Errorf("the prefix %q of repository %s is inside the prefix %q of repository %s", current.prefix, localPath, other.prefix, other.repoPath)
+			case prefixWithin(other.prefix, current.prefix):
+				return fmt.Errorf("the prefix %q of repository %s is inside the prefix %q of repository %s", other.prefix, other.repoPath, current.prefix, localPath)
+			}
+		}
+		locations = append(locations, current)
+	}
+	return nil
+}
+
+// Whether the keys under prefix are under parent too, all of them being under
+// the empty prefix
+func prefixWithin(prefix, parent string) bool {
+	return parent == "" || strings.HasPrefix(prefix+"/", parent+"/")
+}
+
+// Loads the config with the given profile applied, no profile when empty
+func LoadConfig(profile string) (*Config, error) {
 	configPath, err := ConfigPath()
 	if err != nil {
 		return nil, err
 	}
 
-	data, err := os.ReadFile(configPath)
+	data, err := readConfigFile(configPath, false)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		return nil, err
 	}
 
-	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
+	data, err = mergeDropIns(configPath, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// The secrets file is named in the config it is merged into
+	var secrets struct {
+		SecretsFile string `json:"secrets_file"`
+	}
+	if err := json.Unmarshal(data, &secrets); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
+	if secrets.SecretsFile != "" {
+		secretsPath, err := expandConfigPath(configPath, secrets.SecretsFile)
+		if err != nil {
+			return nil, err
+		}
+		data, err = mergeConfigFiles(data, []string{secretsPath}, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err = applyProfile(data, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = applyRepositoryDefaults(data)
+	if err != nil {
+		return nil, err
+	}
 
-	config.SyncInterval = max(config.SyncInterval, 10)
+	data, err = expandPrefixTemplates(data)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := parseConfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.SyncInterval == 0 {
+		config.SyncInterval = defaultSyncInterval
+	}
+	config.SyncInterval = max(config.SyncInterval, minSyncInterval)
+	if config.SyncTimeout <= 0 {
+		config.SyncTimeout = defaultSyncTimeout
+	}
+	if err := config.Metered.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if config.Metered.ThrottleRate == 0 {
+		config.Metered.ThrottleRate = defaultThrottleRate
+	}
+	if err := config.Battery.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if config.Battery.SyncInterval == 0 {
+		config.Battery.SyncInterval = defaultBatterySyncInterval
+	}
+	config.Battery.SyncInterval = max(config.Battery.SyncInterval, minSyncInterval)
+	if err := config.S3.Retry.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if err := config.Seed.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if config.Seed.Concurrency == 0 {
+		config.Seed.Concurrency = defaultSeedConcurrency
+	}
+	if config.Seed.MinFiles == 0 {
+		config.Seed.MinFiles = defaultSeedMinFiles
+	}
+	if err := config.DeletionLimit.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	config.DeletionLimit = config.DeletionLimit.withDefaults(DeletionLimit{
+		Files:   defaultDeletionLimitFiles,
+		Percent: defaultDeletionLimitPercent,
+	})
+	if config.Notifications.FailureThreshold < 0 {
+		return nil, fmt.Errorf("invalid config: notifications.failure_threshold can't be negative")
+	}
+	if config.Notifications.FailureThreshold == 0 {
+		config.Notifications.FailureThreshold = defaultFailureThreshold
+	}
+	if config.Trash.Retention == 0 {
+		config.Trash.Retention = defaultTrashRetention
+	}
+	if config.Scrub.Interval < 0 || config.Scrub.Objects < 0 {
+		return nil, fmt.Errorf("invalid config: scrub.interval and scrub.objects can't be negative")
+	}
+	if config.Scrub.Objects == 0 {
+		config.Scrub.Objects = defaultScrubObjects
+	}
+	if err := config.Transport.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	config.Transport = config.Transport.withDefaults()
+	if err := config.Socket.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if config.Socket.MaxConcurrentSyncs == 0 {
+		config.Socket.MaxConcurrentSyncs = defaultMaxConcurrentSyncs
+	}
+	if config.Socket.Token, err = resolveConfigValue(config.Socket.Token); err != nil {
+		return nil, err
+	}
+	if _, err := compileExcludes(config.GlobalExcludes); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
 	if config.IgnoreCase == nil {
 		// default true if running on macOS or Windows
 		ignoreCase := false
@@ -83,8 +805,29 @@ func LoadConfig() (*Config, error) {
 		if (repo.IgnoreCase == nil) {
 			repo.IgnoreCase = config.IgnoreCase
 		}
+		if repo.GitExcludes == nil {
+			repo.GitExcludes = defaultGitExcludes
+		}
+		if repo.TempExcludes == nil {
+			repo.TempExcludes = defaultTempExcludes
+		}
+		if repo.Direction == "" {
+			repo.Direction = DirectionBoth
+		}
+		if repo.SyncTimeout == nil || *repo.SyncTimeout <= 0 {
+			repo.SyncTimeout = &config.SyncTimeout
+		}
+		if repo.DeletionLimit == nil {
+			repo.DeletionLimit = &config.DeletionLimit
+		} else {
+			limit := repo.DeletionLimit.withDefaults(config.DeletionLimit)
+			repo.DeletionLimit = &limit
+		}
 
 	}
+	if err := checkRepositoryPrefixes(config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
 
-	return &config, nil
+	return config, nil
 }
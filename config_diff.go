@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+)
+
+// Describes what a reload changes, from the config and repositories in use
+// to the newly loaded ones. Credentials are only reported as rotated.
+func diffConfig(oldConfig *Config, oldRepos []*Repository, newConfig *Config, newRepos []*Repository) []string {
+	var changes []string
+	changed := func(format string, args ...any) {
+		changes = append(changes, fmt.Sprintf(format, args...))
+	}
+
+	oldByPath := make(map[string]*Repository, len(oldRepos))
+	for _, repository := range oldRepos {
+		oldByPath[repository.Path] = repository
+	}
+	newByPath := make(map[string]*Repository, len(newRepos))
+	for _, repository := range newRepos {
+		newByPath[repository.Path] = repository
+	}
+
+	for _, repoPath := range sortedKeys(newByPath) {
+		oldRepo, ok := oldByPath[repoPath]
+		if !ok {
+			changed("Repository added: %s", repoPath)
+			continue
+		}
+		changes = append(changes, diffRepository(oldRepo, newByPath[repoPath])...)
+	}
+	for _, repoPath := range sortedKeys(oldByPath) {
+		if _, ok := newByPath[repoPath]; ok {
+			continue
+		}
+		if repoConfig, ok := newConfig.Repositories[repoPath]; ok && repoConfig.Skip {
+			changed("Repository skipped: %s", repoPath)
+		} else {
+			changed("Repository removed: %s", repoPath)
+		}
+	}
+
+	if oldConfig.SyncInterval != newConfig.SyncInterval {
+		changed("Sync interval: %s -> %s", oldConfig.SyncInterval, newConfig.SyncInterval)
+	}
+	if oldConfig.LogFormat != newConfig.LogFormat {
+		changed("Log format: %q -> %q", oldConfig.LogFormat, newConfig.LogFormat)
+	}
+	if oldConfig.LogLevel != newConfig.LogLevel {
+		changed("Log level: %q -> %q", oldConfig.LogLevel, newConfig.LogLevel)
+	}
+	// the HTTP server is only set up when the sync service starts
+	if oldConfig.HTTP.Listen != newConfig.HTTP.Listen {
+		changed("HTTP API address: %q -> %q (takes effect after 'reposy stop' and 'reposy start')", oldConfig.HTTP.Listen, newConfig.HTTP.Listen)
+	}
+	if oldConfig.HTTP.Token != newConfig.HTTP.Token {
+		changed("HTTP API token rotated (takes effect after 'reposy stop' and 'reposy start')")
+	}
+	if !maps.Equal(oldConfig.Notifications.Events, newConfig.Notifications.Events) {
+		changed("Notification events changed")
+	}
+	if oldConfig.Notifications.FailureThreshold != newConfig.Notifications.FailureThreshold {
+		changed("Notification failure threshold %d -> %d", oldConfig.Notifications.FailureThreshold, newConfig.Notifications.FailureThreshold)
+	}
+	if oldConfig.Scrub != newConfig.Scrub {
+		changed("Scrub settings changed")
+	}
+	if !oldConfig.Socket.equal(newConfig.Socket) {
+		changed("Socket settings changed")
+	}
+	if !oldConfig.Transport.equal(newConfig.Transport) {
+		changed("Transport settings changed")
+	}
+	if !slices.Equal(oldConfig.GlobalExcludes, newConfig.GlobalExcludes) {
+		changed("global_excludes %q -> %q", oldConfig.GlobalExcludes, newConfig.GlobalExcludes)
+	}
+	if oldConfig.Metered != newConfig.Metered {
+		changed("Metered network settings changed")
+	}
+	if oldConfig.Battery != newConfig.Battery {
+		changed("Battery settings changed")
+	}
+	if oldConfig.Seed != newConfig.Seed {
+		changed("Seed settings changed")
+	}
+	if oldConfig.Trash != newConfig.Trash {
+		changed("Trash retention %s -> %s", oldConfig.Trash.Retention, newConfig.Trash.Retention)
+	}
+	return changes
+}
+
+func diffRepository(oldRepo, newRepo *Repository) []string {
+	var changes []string
+	changed := func(format string, args ...any) {
+		changes = append(changes, fmt.Sprintf("Repository %s: "+format, append([]any{newRepo.Path}, args...)...))
+	}
+
+	if oldRepo.Skip != newRepo.Skip {
+		changed("skip %t -> %t", oldRepo.Skip, newRepo.Skip)
+	}
+	if oldRepo.IgnoreCase != newRepo.IgnoreCase {
+		changed("ignore_case %t -> %t", oldRepo.IgnoreCase, newRepo.IgnoreCase)
+	}
+	if oldRepo.Timeout != newRepo.Timeout {
+		changed("sync_timeout %s -> %s", oldRepo.Timeout, newRepo.Timeout)
+	}
+	if oldRepo.Schedule.String() != newRepo.Schedule.String() {
+		changed("schedule %q -> %q", oldRepo.Schedule, newRepo.Schedule)
+	}
+	if oldRepo.WorktreeMetadata != newRepo.WorktreeMetadata {
+		changed("worktree_metadata %t -> %t", oldRepo.WorktreeMetadata, newRepo.WorktreeMetadata)
+	}
+	if !slices.Equal(oldRepo.GitExcludes, newRepo.GitExcludes) {
+		changed("git_excludes %q -> %q", oldRepo.GitExcludes, newRepo.GitExcludes)
+	}
+	if !slices.Equal(oldRepo.TempExcludes, newRepo.TempExcludes) {
+		changed("temp_excludes %q -> %q", oldRepo.TempExcludes, newRepo.TempExcludes)
+	}
+	if oldRepo.GitBackend != newRepo.GitBackend {
+		changed("git_backend %q -> %q", oldRepo.GitBackend, newRepo.GitBackend)
+	}
+	if oldRepo.Direction != newRepo.Direction {
+		changed("direction %s -> %s", oldRepo.Direction, newRepo.Direction)
+	}
+	if oldRepo.DeletionLimit != newRepo.DeletionLimit {
+		changed("deletion_limit %d files or %d%% -> %d files or %d%%",
+			oldRepo.DeletionLimit.Files, oldRepo.DeletionLimit.Percent, newRepo.DeletionLimit.Files, newRepo.DeletionLimit.Percent)
+	}
+	if oldRepo.UploadConcurrency != newRepo.UploadConcurrency || oldRepo.DownloadConcurrency != newRepo.DownloadConcurrency {
+		changed("concurrency %d uploads, %d downloads -> %d uploads, %d downloads",
+			oldRepo.UploadConcurrency, oldRepo.DownloadConcurrency, newRepo.UploadConcurrency, newRepo.DownloadConcurrency)
+	}
+	if oldRepo.Modes != newRepo.Modes {
+		changed("modes %04o files, %04o directories -> %04o files, %04o directories", uint32(oldRepo.Modes.File), uint32(oldRepo.Modes.Dir), uint32(newRepo.Modes.File), uint32(newRepo.Modes.Dir))
+	}
+	if oldRepo.VerifyLocal != newRepo.VerifyLocal {
+		changed("verify_local %t -> %t", oldRepo.VerifyLocal, newRepo.VerifyLocal)
+	}
+	if oldRepo.Xattrs != newRepo.Xattrs {
+		changed("xattrs %t -> %t", oldRepo.Xattrs, newRepo.Xattrs)
+	}
+	if oldRepo.XattrsACLs != newRepo.XattrsACLs {
+		changed("xattrs_acls %t -> %t", oldRepo.XattrsACLs, newRepo.XattrsACLs)
+	}
+	if oldRepo.SnapshotInterval != newRepo.SnapshotInterval || oldRepo.SnapshotKeep != newRepo.SnapshotKeep {
+		changed("snapshots every %s keeping %d -> every %s keeping %d", oldRepo.SnapshotInterval, oldRepo.SnapshotKeep, newRepo.SnapshotInterval, newRepo.SnapshotKeep)
+	}
+	if oldRepo.MaxInflightBytes != newRepo.MaxInflightBytes {
+		changed("max_inflight_bytes %d -> %d", oldRepo.MaxInflightBytes, newRepo.MaxInflightBytes)
+	}
+	oldClient, oldOK := oldRepo.Client.(*S3Client)
+	newClient, newOK := newRepo.Client.(*S3Client)
+	if !oldOK || !newOK {
+		return changes
+	}
+	settings := []struct{ name, oldValue, newValue string }{
+		{"endpoint", oldClient.Endpoint, newClient.Endpoint},
+		{"bucket", oldClient.Bucket, newClient.Bucket},
+		{"region", oldClient.Region, newClient.Region},
+		{"prefix", oldClient.Prefix, newClient.Prefix},
+	}
+	for _, setting := range settings {
+		if setting.oldValue != setting.newValue {
+			changed("%s %q -> %q", setting.name, setting.oldValue, setting.newValue)
+		}
+	}
+	if oldClient.Compress != newClient.Compress {
+		changed("compress %t -> %t", oldClient.Compress, newClient.Compress)
+	}
+	if oldClient.Dedup != newClient.Dedup {
+		changed("dedup %t -> %t", oldClient.Dedup, newClient.Dedup)
+	}
+	if !oldClient.Retry.equal(newClient.Retry) {
+		changed("retry policy changed")
+	}
+	if oldClient.IndexKey != newClient.IndexKey {
+		changed("index key changed")
+	}
+	if !maps.Equal(oldClient.ExtraHeaders, newClient.ExtraHeaders) {
+		changed("extra headers changed")
+	}
+	if oldClient.ObjectLock != newClient.ObjectLock {
+		changed("object lock %q %s -> %q %s", oldClient.ObjectLock.Mode, oldClient.ObjectLock.Retention, newClient.ObjectLock.Mode, newClient.ObjectLock.Retention)
+	}
+	if oldClient.AccessKeyID != newClient.AccessKeyID || oldClient.SecretAccessKey != newClient.SecretAccessKey {
+		changed("credentials rotated")
+	}
+	return changes
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
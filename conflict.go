@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// A file changed both locally and remotely since the last sync. The remote
+// version, being newer, replaced the file, and the local one was kept next
+// to it as a conflict copy until the conflict is resolved.
+type Conflict struct {
+	Repository string `json:"repository"`
+	// Slash path of the file, holding the remote version
+	File string `json:"file"`
+	// Slash path of the conflict copy, holding the local version
+	Copy          string `json:"copy"`
+	LocalModTime  int64  `json:"local_mod_time"`
+	RemoteModTime int64  `json:"remote_mod_time"`
+	// Where each version was written: this machine and the remote
+	LocalOrigin  string    `json:"local_origin"`
+	RemoteOrigin string    `json:"remote_origin"`
+	DetectedAt   time.Time `json:"detected_at"`
+}
+
+const (
+	ConflictKeepLocal  = "local"
+	ConflictKeepRemote = "remote"
+)
+
+type ResolveConflictArgs struct {
+	Path string `json:"path"`
+	Keep string `json:"keep"`
+}
+
+type ConflictsPayload struct {
+	Conflicts []Conflict `json:"conflicts"`
+}
+
+// Unresolved conflicts, kept in the state directory by the absolute path of
+// their conflict copy
+type conflictStore struct {
+	mu        sync.Mutex
+	loaded    bool
+	conflicts map[string]*Conflict
+}
+
+var fileConflicts = &conflictStore{}
+
+func conflictStatePath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "conflicts.json"), nil
+}
+
+func conflictKey(conflict *Conflict) string {
+	return filepath.Join(conflict.Repository, filepath.FromSlash(diskPath(conflict.Copy)))
+}
+
+// Returns the unresolved conflicts, forgetting those whose conflict copy was
+// removed by hand
+func (store *conflictStore) list() []Conflict {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.load()
+	conflicts := make([]Conflict, 0, len(store.conflicts))
+	pruned := false
+	for key, conflict := range store.conflicts {
+		if _, err := os.Lstat(key); os.IsNotExist(err) {
+			delete(store.conflicts, key)
+			pruned = true
+			continue
+		}
+		conflicts = append(conflicts, *conflict)
+	}
+	if pruned {
+		store.saveOrWarn()
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflictKey(&conflicts[i]) < conflictKey(&conflicts[j])
+	})
+	return conflicts
+}
+
+// Returns the conflict of a file or of its conflict copy, or nil
+func (store *conflictStore) find(fullPath string) *Conflict {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.load()
+	for key, conflict := range store.conflicts {
+		if key == fullPath || filepath.Join(conflict.Repository, filepath.FromSlash(diskPath(conflict.File))) == fullPath {
+			copied := *conflict
+			return &copied
+		}
+	}
+	return nil
+}
+
+func (store *conflictStore) add(conflict *Conflict) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.load()
+	store.conflicts[conflictKey(conflict)] = conflict
+	store.saveOrWarn()
+}
+
+func (store *conflictStore) remove(conflict *Conflict) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.load()
+	delete(store.conflicts, conflictKey(conflict))
+	store.saveOrWarn()
+}
+
+func (store *conflictStore) load() {
+	if store.loaded {
+		return
+	}
+	store.loaded = true
+	store.conflicts = make(map[string]*Conflict)
+	statePath, err := conflictStatePath()
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &store.conflicts); err != nil {
+		slog.Warn("Ignoring unreadable conflict state", "file", statePath, "error", err)
+		store.conflicts = make(map[string]*Conflict)
+	}
+}
+
+func (store *conflictStore) saveOrWarn() {
+	if err := store.save(); err != nil {
+		// The conflict copies are still there, only no longer listed
+		slog.Warn("Failed to save conflict state", "error", err)
+	}
+}
+
+func (store *conflictStore) save() error {
+	statePath, err := conflictStatePath()
+	if err != nil {
+		return err
+	}
+	if len(store.conflicts) == 0 {
+		if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(store.conflicts)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(statePath, data)
+}
+
+// Path of the conflict copy of a file, e.g. notes.conflict-20260102-150405.md
+func conflictCopyPath(slashPath string, detectedAt time.Time) string {
+	ext := path.Ext(slashPath)
+	return fmt.Sprintf("%s.conflict-%s%s", strings.TrimSuffix(slashPath, ext), detectedAt.Format("20060102-150405"), ext)
+}
+
+// Describes the remote a repository syncs with
+func (repo *Repository) remoteOrigin() string {
+	if client, ok := repo.Client.(*S3Client); ok {
+		return fmt.Sprintf("s3://%s/%s", client.Bucket, client.Prefix)
+	}
+	return "remote"
+}
+
+// Moves the local version of a file changed on both sides to a conflict copy,
+// before the remote version is downloaded in its place
+func (repo *Repository) keepConflictCopy(slashPath string, localItem *FileItem, remoteItem *RemoteItem) (*Conflict, error) {
+	detectedAt := time.Now()
+	copyPath := conflictCopyPath(slashPath, detectedAt)
+	defer repo.touch(slashPath, copyPath)
+	if err := os.Rename(repo.localPath(slashPath), repo.localPath(copyPath)); err != nil {
+		return nil, fmt.Errorf("failed to keep conflict copy of %s: %w", slashPath, err)
+	}
+	localOrigin, err := os.Hostname()
+	if err != nil {
+		localOrigin = "this machine"
+	}
+	conflict := &Conflict{
+		Repository:    repo.Path,
+		File:          slashPath,
+		Copy:          copyPath,
+		LocalModTime:  localItem.ModTime,
+		RemoteModTime: remoteItem.ModTime,
+		LocalOrigin:   localOrigin,
+		RemoteOrigin:  repo.remoteOrigin(),
+		DetectedAt:    detectedAt,
+	}
+	fileConflicts.add(conflict)
+	return conflict, nil
+}
+
+// ResolveConflict finalizes the conflict of a file, given by the absolute
+// path of the file or of its conflict copy. Keeping the local version moves
+// the copy back over the file, to be uploaded by the next sync; keeping the
+// remote one moves the copy to the trash.
+func (repo *Repository) ResolveConflict(fullPath, keep string) (*Conflict, error) {
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+
+	conflict := fileConflicts.find(fullPath)
+	if conflict == nil || conflict.Repository != repo.Path {
+		return nil, fmt.Errorf("no unresolved conflict for %s", fullPath)
+	}
+	copyPath := repo.localPath(conflict.Copy)
+	defer repo.touch(conflict.File, conflict.Copy)
+	switch keep {
+	case ConflictKeepLocal:
+		filePath := repo.localPath(conflict.File)
+		if _, err := ensureWritableIfExist(filePath); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(copyPath, filePath); err != nil {
+			return nil, fmt.Errorf("failed to restore local version: %w", err)
+		}
+		// Newer than the remote version, so that it is uploaded
+		now := time.Now()
+		if err := os.Chtimes(filePath, now, now); err != nil {
+			return nil, fmt.Errorf("failed to change modtime of file %s: %w", filePath, err)
+		}
+	case ConflictKeepRemote:
+		if _, err := repo.trashFile(conflict.Copy); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove conflict copy: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("keep must be %q or %q, got %q", ConflictKeepLocal, ConflictKeepRemote, keep)
+	}
+	fileConflicts.remove(conflict)
+	repo.logger.Info("Resolved conflict", "file", conflict.File, "keep", keep)
+	return conflict, nil
+}
+
+func newConflictsCmd() *cobra.Command {
+	conflictsCmd := &cobra.Command{
+		Use:   "conflicts",
+		Short: "List files changed both locally and remotely, kept as conflict copies",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			resp := sendCommand("conflicts", "")
+			var conflicts ConflictsPayload
+			if decodePayload(resp, &conflicts) {
+				fmt.Print(formatConflicts(conflicts.Conflicts))
+				return
+			}
+			printResponse(resp, ExitFailure)
+		},
+	}
+
+	var keep string
+	resolveCmd := &cobra.Command{
+		Use:   "resolve <path>",
+		Short: "Keep the local or the remote version of a conflicting file",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if keep != ConflictKeepLocal && keep != ConflictKeepRemote {
+				fmt.Printf("--keep must be %s or %s\n", ConflictKeepLocal, ConflictKeepRemote)
+				os.Exit(ExitUsage)
+			}
+			requireDaemon()
+			filePath, err := filepath.Abs(args[0])
+			if err != nil {
+				fmt.Printf("Invalid path: %v\n", err)
+				os.Exit(ExitUsage)
+			}
+			resolveArgs, _ := json.Marshal(ResolveConflictArgs{Path: filePath, Keep: keep})
+			printResponse(sendCommand("resolve-conflict", string(resolveArgs)), ExitFailure)
+		},
+	}
+	resolveCmd.Flags().StringVar(&keep, "keep", "", "Version to keep: local or remote")
+	resolveCmd.MarkFlagRequired("keep")
+
+	conflictsCmd.AddCommand(resolveCmd)
+	return conflictsCmd
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// Keychain account names of the credentials stored for a remote
+func credentialKeys(remote string) (accessKeyID, secretAccessKey string) {
+	return remote + "/access_key_id", remote + "/secret_access_key"
+}
+
+// Fills in the access keys of an S3 config from the credentials stored
+// under its "credentials" name, unless they are set in the config
+func loadStoredCredentials(config *S3Config) error {
+	if config.Credentials == "" {
+		return nil
+	}
+	accessKeyName, secretKeyName := credentialKeys(config.Credentials)
+	if config.AccessKeyID == "" {
+		value, err := keychainGet(accessKeyName)
+		if err != nil {
+			return fmt.Errorf("failed to read credentials %s from keychain: %w", config.Credentials, err)
+		}
+		config.AccessKeyID = value
+	}
+	if config.SecretAccessKey == "" {
+		value, err := keychainGet(secretKeyName)
+		if err != nil {
+			return fmt.Errorf("failed to read credentials %s from keychain: %w", config.Credentials, err)
+		}
+		config.SecretAccessKey = value
+	}
+	return nil
+}
+
+func newCredentialsCmd() *cobra.Command {
+	credentialsCmd := &cobra.Command{
+		Use:   "credentials",
+		Short: "Manage S3 credentials stored in the OS keychain",
+	}
+
+	setCmd := &cobra.Command{
+		Use:   "set <remote>",
+		Short: "Store the access keys of a remote in the OS keychain",
+		Long: "Store the access keys of a remote in the OS keychain. Reference them with\n" +
+			"\"credentials\": \"<remote>\" in the s3 section or a repository of the config.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			remote := args[0]
+			reader := bufio.NewReader(os.Stdin)
+			accessKeyID, err := promptCredential(reader, "Access key ID: ", false)
+			if err == nil {
+				var secretAccessKey string
+				secretAccessKey, err = promptCredential(reader, "Secret access key: ", true)
+				if err == nil {
+					err = storeCredentials(remote, accessKeyID, secretAccessKey)
+				}
+			}
+			if err != nil {
+				fmt.Printf("Failed to store credentials: %v\n", err)
+				os.Exit(ExitFailure)
+			}
+			fmt.Printf("Credentials for %s stored in the keychain\n", remote)
+		},
+	}
+
+	credentialsCmd.AddCommand(setCmd)
+	return credentialsCmd
+}
+
+func storeCredentials(remote, accessKeyID, secretAccessKey string) error {
+	if accessKeyID == "" || secretAccessKey == "" {
+		return fmt.Errorf("access key ID and secret access key are required")
+	}
+	accessKeyName, secretKeyName := credentialKeys(remote)
+	if err := keychainSet(accessKeyName, accessKeyID); err != nil {
+		return err
+	}
+	return keychainSet(secretKeyName, secretAccessKey)
+}
+
+// Reads one line from stdin, without echo for secrets typed in a terminal
+func promptCredential(reader *bufio.Reader, prompt string, secret bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimSpace(line), nil
+	}
+
+	fmt.Print(prompt)
+	if secret {
+		value, err := term.ReadPassword(fd)
+		fmt.Println()
+		return strings.TrimSpace(string(value)), err
+	}
+	line, err := reader.ReadString('\n')
+	return strings.TrimSpace(line), err
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With dedup, a file is split into chunks at boundaries picked by its content,
+// so that an insertion only changes the chunks around it. Chunks are stored
+// once per repository, addressed by their SHA-256 under CHUNK_PREFIX followed
+// by the prefix of the repository, apart from its files, and the file's object
+// holds the list of its chunks instead of its content. Older versions stored
+// chunks at the root of CHUNK_PREFIX, shared by every repository of the
+// bucket; those are still read, but never deleted.
+const CHUNK_PREFIX = ".reposychunks"
+
+// Chunks no file refers to are deleted once they weren't written for this
+// long, which leaves a sync that stored a chunk, or found it stored, the time
+// to add its file to the index. A sync reusing a chunk older than half of it
+// writes it again, see touchChunk.
+const chunkGracePeriod = 24 * time.Hour
+
+const (
+	// Smaller files are stored whole
+	dedupMinSize = 64 << 10
+	// Bounds and average size of chunks
+	chunkMinSize = 256 << 10
+	chunkMaxSize = 4 << 20
+	// A boundary is cut where the rolling hash has these bits clear, about
+	// every 1 MiB past the minimum
+	chunkMask = 1<<20 - 1
+)
+
+// The object of a deduplicated file
+type chunkManifest struct {
+	Size   int64       `json:"size"`
+	Chunks []chunkInfo `json:"chunks"`
+}
+
+type chunkInfo struct {
+	SHA256 string `json:"sha256"`
+	Size   int    `json:"size"`
+}
+
+// Random values the rolling hash adds up for each byte, the same on every
+// machine so that the same content gives the same chunks
+var gearTable = func() (table [256]uint64) {
+	// splitmix64
+	seed := uint64(0x5265706f7379)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Splits data into content-defined chunks with a gear rolling hash
+func splitChunks(data []byte) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		end := len(data)
+		if end > chunkMinSize {
+			end = min(end, chunkMaxSize)
+			var hash uint64
+			for i := chunkMinSize; i < end; i++ {
+				hash = hash<<1 + gearTable[data[i]]
+				if hash&chunkMask == 0 {
+					end = i + 1
+					break
+				}
+			}
+		}
+		chunks = append(chunks, data[:end])
+		data = data[end:]
+	}
+	return chunks
+}
+
+func (s3 *S3Client) chunkDir() string {
+	return path.Join(CHUNK_PREFIX, s3.Prefix)
+}
+
+func (s3 *S3Client) chunkKey(sum string) string {
+	return path.Join(s3.chunkDir(), sum[:2], sum)
+}
+
+// Where older versions stored a chunk
+func legacyChunkKey(sum string) string {
+	return path.Join(CHUNK_PREFIX, sum[:2], sum)
+}
+
+// What the metadata of a stored chunk says about it
+type chunkObject struct {
+	Exists   bool
+	Modified time.Time
+	Encoding string
+	// Bytes stored, -1 when unknown
+	StoredSize int64
+}
+
+// Reads the metadata of the chunk stored at key. Chunks are always checked on
+// the remote, since another machine may have deleted them since they were
+// last seen.
+func (s3 *S3Client) statChunk(key string) (chunkObject, error) {
+	resp, err := s3.request("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return chunkObject{}, err
+	}
+	switch resp.StatusCode {
+	case 200:
+	case 404:
+		return chunkObject{}, nil
+	default:
+		return chunkObject{}, fmt.Errorf("failed to check chunk %s: status %d", key, resp.StatusCode)
+	}
+	chunk := chunkObject{
+		Exists:     true,
+		Encoding:   resp.Headers[http.CanonicalHeaderKey(HEADER_ENCODING)],
+		StoredSize: -1,
+	}
+	// Unknown, so taken as just written, when missing
+	chunk.Modified, err = http.ParseTime(resp.Headers["Last-Modified"])
+	if err != nil {
+		chunk.Modified = time.Now()
+	}
+	if size, err := strconv.ParseInt(resp.Headers["Content-Length"], 10, 64); err == nil {
+		chunk.StoredSize = size
+	}
+	return chunk, nil
+}
+
+// Copies a stored chunk onto itself, renewing the time it was last written so
+// that collectChunks keeps it until the file reusing it is in the index.
+// Returns false when the chunk was deleted in the meantime.
+func (s3 *S3Client) touchChunk(key, encoding string) (bool, error) {
+	headers := map[string]string{
+		"x-amz-copy-source":        (&url.URL{Path: "/" + s3.Bucket + "/" + key}).EscapedPath(),
+		"x-amz-metadata-directive": "REPLACE",
+	}
+	if encoding != "" {
+		headers[HEADER_ENCODING] = encoding
+	}
+	s3.lockHeaders(headers)
+	resp, err := s3.request("PUT", key, nil, headers, nil)
+	if err != nil {
+		return false, err
+	}
+	// S3 may report an error with a 200 once it started copying
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+	}
+	failed := resp.StatusCode != 200 || xml.Unmarshal(resp.Body, &result) == nil && result.XMLName.Local == "Error"
+	if resp.StatusCode == 404 || failed && result.Code == "NoSuchKey" {
+		return false, nil
+	}
+	if failed {
+		return false, fmt.Errorf("failed to renew chunk %s: %s", key, resp.Body)
+	}
+	return true, nil
+}
+
+// Uploads the chunks of a file missing from the bucket, then its manifest
+func (s3 *S3Client) putChunked(data []byte, headers map[string]string, slashPath string) error {
+	manifest := chunkManifest{Size: int64(len(data))}
+	for _, chunk := range splitChunks(data) {
+		sum := sha256.Sum256(chunk)
+		info := chunkInfo{SHA256: hex.EncodeToString(sum[:]), Size: len(chunk)}
+		manifest.Chunks = append(manifest.Chunks, info)
+
+		key := s3.chunkKey(info.SHA256)
+		stored, err := s3.statChunk(key)
+		if err != nil {
+			return err
+		}
+		if stored.Exists && time.Since(stored.Modified) < chunkGracePeriod/2 {
+			continue
+		}
+		if stored.Exists {
+			touched, err := s3.touchChunk(key, stored.Encoding)
+			if err != nil {
+				return err
+			}
+			if touched {
+				continue
+			}
+		}
+		payload, chunkHeaders := chunk, map[string]string{}
+		s3.lockHeaders(chunkHeaders)
+		if s3.Compress {
+			if compressed, ok := compressPayload(slashPath, chunk); ok {
+				payload = compressed
+				chunkHeaders[HEADER_ENCODING] = "gzip"
+			}
+		}
+		resp, err := s3.request("PUT", key, payload, chunkHeaders, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != 200 {
+			return fmt.Errorf("failed to put chunk of %s: %s", slashPath, resp.Body)
+		}
+	}
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	headers[HEADER_ENCODING] = "chunks"
+	resp, err := s3.request("PUT", path.Join(s3.Prefix, slashPath), body, headers, nil)
+	if err == nil && resp.StatusCode != 200 {
+		return fmt.Errorf("failed to put %s: %s", slashPath, resp.Body)
+	}
+	return err
+}
+
+// Downloads the chunks listed by the manifest of a file and joins them
+func (s3 *S3Client) getChunked(slashPath string, body []byte) ([]byte, error) {
+	var manifest chunkManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid chunk manifest of %s: %w", slashPath, err)
+	}
+	content := make([]byte, 0, manifest.Size)
+	// Every archived chunk is reported, so that they are all restored at once
+	archived := &archivedError{}
+	for _, info := range manifest.Chunks {
+		key := s3.chunkKey(info.SHA256)
+		resp, err := s3.request("GET", key, nil, nil, nil)
+		if err == nil && resp.StatusCode == 404 {
+			key = legacyChunkKey(info.SHA256)
+			resp, err = s3.request("GET", key, nil, nil, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isArchived(resp) {
+			archived.Keys = append(archived.Keys, key)
+			continue
+		}
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("failed to download chunk of %s: %s", slashPath, resp.Body)
+		}
+		chunk := resp.Body
+		if resp.Headers[http.CanonicalHeaderKey(HEADER_ENCODING)] == "gzip" {
+			if chunk, err = decompressPayload(slashPath, chunk); err != nil {
+				return nil, err
+			}
+		}
+		if sum := sha256.Sum256(chunk); hex.EncodeToString(sum[:]) != info.SHA256 {
+			return nil, fmt.Errorf("chunk %s of %s is corrupt", info.SHA256, slashPath)
+		}
+		content = append(content, chunk...)
+	}
+	if len(archived.Keys) > 0 {
+		return nil, archived
+	}
+	if int64(len(content)) != manifest.Size {
+		return nil, fmt.Errorf("chunks of %s add up to %d bytes, expected %d", slashPath, len(content), manifest.Size)
+	}
+	return content, nil
+}
+
+var errCorruptManifest = errors.New("invalid chunk manifest")
+
+// Reads the chunks listed by the object of a file, nil when it isn't stored
+// as chunks
+func (s3 *S3Client) manifestChunks(objectPath string) ([]chunkInfo, error) {
+	resp, err := s3.request("GET", path.Join(s3.Prefix, objectPath), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == 404:
+		return nil, nil
+	case resp.StatusCode != 200:
+		return nil, fmt.Errorf("failed to get chunk manifest of %s: %s", objectPath, resp.Body)
+	case resp.Headers[http.CanonicalHeaderKey(HEADER_ENCODING)] != "chunks":
+		return nil, nil
+	}
+	var manifest chunkManifest
+	if err := json.Unmarshal(resp.Body, &manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w: %v", objectPath, errCorruptManifest, err)
+	}
+	return manifest.Chunks, nil
+}
+
+// Finds the chunk of a manifest, where older versions may have stored it too
+func (s3 *S3Client) findChunk(sum string) (chunkObject, error) {
+	chunk, err := s3.statChunk(s3.chunkKey(sum))
+	if err == nil && !chunk.Exists {
+		chunk, err = s3.statChunk(legacyChunkKey(sum))
+	}
+	return chunk, err
+}
+
+// CheckChunks checks that the chunks listed by the object of a file are
+// stored, with the size the manifest lists for those stored as they are
+func (s3 *S3Client) CheckChunks(objectPath string) (missing, corrupt bool, err error) {
+	chunks, err := s3.manifestChunks(objectPath)
+	if errors.Is(err, errCorruptManifest) {
+		return false, true, nil
+	} else if err != nil {
+		return false, false, err
+	}
+	for _, info := range chunks {
+		chunk, err := s3.findChunk(info.SHA256)
+		if err != nil {
+			return false, false, err
+		}
+		switch {
+		case !chunk.Exists:
+			missing = true
+		case chunk.Encoding == "" && chunk.StoredSize >= 0 && chunk.StoredSize != int64(info.Size):
+			corrupt = true
+		}
+	}
+	return missing, corrupt, nil
+}
+
+// Lists the chunks of the repository, by SHA-256, with the time they were
+// last written
+func (s3 *S3Client) listChunks() (map[string]time.Time, error) {
+	prefix := s3.chunkDir() + "/"
+	chunks := make(map[string]time.Time)
+	params := map[string]string{"list-type": "2", "prefix": prefix}
+	for {
+		resp, err := s3.request("GET", "", nil, nil, params)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("failed to list chunks: %s", resp.Body)
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := xml.Unmarshal(resp.Body, &result); err != nil {
+			return nil, fmt.Errorf("failed to parse chunk list: %w", err)
+		}
+		for _, object := range result.Contents {
+			// Those of repositories with a prefix under this one's don't match
+			dir, sum, _ := strings.Cut(strings.TrimPrefix(object.Key, prefix), "/")
+			if len(sum) != sha256.Size*2 || !strings.HasPrefix(sum, dir) || len(dir) != 2 {
+				continue
+			}
+			chunks[sum] = object.LastModified
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		params["continuation-token"] = result.NextContinuationToken
+	}
+	return chunks, nil
+}
+
+// Manifests read at a time while collecting chunks
+const chunkCollectParallel = 8
+
+// Reads the chunks listed by the objects of files
+func (s3 *S3Client) referencedChunks(files []string) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	objectPaths := make(chan string)
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for range chunkCollectParallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for objectPath := range objectPaths {
+				mu.Lock()
+				failed := firstErr != nil
+				mu.Unlock()
+				if failed {
+					continue
+				}
+				chunks, err := s3.manifestChunks(objectPath)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				for _, info := range chunks {
+					referenced[info.SHA256] = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, objectPath := range files {
+		objectPaths <- objectPath
+	}
+	close(objectPaths)
+	wg.Wait()
+	return referenced, firstErr
+}
+
+// CollectChunks deletes the chunks of the repository that none of the objects
+// of files lists, and that weren't written within chunkGracePeriod. Returns
+// the number of chunks deleted.
+func (s3 *S3Client) CollectChunks(files []string) (int, error) {
+	if s3.ObjectLock.enabled() {
+		return 0, nil
+	}
+	// Listed before the manifests are read, so that a chunk stored meanwhile
+	// isn't considered
+	stored, err := s3.listChunks()
+	if err != nil || len(stored) == 0 {
+		return 0, err
+	}
+	referenced, err := s3.referencedChunks(files)
+	if err != nil {
+		return 0, err
+	}
+	collected := 0
+	for sum, modified := range stored {
+		if referenced[sum] || time.Since(modified) < chunkGracePeriod {
+			continue
+		}
+		// A sync may have reused it since it was listed
+		key := s3.chunkKey(sum)
+		chunk, err := s3.statChunk(key)
+		if err != nil {
+			return collected, err
+		}
+		if !chunk.Exists || time.Since(chunk.Modified) < chunkGracePeriod {
+			continue
+		}
+		resp, err := s3.request("DELETE", key, nil, nil, nil)
+		if err == nil && resp.StatusCode != 204 && resp.StatusCode != 200 {
+			err = fmt.Errorf("failed to delete chunk %s: %s", key, resp.Body)
+		}
+		if err != nil {
+			return collected, err
+		}
+		collected++
+	}
+	return collected, nil
+}
+
+// Deletes the chunks that none of the files of items, the live entries of
+// the index, nor those of a partial seed refer to, when the remote stores
+// chunks. Called with syncMu held.
+func (repo *Repository) collectChunks(items map[string]*RemoteItem) (int, error) {
+	collector, ok := repo.Client.(interface {
+		CollectChunks(files []string) (int, error)
+	})
+	if !ok {
+		return 0, nil
+	}
+	if seeder, ok := repo.Client.(interface {
+		GetSeed() (map[string]*RemoteItem, error)
+	}); ok {
+		seeded, err := seeder.GetSeed()
+		if err != nil {
+			return 0, err
+		}
+		items = maps.Clone(items)
+		for slashPath, item := range seeded {
+			if _, found := items[slashPath]; !found && !item.Tombstone {
+				items[slashPath] = item
+			}
+		}
+	}
+	files := make(map[string]bool)
+	for slashPath, item := range items {
+		// Smaller files are never stored as chunks, 0 may be an unknown size
+		if item.Size == 0 || item.Size >= dedupMinSize {
+			files[item.objectPath(slashPath)] = true
+		}
+	}
+	return collector.CollectChunks(sortedKeys(files))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+)
+
+// DeletionLimit holds back a sync that would delete much of a repository at
+// once, as when a drive is briefly unmounted and every file seems gone,
+// until the deletions are confirmed
+type DeletionLimit struct {
+	// Most files a sync may delete, unlimited when negative
+	Files int `json:"files"`
+	// Largest share of the files a sync may delete, unlimited when negative
+	Percent int `json:"percent"`
+}
+
+const (
+	defaultDeletionLimitFiles   = 1000
+	defaultDeletionLimitPercent = 50
+	// Fewer deletions are never held back by the percentage, so that small
+	// repositories can lose a few files
+	deletionLimitMinFiles = 10
+)
+
+func (limit DeletionLimit) validate() error {
+	if limit.Percent > 100 {
+		return fmt.Errorf("deletion_limit.percent can't be more than 100")
+	}
+	return nil
+}
+
+// Fills the settings left unset from defaults
+func (limit DeletionLimit) withDefaults(defaults DeletionLimit) DeletionLimit {
+	if limit.Files == 0 {
+		limit.Files = defaults.Files
+	}
+	if limit.Percent == 0 {
+		limit.Percent = defaults.Percent
+	}
+	return limit
+}
+
+// Whether deleting deleted files out of total goes past the limit
+func (limit DeletionLimit) exceeded(deleted, total int) bool {
+	if limit.Files >= 0 && deleted > limit.Files {
+		return true
+	}
+	return limit.Percent >= 0 && deleted >= deletionLimitMinFiles && deleted*100 > limit.Percent*total
+}
+
+// HeldDeletions counts the files a held back sync would have deleted
+type HeldDeletions struct {
+	Files int `json:"files"`
+	// Files as of the last sync
+	Total int `json:"total"`
+}
+
+// Counts the files synced last time, and those of them that are gone, which
+// the sync would delete remotely
+func (repo *Repository) removedFiles(localFiles *localListing) (removed, total int, err error) {
+	shards := indexShardsFor(max(localFiles.Len(), repo.lastLocal.Len()))
+	for shard := 0; shard < shards; shard++ {
+		localItems, err := localFiles.Shard(shard, shards)
+		if err != nil {
+			return 0, 0, err
+		}
+		lastItems, err := repo.lastLocal.Shard(shard, shards)
+		if err != nil {
+			return 0, 0, err
+		}
+		for slashPath, item := range lastItems {
+			if item.Tombstone {
+				continue
+			}
+			total++
+			if _, found := localItems[slashPath]; !found {
+				removed++
+			}
+		}
+	}
+	return removed, total, nil
+}
+
+// Returns the deletions to hold back, if the sync would delete more files
+// than the limit allows and they weren't confirmed
+func (repo *Repository) checkDeletions(localFiles *localListing) (*HeldDeletions, error) {
+	if repo.Direction == DirectionPull || repo.lastLocal.Len() == 0 {
+		return nil, nil
+	}
+	repo.mu.Lock()
+	confirmed := repo.deletionsConfirmed
+	repo.deletionsConfirmed = false
+	repo.mu.Unlock()
+	if confirmed {
+		return nil, nil
+	}
+	removed, total, err := repo.removedFiles(localFiles)
+	if err != nil {
+		return nil, err
+	}
+	if !repo.DeletionLimit.exceeded(removed, total) {
+		return nil, nil
+	}
+	return &HeldDeletions{Files: removed, Total: total}, nil
+}
+
+// ConfirmDeletions lets the next sync delete files past the deletion limit
+func (repo *Repository) ConfirmDeletions() {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.deletionsConfirmed = true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"maps"
+)
+
+// Before a shard of the index downloads anything, the sizes of its
+// downloads are checked against the free space of the volume of the
+// repository. When they don't fit, the downloads of the sync are held back,
+// rather than failing part way with files half written, while uploads and
+// local removals go on. The status shows how much space is missing, and
+// every sync checks again until the downloads fit.
+
+// Space left free on the volume, for the other files being written to it
+const diskSpaceReserve = 128 << 20
+
+// DiskShortage is the space held back downloads needed, as of the last sync
+type DiskShortage struct {
+	Needed    int64 `json:"needed"`
+	Available int64 `json:"available"`
+}
+
+// Bytes the downloads of a shard write to disk, as far as the index records
+// their sizes. Files uploaded before sizes were recorded count for nothing,
+// rather than each being looked up on the remote before every sync, until
+// they are uploaded again.
+func (repo *Repository) downloadSize(remoteNewerItems map[string]*RemoteItem) int64 {
+	var size int64
+	for slashPath, remoteItem := range remoteNewerItems {
+		if remoteItem.Tombstone || remoteItem.Link != "" || !repo.syncsRemotePath(slashPath) || repo.retryPending(slashPath) {
+			continue
+		}
+		size += remoteItem.Size
+	}
+	return size
+}
+
+// Holds back the downloads of a shard when they don't fit on disk, or when
+// those of an earlier shard didn't, recording the shortage
+func (repo *Repository) checkDiskSpace(remoteNewerItems map[string]*RemoteItem) {
+	needed := repo.downloadSize(remoteNewerItems)
+	if needed == 0 {
+		return
+	}
+	if repo.diskShortage == nil {
+		available, err := freeDiskSpace(repo.Path)
+		if errors.Is(err, errors.ErrUnsupported) {
+			return
+		}
+		if err != nil {
+			repo.logger.Warn("Failed to check free disk space", "error", err)
+			return
+		}
+		if needed+diskSpaceReserve <= available {
+			return
+		}
+		repo.diskShortage = &DiskShortage{Available: available}
+	}
+	repo.diskShortage.Needed += needed
+	maps.DeleteFunc(remoteNewerItems, func(slashPath string, item *RemoteItem) bool {
+		return !item.Tombstone
+	})
+}
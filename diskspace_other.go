@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "errors"
+
+// Free space isn't checked before downloads
+func freeDiskSpace(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
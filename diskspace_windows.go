@@ -0,0 +1,22 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceExW = kernel32.NewProc("GetDiskFreeSpaceExW")
+
+// Bytes the user may still write to the volume of path, quotas included
+func freeDiskSpace(path string) (int64, error) {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var available uint64
+	ret, _, err := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(&available)), 0, 0)
+	if ret == 0 {
+		return 0, err
+	}
+	return int64(available), nil
+}
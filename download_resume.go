@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Downloads left unfinished for longer are forgotten, and their partial file
+// removed
+const partialDownloadMaxAge = 7 * 24 * time.Hour
+
+// A download in parts in progress, kept in the state directory by the path of
+// its partial file, so that a download cut short by a lost connection or a
+// restart resumes with the parts it misses instead of from zero
+type partialDownload struct {
+	// The object the parts come from, which must be unchanged to resume
+	Key      string `json:"key"`
+	ETag     string `json:"etag"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"part_size"`
+	// Offsets of the parts written to the partial file
+	Parts     map[int64]bool `json:"parts"`
+	StartedAt time.Time      `json:"started_at"`
+}
+
+type partialDownloadStore struct {
+	mu        sync.Mutex
+	loaded    bool
+	downloads map[string]*partialDownload
+}
+
+var partialDownloads = &partialDownloadStore{}
+
+func partialDownloadStatePath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "downloads.json"), nil
+}
+
+// Returns a copy of the download recorded for the partial file, or nil
+func (store *partialDownloadStore) get(partialPath string) *partialDownload {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.load()
+	download, ok := store.downloads[partialPath]
+	if !ok {
+		return nil
+	}
+	copied := *download
+	copied.Parts = make(map[int64]bool, len(download.Parts))
+	for offset := range download.Parts {
+		copied.Parts[offset] = true
+	}
+	return &copied
+}
+
+func (store *partialDownloadStore) has(partialPath string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.load()
+	_, ok := store.downloads[partialPath]
+	return ok
+}
+
+func (store *partialDownloadStore) start(partialPath string, download *partialDownload) {
+	store.update(func() {
+		copied := *download
+		copied.Parts = make(map[int64]bool, len(download.Parts))
+		for offset := range download.Parts {
+			copied.Parts[offset] = true
+		}
+		store.downloads[partialPath] = &copied
+	})
+}
+
+func (store *partialDownloadStore) completePart(partialPath string, offset int64) {
+	store.update(func() {
+		if download, ok := store.downloads[partialPath]; ok {
+			download.Parts[offset] = true
+		}
+	})
+}
+
+func (store *partialDownloadStore) remove(partialPath string) {
+	store.update(func() {
+		delete(store.downloads, partialPath)
+	})
+}
+
+func (store *partialDownloadStore) update(change func()) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.load()
+	change()
+	for partialPath, download := range store.downloads {
+		if time.Since(download.StartedAt) > partialDownloadMaxAge {
+			delete(store.downloads, partialPath)
+			os.Remove(partialPath)
+		}
+	}
+	if err := store.save(); err != nil {
+		// The download goes on, it just can't be resumed
+		slog.Warn("Failed to save download state", "error", err)
+	}
+}
+
+func (store *partialDownloadStore) load() {
+	if store.loaded {
+		return
+	}
+	store.loaded = true
+	store.downloads = make(map[string]*partialDownload)
+	statePath, err := partialDownloadStatePath()
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &store.downloads); err != nil {
+		slog.Warn("Ignoring unreadable download state", "file", statePath, "error", err)
+		store.downloads = make(map[string]*partialDownload)
+	}
+}
+
+func (store *partialDownloadStore) save() error {
+	statePath, err := partialDownloadStatePath()
+	if err != nil {
+		return err
+	}
+	if len(store.downloads) == 0 {
+		if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(store.downloads)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(statePath, data)
+}
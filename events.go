@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EventSyncStarted    = "sync_started"
+	EventSyncCompleted  = "sync_completed"
+	EventSyncFailed     = "sync_failed"
+	EventFileUploaded   = "file_uploaded"
+	EventFileDownloaded = "file_downloaded"
+	EventFileTombstoned = "file_tombstoned"
+	EventFileRemoved    = "file_removed"
+	EventFileDeleted    = "file_deleted"
+	EventTombstonePurge = "tombstone_purged"
+	EventConflict       = "conflict"
+	EventScrubFailed    = "scrub_failed"
+)
+
+// Event describes the progress of a sync run, streamed to IPC subscribers
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Repository string    `json:"repository,omitempty"`
+	File       string    `json:"file,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	// Syncs in a row that failed, for a failed sync
+	Failures int `json:"failures,omitempty"`
+}
+
+// EventBus fans out events to subscribers. Slow subscribers miss events
+// instead of blocking the sync.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[chan Event]struct{})}
+}
+
+func (bus *EventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+	bus.mu.Lock()
+	bus.subscribers[ch] = struct{}{}
+	bus.mu.Unlock()
+
+	unsubscribe := func() {
+		bus.mu.Lock()
+		delete(bus.subscribers, ch)
+		bus.mu.Unlock()
+	}
+	return ch, unsubscribe
+}
+
+func (bus *EventBus) Publish(event Event) {
+	if bus == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for ch := range bus.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Exit codes of the CLI, so that scripts can branch on them
+const (
+	ExitOK               = 0
+	ExitFailure          = 1 // the command failed for any other reason
+	ExitUsage            = 2 // invalid command line
+	ExitDaemonNotRunning = 3 // the sync service is not running or not responding
+	ExitSyncError        = 4 // syncing failed, for every repository if several are involved
+	ExitConfigError      = 5 // the config file is missing or invalid
+	ExitPartialFailure   = 6 // some repositories failed to sync, others are fine
+)
+
+// Exits with ExitDaemonNotRunning unless the sync service answers
+func requireDaemon() {
+	if isDaemonRunning() {
+		return
+	}
+	if pid, alive := daemonPid(); alive {
+		fmt.Printf("Reposy sync service (pid %d) is not responding. Use 'reposy stop --force' to kill it\n", pid)
+	} else {
+		fmt.Println("Reposy sync service is not running. Please run 'reposy start' first")
+	}
+	os.Exit(ExitDaemonNotRunning)
+}
+
+// Prints a response and exits with code if the command failed
+func printResponse(resp Response, code int) {
+	fmt.Println(resp.Message)
+	if resp.Data != "" {
+		fmt.Println(resp.Data)
+	}
+	if resp.Status != "success" {
+		if resp.Code == ErrCodeUnavailable {
+			code = ExitDaemonNotRunning
+		}
+		os.Exit(code)
+	}
+}
+
+// Exit code for a status: sync error if every repository failed, partial
+// failure if only some did
+func statusExitCode(status StatusPayload) int {
+	failed := 0
+	for _, repository := range status.Repositories {
+		if repository.Error != "" {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return ExitOK
+	case failed == len(status.Repositories):
+		return ExitSyncError
+	default:
+		return ExitPartialFailure
+	}
+}
+
+func decodePayload(resp Response, payload any) bool {
+	return len(resp.Payload) > 0 && json.Unmarshal(resp.Payload, payload) == nil
+}
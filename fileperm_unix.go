@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Refuses files readable or writable by the group or other users
+func checkPrivateFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	if mode := info.Mode().Perm(); mode&0077 != 0 {
+		return fmt.Errorf("%s holds credentials but is accessible by other users (mode %04o), run: chmod 600 %s", path, mode, path)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Human readable status, used by the CLI and for clients that only understand text
+func formatStatus(status StatusPayload) string {
+	var sb strings.Builder
+
+	if len(status.Repositories) == 0 {
+		return "No repositories configured"
+	}
+
+	if status.Profile != "" {
+		sb.WriteString(fmt.Sprintf("Profile: %s\n\n", status.Profile))
+	}
+
+	if status.Paused {
+		sb.WriteString("Syncing is paused, run 'reposy resume' to continue\n\n")
+	}
+	switch status.Metered {
+	case MeteredPause:
+		sb.WriteString("On a metered network, syncing is paused\n\n")
+	case MeteredThrottle:
+		sb.WriteString(fmt.Sprintf("On a metered network, transfers are throttled to %s/s\n\n", formatBytes(status.ThrottleRate)))
+	}
+	if battery := status.Battery; battery != nil {
+		sb.WriteString(fmt.Sprintf("On battery (%d%%), syncing every %s", battery.Percent, battery.SyncInterval))
+		if battery.MaxUploadSize > 0 {
+			sb.WriteString(fmt.Sprintf(", uploads over %s wait until plugged in", formatBytes(battery.MaxUploadSize)))
+		}
+		sb.WriteString("\n\n")
+	}
+
+	for _, repository := range status.Repositories {
+		sb.WriteString(fmt.Sprintf("Repository: %s\n", repository.Path))
+
+		if repository.LastSync.IsZero() {
+			sb.WriteString("  Never synced\n")
+		} else {
+			sb.WriteString(fmt.Sprintf("  Last sync: %s\n", repository.LastSync.Format(time.RFC3339)))
+		}
+
+		if repository.Schedule != "" {
+			sb.WriteString(fmt.Sprintf("  Schedule: %s\n", repository.Schedule))
+		}
+		switch repository.Direction {
+		case DirectionPush:
+			sb.WriteString("  Direction: push only, local files are never changed\n")
+		case DirectionPull:
+			sb.WriteString("  Direction: pull only, the remote is never written to\n")
+		case DirectionMirror:
+			sb.WriteString("  Direction: mirror, the remote is made to match local files\n")
+		case DirectionArchive:
+			sb.WriteString("  Direction: archive, remote files are kept until purged\n")
+		}
+
+		if repository.InProgress {
+			sb.WriteString("  Status: In progress\n")
+			if repository.CurrentFile != "" {
+				sb.WriteString(fmt.Sprintf("  Current file: %s\n", repository.CurrentFile))
+			}
+			if repository.Queued > 0 || repository.BytesPending > 0 {
+				sb.WriteString(fmt.Sprintf("  Pending: %d file(s), %s to upload\n", repository.Queued, formatBytes(repository.BytesPending)))
+			}
+			if seed := repository.Seed; seed != nil {
+				sb.WriteString(fmt.Sprintf("  Seeding: %s %d/%d files\n", progressBar(seed.Done, seed.Total, 30), seed.Done, seed.Total))
+			}
+		} else if repository.Skipped {
+			sb.WriteString(fmt.Sprintf("  Status: Skipped - run 'reposy unskip %s' to sync it\n", repository.Path))
+		} else if repository.Missing {
+			sb.WriteString(fmt.Sprintf("  Status: Path missing - if it was moved, run 'reposy move %s <new path>'\n", repository.Path))
+		} else if until := repository.CircuitOpenUntil; until != nil {
+			sb.WriteString(fmt.Sprintf("  Status: Remote unavailable - it kept failing, next attempt at %s\n", until.Format(time.TimeOnly)))
+		} else if short := repository.DiskSpace; short != nil {
+			sb.WriteString(fmt.Sprintf("  Status: Insufficient space - downloads held back, they need %s and %s is free\n", formatBytes(short.Needed), formatBytes(short.Available)))
+		} else if held := repository.HeldDeletions; held != nil {
+			sb.WriteString(fmt.Sprintf("  Status: Held back - %d of %d files were removed, if intended run 'reposy sync --confirm-deletions %s'\n", held.Files, held.Total, repository.Path))
+		} else if repository.Failing {
+			sb.WriteString(fmt.Sprintf("  Status: Failing - %d syncs in a row failed, the last with: %s\n", repository.FailureStreak, repository.Error))
+		} else if repository.Error != "" {
+			sb.WriteString(fmt.Sprintf("  Status: Error - %s\n", repository.Error))
+			if repository.ErrorAt != nil {
+				sb.WriteString(fmt.Sprintf("  Failed at: %s\n", repository.ErrorAt.Format(time.RFC3339)))
+			}
+		} else {
+			sb.WriteString("  Status: Idle\n")
+		}
+		if !repository.LastSync.IsZero() {
+			sb.WriteString(fmt.Sprintf("  Last run: %s\n", formatTransferStats(repository.LastRun)))
+			sb.WriteString(fmt.Sprintf("  Total: %s\n", formatTransferStats(repository.Total)))
+		}
+		if repository.NextSync != nil && !repository.InProgress && !repository.Skipped {
+			sb.WriteString(fmt.Sprintf("  Next sync: %s\n", repository.NextSync.Format(time.RFC3339)))
+		}
+		if repository.ScheduledSync != nil {
+			sb.WriteString(fmt.Sprintf("  Scheduled sync: %s, once\n", repository.ScheduledSync.Format(time.RFC3339)))
+		}
+		if behind := repository.Behind; behind != nil {
+			sb.WriteString(fmt.Sprintf("  Warning: behind %s - %d file(s) changed there are newer than the local copies, last at %s\n", behind.Machine, behind.Files, modTimeToTime(behind.ModifiedAt).Format(time.RFC3339)))
+		}
+		if scrub := repository.Scrub; scrub != nil && !scrub.Healthy() {
+			sb.WriteString(fmt.Sprintf("  Scrub: %s\n", scrub.summary()))
+		}
+		if len(repository.Retries) > 0 {
+			sb.WriteString(fmt.Sprintf("  Waiting to retry: %d file(s), see 'reposy status --json'\n", len(repository.Retries)))
+			restoring := 0
+			for _, item := range repository.Retries {
+				if item.Restore != nil {
+					restoring++
+				}
+			}
+			if restoring > 0 {
+				sb.WriteString(fmt.Sprintf("  Restoring from archive tier: %d file(s)\n", restoring))
+			}
+		}
+
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+func formatPlan(plan *SyncPlan) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Repository: %s\n", plan.Repository))
+	if plan.Offline {
+		sb.WriteString("  Remote unreachable, planned against its cached index\n")
+	}
+	sections := []struct {
+		title string
+		files []string
+	}{
+		{"Upload", plan.Upload},
+		{"Mark deleted on remote", plan.Tombstone},
+		{"Delete from remote", plan.Delete},
+		{"Download", plan.Download},
+		{"Remove locally", plan.Remove},
+	}
+	empty := true
+	for _, section := range sections {
+		if len(section.files) == 0 {
+			continue
+		}
+		empty = false
+		sb.WriteString(fmt.Sprintf("  %s (%d):\n", section.title, len(section.files)))
+		for _, file := range section.files {
+			sb.WriteString(fmt.Sprintf("    %s\n", file))
+		}
+	}
+	if empty {
+		sb.WriteString("  Up to date\n")
+	}
+	return sb.String()
+}
+
+func formatConflicts(conflicts []Conflict) string {
+	if len(conflicts) == 0 {
+		return "No unresolved conflicts\n"
+	}
+	var sb strings.Builder
+	for _, conflict := range conflicts {
+		sb.WriteString(fmt.Sprintf("%s\n", filepath.Join(conflict.Repository, filepath.FromSlash(conflict.File))))
+		sb.WriteString(fmt.Sprintf("  Remote: %s from %s\n", modTimeToTime(conflict.RemoteModTime).Format(time.DateTime), conflict.RemoteOrigin))
+		sb.WriteString(fmt.Sprintf("  Local:  %s from %s, kept as %s\n", modTimeToTime(conflict.LocalModTime).Format(time.DateTime), conflict.LocalOrigin, conflict.Copy))
+	}
+	return sb.String()
+}
+
+func formatScrub(results map[string]ScrubResult) string {
+	if len(results) == 0 {
+		return "No repositories configured\n"
+	}
+	var sb strings.Builder
+	for _, repoPath := range sortedKeys(results) {
+		result := results[repoPath]
+		sb.WriteString(fmt.Sprintf("Repository: %s\n", repoPath))
+		sb.WriteString(fmt.Sprintf("  Checked %d files at %s\n", result.Checked, result.At.Format(time.RFC3339)))
+		if result.Error != "" {
+			sb.WriteString(fmt.Sprintf("  Error: %s\n", result.Error))
+		}
+		for _, file := range result.Missing {
+			sb.WriteString(fmt.Sprintf("  Missing: %s\n", file))
+		}
+		for _, file := range result.Corrupt {
+			sb.WriteString(fmt.Sprintf("  Corrupt: %s\n", file))
+		}
+		for _, file := range result.Damaged {
+			sb.WriteString(fmt.Sprintf("  Damaged locally: %s\n", file))
+		}
+		if result.ChunksCollected > 0 {
+			sb.WriteString(fmt.Sprintf("  Deleted %d unused chunks\n", result.ChunksCollected))
+		}
+	}
+	return sb.String()
+}
+
+// Draws a bar of width characters filled in proportion to done out of total
+func progressBar(done, total, width int) string {
+	filled := 0
+	if total > 0 {
+		filled = min(done*width/total, width)
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", width-filled) + "]"
+}
+
+func formatTransferStats(stats TransferStats) string {
+	return fmt.Sprintf("%d up (%s), %d down (%s), %d deleted remotely in %s, %s/s",
+		stats.FilesUploaded, formatBytes(stats.BytesUploaded),
+		stats.FilesDownloaded, formatBytes(stats.BytesDownloaded),
+		stats.FilesTombstoned, stats.Duration.Round(time.Millisecond),
+		formatBytes(int64(stats.BytesPerSecond())))
+}
+
+// One line per sync run, or with the action taken on the file if given
+func formatHistory(runs []SyncRun, slashPath string) string {
+	if len(runs) == 0 {
+		return "No sync runs recorded"
+	}
+	var sb strings.Builder
+	for _, run := range runs {
+		sb.WriteString(fmt.Sprintf("%s  %s  %s  ", run.StartedAt.Format(time.RFC3339), run.Repository, run.FinishedAt.Sub(run.StartedAt).Round(time.Millisecond)))
+		if slashPath != "" {
+			sb.WriteString(fmt.Sprintf("%s %s", slashPath, run.action(slashPath)))
+		} else {
+			sb.WriteString(fmt.Sprintf("%d up (%s), %d down (%s), %d deleted remotely, %d removed locally",
+				len(run.Uploaded), formatBytes(run.BytesUploaded),
+				len(run.Downloaded), formatBytes(run.BytesDownloaded),
+				len(run.Tombstoned), len(run.Removed)))
+		}
+		if run.Error != "" {
+			sb.WriteString(fmt.Sprintf("  error: %s", run.Error))
+		}
+		sb.WriteString("\n")
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// How the files of a repository are listed: "binary" runs git ls-files,
+// "builtin" reads the git index and gitignore files itself, and "auto", the
+// default, runs git when it is in PATH and reads them itself otherwise, as
+// in minimal containers
+const (
+	GitBackendAuto    = "auto"
+	GitBackendBinary  = "binary"
+	GitBackendBuiltin = "builtin"
+)
+
+var warnNoGit sync.Once
+
+// Lists the tracked files and the untracked ones that aren't ignored, like
+// git ls-files --cached --others --exclude-standard
+func (repo *Repository) lsFiles(add func(slashPath string) error) error {
+	backend := repo.GitBackend
+	if backend == "" || backend == GitBackendAuto {
+		backend = GitBackendBinary
+		if _, err := exec.LookPath("git"); err != nil {
+			warnNoGit.Do(func() {
+				slog.Info("git isn't in PATH, listing files without it")
+			})
+			backend = GitBackendBuiltin
+		}
+	}
+	if backend == GitBackendBuiltin {
+		return builtinLsFiles(repo.Path, add)
+	}
+	return execLsFiles(repo.Path, add)
+}
+
+func execLsFiles(repoPath string, add func(slashPath string) error) error {
+	cmd := exec.Command("git", "-C", repoPath, "ls-files", "--others", "--exclude-standard", "--cached")
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("git ls-files command failed: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("git ls-files command failed: %w", err)
+	}
+	err = func() error {
+		scanner := bufio.NewScanner(output) // slash path per line
+		for scanner.Scan() {
+			filePath := scanner.Text()
+			if filePath == "" {
+				continue
+			}
+			if filePath[0] == '"' {
+				unquoted, err := strconv.Unquote(filePath)
+				if err != nil {
+					return fmt.Errorf("failed to unquote file path: %s", filePath)
+				}
+				filePath = unquoted
+			}
+			if err := add(filePath); err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	}()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("git ls-files command failed: %w", err)
+	}
+	return nil
+}
+
+func builtinLsFiles(repoPath string, add func(slashPath string) error) error {
+	git, err := resolveGitLayout(repoPath)
+	if err != nil {
+		return fmt.Errorf("failed to find git metadata: %w", err)
+	}
+	tracked := make(map[string]bool)
+	err = readGitIndexPaths(git, func(slashPath string) error {
+		tracked[slashPath] = true
+		return add(slashPath)
+	})
+	if err != nil {
+		return err
+	}
+	return walkUntracked(repoPath, "", repositoryGitIgnore(git), tracked, add)
+}
+
+// Walks a directory of the working tree for the files that are neither
+// tracked nor ignored. Ignored directories aren't entered, their tracked
+// files being listed from the index already.
+func walkUntracked(repoPath, dir string, patterns gitIgnore, tracked map[string]bool, add func(slashPath string) error) error {
+	fullDir := filepath.Join(repoPath, filepath.FromSlash(dir))
+	patterns = append(patterns[:len(patterns):len(patterns)], readGitIgnoreFile(filepath.Join(fullDir, ".gitignore"), dir)...)
+	entries, err := os.ReadDir(fullDir)
+	if os.IsNotExist(err) {
+		// Removed while walking
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	for _, entry := range entries {
+		if entry.Name() == ".git" {
+			continue
+		}
+		slashPath := path.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if patterns.ignored(slashPath, true) {
+				continue
+			}
+			if _, err := os.Lstat(filepath.Join(fullDir, entry.Name(), ".git")); err == nil {
+				// A nested repository, which git lists as a directory
+				continue
+			}
+			if err := walkUntracked(repoPath, slashPath, patterns, tracked, add); err != nil {
+				return err
+			}
+			continue
+		}
+		if tracked[slashPath] || patterns.ignored(slashPath, false) {
+			continue
+		}
+		if err := add(slashPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
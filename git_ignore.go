@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A pattern of a gitignore file, see gitignore(5)
+type gitIgnorePattern struct {
+	// Directory of the file it comes from, as a slash path relative to the
+	// repository, "" for the top
+	base    string
+	regexp  *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	// Patterns without a slash match the name of a file at any depth
+	nameOnly bool
+}
+
+// The patterns in force in a directory, later ones taking precedence
+type gitIgnore []*gitIgnorePattern
+
+// Reads the patterns of a gitignore file, none when it doesn't exist
+func readGitIgnoreFile(filePath, base string) gitIgnore {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	var patterns gitIgnore
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if pattern := parseGitIgnoreLine(scanner.Text(), base); pattern != nil {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+func parseGitIgnoreLine(line, base string) *gitIgnorePattern {
+	line = strings.TrimSuffix(line, "\r")
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+	// Trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	pattern := &gitIgnorePattern{base: base}
+	if line[0] == '!' {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil
+	}
+	pattern.nameOnly = !strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	compiled, err := regexp.Compile("^" + gitGlobRegexp(line) + "$")
+	if err != nil {
+		return nil
+	}
+	pattern.regexp = compiled
+	return pattern
+}
+
+// Translates a gitignore glob to a regular expression, where * and ? don't
+// match slashes and ** matches any number of directories
+func gitGlobRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case glob[i:] == "**" && (i == 0 || glob[i-1] == '/'):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '\\' && i+1 < len(glob):
+			i++
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if end == 0 {
+				// "[]...]" has a literal ] first
+				next := strings.IndexByte(glob[i+2:], ']')
+				if next < 0 {
+					sb.WriteString(`\[`)
+					continue
+				}
+				class = glob[i+1 : i+2+next]
+				end = next + 1
+			}
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+// Whether a slash path relative to the repository is ignored, the last
+// pattern matching it deciding
+func (patterns gitIgnore) ignored(slashPath string, isDir bool) bool {
+	for i := len(patterns) - 1; i >= 0; i-- {
+		pattern := patterns[i]
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		rel := slashPath
+		if pattern.base != "" {
+			var ok bool
+			if rel, ok = strings.CutPrefix(slashPath, pattern.base+"/"); !ok {
+				continue
+			}
+		}
+		if pattern.nameOnly {
+			rel = path.Base(rel)
+		}
+		if pattern.regexp.MatchString(rel) {
+			return !pattern.negate
+		}
+	}
+	return false
+}
+
+// Compiles patterns given in the config
+// Transient files editors write while saving, which would otherwise be
+// uploaded and tombstoned again by every sync that catches them, unless a
+// repository sets its own temp_excludes: vim swap files and the 4913 file it
+// probes directories with, backups ending with ~, emacs lock and auto-save
+// files and LibreOffice lock files
+var defaultTempExcludes = []string{
+	"*.swp",
+	"*.swo",
+	"*~",
+	"4913",
+	".#*",
+	`\#*#`,
+	".~lock.*#",
+}
+
+func compileExcludes(lines []string) (gitIgnore, error) {
+	var patterns gitIgnore
+	for _, line := range lines {
+		pattern := parseGitIgnoreLine(line, "")
+		if pattern == nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q", line)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// Whether a file is ignored, or one of its directories is
+func (patterns gitIgnore) excludes(slashPath string) bool {
+	for dir := path.Dir(slashPath); dir != "."; dir = path.Dir(dir) {
+		if patterns.ignored(dir, true) {
+			return true
+		}
+	}
+	return patterns.ignored(slashPath, false)
+}
+
+// The patterns that apply to the whole repository, from the lowest
+// precedence: the user's global excludes file and .git/info/exclude
+func repositoryGitIgnore(git *gitLayout) gitIgnore {
+	var patterns gitIgnore
+	if configDir := os.Getenv("XDG_CONFIG_HOME"); configDir != "" {
+		patterns = append(patterns, readGitIgnoreFile(filepath.Join(configDir, "git", "ignore"), "")...)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		patterns = append(patterns, readGitIgnoreFile(filepath.Join(home, ".config", "git", "ignore"), "")...)
+	}
+	return append(patterns, readGitIgnoreFile(filepath.Join(git.commonDir, "info", "exclude"), "")...)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Reads the paths of the files tracked in the index of a git repository,
+// like git ls-files --cached, for machines without git. Versions 2 to 4 of
+// the index format are read, see gitformat-index(5). A repository without
+// an index yet tracks no files.
+func readGitIndexPaths(git *gitLayout, add func(slashPath string) error) error {
+	file, err := os.Open(filepath.Join(git.gitDir, "index"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	var header struct {
+		Signature [4]byte
+		Version   uint32
+		Entries   uint32
+	}
+	if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+		return fmt.Errorf("failed to read git index: %w", err)
+	}
+	if string(header.Signature[:]) != "DIRC" {
+		return fmt.Errorf("invalid git index signature")
+	}
+	if header.Version < 2 || header.Version > 4 {
+		return fmt.Errorf("unsupported git index version %d", header.Version)
+	}
+	hashSize := 20
+	if gitObjectFormat(git) == "sha256" {
+		hashSize = 32
+	}
+
+	// Times, device, inode, mode, uid, gid and size, then the object hash
+	fixed := make([]byte, 40+hashSize)
+	var previous []byte
+	seen := ""
+	for i := uint32(0); i < header.Entries; i++ {
+		if _, err := io.ReadFull(reader, fixed); err != nil {
+			return fmt.Errorf("failed to read git index: %w", err)
+		}
+		var flags uint16
+		if err := binary.Read(reader, binary.BigEndian, &flags); err != nil {
+			return fmt.Errorf("failed to read git index: %w", err)
+		}
+		size := len(fixed) + 2
+		if header.Version >= 3 && flags&0x4000 != 0 {
+			var extended uint16
+			if err := binary.Read(reader, binary.BigEndian, &extended); err != nil {
+				return fmt.Errorf("failed to read git index: %w", err)
+			}
+			size += 2
+		}
+
+		var name []byte
+		if header.Version == 4 {
+			// The length of the end of the previous name to drop, then the
+			// rest of this one
+			strip, err := readGitIndexVarint(reader)
+			if err != nil || strip > uint64(len(previous)) {
+				return fmt.Errorf("failed to read git index: invalid path")
+			}
+			suffix, err := reader.ReadBytes(0)
+			if err != nil {
+				return fmt.Errorf("failed to read git index: %w", err)
+			}
+			name = append(previous[:len(previous)-int(strip):len(previous)-int(strip)], suffix[:len(suffix)-1]...)
+		} else {
+			suffix, err := reader.ReadBytes(0)
+			if err != nil {
+				return fmt.Errorf("failed to read git index: %w", err)
+			}
+			name = suffix[:len(suffix)-1]
+			// Entries are padded with NULs to a multiple of 8 bytes, of
+			// which the name's terminator is the first
+			size += len(suffix)
+			if padding := (8 - size%8) % 8; padding > 0 {
+				if _, err := reader.Discard(padding); err != nil {
+					return fmt.Errorf("failed to read git index: %w", err)
+				}
+			}
+		}
+		previous = name
+
+		// Unmerged files have an entry for each stage
+		if string(name) == seen {
+			continue
+		}
+		seen = string(name)
+		if err := add(seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Git's offset varint, where each continuation adds one before shifting
+func readGitIndexVarint(reader *bufio.Reader) (uint64, error) {
+	c, err := reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	value := uint64(c & 0x7f)
+	for c&0x80 != 0 {
+		if c, err = reader.ReadByte(); err != nil {
+			return 0, err
+		}
+		value = (value+1)<<7 | uint64(c&0x7f)
+	}
+	return value, nil
+}
+
+// The hash algorithm of the objects of a repository, from
+// extensions.objectFormat in its config
+func gitObjectFormat(git *gitLayout) string {
+	config, err := os.ReadFile(filepath.Join(git.commonDir, "config"))
+	if err != nil {
+		return "sha1"
+	}
+	for _, line := range bytes.Split(config, []byte("\n")) {
+		key, value, ok := strings.Cut(string(line), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(key), "objectformat") {
+			return strings.ToLower(strings.TrimSpace(value))
+		}
+	}
+	return "sha1"
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Volatile files git creates and removes while it works, which aren't synced
+// unless a repository sets its own git_excludes. Patterns are matched
+// against paths in .git, or against file names when they have no slash.
+var defaultGitExcludes = []string{
+	"*.lock",
+	"gc.pid",
+	"gc.log",
+	"objects/pack/tmp_*",
+	"objects/tmp_obj_*",
+	"objects/incoming-*",
+	"fsmonitor--daemon.ipc",
+	"fsmonitor--daemon/*",
+}
+
+func validateGitExcludes(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid git_excludes pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Reports whether a .git/ slash path matches one of the patterns, or the
+// directory of one of its parents does
+func excludedGitPath(patterns []string, slashPath string) bool {
+	rel, ok := strings.CutPrefix(slashPath, ".git/")
+	if !ok {
+		return false
+	}
+	for _, pattern := range patterns {
+		target := rel
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(rel)
+		}
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+		// Files in an excluded directory, such as objects/incoming-*
+		for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+			if matched, _ := path.Match(pattern, dir); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gitLayout locates the git metadata of a repository. In a linked worktree,
+// .git is a file pointing at the worktree's own gitdir, under .git/worktrees
+// of the main repository, which shares everything else through its common
+// dir.
+type gitLayout struct {
+	gitDir    string
+	commonDir string
+	worktree  bool
+}
+
+// Paths in the gitdir of a linked worktree that are shared by all worktrees
+// and so live in the common dir, from git's common_list. The longest match
+// decides.
+var gitCommonPaths = []struct {
+	path   string
+	common bool
+}{
+	{"branches", true},
+	{"common", true},
+	{"config", true},
+	{"hooks", true},
+	{"info", true},
+	{"info/sparse-checkout", false},
+	{"logs", true},
+	{"logs/HEAD", false},
+	{"logs/refs/bisect", false},
+	{"logs/refs/rewritten", false},
+	{"logs/refs/worktree", false},
+	{"lost-found", true},
+	{"objects", true},
+	{"packed-refs", true},
+	{"refs", true},
+	{"refs/bisect", false},
+	{"refs/rewritten", false},
+	{"refs/worktree", false},
+	{"remotes", true},
+	{"shallow", true},
+	{"worktrees", true},
+}
+
+// Files in the gitdir of a linked worktree that tie it to the paths of this
+// machine, never synced
+var worktreeAdminFiles = map[string]bool{"commondir": true, "gitdir": true}
+
+func resolveGitLayout(repoPath string) (*gitLayout, error) {
+	dotGit := filepath.Join(repoPath, ".git")
+	info, err := os.Stat(dotGit)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &gitLayout{gitDir: dotGit, commonDir: dotGit}, nil
+	}
+
+	content, err := os.ReadFile(dotGit)
+	if err != nil {
+		return nil, err
+	}
+	gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(content)), "gitdir:")
+	if !ok {
+		return nil, fmt.Errorf("%s is neither a directory nor a gitdir file", dotGit)
+	}
+	gitDir = resolveGitPath(repoPath, strings.TrimSpace(gitDir))
+	layout := &gitLayout{gitDir: gitDir, commonDir: gitDir, worktree: true}
+	if commonDir, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		layout.commonDir = resolveGitPath(gitDir, strings.TrimSpace(string(commonDir)))
+	}
+	return layout, nil
+}
+
+func resolveGitPath(base, gitPath string) string {
+	gitPath = filepath.FromSlash(gitPath)
+	if !filepath.IsAbs(gitPath) {
+		gitPath = filepath.Join(base, gitPath)
+	}
+	return filepath.Clean(gitPath)
+}
+
+func isCommonGitPath(rel string) bool {
+	common, matched := false, 0
+	for _, entry := range gitCommonPaths {
+		if (rel == entry.path || strings.HasPrefix(rel, entry.path+"/")) && len(entry.path) > matched {
+			common, matched = entry.common, len(entry.path)
+		}
+	}
+	return common
+}
+
+// Returns the local path of a .git/ slash path, in the gitdir or the common
+// dir the way git resolves it
+func (layout *gitLayout) localPath(slashPath string) (string, bool) {
+	rel, ok := strings.CutPrefix(slashPath, ".git/")
+	if !ok || !layout.worktree {
+		return "", false
+	}
+	if isCommonGitPath(rel) {
+		return filepath.Join(layout.commonDir, filepath.FromSlash(rel)), true
+	}
+	return filepath.Join(layout.gitDir, filepath.FromSlash(rel)), true
+}
+
+// Calls add with the .git/ slash path and local path of each file of the git
+// metadata a linked worktree sees: its own gitdir and the shared part of the
+// common dir, laid out as the .git directory of a regular repository
+func (layout *gitLayout) walkWorktree(add func(slashPath, fullPath string) error) error {
+	walk := func(dir string, keep func(rel string) bool) error {
+		return filepath.Walk(dir, func(fullPath string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				// Removed by git while walking
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, fullPath)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if info.IsDir() {
+				// The gitdirs of the worktrees
+				if rel == "worktrees" && dir == layout.commonDir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !keep(rel) {
+				return nil
+			}
+			return add(".git/"+rel, fullPath)
+		})
+	}
+	err := walk(layout.gitDir, func(rel string) bool {
+		return !worktreeAdminFiles[rel] && !isCommonGitPath(rel)
+	})
+	if err != nil {
+		return err
+	}
+	return walk(layout.commonDir, isCommonGitPath)
+}
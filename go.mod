@@ -2,7 +2,14 @@ module github.com/likang/reposy
 
 go 1.22.2
 
-require github.com/spf13/cobra v1.9.1
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/Microsoft/go-winio v0.6.2
+	github.com/spf13/cobra v1.9.1
+	golang.org/x/sys v0.10.0
+	golang.org/x/term v0.10.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Files hard-linked to each other within a repository are uploaded once. The
+// first of a group of links by path holds the content, and the index records
+// the others as links to it, which downloads recreate instead of fetching
+// the content again. A file whose links change, like one left alone when the
+// others are removed, is uploaded again even though its modtime is the same.
+
+// Groups the files of a listing by the file they are links to
+type hardLinkTracker struct {
+	groups map[hardLinkID][]string
+}
+
+type hardLinkID struct {
+	dev, ino uint64
+}
+
+func (tracker *hardLinkTracker) add(slashPath string, id hardLinkID) {
+	if tracker.groups == nil {
+		tracker.groups = make(map[hardLinkID][]string)
+	}
+	tracker.groups[id] = append(tracker.groups[id], slashPath)
+}
+
+// The path of the first file of its group, by the path of each other file
+func (tracker *hardLinkTracker) links() map[string]string {
+	links := make(map[string]string)
+	for _, paths := range tracker.groups {
+		if len(paths) < 2 {
+			// Linked to from outside the repository
+			continue
+		}
+		sort.Strings(paths)
+		for _, slashPath := range paths[1:] {
+			links[slashPath] = paths[0]
+		}
+	}
+	return links
+}
+
+// Local files whose links differ from those in the index, to upload though
+// they are unchanged otherwise. A file the index records as a link that isn't
+// one locally is left alone when links can't be detected, or when it holds
+// the content of the link, as after a download as a copy, so that it isn't
+// uploaded again at every sync.
+func relinkedItems(localItems map[string]*FileItem, remoteItems map[string]*RemoteItem) map[string]*FileItem {
+	items := make(map[string]*FileItem)
+	for slashPath, localItem := range localItems {
+		remoteItem, exists := remoteItems[slashPath]
+		if localItem.Tombstone || !exists || remoteItem.Tombstone {
+			continue
+		}
+		if localItem.Link == remoteItem.Link || !sameModTime(localItem.ModTime, remoteItem.ModTime) {
+			continue
+		}
+		if localItem.Link == "" && !hardLinksDetected {
+			continue
+		}
+		if localItem.Link == "" && remoteItem.SHA256 != "" {
+			if sum, err := fileChecksums.sum(localItem.FilePath); err == nil && sum == remoteItem.SHA256 {
+				continue
+			}
+		}
+		items[slashPath] = localItem
+	}
+	return items
+}
+
+// Recreates the links downloaded by the sync once every other file is,
+// adding them to synced. Returns how many failed and are left to retries.
+func (repo *Repository) downloadLinks(synced *localListing) (int, error) {
+	failed := 0
+	for slashPath, remoteItem := range repo.pendingLinks {
+		if err := repo.downloadLink(slashPath, remoteItem); err != nil {
+			repo.queueRetry(slashPath, "download", err)
+			failed++
+			continue
+		}
+		repo.clearRetry(slashPath)
+		err := synced.Add(slashPath, &FileItem{
+			FilePath: repo.localFilePath(slashPath),
+			ModTime:  remoteItem.ModTime,
+			Link:     remoteItem.Link,
+		})
+		if err != nil {
+			return failed, err
+		}
+	}
+	return failed, nil
+}
+
+// Links a file to the local file it shares its content with. When that file
+// doesn't have the content of the link, as when it failed to download or
+// changed since, the content is downloaded from its object instead, as a
+// copy.
+func (repo *Repository) downloadLink(slashPath string, remoteItem *RemoteItem) error {
+	defer repo.touch(slashPath)
+	fullLocalPath := repo.localPath(slashPath)
+	target := repo.localPath(remoteItem.Link)
+	if remoteItem.SHA256 != "" {
+		if sum, err := fileChecksums.sum(target); err == nil && sum == remoteItem.SHA256 {
+			if err := repo.Modes.mkdirAll(filepath.Dir(fullLocalPath)); err != nil {
+				return fmt.Errorf("failed to create directory of %s: %w", fullLocalPath, err)
+			}
+			if _, err := ensureWritableIfExist(fullLocalPath); err != nil {
+				return fmt.Errorf("failed to ensure writable for file %s: %w", fullLocalPath, err)
+			}
+			linkPath := filepath.Join(filepath.Dir(fullLocalPath), "."+filepath.Base(fullLocalPath)+partialDownloadSuffix)
+			os.Remove(linkPath)
+			if err := os.Link(target, linkPath); err != nil {
+				return fmt.Errorf("failed to link %s to %s: %w", slashPath, remoteItem.Link, err)
+			}
+			err := os.Rename(linkPath, fullLocalPath)
+			// Renaming over a link to the same file leaves both in place
+			os.Remove(linkPath)
+			if err != nil {
+				return fmt.Errorf("failed to link %s to %s: %w", slashPath, remoteItem.Link, err)
+			}
+			repo.logger.Info("Linked file", "file", slashPath, "to", remoteItem.Link)
+			repo.emit(Event{Type: EventFileDownloaded, File: slashPath})
+			return nil
+		}
+	}
+	repo.logger.Info("Downloading linked file as a copy", "file", slashPath, "to", remoteItem.Link)
+	return repo.downloadFile(slashPath, remoteItem)
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const hardLinksDetected = true
+
+// Identifies the file a path links to, when more than one path does
+func hardLinkOf(info os.FileInfo) (hardLinkID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return hardLinkID{}, false
+	}
+	return hardLinkID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
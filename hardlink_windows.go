@@ -0,0 +1,11 @@
+package main
+
+import "os"
+
+// os.Stat doesn't report the links of a file on Windows, whose hard links
+// are synced as separate files
+const hardLinksDetected = false
+
+func hardLinkOf(info os.FileInfo) (hardLinkID, bool) {
+	return hardLinkID{}, false
+}
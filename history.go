@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Number of sync runs kept in the history file, older runs are dropped when
+// the sync service starts
+const maxHistoryRuns = 10000
+
+// SyncRun is one sync of a repository as recorded in the history
+type SyncRun struct {
+	Repository      string    `json:"repository"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	Uploaded        []string  `json:"uploaded,omitempty"`
+	Downloaded      []string  `json:"downloaded,omitempty"`
+	Tombstoned      []string  `json:"tombstoned,omitempty"`
+	Removed         []string  `json:"removed,omitempty"`
+	BytesUploaded   int64     `json:"bytes_uploaded"`
+	BytesDownloaded int64     `json:"bytes_downloaded"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// Adds the file changes of a sync event to the run
+func (run *SyncRun) record(event Event) {
+	switch event.Type {
+	case EventFileUploaded:
+		run.Uploaded = append(run.Uploaded, event.File)
+		run.BytesUploaded += event.Size
+	case EventFileDownloaded:
+		run.Downloaded = append(run.Downloaded, event.File)
+		run.BytesDownloaded += event.Size
+	case EventFileTombstoned, EventFileDeleted:
+		run.Tombstoned = append(run.Tombstoned, event.File)
+	case EventFileRemoved:
+		run.Removed = append(run.Removed, event.File)
+	}
+}
+
+func (run *SyncRun) stats() TransferStats {
+	return TransferStats{
+		FilesUploaded:   len(run.Uploaded),
+		FilesDownloaded: len(run.Downloaded),
+		FilesTombstoned: len(run.Tombstoned),
+		BytesUploaded:   run.BytesUploaded,
+		BytesDownloaded: run.BytesDownloaded,
+		Duration:        run.FinishedAt.Sub(run.StartedAt),
+	}
+}
+
+// Action a run took on a file, empty if it didn't touch the file
+func (run *SyncRun) action(slashPath string) string {
+	switch {
+	case slices.Contains(run.Uploaded, slashPath):
+		return "uploaded"
+	case slices.Contains(run.Downloaded, slashPath):
+		return "downloaded"
+	case slices.Contains(run.Tombstoned, slashPath):
+		return "deleted remotely"
+	case slices.Contains(run.Removed, slashPath):
+		return "removed locally"
+	}
+	return ""
+}
+
+// History is the log of sync runs, stored as JSON lines in the state directory
+const historyFile = "history.jsonl"
+
+type History struct {
+	mu   sync.Mutex
+	path string
+}
+
+func OpenHistory() (*History, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	history := &History{path: filepath.Join(dir, historyFile)}
+	if err := history.prune(); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func (h *History) Append(run *SyncRun) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return appendJSONLine(h.path, run)
+}
+
+// Runs returns the recorded runs, oldest first, optionally only those of one
+// repository and those touching one file
+func (h *History) Runs(repository, slashPath string) ([]SyncRun, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	lines, err := h.readLines()
+	if err != nil {
+		return nil, err
+	}
+	runs := make([]SyncRun, 0)
+	for _, line := range lines {
+		var run SyncRun
+		if err := json.Unmarshal(line, &run); err != nil {
+			continue // a line cut short by a crash
+		}
+		if repository != "" && run.Repository != repository {
+			continue
+		}
+		if slashPath != "" && run.action(slashPath) == "" {
+			continue
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+func (h *History) readLines() ([][]byte, error) {
+	lines, err := readJSONLines(h.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+	return lines, nil
+}
+
+// Drops all but the last maxHistoryRuns runs
+func (h *History) prune() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	lines, err := h.readLines()
+	if err != nil || len(lines) <= maxHistoryRuns {
+		return err
+	}
+	data := bytes.Join(lines[len(lines)-maxHistoryRuns:], []byte("\n"))
+	tmpPath := h.path + ".tmp"
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return os.Rename(tmpPath, h.path)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Git hooks that ask the sync service to sync the repository they run in
+var gitHooks = []string{"post-commit", "post-merge"}
+
+// Lines around the part of a hook reposy manages, so hooks the user already
+// has are kept
+const (
+	hookBegin = "# >>> reposy sync >>>"
+	hookEnd   = "# <<< reposy sync <<<"
+)
+
+func newHookCmd() *cobra.Command {
+	hookCmd := &cobra.Command{
+		Use:   "hook",
+		Short: "Manage git hooks that sync a repository after each commit",
+	}
+
+	installCmd := &cobra.Command{
+		Use:   "install <repo>",
+		Short: "Install post-commit and post-merge hooks that sync the repository",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			hooksDir, repoPath := gitHooksDir(args[0])
+			command, err := hookCommand(cmd, repoPath)
+			if err != nil {
+				fmt.Printf("Failed to install hooks: %v\n", err)
+				os.Exit(ExitFailure)
+			}
+			for _, hook := range gitHooks {
+				hookPath := filepath.Join(hooksDir, hook)
+				if err := installHook(hookPath, command); err != nil {
+					fmt.Printf("Failed to install %s hook: %v\n", hook, err)
+					os.Exit(ExitFailure)
+				}
+				fmt.Printf("Installed %s\n", hookPath)
+			}
+		},
+	}
+
+	uninstallCmd := &cobra.Command{
+		Use:   "uninstall <repo>",
+		Short: "Remove the hooks installed by 'reposy hook install'",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			hooksDir, _ := gitHooksDir(args[0])
+			for _, hook := range gitHooks {
+				hookPath := filepath.Join(hooksDir, hook)
+				removed, err := uninstallHook(hookPath)
+				if err != nil {
+					fmt.Printf("Failed to uninstall %s hook: %v\n", hook, err)
+					os.Exit(ExitFailure)
+				}
+				if removed {
+					fmt.Printf("Removed reposy from %s\n", hookPath)
+				}
+			}
+		},
+	}
+
+	hookCmd.AddCommand(installCmd, uninstallCmd)
+	return hookCmd
+}
+
+// Returns the hooks directory of a repository, honoring core.hooksPath, and
+// the absolute path of the repository. Exits when it isn't a git repository.
+func gitHooksDir(repo string) (string, string) {
+	repoPath, err := filepath.Abs(repo)
+	if err != nil {
+		fmt.Printf("Invalid repository path: %v\n", err)
+		os.Exit(ExitUsage)
+	}
+	output, err := exec.Command("git", "-C", repoPath, "rev-parse", "--git-path", "hooks").Output()
+	if err != nil {
+		fmt.Printf("Not a git repository: %s: %v\n", repoPath, commandError(err))
+		os.Exit(ExitUsage)
+	}
+	hooksDir := filepath.FromSlash(strings.TrimSpace(string(output)))
+	if !filepath.IsAbs(hooksDir) {
+		hooksDir = filepath.Join(repoPath, hooksDir)
+	}
+	return hooksDir, repoPath
+}
+
+// The shell command a hook runs. It doesn't wait for the sync service, so a
+// commit is never held up by it.
+func hookCommand(cmd *cobra.Command, repoPath string) (string, error) {
+	execPath, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to get executable path: %w", err)
+	}
+	// Git runs hooks with sh, also on Windows
+	args := []string{shellQuote(filepath.ToSlash(execPath))}
+	if cmd.Flags().Changed("socket") {
+		args = append(args, "--socket", shellQuote(filepath.ToSlash(socketPath)))
+	}
+	args = append(args, "sync", shellQuote(filepath.ToSlash(repoPath)))
+	return strings.Join(args, " ") + " >/dev/null 2>&1 &", nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Adds the reposy part to a hook, replacing the part an earlier install
+// added, and creates the hook when there is none
+func installHook(hookPath, command string) error {
+	content, err := os.ReadFile(hookPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	script := removeHookBlock(string(content))
+	if strings.TrimSpace(script) == "" {
+		script = "#!/bin/sh\n"
+	}
+	if !strings.HasSuffix(script, "\n") {
+		script += "\n"
+	}
+	script += hookBegin + "\n" + command + "\n" + hookEnd + "\n"
+
+	if err := os.MkdirAll(filepath.Dir(hookPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(hookPath, []byte(script), 0755)
+}
+
+// Removes the reposy part from a hook, and the hook when nothing else is
+// left in it. Reports whether there was a reposy part.
+func uninstallHook(hookPath string) (bool, error) {
+	content, err := os.ReadFile(hookPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	script := removeHookBlock(string(content))
+	if script == string(content) {
+		return false, nil
+	}
+	if strings.TrimSpace(strings.TrimPrefix(script, "#!/bin/sh")) == "" {
+		return true, os.Remove(hookPath)
+	}
+	return true, os.WriteFile(hookPath, []byte(script), 0755)
+}
+
+func removeHookBlock(script string) string {
+	begin := strings.Index(script, hookBegin)
+	if begin < 0 {
+		return script
+	}
+	end := strings.Index(script[begin:], hookEnd)
+	if end < 0 {
+		return script
+	}
+	end += begin + len(hookEnd)
+	if end < len(script) && script[end] == '\n' {
+		end++
+	}
+	return script[:begin] + script[end:]
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Maps HTTP API routes to socket commands
+var httpRoutes = map[string]string{
+	"GET /v1/status":    "status",
+	"GET /v1/health":    "health",
+	"POST /v1/sync":     "sync",
+	"POST /v1/reload":   "restart",
+	"POST /v1/pause":    "pause",
+	"POST /v1/resume":   "resume",
+	"POST /v1/restore":  "restore",
+	"GET /v1/conflicts": "conflicts",
+	"GET /v1/stats":     "stats",
+	// Body is the repository path
+	"POST /v1/confirm-deletions": "confirm-deletions",
+	// Body is ScheduleSyncArgs as JSON
+	"POST /v1/schedule-sync": "schedule-sync",
+}
+
+// Serves the daemon's commands over HTTP on a loopback address, so that
+// clients without unix socket support can integrate. Every request must
+// carry the configured token as "Authorization: Bearer <token>".
+func startHTTPServer(config HTTPConfig, engine *SyncEngine) error {
+	if config.Listen == "" {
+		return nil
+	}
+	if config.Token == "" {
+		return fmt.Errorf("http.token is required when http.listen is set")
+	}
+	host, _, err := net.SplitHostPort(config.Listen)
+	if err != nil {
+		return fmt.Errorf("invalid http.listen address %s: %w", config.Listen, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("http.listen must be a loopback address, got %s", config.Listen)
+	}
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	for route, command := range httpRoutes {
+		mux.HandleFunc(route, httpCommandHandler(config.Token, engine, command))
+	}
+
+	slog.Info("Serving HTTP API", "address", listener.Addr().String())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			slog.Error("HTTP API stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+func httpCommandHandler(token string, engine *SyncEngine, command string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !bearer || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			writeHTTPResponse(w, http.StatusUnauthorized, Response{Status: "error", Code: ErrCodeUnauthorized, Message: "Unauthorized"})
+			return
+		}
+		if denied := engine.SocketConfig().allowCommand(command); denied != nil {
+			writeHTTPResponse(w, http.StatusForbidden, *denied)
+			return
+		}
+
+		// The request body, if any, is passed as the command arguments
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			writeHTTPResponse(w, http.StatusBadRequest, Response{Status: "error", Code: ErrCodeInvalidArgs, Message: err.Error()})
+			return
+		}
+
+		slog.Info("HTTP command received", "command", command)
+		resp := dispatchCommand(engine, Message{Command: command, Args: string(body)})
+		statusCode := http.StatusOK
+		if resp.Status != "success" {
+			statusCode = http.StatusConflict
+			if command == "health" {
+				statusCode = http.StatusServiceUnavailable
+			}
+		}
+		writeHTTPResponse(w, statusCode, resp)
+	}
+}
+
+func writeHTTPResponse(w http.ResponseWriter, statusCode int, resp Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(resp)
+}
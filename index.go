@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The remote index is split into shards by a hash of the path once it grows
+// past indexShardSize entries, so a sync only holds one shard of the index and
+// of the local files in memory at a time.
+//
+// An index of a single shard is stored in INDEX_FILE. A sharded index stores
+// its shards in INDEX_SHARD_DIR/<shards>/<n> and a plain JSON manifest in
+// INDEX_FILE.
+const INDEX_SHARD_DIR = ".reposyindex.d"
+
+// Changes to a large shard are appended to the index as numbered deltas in
+// INDEX_DELTA_DIR/<n> instead of rewriting the shard. Each shard records its
+// generation, the last delta it includes, and the deltas are compacted into
+// the shards once there are indexMaxDeltas of them or indexDeltaMaxEntries
+// entries in them.
+const INDEX_DELTA_DIR = ".reposyindex.log"
+
+const (
+	indexMaxDeltas       = 16
+	indexDeltaMaxEntries = 10000
+	// Smaller shards are rewritten, a delta would save little
+	indexDeltaMinShard = 1000
+)
+
+// A shard or delta is stored as indexMagic, a format version byte, then
+// gzipped: the generation, the number of entries and the entries sorted by
+// path. Each entry is the length of the prefix it shares with the previous
+// path, the rest of the path, the mod time, flags and the raw SHA-256 when
+// there is one, all lengths and numbers as varints. Hard links are followed
+// by the path they link to, then entries written by a known machine by its
+// ID and name, then entries of a known size by it. Mod times are in
+// nanoseconds since version 3 and in seconds before, version 4 added links,
+// version 5 machines and version 6 sizes. Version 1 has no generation.
+// Shards written by older versions are gzipped JSON maps, which are still
+// read.
+const (
+	indexMagic         = "RPYX"
+	indexFormatVersion = 6
+)
+
+const (
+	indexFlagTombstone = 1 << iota
+	indexFlagSHA256
+	// The entry was removed from the index, only used in deltas
+	indexFlagRemoved
+	indexFlagLink
+	indexFlagMachine
+	indexFlagSize
+)
+
+const (
+	indexShardSize = 50000
+	// Shard counts are powers of two up to maxIndexShards, so a file's shard
+	// is its bucket modulo the shard count
+	maxIndexShards = 256
+)
+
+// IndexManifest describes how the remote index is stored
+type IndexManifest struct {
+	Shards int `json:"shards"`
+	// Last delta included in every shard
+	Generation int `json:"generation,omitempty"`
+
+	// Entries of an index that isn't sharded, read along with the manifest
+	items map[string]*RemoteItem
+	// Deltas after Generation in order, a nil entry is a removed one
+	deltas []map[string]*RemoteItem
+}
+
+// LastDelta returns the number of the last delta of the index
+func (index *IndexManifest) LastDelta() int {
+	return index.Generation + len(index.deltas)
+}
+
+// NeedsCompaction reports whether the deltas should be merged into the shards
+func (index *IndexManifest) NeedsCompaction() bool {
+	entries := 0
+	for _, delta := range index.deltas {
+		entries += len(delta)
+	}
+	return len(index.deltas) >= indexMaxDeltas || entries >= indexDeltaMaxEntries
+}
+
+// Reports whether any delta changes a shard of the index
+func (index *IndexManifest) deltaTouches(shard, shards int) bool {
+	for _, delta := range index.deltas {
+		for slashPath := range delta {
+			if indexShard(slashPath, shards) == shard {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Applies the deltas after generation to the entries of a stored shard
+func (index *IndexManifest) applyDeltas(items map[string]*RemoteItem, shard, generation int) {
+	for i, delta := range index.deltas {
+		if index.Generation+i+1 <= generation {
+			continue
+		}
+		for slashPath, item := range delta {
+			if indexShard(slashPath, index.Shards) != shard {
+				continue
+			}
+			if item == nil {
+				delete(items, slashPath)
+			} else {
+				items[slashPath] = item
+			}
+		}
+	}
+}
+
+// Bucket of a path among maxIndexShards
+func indexBucket(slashPath string) int {
+	h := fnv.New32a()
+	h.Write([]byte(slashPath))
+	return int(h.Sum32() % maxIndexShards)
+}
+
+func indexShard(slashPath string, shards int) int {
+	return indexBucket(slashPath) % shards
+}
+
+// Number of shards for an index of the given number of entries
+func indexShardsFor(entries int) int {
+	shards := 1
+	for shards < maxIndexShards && shards*indexShardSize < entries {
+		shards *= 2
+	}
+	return shards
+}
+
+// Remote path of an index shard, relative to the prefix
+func indexShardPath(shard, shards int) string {
+	if shards == 1 {
+		return INDEX_FILE
+	}
+	return path.Join(INDEX_SHARD_DIR, strconv.Itoa(shards), strconv.Itoa(shard))
+}
+
+func indexDeltaPath(delta int) string {
+	return path.Join(INDEX_DELTA_DIR, strconv.Itoa(delta))
+}
+
+// Reports whether a remote path is part of the index rather than a file
+func isIndexPath(slashPath string) bool {
+	return slashPath == INDEX_FILE || slashPath == SEED_FILE ||
+		strings.HasPrefix(slashPath, INDEX_SHARD_DIR+"/") ||
+		strings.HasPrefix(slashPath, INDEX_DELTA_DIR+"/")
+}
+
+// Parses the content of INDEX_FILE, which is either a manifest or the entries
+// of an index that isn't sharded
+func parseIndexManifest(content []byte) (*IndexManifest, error) {
+	if isGzip(content) || isBinaryIndex(content) {
+		items, generation, err := decodeIndexShard(content)
+		if err != nil {
+			return nil, err
+		}
+		return &IndexManifest{Shards: 1, Generation: generation, items: items}, nil
+	}
+
+	var manifest IndexManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode index manifest: %v", err)
+	}
+	shards := manifest.Shards
+	if shards < 1 || shards > maxIndexShards || shards&(shards-1) != 0 {
+		return nil, fmt.Errorf("invalid number of index shards: %d", shards)
+	}
+	if manifest.Generation < 0 {
+		return nil, fmt.Errorf("invalid index generation: %d", manifest.Generation)
+	}
+	return &manifest, nil
+}
+
+func isGzip(content []byte) bool {
+	return len(content) >= 2 && content[0] == 0x1f && content[1] == 0x8b
+}
+
+func isBinaryIndex(content []byte) bool {
+	return bytes.HasPrefix(content, []byte(indexMagic))
+}
+
+// Decodes a shard or delta, returning its entries and generation. Removed
+// entries of a delta are nil.
+func decodeIndexShard(content []byte) (map[string]*RemoteItem, int, error) {
+	if isBinaryIndex(content) {
+		return decodeBinaryIndexShard(content)
+	}
+
+	// written by an older version
+	gzReader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create gzip reader: %v", err)
+	}
+	defer gzReader.Close()
+
+	var items map[string]*RemoteItem
+	if err := json.NewDecoder(gzReader).Decode(&items); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode index file content: %v", err)
+	}
+	if items == nil {
+		items = make(map[string]*RemoteItem)
+	}
+	for _, item := range items {
+		if item != nil {
+			item.ModTime = modTimeNanos(item.ModTime)
+		}
+	}
+	return items, 0, nil
+}
+
+func decodeBinaryIndexShard(content []byte) (map[string]*RemoteItem, int, error) {
+	content = content[len(indexMagic):]
+	version := -1
+	if len(content) > 0 {
+		version = int(content[0])
+	}
+	if version < 1 || version > indexFormatVersion {
+		return nil, 0, fmt.Errorf("unsupported index format version %d, a newer version of reposy wrote it", version)
+	}
+
+	gzReader, err := gzip.NewReader(bytes.NewReader(content[1:]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create gzip reader: %v", err)
+	}
+	defer gzReader.Close()
+	reader := bufio.NewReader(gzReader)
+
+	var generation uint64
+	if version >= 2 {
+		if generation, err = binary.ReadUvarint(reader); err != nil {
+			return nil, 0, fmt.Errorf("failed to decode index file content: %v", err)
+		}
+	}
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to decode index file content: %v", err)
+	}
+	items := make(map[string]*RemoteItem, min(count, indexShardSize))
+	var slashPath []byte
+	for i := uint64(0); i < count; i++ {
+		slashPath, err = readIndexPath(reader, slashPath)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to decode index file content: %v", err)
+		}
+		item, err := readIndexItem(reader, version)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to decode index file content: %v", err)
+		}
+		items[string(slashPath)] = item
+	}
+	return items, int(generation), nil
+}
+
+// Reads a path stored as the length it shares with the previous one and the
+// bytes that follow
+func readIndexPath(reader *bufio.Reader, previous []byte) ([]byte, error) {
+	shared, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if shared > uint64(len(previous)) || rest > 4096 {
+		return nil, fmt.Errorf("invalid path length")
+	}
+	slashPath := append(previous[:shared:shared], make([]byte, rest)...)
+	if _, err := io.ReadFull(reader, slashPath[shared:]); err != nil {
+		return nil, err
+	}
+	return slashPath, nil
+}
+
+func readIndexItem(reader *bufio.Reader, version int) (*RemoteItem, error) {
+	modTime, err := binary.ReadVarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if version < 3 {
+		modTime *= int64(time.Second)
+	}
+	flags, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if flags&indexFlagRemoved != 0 {
+		return nil, nil
+	}
+	item := &RemoteItem{
+		ModTime:   modTime,
+		Tombstone: flags&indexFlagTombstone != 0,
+	}
+	if flags&indexFlagSHA256 != 0 {
+		var sum [sha256.Size]byte
+		if _, err := io.ReadFull(reader, sum[:]); err != nil {
+			return nil, err
+		}
+		item.SHA256 = hex.EncodeToString(sum[:])
+	}
+	if flags&indexFlagLink != 0 {
+		link, err := readIndexPath(reader, nil)
+		if err != nil {
+			return nil, err
+		}
+		item.Link = string(link)
+	}
+	if flags&indexFlagMachine != 0 {
+		id, err := readIndexPath(reader, nil)
+		if err != nil {
+			return nil, err
+		}
+		name, err := readIndexPath(reader, nil)
+		if err != nil {
+			return nil, err
+		}
+		item.MachineID, item.MachineName = string(id), string(name)
+	}
+	if flags&indexFlagSize != 0 {
+		size, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		item.Size = int64(size)
+	}
+	return item, nil
+}
+
+// Encodes a shard or delta, nil entries being removed ones
+func encodeIndexShard(items map[string]*RemoteItem, generation int) ([]byte, error) {
+	paths := make([]string, 0, len(items))
+	for slashPath := range items {
+		paths = append(paths, slashPath)
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	buf.WriteString(indexMagic)
+	buf.WriteByte(indexFormatVersion)
+	gzWriter := gzip.NewWriter(&buf)
+	writer := bufio.NewWriter(gzWriter)
+	varint := make([]byte, binary.MaxVarintLen64)
+	writeUvarint := func(v uint64) {
+		writer.Write(varint[:binary.PutUvarint(varint, v)])
+	}
+
+	writeUvarint(uint64(generation))
+	writeUvarint(uint64(len(paths)))
+	previous := ""
+	for _, slashPath := range paths {
+		item := items[slashPath]
+		shared := 0
+		for shared < len(previous) && shared < len(slashPath) && previous[shared] == slashPath[shared] {
+			shared++
+		}
+		writeUvarint(uint64(shared))
+		writeUvarint(uint64(len(slashPath) - shared))
+		writer.WriteString(slashPath[shared:])
+		previous = slashPath
+		if item == nil {
+			writer.Write(varint[:binary.PutVarint(varint, 0)])
+			writer.WriteByte(indexFlagRemoved)
+			continue
+		}
+		writer.Write(varint[:binary.PutVarint(varint, item.ModTime)])
+
+		var flags byte
+		if item.Tombstone {
+			flags |= indexFlagTombstone
+		}
+		var sum []byte
+		if item.SHA256 != "" {
+			decoded, err := hex.DecodeString(item.SHA256)
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("invalid sha256 of %s: %s", slashPath, item.SHA256)
+			}
+			flags |= indexFlagSHA256
+			sum = decoded
+		}
+		if item.Link != "" {
+			flags |= indexFlagLink
+		}
+		if item.MachineID != "" {
+			flags |= indexFlagMachine
+		}
+		if item.Size > 0 {
+			flags |= indexFlagSize
+		}
+		writer.WriteByte(flags)
+		writer.Write(sum)
+		writeString := func(s string) {
+			writeUvarint(0)
+			writeUvarint(uint64(len(s)))
+			writer.WriteString(s)
+		}
+		if item.Link != "" {
+			writeString(item.Link)
+		}
+		if item.MachineID != "" {
+			writeString(item.MachineID)
+			writeString(item.MachineName)
+		}
+		if item.Size > 0 {
+			writeUvarint(uint64(item.Size))
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		gzWriter.Close()
+		return nil, fmt.Errorf("failed to write meta to gzip writer: %v", err)
+	}
+	if err := gzWriter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close gzip writer: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Entries of items that fall in a shard of a larger shard count
+func splitIndexShard(items map[string]*RemoteItem, shard, shards int) map[string]*RemoteItem {
+	result := make(map[string]*RemoteItem)
+	for slashPath, item := range items {
+		if indexShard(slashPath, shards) == shard {
+			result[slashPath] = item
+		}
+	}
+	return result
+}
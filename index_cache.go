@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// The index objects last downloaded or written are kept on disk too, in the
+// state directory by remote, so that a restarted daemon only checks their
+// ETags instead of downloading the whole index again. When the remote can't
+// be reached, the index is read from there instead: plans and restores of
+// what the remote had work on it, but syncs fail early, as they would
+// compare the files against a remote that may have changed since.
+
+// Returned by a sync that found the remote unreachable and its index cached
+var errIndexOffline = errors.New("the remote is unreachable, only its cached index can be read")
+
+// Directory of the cached index objects of the remote
+func (s3 *S3Client) indexCacheDir() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(s3.Endpoint + "/" + s3.Bucket + "/" + s3.Prefix))
+	return filepath.Join(dir, "index-cache", hex.EncodeToString(sum[:8])), nil
+}
+
+func (s3 *S3Client) indexCachePath(slashPath string) (string, error) {
+	dir, err := s3.indexCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, url.QueryEscape(slashPath)), nil
+}
+
+// Keeps the content of an index object with its ETag, on its first line
+func (s3 *S3Client) saveIndexObject(slashPath, etag string, content []byte) {
+	cachePath, err := s3.indexCachePath(slashPath)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0o700); err != nil {
+		slog.Warn("Failed to cache index", "file", slashPath, "error", err)
+		return
+	}
+	data := append([]byte(etag+"\n"), content...)
+	if err := writeFileAtomic(cachePath, data); err != nil {
+		slog.Warn("Failed to cache index", "file", slashPath, "error", err)
+	}
+}
+
+// Reads an index object cached on disk, nil when there is none
+func (s3 *S3Client) loadIndexObject(slashPath string, decode func([]byte) (*cachedIndexObject, error)) *cachedIndexObject {
+	cachePath, err := s3.indexCachePath(slashPath)
+	if err != nil {
+		return nil
+	}
+	data, err := os.ReadFile(cachePath)
+	if err != nil {
+		return nil
+	}
+	etag, content, ok := bytes.Cut(data, []byte("\n"))
+	if !ok || len(etag) == 0 {
+		return nil
+	}
+	object, err := decode(content)
+	if err != nil {
+		slog.Warn("Ignoring damaged cached index", "file", slashPath, "error", err)
+		os.Remove(cachePath)
+		return nil
+	}
+	object.etag = string(etag)
+	return object
+}
+
+// Forgets an index object that no longer exists
+func (s3 *S3Client) forgetIndexObject(slashPath string) {
+	delete(s3.indexCache, slashPath)
+	if cachePath, err := s3.indexCachePath(slashPath); err == nil {
+		os.Remove(cachePath)
+	}
+}
+
+// Whether the last Index was read from the cache because the remote was
+// unreachable
+func (s3 *S3Client) IndexOffline() bool {
+	return s3.indexOffline
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+)
+
+// With an index key, every object of the index is stored with an HMAC-SHA256
+// of its full path and content in this header, and objects read without a
+// valid signature are rejected. Someone who can write to the bucket but
+// doesn't have the key can then not make the daemon delete or replace local
+// files with an index of their own. They can still delete the index or
+// restore an older signed version of it.
+const HEADER_INDEX_SIGNATURE = "x-amz-meta-reposy-signature"
+
+// Shortest index key accepted
+const indexKeyMinLength = 16
+
+func (s3 *S3Client) indexSignature(slashPath string, content []byte) string {
+	mac := hmac.New(sha256.New, []byte(s3.IndexKey))
+	mac.Write([]byte(path.Join(s3.Prefix, slashPath)))
+	mac.Write([]byte{0})
+	mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Headers of an index object written, signing it when there is an index key
+func (s3 *S3Client) indexHeaders(slashPath string, content []byte) map[string]string {
+	if s3.IndexKey == "" {
+		return nil
+	}
+	return map[string]string{HEADER_INDEX_SIGNATURE: s3.indexSignature(slashPath, content)}
+}
+
+// Checks the signature of an index object read, when there is an index key
+func (s3 *S3Client) verifyIndex(slashPath string, resp *httpResponse) error {
+	if s3.IndexKey == "" {
+		return nil
+	}
+	signature := resp.Headers[http.CanonicalHeaderKey(HEADER_INDEX_SIGNATURE)]
+	if signature == "" {
+		return fmt.Errorf("index %s is not signed, if the index key was just set run 'reposy sign-index'", slashPath)
+	}
+	if !hmac.Equal([]byte(signature), []byte(s3.indexSignature(slashPath, resp.Body))) {
+		return fmt.Errorf("signature of index %s is invalid, it was changed without the index key", slashPath)
+	}
+	return nil
+}
+
+// SignIndex signs the objects of the index as they are, returning their
+// paths. The objects aren't verified, so it must only be run on a remote
+// known to be intact.
+func (s3 *S3Client) SignIndex() ([]string, error) {
+	if s3.IndexKey == "" {
+		return nil, fmt.Errorf("no index_key is set for %s", remoteName(s3))
+	}
+	signed := make([]string, 0)
+	sign := func(slashPath string) (content []byte, found bool, err error) {
+		resp, err := s3.request("GET", path.Join(s3.Prefix, slashPath), nil, nil, nil)
+		if err != nil {
+			return nil, false, err
+		}
+		switch resp.StatusCode {
+		case 200:
+		case 404:
+			return nil, false, nil
+		default:
+			return nil, false, fmt.Errorf("failed to download %s: %s", slashPath, resp.Body)
+		}
+		content = resp.Body
+		delete(s3.indexCache, slashPath)
+		resp, err = s3.request("PUT", path.Join(s3.Prefix, slashPath), content, s3.indexHeaders(slashPath, content), nil)
+		if err == nil && resp.StatusCode != 200 {
+			err = fmt.Errorf("failed to put %s: %s", slashPath, resp.Body)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		signed = append(signed, slashPath)
+		return content, true, nil
+	}
+
+	content, found, err := sign(INDEX_FILE)
+	if err != nil || !found {
+		return signed, err
+	}
+	manifest, err := parseIndexManifest(content)
+	if err != nil {
+		return signed, err
+	}
+	if manifest.Shards > 1 {
+		for shard := 0; shard < manifest.Shards; shard++ {
+			if _, _, err := sign(indexShardPath(shard, manifest.Shards)); err != nil {
+				return signed, err
+			}
+		}
+	}
+	for delta := manifest.Generation + 1; ; delta++ {
+		_, found, err := sign(indexDeltaPath(delta))
+		if err != nil {
+			return signed, err
+		}
+		if !found {
+			break
+		}
+	}
+	if _, _, err := sign(SEED_FILE); err != nil {
+		return signed, err
+	}
+	return signed, nil
+}
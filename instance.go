@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Several sync services can run side by side as named instances, e.g. one
+// for work repositories and one for personal ones, each with its own config
+// file, socket, state, log and service unit. The instance is selected with
+// --instance or REPOSY_INSTANCE, the default one having no name.
+var instanceName string
+
+var instanceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// "-<name>" for a named instance, appended to the names of its files
+func instanceSuffix() string {
+	if instanceName == "" {
+		return ""
+	}
+	return "-" + instanceName
+}
+
+// Adds the instance name to a file name, before its extension, e.g.
+// reposy.sock -> reposy-work.sock
+func instanceFile(filePath string) string {
+	ext := filepath.Ext(filePath)
+	return strings.TrimSuffix(filePath, ext) + instanceSuffix() + ext
+}
+
+// Points the socket, log and service unit to those of the selected
+// instance. A socket given with --socket is kept as it is.
+func applyInstance(cmd *cobra.Command) error {
+	if instanceName == "" {
+		return nil
+	}
+	if !instanceNamePattern.MatchString(instanceName) {
+		return fmt.Errorf("invalid instance name %q, use letters, digits, - and _", instanceName)
+	}
+	if !cmd.Flags().Changed("socket") {
+		socketPath = instanceFile(defaultSocketPath())
+	}
+	logPath = instanceFile(logPath)
+	systemdUnitName = instanceFile(systemdUnitName)
+	launchdLabel += "." + instanceName
+	return nil
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// A framed connection starts with ipcMagic followed by the protocol version
+// byte of the client, answered by ipcMagic and the version of the server.
+// After that, both sides exchange frames: a 4-byte big-endian length followed
+// by a JSON document. Connections starting with '{' use the legacy protocol
+// of a single JSON Message answered by a single JSON Response.
+//
+// Protocol versions:
+//
+//	1: legacy, a single JSON message per connection
+//	2: framed, multiple requests per connection and streaming
+//	3: typed response payloads
+const (
+	ipcMagic              = "RPSY"
+	ipcProtocolVersion    = 3
+	ipcMinProtocolVersion = 2
+	maxFrameSize          = 16 << 20
+
+	watchInterval = time.Second
+)
+
+// Codes of error responses, telling scripts why a request failed without
+// parsing the message
+const (
+	ErrCodeUnauthorized        = "unauthorized"
+	ErrCodeDisabled            = "disabled"
+	ErrCodeInvalidArgs         = "invalid_arguments"
+	ErrCodeNotFound            = "not_found"
+	ErrCodeBusy                = "busy"
+	ErrCodeUnknownCommand      = "unknown_command"
+	ErrCodeUnsupportedProtocol = "unsupported_protocol"
+	ErrCodeDuplicateRequest    = "duplicate_request"
+	// The sync service isn't running or can't be reached
+	ErrCodeUnavailable = "unavailable"
+	ErrCodeFailed      = "failed"
+)
+
+type Request struct {
+	ID      uint64 `json:"id"`
+	Command string `json:"command"`
+	Args    string `json:"args,omitempty"`
+	// socket.token of the sync service, when it requires one
+	Token string `json:"token,omitempty"`
+}
+
+// ResponseFrame answers the request with the same ID. Streaming commands send
+// any number of event frames before the final frame with Done set.
+type ResponseFrame struct {
+	ID uint64 `json:"id"`
+	Response
+	Event    *Event               `json:"event,omitempty"`
+	Snapshot []RepositorySnapshot `json:"snapshot,omitempty"`
+	Done     bool                 `json:"done,omitempty"`
+}
+
+func writeFrame(w io.Writer, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	if _, err := w.Write(append(header[:], payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readFrame(r io.Reader, v any) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return fmt.Errorf("frame too large: %d bytes", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
+
+func readHandshake(r io.Reader) (byte, error) {
+	handshake := make([]byte, len(ipcMagic)+1)
+	if _, err := io.ReadFull(r, handshake); err != nil {
+		return 0, err
+	}
+	if string(handshake[:len(ipcMagic)]) != ipcMagic {
+		return 0, fmt.Errorf("unexpected protocol handshake")
+	}
+	return handshake[len(ipcMagic)], nil
+}
+
+// Typed response payloads, sent alongside the human readable Data
+type StatusPayload struct {
+	Profile string `json:"profile,omitempty"`
+	Paused  bool   `json:"paused"`
+	// "pause" or "throttle" while on a metered network
+	Metered      string `json:"metered,omitempty"`
+	ThrottleRate int64  `json:"throttle_bytes_per_second,omitempty"`
+	// Set while on battery below the threshold
+	Battery      *BatteryPayload      `json:"battery,omitempty"`
+	Repositories []RepositorySnapshot `json:"repositories"`
+}
+
+type BatteryPayload struct {
+	Percent       int      `json:"percent"`
+	SyncInterval  Interval `json:"sync_interval"`
+	MaxUploadSize int64    `json:"max_upload_bytes,omitempty"`
+}
+
+type HistoryPayload struct {
+	Runs []SyncRun `json:"runs"`
+}
+
+type ReloadPayload struct {
+	Changes []string `json:"changes"`
+}
+
+type HealthPayload struct {
+	Healthy  bool     `json:"healthy"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+type RestorePayload struct {
+	Files []string `json:"files"`
+}
+
+type PurgePayload struct {
+	Files  []string `json:"files"`
+	DryRun bool     `json:"dry_run,omitempty"`
+}
+
+// Builds a success response with a typed payload for clients that understand it
+func payloadResponse(message string, data string, payload any) Response {
+	resp := Response{Status: "success", Message: message, Data: data}
+	if encoded, err := json.Marshal(payload); err == nil {
+		resp.Payload = encoded
+	}
+	return resp
+}
+
+func writeHandshake(w io.Writer) error {
+	_, err := w.Write(append([]byte(ipcMagic), ipcProtocolVersion))
+	return err
+}
+
+// Serves framed requests until the client disconnects. Requests are handled
+// concurrently, responses are correlated by request ID, which must be unique
+// among the requests of the connection in progress.
+func handleFramedConnection(conn net.Conn, connID uint64, reader *bufio.Reader, engine *SyncEngine) error {
+	clientVersion, err := readHandshake(reader)
+	if err != nil {
+		return err
+	}
+	if err := writeHandshake(conn); err != nil {
+		return err
+	}
+	if clientVersion < ipcMinProtocolVersion {
+		return writeFrame(conn, ResponseFrame{
+			Response: Response{
+				Status:  "error",
+				Code:    ErrCodeUnsupportedProtocol,
+				Message: fmt.Sprintf("Protocol version %d is no longer supported by the sync service, please upgrade reposy", clientVersion),
+			},
+			Done: true,
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var writeMu sync.Mutex
+	send := func(frame ResponseFrame) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return writeFrame(conn, frame)
+	}
+
+	// Requests in progress, by ID
+	var inflightMu sync.Mutex
+	inflight := make(map[uint64]bool)
+	finish := func(id uint64) {
+		inflightMu.Lock()
+		defer inflightMu.Unlock()
+		delete(inflight, id)
+	}
+
+	// The requests in progress are cancelled before being waited for, once the
+	// connection is gone
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	for {
+		var req Request
+		if err := readFrame(reader, &req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		logCommand(req.Command, "conn", connID, "request", req.ID)
+
+		if denied := engine.SocketConfig().authorize(req.Command, req.Token); denied != nil {
+			send(ResponseFrame{ID: req.ID, Response: *denied, Done: true})
+			continue
+		}
+		inflightMu.Lock()
+		var refused *Response
+		if inflight[req.ID] {
+			refused = &Response{Status: "error", Code: ErrCodeDuplicateRequest, Message: fmt.Sprintf("Request %d is already in progress", req.ID)}
+		} else if len(inflight) >= maxConnectionRequests {
+			refused = &Response{Status: "error", Code: ErrCodeBusy, Message: fmt.Sprintf("Too many requests in progress, at most %d per connection", maxConnectionRequests)}
+		} else {
+			inflight[req.ID] = true
+		}
+		inflightMu.Unlock()
+		if refused != nil {
+			slog.Warn("Request refused", "conn", connID, "request", req.ID, "code", refused.Code)
+			send(ResponseFrame{ID: req.ID, Response: *refused, Done: true})
+			continue
+		}
+		switch req.Command {
+		case "shutdown":
+			send(ResponseFrame{
+				ID:       req.ID,
+				Response: Response{Status: "success", Message: "Sync service shutting down"},
+				Done:     true,
+			})
+			shutdownDaemon(engine)
+		case "events":
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer finish(req.ID)
+				streamEvents(ctx, engine, req, send)
+			}()
+		case "watch":
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer finish(req.ID)
+				streamSnapshots(ctx, engine, req, send)
+			}()
+		default:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp := dispatchCommand(engine, Message{Command: req.Command, Args: req.Args})
+				if resp.Status == "error" {
+					slog.Info("Command failed", "conn", connID, "request", req.ID, "command", req.Command, "code", resp.Code)
+				}
+				// Done before the response, so that the client may reuse the ID
+				finish(req.ID)
+				send(ResponseFrame{ID: req.ID, Response: resp, Done: true})
+			}()
+		}
+	}
+}
+
+// Streams sync progress events until the client goes away
+func streamEvents(ctx context.Context, engine *SyncEngine, req Request, send func(ResponseFrame) error) {
+	events, unsubscribe := engine.Events().Subscribe()
+	defer unsubscribe()
+
+	err := send(ResponseFrame{ID: req.ID, Response: Response{Status: "success", Message: "Streaming sync events"}})
+	if err != nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			if err := send(ResponseFrame{ID: req.ID, Event: &event}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Streams a status snapshot on every sync event, and at least every
+// watchInterval so that transfer speeds stay current
+func streamSnapshots(ctx context.Context, engine *SyncEngine, req Request, send func(ResponseFrame) error) {
+	events, unsubscribe := engine.Events().Subscribe()
+	defer unsubscribe()
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		if err := send(ResponseFrame{ID: req.ID, Snapshot: engine.Snapshot()}); err != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+		case <-ticker.C:
+		}
+	}
+}
+
+// ipcClient talks the framed protocol to the sync service
+type ipcClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	nextID uint64
+
+	// protocol version spoken by the sync service
+	serverVersion byte
+}
+
+func dialDaemon() (*ipcClient, error) {
+	conn, err := dialIPC()
+	if err != nil {
+		return nil, err
+	}
+	client := &ipcClient{conn: conn, reader: bufio.NewReader(conn)}
+	if err := writeHandshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	serverVersion, err := readHandshake(client.reader)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client.serverVersion = serverVersion
+	return client, nil
+}
+
+func (c *ipcClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *ipcClient) send(command, args string) (uint64, error) {
+	c.nextID++
+	return c.nextID, writeFrame(c.conn, Request{ID: c.nextID, Command: command, Args: args, Token: clientSocketToken()})
+}
+
+// Call sends a command and waits for its final response
+func (c *ipcClient) Call(command, args string) (Response, error) {
+	id, err := c.send(command, args)
+	if err != nil {
+		return Response{}, err
+	}
+	for {
+		var frame ResponseFrame
+		if err := readFrame(c.reader, &frame); err != nil {
+			return Response{}, err
+		}
+		// frames with ID 0 are connection level errors
+		if (frame.ID == id || frame.ID == 0) && frame.Done {
+			return frame.Response, nil
+		}
+	}
+}
+
+// Stream sends a streaming command and calls handle for every frame until
+// handle returns false, the stream ends or the connection fails
+func (c *ipcClient) Stream(command, args string, handle func(ResponseFrame) bool) error {
+	id, err := c.send(command, args)
+	if err != nil {
+		return err
+	}
+	for {
+		var frame ResponseFrame
+		if err := readFrame(c.reader, &frame); err != nil {
+			return err
+		}
+		if frame.ID != id && frame.ID != 0 {
+			continue
+		}
+		if frame.Status == "error" {
+			return fmt.Errorf("%s", frame.Message)
+		}
+		if (frame.Event != nil || frame.Snapshot != nil) && !handle(frame) {
+			return nil
+		}
+		if frame.Done {
+			return nil
+		}
+	}
+}
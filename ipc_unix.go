@@ -0,0 +1,189 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var logPath = "/tmp/reposy.log"
+
+// $XDG_RUNTIME_DIR/reposy/reposy.sock, falling back to ~/.local/run
+func defaultSocketPath() string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			runtimeDir = os.TempDir()
+		} else {
+			runtimeDir = filepath.Join(homeDir, ".local", "run")
+		}
+	}
+	return filepath.Join(runtimeDir, "reposy", "reposy.sock")
+}
+
+// The pid file lives alongside the socket, e.g. reposy.sock -> reposy.pid
+func pidFilePath() string {
+	return strings.TrimSuffix(socketPath, filepath.Ext(socketPath)) + ".pid"
+}
+
+// $XDG_STATE_HOME/reposy, falling back to ~/.local/state/reposy, with the
+// instance name appended for named instances
+func stateDir() (string, error) {
+	dataDir := os.Getenv("XDG_STATE_HOME")
+	if dataDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get home directory: %w", err)
+		}
+		dataDir = filepath.Join(homeDir, ".local", "state")
+	}
+	return filepath.Join(dataDir, "reposy"+instanceSuffix()), nil
+}
+
+// $XDG_DATA_HOME/reposy, falling back to ~/.local/share/reposy
+func dataDir() (string, error) {
+	dataDir := os.Getenv("XDG_DATA_HOME")
+	if dataDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get home directory: %w", err)
+		}
+		dataDir = filepath.Join(homeDir, ".local", "share")
+	}
+	return filepath.Join(dataDir, "reposy"+instanceSuffix()), nil
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Whether a process runs the reposy executable, by its name, so that a pid
+// reused since the sync service died isn't taken for it. Assumed when it
+// can't be told.
+func processIsReposy(pid int) bool {
+	self, err := os.Executable()
+	if err != nil {
+		return true
+	}
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		if _, err := os.Stat("/proc/self/exe"); err == nil {
+			// Linux, where the processes of other users can't be read
+			return false
+		}
+		// The full path of the executable on macOS and the BSDs
+		output, err := exec.Command("ps", "-p", strconv.Itoa(pid), "-o", "comm=").Output()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return false
+		} else if err != nil {
+			return true
+		}
+		exe = strings.TrimSpace(string(output))
+	}
+	// The executable was replaced while the process ran
+	exe = strings.TrimSuffix(exe, " (deleted)")
+	return filepath.Base(exe) == filepath.Base(self)
+}
+
+func listenIPC() (net.Listener, error) {
+	socketDir := filepath.Dir(socketPath)
+	if err := os.MkdirAll(socketDir, 0700); err != nil {
+		return nil, err
+	}
+
+	// Take over the socket only if its previous owner is gone
+	if _, err := removeStaleSocket(); err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(socketPath); err == nil {
+		return nil, fmt.Errorf("socket %s is in use by another sync service", socketPath)
+	}
+
+	// Only the current user may connect to the socket
+	oldMask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", socketPath)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func dialIPC() (net.Conn, error) {
+	return net.Dial("unix", socketPath)
+}
+
+func removeSocketFile() {
+	os.Remove(socketPath)
+}
+
+// Lets other users reach the socket, for socket.allowed_uids to decide
+// which of them may use it. Only the directory reposy keeps its default
+// socket in is made searchable by them, the permissions of any other, like
+// the home directory or /tmp of a socket given with --socket, are left alone.
+func shareSocket() error {
+	socketDir := filepath.Dir(socketPath)
+	info, err := os.Stat(socketDir)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0001 == 0 {
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if socketDir != filepath.Dir(defaultSocketPath()) || !ok || int(stat.Uid) != os.Getuid() {
+			return fmt.Errorf("other users can't reach %s, allow them to search it with chmod o+x", socketDir)
+		}
+		if err := os.Chmod(socketDir, 0711); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(socketPath, 0666)
+}
+
+// A socket file nobody is listening on is left over by a crashed daemon, remove it
+func removeStaleSocket() (bool, error) {
+	info, err := os.Lstat(socketPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return false, fmt.Errorf("%s exists and is not a socket", socketPath)
+	}
+
+	conn, err := dialIPC()
+	if err == nil {
+		conn.Close()
+		return false, nil
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return false, err
+	}
+	if err := os.Remove(socketPath); err != nil {
+		return false, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+	return true, nil
+}
+
+// Detach the daemon from the controlling terminal
+func daemonSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Setsid: true,
+	}
+}
@@ -0,0 +1,119 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/Microsoft/go-winio"
+)
+
+const (
+	// Grant full access to the pipe owner and LocalSystem only
+	pipeSecurityDescriptor = "D:P(A;;GA;;;OW)(A;;GA;;;SY)"
+
+	// https://learn.microsoft.com/en-us/windows/win32/procthread/process-creation-flags
+	createNewProcessGroup = 0x00000200
+	detachedProcess       = 0x00000008
+)
+
+var logPath = filepath.Join(os.TempDir(), "reposy.log")
+
+// \\.\pipe\reposy-<username>
+func defaultSocketPath() string {
+	userName := strings.ReplaceAll(os.Getenv("USERNAME"), `\`, "-")
+	if userName == "" {
+		return `\\.\pipe\reposy`
+	}
+	return `\\.\pipe\reposy-` + userName
+}
+
+// Named pipes have no file system location, keep the pid file in the temp dir
+func pidFilePath() string {
+	return filepath.Join(os.TempDir(), filepath.Base(socketPath)+".pid")
+}
+
+// %LOCALAPPDATA%\reposy
+func stateDir() (string, error) {
+	dataDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataDir, "reposy"+instanceSuffix()), nil
+}
+
+// %LOCALAPPDATA%\reposy, shared with the state
+func dataDir() (string, error) {
+	return stateDir()
+}
+
+func processAlive(pid int) bool {
+	// FindProcess opens a handle to the process on Windows and fails if it is gone
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
+
+var procQueryFullProcessImageNameW = kernel32.NewProc("QueryFullProcessImageNameW")
+
+const processQueryLimitedInformation = 0x1000
+
+// Whether a process runs the reposy executable, by its name, so that a pid
+// reused since the sync service died isn't taken for it. Assumed when it
+// can't be told.
+func processIsReposy(pid int) bool {
+	self, err := os.Executable()
+	if err != nil {
+		return true
+	}
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(handle)
+	buf := make([]uint16, syscall.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	ok, _, _ := procQueryFullProcessImageNameW.Call(uintptr(handle), 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+	if ok == 0 {
+		return true
+	}
+	return strings.EqualFold(filepath.Base(syscall.UTF16ToString(buf[:size])), filepath.Base(self))
+}
+
+func listenIPC() (net.Listener, error) {
+	return winio.ListenPipe(socketPath, &winio.PipeConfig{
+		SecurityDescriptor: pipeSecurityDescriptor,
+	})
+}
+
+func dialIPC() (net.Conn, error) {
+	return winio.DialPipe(socketPath, nil)
+}
+
+func removeSocketFile() {}
+
+// Named pipes are only shared through their security descriptor
+func shareSocket() error {
+	return nil
+}
+
+// Named pipes disappear together with the process that created them
+func removeStaleSocket() (bool, error) {
+	return false, nil
+}
+
+// Run the daemon without a console window, outside of the caller's process group
+func daemonSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		CreationFlags: createNewProcessGroup | detachedProcess,
+		HideWindow:    true,
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// macOS Keychain, through the security command line tool
+func keychainGet(name string) (string, error) {
+	output, err := exec.Command("security", "find-generic-password", "-s", keychainService, "-a", name, "-w").Output()
+	if err != nil {
+		return "", commandError(err)
+	}
+	return strings.TrimRight(string(output), "\n"), nil
+}
+
+func keychainSet(name, secret string) error {
+	// -U updates the item if it already exists. -w last, without a value,
+	// prompts for the secret and its confirmation, read from stdin so that it
+	// doesn't show in the process list
+	cmd := exec.Command("security", "add-generic-password", "-U", "-s", keychainService, "-a", name, "-w")
+	cmd.Stdin = strings.NewReader(secret + "\n" + secret + "\n")
+	_, err := cmd.Output()
+	return commandError(err)
+}
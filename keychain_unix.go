@@ -0,0 +1,25 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// Secret Service (GNOME Keyring, KWallet), through libsecret's secret-tool
+func keychainGet(name string) (string, error) {
+	output, err := exec.Command("secret-tool", "lookup", "service", keychainService, "account", name).Output()
+	if err != nil {
+		return "", commandError(err)
+	}
+	return strings.TrimRight(string(output), "\n"), nil
+}
+
+func keychainSet(name, secret string) error {
+	// secret-tool reads the secret from stdin, keeping it off the command line
+	cmd := exec.Command("secret-tool", "store", "--label", keychainService+": "+name, "service", keychainService, "account", name)
+	cmd.Stdin = strings.NewReader(secret)
+	_, err := cmd.Output()
+	return commandError(err)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	advapi32      = syscall.NewLazyDLL("advapi32.dll")
+	procCredRead  = advapi32.NewProc("CredReadW")
+	procCredWrite = advapi32.NewProc("CredWriteW")
+	procCredFree  = advapi32.NewProc("CredFree")
+)
+
+const (
+	credTypeGeneric         = 1
+	credPersistLocalMachine = 2
+)
+
+// https://learn.microsoft.com/en-us/windows/win32/api/wincred/ns-wincred-credentialw
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// Windows Credential Manager, credentials are stored as "reposy:<name>"
+func keychainGet(name string) (string, error) {
+	target, err := syscall.UTF16PtrFromString(credentialTarget(name))
+	if err != nil {
+		return "", err
+	}
+	var cred *credential
+	ret, _, err := procCredRead.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if ret == 0 {
+		return "", err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	blob := unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)
+	return string(blob), nil
+}
+
+func keychainSet(name, secret string) error {
+	target, err := syscall.UTF16PtrFromString(credentialTarget(name))
+	if err != nil {
+		return err
+	}
+	userName, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	blob := []byte(secret)
+	cred := credential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(blob)),
+		Persist:            credPersistLocalMachine,
+		UserName:           userName,
+	}
+	if len(blob) > 0 {
+		cred.CredentialBlob = &blob[0]
+	}
+	ret, _, err := procCredWrite.Call(uintptr(unsafe.Pointer(&cred)), 0)
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
+func credentialTarget(name string) string {
+	return keychainService + ":" + name
+}
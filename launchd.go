@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// With ".<instance>" appended for named instances
+var launchdLabel = "com.github.likang.reposy"
+
+// KeepAlive only restarts the daemon when it exits abnormally, so that
+// `reposy stop` keeps it stopped until the next login
+const launchdPlistTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`
+
+func launchdPlistPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, "Library", "LaunchAgents", launchdLabel+".plist"), nil
+}
+
+func installLaunchdService() error {
+	execPath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+	plistPath, err := launchdPlistPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(plistPath), 0755); err != nil {
+		return fmt.Errorf("failed to create LaunchAgents directory: %w", err)
+	}
+	args, err := daemonArgs()
+	if err != nil {
+		return err
+	}
+	programArguments := ""
+	for _, arg := range append([]string{execPath}, args...) {
+		programArguments += "\t\t<string>" + html.EscapeString(arg) + "</string>\n"
+	}
+	plist := fmt.Sprintf(launchdPlistTemplate,
+		launchdLabel,
+		programArguments,
+		html.EscapeString(logPath),
+		html.EscapeString(logPath))
+	if err := os.WriteFile(plistPath, []byte(plist), 0644); err != nil {
+		return fmt.Errorf("failed to write plist file: %w", err)
+	}
+	fmt.Printf("Wrote %s\n", plistPath)
+
+	// reload if it was installed before
+	launchctl("bootout", launchdDomain(), plistPath)
+	return launchctl("bootstrap", launchdDomain(), plistPath)
+}
+
+func uninstallLaunchdService() error {
+	plistPath, err := launchdPlistPath()
+	if err != nil {
+		return err
+	}
+	if err := launchctl("bootout", launchdDomain(), plistPath); err != nil {
+		return err
+	}
+	if err := os.Remove(plistPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove plist file: %w", err)
+	}
+	fmt.Printf("Removed %s\n", plistPath)
+	return nil
+}
+
+func launchdDomain() string {
+	return "gui/" + strconv.Itoa(os.Getuid())
+}
+
+func launchctl(args ...string) error {
+	cmd := exec.Command("launchctl", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl %v failed: %w: %s", args, err, output)
+	}
+	return nil
+}
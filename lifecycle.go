@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Lifecycle rules written by 'reposy lifecycle apply' have IDs starting with
+// this, followed by the prefix of their repository. Rules with other IDs are
+// left as they are.
+const lifecycleRulePrefix = "reposy:"
+
+const (
+	defaultNoncurrentDays     = 90
+	defaultAbortMultipartDays = 7
+)
+
+// What the lifecycle rule of a repository does, a part being left out when 0
+type LifecycleRules struct {
+	// Days after which the versions of files replaced or deleted are expired,
+	// in buckets with versioning
+	NoncurrentDays int `json:"noncurrent_days"`
+	// Days after which incomplete multipart uploads are aborted
+	AbortMultipartDays int `json:"abort_multipart_days"`
+}
+
+type LifecycleArgs struct {
+	// All repositories when empty
+	Repository string         `json:"repository,omitempty"`
+	Rules      LifecycleRules `json:"rules"`
+	DryRun     bool           `json:"dry_run,omitempty"`
+}
+
+type LifecyclePayload struct {
+	// Rule applied by repository path, as the XML sent
+	Rules  map[string]string `json:"rules"`
+	DryRun bool              `json:"dry_run,omitempty"`
+}
+
+type lifecycleRule struct {
+	XMLName xml.Name `xml:"Rule"`
+	ID      string   `xml:"ID"`
+	Prefix  string   `xml:"Filter>Prefix"`
+	Status  string   `xml:"Status"`
+	Abort   *struct {
+		Days int `xml:"DaysAfterInitiation"`
+	} `xml:"AbortIncompleteMultipartUpload,omitempty"`
+	Noncurrent *struct {
+		Days int `xml:"NoncurrentDays"`
+	} `xml:"NoncurrentVersionExpiration,omitempty"`
+}
+
+// Rules as stored in the bucket, kept as they are
+type storedLifecycle struct {
+	Rules []struct {
+		ID    string `xml:"ID"`
+		Inner string `xml:",innerxml"`
+	} `xml:"Rule"`
+}
+
+func (rules LifecycleRules) rule(prefix string) *lifecycleRule {
+	if rules.AbortMultipartDays == 0 && rules.NoncurrentDays == 0 {
+		return nil
+	}
+	// Ends with a slash, so that the rule doesn't reach the keys of another
+	// prefix starting the same, except for the whole bucket
+	prefix = strings.TrimPrefix(strings.TrimSuffix(prefix, "/")+"/", "/")
+	rule := &lifecycleRule{ID: lifecycleRulePrefix + prefix, Prefix: prefix, Status: "Enabled"}
+	if rules.AbortMultipartDays > 0 {
+		rule.Abort = &struct {
+			Days int `xml:"DaysAfterInitiation"`
+		}{rules.AbortMultipartDays}
+	}
+	if rules.NoncurrentDays > 0 {
+		rule.Noncurrent = &struct {
+			Days int `xml:"NoncurrentDays"`
+		}{rules.NoncurrentDays}
+	}
+	return rule
+}
+
+// ApplyLifecycle replaces the lifecycle rule of the prefix in the bucket's
+// lifecycle configuration, removing it when rules is empty, and returns the
+// rule. With dryRun, the bucket isn't changed.
+func (s3 *S3Client) ApplyLifecycle(rules LifecycleRules, dryRun bool) (string, error) {
+	var ruleXML []byte
+	if rule := rules.rule(s3.Prefix); rule != nil {
+		var err error
+		if ruleXML, err = xml.Marshal(rule); err != nil {
+			return "", err
+		}
+	}
+	if dryRun {
+		return string(ruleXML), nil
+	}
+
+	resp, err := s3.request("GET", "", nil, nil, map[string]string{"lifecycle": ""})
+	if err != nil {
+		return "", err
+	}
+	var stored storedLifecycle
+	switch resp.StatusCode {
+	case 200:
+		if err := xml.Unmarshal(resp.Body, &stored); err != nil {
+			return "", fmt.Errorf("failed to parse lifecycle configuration of %s: %w", s3.Bucket, err)
+		}
+	case 404:
+		// NoSuchLifecycleConfiguration
+	default:
+		return "", fmt.Errorf("failed to get lifecycle configuration of %s: %s", s3.Bucket, resp.Body)
+	}
+
+	var body bytes.Buffer
+	body.WriteString(`<LifecycleConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`)
+	kept := 0
+	for _, rule := range stored.Rules {
+		if rule.ID == lifecycleRulePrefix+s3.Prefix {
+			continue
+		}
+		body.WriteString("<Rule>" + rule.Inner + "</Rule>")
+		kept++
+	}
+	body.Write(ruleXML)
+	body.WriteString("</LifecycleConfiguration>")
+
+	if kept == 0 && ruleXML == nil {
+		if len(stored.Rules) == 0 {
+			return "", nil
+		}
+		resp, err = s3.request("DELETE", "", nil, nil, map[string]string{"lifecycle": ""})
+		if err == nil && resp.StatusCode != 204 {
+			err = fmt.Errorf("failed to remove lifecycle configuration of %s: %s", s3.Bucket, resp.Body)
+		}
+		return "", err
+	}
+	sum := md5.Sum(body.Bytes())
+	headers := map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(sum[:])}
+	resp, err = s3.request("PUT", "", body.Bytes(), headers, map[string]string{"lifecycle": ""})
+	if err == nil && resp.StatusCode != 200 {
+		err = fmt.Errorf("failed to put lifecycle configuration of %s: %s", s3.Bucket, resp.Body)
+	}
+	return string(ruleXML), err
+}
+
+// ApplyLifecycle writes the lifecycle rule of the repository's prefix
+func (repo *Repository) ApplyLifecycle(rules LifecycleRules, dryRun bool) (string, error) {
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+
+	applier, ok := repo.Client.(interface {
+		ApplyLifecycle(LifecycleRules, bool) (string, error)
+	})
+	if !ok {
+		return "", fmt.Errorf("the remote of %s has no lifecycle rules", repo.Path)
+	}
+	rule, err := applier.ApplyLifecycle(rules, dryRun)
+	if err == nil && !dryRun {
+		repo.logger.Info("Applied lifecycle rule", "rule", rule)
+	}
+	return rule, err
+}
+
+func newLifecycleCmd() *cobra.Command {
+	lifecycleCmd := &cobra.Command{
+		Use:   "lifecycle",
+		Short: "Manage S3 lifecycle rules of repository prefixes",
+	}
+
+	var rules LifecycleRules
+	var dryRun bool
+	applyCmd := &cobra.Command{
+		Use:   "apply [repo]",
+		Short: "Write a lifecycle rule for the prefix of each repository, or of one",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if rules.NoncurrentDays < 0 || rules.AbortMultipartDays < 0 {
+				fmt.Println("--noncurrent-days and --abort-multipart-days can't be negative")
+				os.Exit(ExitUsage)
+			}
+			requireDaemon()
+			lifecycleArgs := LifecycleArgs{Rules: rules, DryRun: dryRun}
+			if len(args) > 0 {
+				repoPath, err := filepath.Abs(args[0])
+				if err != nil {
+					fmt.Printf("Invalid repository path: %v\n", err)
+					os.Exit(ExitUsage)
+				}
+				lifecycleArgs.Repository = repoPath
+			}
+			encodedArgs, _ := json.Marshal(lifecycleArgs)
+			printResponse(sendCommand("lifecycle-apply", string(encodedArgs)), ExitFailure)
+		},
+	}
+	applyCmd.Flags().IntVar(&rules.NoncurrentDays, "noncurrent-days", defaultNoncurrentDays, "Expire replaced and deleted versions after this many days in versioned buckets, 0 to keep them")
+	applyCmd.Flags().IntVar(&rules.AbortMultipartDays, "abort-multipart-days", defaultAbortMultipartDays, "Abort incomplete multipart uploads after this many days, 0 to keep them")
+	applyCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only print the rules that would be written")
+
+	lifecycleCmd.AddCommand(applyCmd)
+	return lifecycleCmd
+}
+
+// One line per repository with the rule written for it
+func formatLifecycle(rules map[string]string) string {
+	var sb strings.Builder
+	for _, repoPath := range sortedKeys(rules) {
+		rule := rules[repoPath]
+		if rule == "" {
+			rule = "no rule"
+		}
+		sb.WriteString(fmt.Sprintf("%s: %s\n", repoPath, rule))
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// localListing holds the files of a repository by slash path. Once it grows
+// past indexShardSize files it spills them to one file per bucket in a
+// temporary directory, and reads back a shard at a time.
+type localListing struct {
+	items map[string]*FileItem
+	count int
+
+	// Set once the listing is spilled to disk
+	dir     string
+	files   []*os.File
+	writers []*bufio.Writer
+}
+
+type listingEntry struct {
+	Path      string `json:"p"`
+	FilePath  string `json:"f"`
+	ModTime   int64  `json:"m"`
+	Tombstone bool   `json:"t,omitempty"`
+}
+
+func newLocalListing() *localListing {
+	return &localListing{items: make(map[string]*FileItem)}
+}
+
+// Len returns the number of files added
+func (l *localListing) Len() int {
+	if l == nil {
+		return 0
+	}
+	return l.count
+}
+
+// Add adds a file, replacing any earlier entry of the same path
+func (l *localListing) Add(slashPath string, item *FileItem) error {
+	l.count++
+	if l.dir == "" {
+		l.items[slashPath] = item
+		if len(l.items) <= indexShardSize {
+			return nil
+		}
+		return l.spill()
+	}
+	return l.write(slashPath, item)
+}
+
+func (l *localListing) spill() error {
+	dir, err := os.MkdirTemp("", "reposy-listing-")
+	if err != nil {
+		return fmt.Errorf("failed to create listing directory: %w", err)
+	}
+	l.dir = dir
+	l.files = make([]*os.File, maxIndexShards)
+	l.writers = make([]*bufio.Writer, maxIndexShards)
+	for bucket := range l.files {
+		file, err := os.Create(filepath.Join(dir, fmt.Sprint(bucket)))
+		if err != nil {
+			return fmt.Errorf("failed to create listing file: %w", err)
+		}
+		l.files[bucket] = file
+		l.writers[bucket] = bufio.NewWriter(file)
+	}
+
+	items := l.items
+	l.items = nil
+	for slashPath, item := range items {
+		if err := l.write(slashPath, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *localListing) write(slashPath string, item *FileItem) error {
+	line, err := json.Marshal(listingEntry{
+		Path:      slashPath,
+		FilePath:  item.FilePath,
+		ModTime:   item.ModTime,
+		Tombstone: item.Tombstone,
+	})
+	if err != nil {
+		return err
+	}
+	writer := l.writers[indexBucket(slashPath)]
+	if _, err := writer.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write listing file: %w", err)
+	}
+	return nil
+}
+
+// Shard returns the files that fall in a shard of the index
+func (l *localListing) Shard(shard, shards int) (map[string]*FileItem, error) {
+	result := make(map[string]*FileItem)
+	if l == nil {
+		return result, nil
+	}
+	if l.dir == "" {
+		for slashPath, item := range l.items {
+			if indexShard(slashPath, shards) == shard {
+				result[slashPath] = item
+			}
+		}
+		return result, nil
+	}
+
+	for bucket := shard; bucket < maxIndexShards; bucket += shards {
+		if err := l.writers[bucket].Flush(); err != nil {
+			return nil, fmt.Errorf("failed to write listing file: %w", err)
+		}
+		file, err := os.Open(l.files[bucket].Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read listing file: %w", err)
+		}
+		decoder := json.NewDecoder(bufio.NewReader(file))
+		for decoder.More() {
+			var entry listingEntry
+			if err := decoder.Decode(&entry); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("failed to read listing file: %w", err)
+			}
+			result[entry.Path] = &FileItem{
+				FilePath:  entry.FilePath,
+				ModTime:   entry.ModTime,
+				Tombstone: entry.Tombstone,
+			}
+		}
+		file.Close()
+	}
+	return result, nil
+}
+
+// Close removes the files the listing spilled to
+func (l *localListing) Close() {
+	if l == nil || l.dir == "" {
+		return
+	}
+	for _, file := range l.files {
+		if file != nil {
+			file.Close()
+		}
+	}
+	os.RemoveAll(l.dir)
+}
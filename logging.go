@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Configures the default slog logger used by the sync service.
+// format is "text" or "json", level is one of "debug", "info", "warn", "error".
+func setupLogger(format string, level string) error {
+	var logLevel slog.Level
+	if level == "" {
+		level = "info"
+	}
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level: %s", level)
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Logs an error and exits, the slog counterpart of log.Fatalf
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
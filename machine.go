@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Every index entry written by this version records the machine that wrote
+// it, so that `reposy which` tells where a file was last changed, and the
+// status warns when another machine has changes this one hasn't got. A
+// machine is known by a random ID kept in the data directory, which outlives
+// host name changes, and by its host name, which people can read.
+type Machine struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+const machineIDFile = "machine-id"
+
+var thisMachine = sync.OnceValue(func() Machine {
+	name, err := os.Hostname()
+	if err != nil {
+		name = "unknown"
+	}
+	return Machine{ID: loadMachineID(), Name: name}
+})
+
+// Reads the ID of this machine, creating it the first time. An ID that can't
+// be kept lasts until the process exits.
+func loadMachineID() string {
+	var idPath string
+	if dir, err := dataDir(); err == nil {
+		idPath = filepath.Join(dir, machineIDFile)
+		if data, err := os.ReadFile(idPath); err == nil {
+			if id := strings.TrimSpace(string(data)); id != "" {
+				return id
+			}
+		}
+	}
+
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+	if idPath == "" {
+		return id
+	}
+	if err := os.MkdirAll(filepath.Dir(idPath), 0o700); err == nil {
+		err = writeFileAtomic(idPath, []byte(id+"\n"))
+		if err != nil {
+			slog.Warn("Failed to save machine ID", "error", err)
+		}
+	}
+	return id
+}
+
+// Whether an entry was written by another machine, as far as it is known
+func (item *RemoteItem) otherMachine() bool {
+	return item.MachineID != "" && item.MachineID != thisMachine().ID
+}
+
+// Files the remote has newer from other machines than the local copies, as
+// of the last sync
+type BehindStatus struct {
+	Files int `json:"files"`
+	// The machine that changed the most recent of them, and when
+	Machine    string `json:"machine,omitempty"`
+	ModifiedAt int64  `json:"modified_at,omitempty"`
+}
+
+// Counts the remote files of a shard that were changed on another machine
+// and are still newer than the local ones after syncing it
+func (repo *Repository) countBehind(behind *BehindStatus, localItems map[string]*FileItem, remoteItems map[string]*RemoteItem) {
+	if repo.Direction == DirectionMirror {
+		return
+	}
+	for slashPath, remoteItem := range remoteItems {
+		if remoteItem.Tombstone || !remoteItem.otherMachine() || !repo.syncsRemotePath(slashPath) {
+			continue
+		}
+		if _, pending := repo.pendingLinks[slashPath]; pending {
+			continue
+		}
+		localItem, found := localItems[slashPath]
+		if found && !localItem.Tombstone && compareModTime(remoteItem.ModTime, localItem.ModTime) <= 0 {
+			continue
+		}
+		behind.Files++
+		if compareModTime(remoteItem.ModTime, behind.ModifiedAt) > 0 {
+			behind.Machine = remoteItem.MachineName
+			behind.ModifiedAt = remoteItem.ModTime
+		}
+	}
+}
+
+type WhichArgs struct {
+	Repository string `json:"repository"`
+	File       string `json:"file"`
+}
+
+// WhichPayload is where a file was last changed, as `reposy which` reports it
+type WhichPayload struct {
+	File string `json:"file"`
+	// The machine that last changed the file on the remote, empty when the
+	// entry predates machine IDs
+	Machine    *Machine  `json:"machine,omitempty"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Deleted    bool      `json:"deleted,omitempty"`
+	// Whether the change was made here
+	ThisMachine bool `json:"this_machine"`
+	// Mod time of the local copy, nil when there is none
+	LocalModifiedAt *time.Time `json:"local_modified_at,omitempty"`
+	// Whether the local copy is older than the remote one
+	Behind bool `json:"behind"`
+}
+
+// Which looks up the machine that last changed a file of the repository,
+// from its remote index entry
+func (repo *Repository) Which(file string) (*WhichPayload, error) {
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+
+	slashPath := strings.TrimPrefix(path.Clean(filepath.ToSlash(file)), "/")
+	if slashPath == "." || slashPath == ".." || strings.HasPrefix(slashPath, "../") {
+		return nil, fmt.Errorf("%s is not a file of %s", file, repo.Path)
+	}
+	index, err := repo.Client.Index()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get remote files: %w", err)
+	}
+	remoteItems, err := repo.Client.List(index, indexShard(slashPath, index.Shards), index.Shards)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get remote files: %w", err)
+	}
+	remoteItem, found := remoteItems[slashPath]
+	if !found {
+		return nil, fmt.Errorf("%s is not on the remote", slashPath)
+	}
+
+	which := &WhichPayload{
+		File:        slashPath,
+		ModifiedAt:  modTimeToTime(remoteItem.ModTime),
+		Deleted:     remoteItem.Tombstone,
+		ThisMachine: remoteItem.MachineID == thisMachine().ID,
+	}
+	if remoteItem.MachineID != "" {
+		which.Machine = &Machine{ID: remoteItem.MachineID, Name: remoteItem.MachineName}
+	}
+	if info, err := os.Stat(repo.localPath(slashPath)); err == nil && !info.IsDir() {
+		localModTime := modTimeOf(info)
+		modifiedAt := modTimeToTime(localModTime)
+		which.LocalModifiedAt = &modifiedAt
+		which.Behind = !remoteItem.Tombstone && compareModTime(remoteItem.ModTime, localModTime) > 0
+	} else {
+		which.Behind = !remoteItem.Tombstone
+	}
+	return which, nil
+}
+
+func formatWhich(which *WhichPayload) string {
+	var sb strings.Builder
+	machine := "an unknown machine, before machine IDs were recorded"
+	if which.Machine != nil {
+		machine = fmt.Sprintf("%s (%s)", which.Machine.Name, which.Machine.ID)
+		if which.ThisMachine {
+			machine += ", this machine"
+		}
+	}
+	change := "Modified"
+	if which.Deleted {
+		change = "Deleted"
+	}
+	sb.WriteString(fmt.Sprintf("%s: %s by %s at %s\n", which.File, change, machine, which.ModifiedAt.Local().Format(time.RFC3339)))
+	switch {
+	case which.LocalModifiedAt == nil && which.Deleted:
+		sb.WriteString("Local copy: none\n")
+	case which.LocalModifiedAt == nil:
+		sb.WriteString("Local copy: none, behind the remote\n")
+	case which.Behind:
+		sb.WriteString(fmt.Sprintf("Local copy: modified at %s, behind the remote\n", which.LocalModifiedAt.Local().Format(time.RFC3339)))
+	default:
+		sb.WriteString(fmt.Sprintf("Local copy: modified at %s\n", which.LocalModifiedAt.Local().Format(time.RFC3339)))
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+func newWhichCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "which <repo> <file>",
+		Short: "Show which machine last changed a file, and whether the local copy is behind",
+		Long: `Show which machine last changed a file of a repository and when, from its
+remote index entry. <file> is relative to the repository, or an absolute
+path inside it.`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			repoPath, err := filepath.Abs(args[0])
+			if err != nil {
+				fmt.Printf("Invalid repository path: %v\n", err)
+				os.Exit(ExitUsage)
+			}
+			file := args[1]
+			if filepath.IsAbs(file) {
+				if file, err = filepath.Rel(repoPath, file); err != nil {
+					fmt.Printf("Invalid file path: %v\n", err)
+					os.Exit(ExitUsage)
+				}
+			}
+			requireDaemon()
+			encodedArgs, _ := json.Marshal(WhichArgs{Repository: repoPath, File: file})
+			printResponse(sendCommand("which", string(encodedArgs)), ExitFailure)
+		},
+	}
+}
@@ -1,32 +1,66 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/exec"
-	"syscall"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/spf13/cobra"
 )
 
-const (
-	socketPath = "/tmp/reposy.sock"
-)
+var socketPath = defaultSocketPath()
+
+// Logs every S3 request, set by the --debug-http flag of the sync service
+var debugHTTP bool
+
+// How long to wait for the sync service to answer a liveness probe
+const pingTimeout = 2 * time.Second
 
 type Message struct {
 	Command string `json:"command"`
 	Args    string `json:"args,omitempty"`
+	// socket.token of the sync service, when it requires one
+	Token string `json:"token,omitempty"`
+}
+
+type RestoreArgs struct {
+	Repository string `json:"repository"`
+	Pattern    string `json:"pattern"`
+}
+
+type PurgeArgs struct {
+	Repository string `json:"repository"`
+	Pattern    string `json:"pattern,omitempty"`
+	DryRun     bool   `json:"dry_run,omitempty"`
+}
+
+type HistoryArgs struct {
+	Repository string `json:"repository,omitempty"`
+	File       string `json:"file,omitempty"`
+	// Number of most recent runs to return, all when zero
+	Limit int `json:"limit,omitempty"`
 }
 
 type Response struct {
-	Status  string `json:"status"`
+	Status string `json:"status"`
+	// Why a request failed, one of the ErrCode constants, for scripts to
+	// branch on
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 	Data    string `json:"data,omitempty"`
+
+	// Typed, command specific payload, see ipc_protocol.go
+	Payload json.RawMessage `json:"payload,omitempty"`
 }
 
 func main() {
@@ -35,33 +69,72 @@ func main() {
 		Short: "Reposy syncs local repository folders with S3",
 		Long:  `Reposy is a CLI tool that syncs local repository folders with S3 buckets based on configuration.`,
 	}
+	rootCmd.PersistentFlags().StringVar(&socketPath, "socket", socketPath, "Path of the sync service socket")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Path of the config file (default ~/.config/reposy.json)")
+	rootCmd.PersistentFlags().StringVar(&configProfile, "profile", "", "Config profile to start with, or to switch to on reload")
+	rootCmd.PersistentFlags().StringVar(&instanceName, "instance", os.Getenv("REPOSY_INSTANCE"), "Name of the sync service instance, with its own config, socket and state (default $REPOSY_INSTANCE)")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		return applyInstance(cmd)
+	}
 
+	var watchStatus, statusJSON bool
 	statusCmd := &cobra.Command{
 		Use:   "status",
 		Short: "Show sync status of repositories",
 		Run: func(cmd *cobra.Command, args []string) {
-			if !isDaemonRunning() {
-				fmt.Println("Reposy sync service is not running. Please run 'reposy start' first")
+			requireDaemon()
+			if watchStatus {
+				if err := watchStatusTable(); err != nil {
+					log.Fatalf("Status stream ended: %v", err)
+				}
 				return
 			}
 			resp := sendCommand("status", "")
-			fmt.Println(resp.Message)
-			if resp.Data != "" {
-				fmt.Println(resp.Data)
+			var status StatusPayload
+			if decodePayload(resp, &status) {
+				if statusJSON {
+					encoder := json.NewEncoder(os.Stdout)
+					encoder.SetIndent("", "  ")
+					encoder.SetEscapeHTML(false)
+					encoder.Encode(status)
+					os.Exit(statusExitCode(status))
+				}
+				fmt.Println(resp.Message)
+				fmt.Println(formatStatus(status))
+				os.Exit(statusExitCode(status))
 			}
+			// sync services before protocol version 3 only send text
+			printResponse(resp, ExitFailure)
 		},
 	}
+	statusCmd.Flags().BoolVarP(&watchStatus, "watch", "w", false, "Keep redrawing a live view of sync progress until interrupted")
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Print the status as JSON, including files waiting to be retried")
 
 	restartCmd := &cobra.Command{
-		Use:   "restart",
-		Short: "Restart the sync service",
+		Use:     "restart",
+		Aliases: []string{"reload"},
+		Short:   "Restart the sync service, reloading the configuration",
 		Run: func(cmd *cobra.Command, args []string) {
-			if !isDaemonRunning() {
-				fmt.Println("Reposy sync service is not running. Please run 'reposy start' first")
+			requireDaemon()
+			if configProfile != "" {
+				printResponse(sendCommand("profile", configProfile), ExitConfigError)
 				return
 			}
-			resp := sendCommand("restart", "")
-			fmt.Println(resp.Message)
+			printResponse(sendCommand("restart", ""), ExitConfigError)
+		},
+	}
+
+	profileCmd := &cobra.Command{
+		Use:   "profile [name]",
+		Short: "Show the active config profile, or switch to another one",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			name := ""
+			if len(args) > 0 {
+				name = args[0]
+			}
+			printResponse(sendCommand("profile", name), ExitConfigError)
 		},
 	}
 
@@ -69,35 +142,501 @@ func main() {
 		Use:   "start",
 		Short: "Start the sync service if not running",
 		Run: func(cmd *cobra.Command, args []string) {
-			if isDaemonRunning() {
-				fmt.Println("Reposy sync service is already running")
+			startService()
+		},
+	}
+	startCmd.Flags().BoolVar(&debugHTTP, "debug-http", false, "Log every S3 request with its status, latency and request IDs")
+
+	var foreground bool
+	daemonCmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "Run the sync service",
+		Long: `Run the sync service. With --foreground the service runs attached to the
+terminal and logs to stderr, which is what service managers and debugging need.
+Without it, the service is detached into the background like 'reposy start'.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if foreground {
+				runDaemon()
+				return
+			}
+			startService()
+		},
+	}
+	daemonCmd.Flags().BoolVar(&foreground, "foreground", false, "Run in the foreground instead of detaching")
+	daemonCmd.Flags().BoolVar(&debugHTTP, "debug-http", false, "Log every S3 request with its status, latency and request IDs")
+
+	pauseCmd := &cobra.Command{
+		Use:   "pause",
+		Short: "Pause syncing until resumed",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			printResponse(sendCommand("pause", ""), ExitFailure)
+		},
+	}
+
+	resumeCmd := &cobra.Command{
+		Use:   "resume",
+		Short: "Resume syncing after a pause",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			printResponse(sendCommand("resume", ""), ExitFailure)
+		},
+	}
+
+	skipCmd := &cobra.Command{
+		Use:   "skip <repo>",
+		Short: "Stop syncing a repository until unskipped, keeping it in the status",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			repoPath, err := filepath.Abs(args[0])
+			if err != nil {
+				fmt.Printf("Invalid repository path: %v\n", err)
+				os.Exit(ExitUsage)
+			}
+			requireDaemon()
+			printResponse(sendCommand("skip", repoPath), ExitFailure)
+		},
+	}
+
+	unskipCmd := &cobra.Command{
+		Use:   "unskip <repo>",
+		Short: "Sync a repository skipped by 'reposy skip' or its config again",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			repoPath, err := filepath.Abs(args[0])
+			if err != nil {
+				fmt.Printf("Invalid repository path: %v\n", err)
+				os.Exit(ExitUsage)
+			}
+			requireDaemon()
+			printResponse(sendCommand("unskip", repoPath), ExitFailure)
+		},
+	}
+
+	healthCmd := &cobra.Command{
+		Use:   "health",
+		Short: "Check that all repositories sync, exiting non-zero otherwise",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			printResponse(sendCommand("health", ""), ExitSyncError)
+		},
+	}
+
+	planCmd := &cobra.Command{
+		Use:   "plan <repo>",
+		Short: "Show what the next sync of a repository would do, without changing anything",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			repoPath, err := filepath.Abs(args[0])
+			if err != nil {
+				fmt.Printf("Invalid repository path: %v\n", err)
+				os.Exit(ExitUsage)
+			}
+			resp := sendCommand("plan", repoPath)
+			var plan SyncPlan
+			if decodePayload(resp, &plan) {
+				fmt.Println(resp.Message)
+				fmt.Println(formatPlan(&plan))
 				return
 			}
-			startDaemon()
-			fmt.Println("Reposy sync service started")
+			printResponse(resp, ExitSyncError)
 		},
 	}
 
+	eventsCmd := &cobra.Command{
+		Use:   "events",
+		Short: "Stream sync progress events until interrupted",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			client, err := dialDaemon()
+			if err != nil {
+				log.Fatalf("Failed to connect to sync service: %v", err)
+			}
+			defer client.Close()
+			err = client.Stream("events", "", func(frame ResponseFrame) bool {
+				event := frame.Event
+				fmt.Printf("%s %-16s %s %s\n", event.Time.Format(time.RFC3339), event.Type, event.Repository, event.File)
+				return true
+			})
+			if err != nil {
+				log.Fatalf("Event stream ended: %v", err)
+			}
+		},
+	}
+
+	var historyFile string
+	var historyLimit int
+	historyCmd := &cobra.Command{
+		Use:   "history [repo]",
+		Short: "Show past sync runs, optionally of one repository or touching one file",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			historyArgs := HistoryArgs{File: historyFile, Limit: historyLimit}
+			if len(args) > 0 {
+				repoPath, err := filepath.Abs(args[0])
+				if err != nil {
+					fmt.Printf("Invalid repository path: %v\n", err)
+					os.Exit(ExitUsage)
+				}
+				historyArgs.Repository = repoPath
+			}
+			encodedArgs, _ := json.Marshal(historyArgs)
+			resp := sendCommand("history", string(encodedArgs))
+			var history HistoryPayload
+			if decodePayload(resp, &history) {
+				fmt.Println(formatHistory(history.Runs, historyFile))
+				return
+			}
+			printResponse(resp, ExitFailure)
+		},
+	}
+	historyCmd.Flags().StringVar(&historyFile, "file", "", "Only show runs that uploaded, downloaded or deleted this file (slash path relative to the repository)")
+	historyCmd.Flags().IntVarP(&historyLimit, "limit", "n", 20, "Number of most recent runs to show, 0 for all")
+
+	var statsJSON bool
+	statsCmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show bytes stored per remote, their growth, the largest files and churn per repository",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			resp := sendCommand("stats", "")
+			var stats StatsPayload
+			if decodePayload(resp, &stats) {
+				if statsJSON {
+					encoder := json.NewEncoder(os.Stdout)
+					encoder.SetIndent("", "  ")
+					encoder.SetEscapeHTML(false)
+					encoder.Encode(stats)
+				} else {
+					printStats(stats)
+				}
+				return
+			}
+			printResponse(resp, ExitFailure)
+		},
+	}
+	statsCmd.Flags().BoolVar(&statsJSON, "json", false, "Print the statistics as JSON")
+
+	var reportSince, reportFormat string
+	reportCmd := &cobra.Command{
+		Use:   "report [repo]",
+		Short: "Print the transfers and errors of a period as JSON or CSV",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if reportFormat != ReportJSON && reportFormat != ReportCSV {
+				fmt.Printf("Invalid report format %s, use %s or %s\n", reportFormat, ReportJSON, ReportCSV)
+				os.Exit(ExitUsage)
+			}
+			since, err := parseSince(reportSince, time.Now())
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(ExitUsage)
+			}
+			reportArgs := ReportArgs{Since: since}
+			if len(args) > 0 {
+				repoPath, err := filepath.Abs(args[0])
+				if err != nil {
+					fmt.Printf("Invalid repository path: %v\n", err)
+					os.Exit(ExitUsage)
+				}
+				reportArgs.Repository = repoPath
+			}
+			report, err := LocalReport(reportArgs)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(ExitFailure)
+			}
+			if err := writeReport(os.Stdout, report, reportFormat); err != nil {
+				log.Fatalf("Failed to write report: %v", err)
+			}
+		},
+	}
+	reportCmd.Flags().StringVar(&reportSince, "since", "7d", "Start of the period, a duration back from now like 7d, 2w or 12h, or a date")
+	reportCmd.Flags().StringVar(&reportFormat, "format", ReportJSON, "Report format, json or csv")
+
+	tuiCmd := &cobra.Command{
+		Use:   "tui",
+		Short: "Full-screen dashboard of repositories, sync progress and recent errors",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			if err := runDashboard(); err != nil {
+				fmt.Println(err)
+				os.Exit(ExitFailure)
+			}
+		},
+	}
+
+	var forceStop bool
 	stopCmd := &cobra.Command{
 		Use:   "stop",
 		Short: "Stop the sync service if running",
 		Run: func(cmd *cobra.Command, args []string) {
-			if !isDaemonRunning() {
+			if isDaemonRunning() {
+				printResponse(sendCommand("shutdown", ""), ExitFailure)
+				return
+			}
+			pid, alive := daemonPid()
+			if !alive {
 				fmt.Println("Reposy sync service is not running")
+				os.Exit(ExitDaemonNotRunning)
+			}
+			if !forceStop {
+				fmt.Printf("Reposy sync service (pid %d) is not responding. Use 'reposy stop --force' to kill it\n", pid)
+				os.Exit(ExitDaemonNotRunning)
+			}
+			if err := killDaemon(pid); err != nil {
+				log.Fatalf("Failed to kill sync service (pid %d): %v", pid, err)
+			}
+			fmt.Printf("Killed sync service (pid %d)\n", pid)
+		},
+	}
+	stopCmd.Flags().BoolVar(&forceStop, "force", false, "Kill the sync service if it no longer answers")
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore <repo> <path>",
+		Short: "Download a file (or glob) from the remote, bypassing the sync comparison",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			repoPath, err := filepath.Abs(args[0])
+			if err != nil {
+				fmt.Printf("Invalid repository path: %v\n", err)
+				os.Exit(ExitUsage)
+			}
+			restoreArgs, _ := json.Marshal(RestoreArgs{Repository: repoPath, Pattern: args[1]})
+			printResponse(sendCommand("restore", string(restoreArgs)), ExitSyncError)
+		},
+	}
+
+	var purgeDryRun bool
+	purgeCmd := &cobra.Command{
+		Use:   "purge <repo> [pattern]",
+		Short: "Delete the files of an archive repository that are no longer local from the remote",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			repoPath, err := filepath.Abs(args[0])
+			if err != nil {
+				fmt.Printf("Invalid repository path: %v\n", err)
+				os.Exit(ExitUsage)
+			}
+			purgeArgs := PurgeArgs{Repository: repoPath, DryRun: purgeDryRun}
+			if len(args) > 1 {
+				purgeArgs.Pattern = args[1]
+			}
+			data, _ := json.Marshal(purgeArgs)
+			printResponse(sendCommand("purge", string(data)), ExitSyncError)
+		},
+	}
+	purgeCmd.Flags().BoolVar(&purgeDryRun, "dry-run", false, "Only list the files that would be deleted")
+
+	var confirmDeletions bool
+	var syncAt string
+	syncCmd := &cobra.Command{
+		Use:   "sync [repo]",
+		Short: "Sync all repositories now, or start syncing one repository",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			repoPath := ""
+			if len(args) > 0 {
+				var err error
+				if repoPath, err = filepath.Abs(args[0]); err != nil {
+					fmt.Printf("Invalid repository path: %v\n", err)
+					os.Exit(ExitUsage)
+				}
+			}
+			if confirmDeletions {
+				if repoPath == "" {
+					fmt.Println("--confirm-deletions needs the repository whose deletions to confirm")
+					os.Exit(ExitUsage)
+				}
+				printResponse(sendCommand("confirm-deletions", repoPath), ExitSyncError)
+				return
+			}
+			if syncAt != "" {
+				at, err := parseSyncAt(syncAt, time.Now())
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(ExitUsage)
+				}
+				data, _ := json.Marshal(ScheduleSyncArgs{Repository: repoPath, At: at})
+				printResponse(sendCommand("schedule-sync", string(data)), ExitSyncError)
+				return
+			}
+			printResponse(sendCommand("sync", repoPath), ExitSyncError)
+		},
+	}
+	syncCmd.Flags().StringVar(&syncAt, "at", "", "Sync once at a time, HH:MM or YYYY-MM-DD HH:MM, instead of now")
+	syncCmd.Flags().BoolVar(&confirmDeletions, "confirm-deletions", false, "Sync the repository even though it deletes more files than deletion_limit allows")
+
+	var scrubObjects int
+	scrubCmd := &cobra.Command{
+		Use:   "scrub [repo]",
+		Short: "Check remote objects against the index now, going on where the last scrub stopped",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			scrubArgs := ScrubArgs{Objects: scrubObjects}
+			if len(args) > 0 {
+				repoPath, err := filepath.Abs(args[0])
+				if err != nil {
+					fmt.Printf("Invalid repository path: %v\n", err)
+					os.Exit(ExitUsage)
+				}
+				scrubArgs.Repository = repoPath
+			}
+			encodedArgs, _ := json.Marshal(scrubArgs)
+			resp := sendCommand("scrub", string(encodedArgs))
+			var scrub ScrubPayload
+			if decodePayload(resp, &scrub) {
+				fmt.Print(formatScrub(scrub.Results))
+				for _, result := range scrub.Results {
+					if !result.Healthy() {
+						os.Exit(ExitSyncError)
+					}
+				}
 				return
 			}
-			resp := sendCommand("shutdown", "")
-			fmt.Println(resp.Message)
+			printResponse(resp, ExitSyncError)
+		},
+	}
+	scrubCmd.Flags().IntVar(&scrubObjects, "objects", 0, "Objects to check per repository, scrub.objects of the config by default")
+
+	signIndexCmd := &cobra.Command{
+		Use:   "sign-index <repo>",
+		Short: "Sign the remote index of a repository with its index_key, as it is",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			repoPath, err := filepath.Abs(args[0])
+			if err != nil {
+				fmt.Printf("Invalid repository path: %v\n", err)
+				os.Exit(ExitUsage)
+			}
+			printResponse(sendCommand("sign-index", repoPath), ExitFailure)
 		},
 	}
 
-	rootCmd.AddCommand(statusCmd, restartCmd, startCmd, stopCmd)
-	rootCmd.Execute()
+	moveCmd := &cobra.Command{
+		Use:   "move <old path> <new path>",
+		Short: "Move a repository, or point its config at where it was moved to",
+		Long: `Move a repository to another path, keeping its remote prefix so nothing is
+uploaded again. When the directory was already moved, only the config is
+updated.`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			from, err := filepath.Abs(args[0])
+			if err != nil {
+				fmt.Printf("Invalid repository path: %v\n", err)
+				os.Exit(ExitUsage)
+			}
+			to, err := filepath.Abs(args[1])
+			if err != nil {
+				fmt.Printf("Invalid repository path: %v\n", err)
+				os.Exit(ExitUsage)
+			}
+			if isDaemonRunning() {
+				moveArgs, _ := json.Marshal(MoveArgs{From: from, To: to})
+				printResponse(sendCommand("move", string(moveArgs)), ExitConfigError)
+				return
+			}
+			config, err := LoadConfig(configProfile)
+			if err != nil {
+				fmt.Printf("Invalid configuration: %v\n", err)
+				os.Exit(ExitConfigError)
+			}
+			done, err := moveRepository(config, from, to)
+			for _, line := range done {
+				fmt.Println(line)
+			}
+			if err != nil {
+				fmt.Printf("Failed to move repository: %v\n", err)
+				os.Exit(ExitConfigError)
+			}
+		},
+	}
+
+	rootCmd.AddCommand(statusCmd, restartCmd, startCmd, stopCmd, pauseCmd, resumeCmd, skipCmd, unskipCmd, syncCmd, scrubCmd, signIndexCmd, moveCmd, restoreCmd, purgeCmd, planCmd, healthCmd, eventsCmd, tuiCmd, historyCmd, statsCmd, reportCmd, profileCmd, daemonCmd, newServiceCmd(), newCredentialsCmd(), newHookCmd(), newConflictsCmd(), newLifecycleCmd(), newSnapshotCmd(), newWhichCmd())
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(ExitUsage)
+	}
 }
 
 func isDaemonRunning() bool {
-	_, err := net.Dial("unix", socketPath)
-	return err == nil
+	return pingDaemon() == nil
+}
+
+// Checks that the sync service not only accepts connections but also answers
+func pingDaemon() error {
+	conn, err := dialIPC()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(pingTimeout))
+
+	// ping uses the legacy protocol so that it works against any daemon version
+	if err := json.NewEncoder(conn).Encode(Message{Command: "ping"}); err != nil {
+		return err
+	}
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Status != "success" {
+		return fmt.Errorf("unexpected ping response: %s", resp.Message)
+	}
+	return nil
+}
+
+func startService() {
+	if isDaemonRunning() {
+		fmt.Println("Reposy sync service is already running")
+		return
+	}
+	if pid, alive := daemonPid(); alive {
+		fmt.Printf("Reposy sync service (pid %d) is not responding. Use 'reposy stop --force' to kill it\n", pid)
+		os.Exit(ExitDaemonNotRunning)
+	}
+	// fail early instead of timing out on a daemon that can't start
+	if _, err := LoadConfig(configProfile); err != nil {
+		fmt.Printf("Invalid configuration: %v\n", err)
+		os.Exit(ExitConfigError)
+	}
+	if removed, err := removeStaleSocket(); err != nil {
+		log.Fatalf("Failed to check existing socket: %v", err)
+	} else if removed {
+		fmt.Println("Removed stale socket left by a previous sync service")
+	}
+	startDaemon()
+	fmt.Println("Reposy sync service started")
+}
+
+// Arguments to run the sync service in the foreground with the current socket and config
+func daemonArgs() ([]string, error) {
+	args := []string{"daemon", "--foreground", "--socket", socketPath}
+	if configFile != "" {
+		absConfigFile, err := filepath.Abs(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve config path: %w", err)
+		}
+		args = append(args, "--config", absConfigFile)
+	}
+	if configProfile != "" {
+		args = append(args, "--profile", configProfile)
+	}
+	if instanceName != "" {
+		args = append(args, "--instance", instanceName)
+	}
+	if debugHTTP {
+		args = append(args, "--debug-http")
+	}
+	return args, nil
 }
 
 func startDaemon() {
@@ -105,14 +644,16 @@ func startDaemon() {
 	if err != nil {
 		log.Fatalf("Failed to get executable path: %v", err)
 	}
-
-	daemonCmd := exec.Command(execPath, "daemon")
-	daemonCmd.SysProcAttr = &syscall.SysProcAttr{
-		Setsid: true,
+	args, err := daemonArgs()
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
 
+	daemonCmd := exec.Command(execPath, args...)
+	daemonCmd.SysProcAttr = daemonSysProcAttr()
+
 	// Open log file for writing
-	logFile, err := os.OpenFile("/tmp/reposy.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Fatalf("Failed to open log file: %v", err)
 	}
@@ -140,59 +681,63 @@ func startDaemon() {
 }
 
 func sendCommand(command, args string) Response {
-	conn, err := net.Dial("unix", socketPath)
+	client, err := dialDaemon()
 	if err != nil {
-		return Response{Status: "error", Message: fmt.Sprintf("Failed to connect to sync service: %v", err)}
-	}
-	defer conn.Close()
-
-	msg := Message{Command: command, Args: args}
-	encoder := json.NewEncoder(conn)
-	if err := encoder.Encode(msg); err != nil {
-		return Response{Status: "error", Message: fmt.Sprintf("Failed to send command: %v", err)}
+		return Response{Status: "error", Code: ErrCodeUnavailable, Message: fmt.Sprintf("Failed to connect to sync service: %v", err)}
 	}
+	defer client.Close()
 
-	var resp Response
-	decoder := json.NewDecoder(conn)
-	if err := decoder.Decode(&resp); err != nil {
-		return Response{Status: "error", Message: fmt.Sprintf("Failed to decode response: %v", err)}
+	resp, err := client.Call(command, args)
+	if err != nil {
+		return Response{Status: "error", Code: ErrCodeUnavailable, Message: fmt.Sprintf("Failed to send command: %v", err)}
 	}
-
 	return resp
 }
 
-// Checks if this instance should run as a daemon
-func init() {
-	if len(os.Args) > 1 && os.Args[1] == "daemon" {
-		runDaemon()
-		os.Exit(0)
-	}
-}
-
-// The daemon function that will run in the background
+// The daemon function that runs the sync service until it is shut down
 func runDaemon() {
-	// Remove existing socket if it exists
-	os.Remove(socketPath)
-
-	// Create Unix domain socket
-	listener, err := net.Listen("unix", socketPath)
+	// Create Unix domain socket (named pipe on Windows)
+	listener, err := listenIPC()
 	if err != nil {
-		log.Fatalf("Failed to create socket: %v", err)
+		fatal("Failed to create socket", "socket", socketPath, "error", err)
+	}
+
+	if err := writePidFile(); err != nil {
+		fatal("Failed to write pid file", "error", err)
 	}
 
 	// Start the daemon
-	engine, err := NewSyncEngine()
+	engine, err := NewSyncEngine(configProfile)
 	if err != nil {
-		log.Fatalf("Failed to create sync engine: %v", err)
+		slog.Error("Failed to create sync engine", "error", err)
+		removePidFile()
+		os.Exit(ExitConfigError)
 	}
 
-	go engine.Start()
+	engine.Start()
+
+	if len(engine.SocketConfig().AllowedUIDs) > 0 {
+		if err := shareSocket(); err != nil {
+			slog.Error("Failed to share socket with allowed users", "socket", socketPath, "error", err)
+		}
+	}
+
+	if err := startHTTPServer(engine.HTTPConfig(), engine); err != nil {
+		slog.Error("Failed to start HTTP API", "error", err)
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Error("Failed to notify systemd readiness", "error", err)
+	}
+	go runSdWatchdog()
+	go handleSignals(engine)
+	go runNotifier(engine)
 
 	// Handle client connections
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
+			slog.Error("Error accepting connection", "error", err)
 			continue
 		}
 
@@ -200,57 +745,486 @@ func runDaemon() {
 	}
 }
 
+// Numbers connections, to tell apart the requests of different clients in
+// the log
+var lastConnID atomic.Uint64
+
 func handleConnection(conn net.Conn, engine *SyncEngine) {
 	defer conn.Close()
+	connID := lastConnID.Add(1)
+	if allowed, uid := engine.SocketConfig().allowsPeer(conn); !allowed {
+		slog.Warn("Refused connection from a user not in socket.allowed_uids", "uid", uid)
+		return
+	}
 
-	var msg Message
-	decoder := json.NewDecoder(conn)
-	if err := decoder.Decode(&msg); err != nil {
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
 		if err == io.EOF {
-			log.Printf("Empty message received, closing connection")
+			slog.Warn("Empty message received, closing connection")
 			return
 		}
-		log.Printf("Error decoding message: %v", err)
+		slog.Error("Error reading message", "error", err)
+		return
+	}
+
+	if first[0] != '{' {
+		if err := handleFramedConnection(conn, connID, reader, engine); err != nil {
+			slog.Error("Error handling connection", "error", err)
+		}
+		return
+	}
+
+	// Legacy protocol: a single JSON message answered by a single JSON response
+	var msg Message
+	decoder := json.NewDecoder(reader)
+	if err := decoder.Decode(&msg); err != nil {
+		slog.Error("Error decoding message", "error", err)
 		return
 	}
+	logCommand(msg.Command, "conn", connID)
+
+	if denied := engine.SocketConfig().authorize(msg.Command, msg.Token); denied != nil {
+		json.NewEncoder(conn).Encode(denied)
+		return
+	}
+	if msg.Command == "shutdown" {
+		resp := Response{Status: "success", Message: "Sync service shutting down"}
+		encoder := json.NewEncoder(conn)
+		encoder.Encode(resp)
+		shutdownDaemon(engine)
+	}
+
+	resp := dispatchCommand(engine, msg)
+	encoder := json.NewEncoder(conn)
+	encoder.Encode(resp)
+}
+
+func logCommand(command string, attrs ...any) {
+	if command != "ping" {
+		slog.Info("Command received", append([]any{"command", command}, attrs...)...)
+	}
+}
 
-	log.Printf("Command: %s", msg.Command)
+// Lets the sync in progress finish, cleans up and exits
+func shutdownDaemon(engine *SyncEngine) {
+	sdNotify("STOPPING=1")
+	engine.Shutdown()
+	removePidFile()
+	removeSocketFile()
+	os.Exit(0)
+}
 
+func reloadResponse(message string, changes []string) Response {
+	if len(changes) == 0 {
+		return payloadResponse(message+", nothing changed", "", ReloadPayload{Changes: []string{}})
+	}
+	return payloadResponse(message+":", strings.Join(changes, "\n"), ReloadPayload{Changes: changes})
+}
+
+// Executes a command received over the socket or the HTTP API
+func dispatchCommand(engine *SyncEngine, msg Message) Response {
 	var resp Response
 
 	switch msg.Command {
+	case "ping":
+		resp = Response{Status: "success", Message: "pong"}
 	case "status":
-		status := engine.GetStatus()
-		resp = Response{
-			Status:  "success",
-			Message: "Current sync status:",
-			Data:    status,
+		status := engine.StatusPayload()
+		resp = payloadResponse("Current sync status:", "", status)
+	case "health":
+		health := engine.Health()
+		if health.Healthy {
+			resp = payloadResponse("All repositories are healthy", "", health)
+		} else {
+			resp = payloadResponse("Some repositories are unhealthy:", strings.Join(health.Problems, "\n"), health)
+			resp.Status = "error"
 		}
+
 	case "restart":
-		err := engine.Restart()
+		changes, err := engine.Restart()
 		if err != nil {
 			resp = Response{Status: "error", Message: err.Error()}
 		} else {
-			resp = Response{Status: "success", Message: "Restarted successfully"}
+			resp = reloadResponse("Configuration reloaded", changes)
 		}
 
+	case "profile":
+		if msg.Args == "" {
+			if engine.Profile() == "" {
+				resp = Response{Status: "success", Message: "No profile active"}
+			} else {
+				resp = Response{Status: "success", Message: fmt.Sprintf("Active profile: %s", engine.Profile())}
+			}
+			break
+		}
+		changes, err := engine.SwitchProfile(msg.Args)
+		if err != nil {
+			resp = Response{Status: "error", Message: err.Error()}
+		} else {
+			resp = reloadResponse(fmt.Sprintf("Switched to profile %s", msg.Args), changes)
+		}
+
+	case "history":
+		var args HistoryArgs
+		if err := json.Unmarshal([]byte(msg.Args), &args); err != nil {
+			resp = Response{Status: "error", Code: ErrCodeInvalidArgs, Message: fmt.Sprintf("Invalid history arguments: %v", err)}
+			break
+		}
+		if engine.History() == nil {
+			resp = Response{Status: "error", Message: "Sync history is not available, see the sync service log"}
+			break
+		}
+		runs, err := engine.History().Runs(args.Repository, args.File)
+		if err != nil {
+			resp = Response{Status: "error", Message: err.Error()}
+			break
+		}
+		if args.Limit > 0 && len(runs) > args.Limit {
+			runs = runs[len(runs)-args.Limit:]
+		}
+		resp = payloadResponse("Sync history:", formatHistory(runs, args.File), HistoryPayload{Runs: runs})
+
+	case "report":
+		var args ReportArgs
+		if err := json.Unmarshal([]byte(msg.Args), &args); err != nil {
+			resp = Response{Status: "error", Code: ErrCodeInvalidArgs, Message: fmt.Sprintf("Invalid report arguments: %v", err)}
+			break
+		}
+		report, err := engine.Report(args)
+		if err != nil {
+			resp = Response{Status: "error", Message: err.Error()}
+			break
+		}
+		resp = payloadResponse(fmt.Sprintf("%d entries since %s", len(report.Entries), args.Since.Format(time.RFC3339)), "", report)
+
+	case "stats":
+		stats, err := engine.Stats()
+		if err != nil {
+			resp = Response{Status: "error", Message: err.Error()}
+			break
+		}
+		resp = payloadResponse("Sync statistics:", "", stats)
+
 	case "sync":
-		if engine.IsSyncing() {
-			resp = Response{Status: "error", Message: "Wait for current sync to finish"}
+		var repository *Repository
+		if msg.Args != "" {
+			if repository = engine.FindRepository(msg.Args); repository == nil {
+				resp = Response{Status: "error", Code: ErrCodeNotFound, Message: fmt.Sprintf("Repository not configured: %s", msg.Args)}
+				break
+			}
+			if engine.Skipped(repository) {
+				resp = Response{Status: "error", Code: ErrCodeDisabled, Message: fmt.Sprintf("%s is skipped, run 'reposy unskip %s' to sync it", repository.Path, repository.Path)}
+				break
+			}
+		} else if engine.IsSyncing() {
+			resp = Response{Status: "error", Code: ErrCodeBusy, Message: "Wait for current sync to finish"}
+			break
+		}
+		release, ok := engine.reserveRequestedSync()
+		if !ok {
+			resp = Response{Status: "error", Code: ErrCodeBusy, Message: fmt.Sprintf("Too many requested syncs in progress, at most %d run at once", engine.SocketConfig().MaxConcurrentSyncs)}
+			break
+		}
+		if repository != nil {
+			engine.SyncRepository(repository, release)
+			resp = Response{Status: "success", Message: fmt.Sprintf("Sync of %s started", repository.Path)}
 		} else {
-			engine.SyncAll()
+			// the reservation is held until every repository synced
+			go func() {
+				defer release()
+				engine.SyncAll()
+			}()
 			resp = Response{Status: "success", Message: "Sync started"}
 		}
 
-	case "shutdown":
-		resp = Response{Status: "success", Message: "Sync service shutting down"}
-		encoder := json.NewEncoder(conn)
-		encoder.Encode(resp)
-		os.Exit(0)
+	case "schedule-sync":
+		var args ScheduleSyncArgs
+		if err := json.Unmarshal([]byte(msg.Args), &args); err != nil {
+			resp = Response{Status: "error", Code: ErrCodeInvalidArgs, Message: fmt.Sprintf("Invalid schedule arguments: %v", err)}
+			break
+		}
+		repositories := engine.Repositories()
+		if args.Repository != "" {
+			repository := engine.FindRepository(args.Repository)
+			if repository == nil {
+				resp = Response{Status: "error", Code: ErrCodeNotFound, Message: fmt.Sprintf("Repository not configured: %s", args.Repository)}
+				break
+			}
+			repositories = []*Repository{repository}
+		}
+		for _, repository := range repositories {
+			engine.ScheduleSync(repository, args.At)
+		}
+		at := args.At.Local().Format("2006-01-02 15:04")
+		if args.Repository != "" {
+			resp = Response{Status: "success", Message: fmt.Sprintf("Sync of %s scheduled at %s", repositories[0].Path, at)}
+		} else {
+			resp = Response{Status: "success", Message: fmt.Sprintf("Sync of all repositories scheduled at %s", at)}
+		}
+
+	case "scrub":
+		var args ScrubArgs
+		if err := json.Unmarshal([]byte(msg.Args), &args); err != nil {
+			resp = Response{Status: "error", Code: ErrCodeInvalidArgs, Message: fmt.Sprintf("Invalid scrub arguments: %v", err)}
+			break
+		}
+		var repositories []*Repository
+		if args.Repository != "" {
+			repository := engine.FindRepository(args.Repository)
+			if repository == nil {
+				resp = Response{Status: "error", Code: ErrCodeNotFound, Message: fmt.Sprintf("Repository not configured: %s", args.Repository)}
+				break
+			}
+			repositories = []*Repository{repository}
+		}
+		objects := args.Objects
+		if objects <= 0 {
+			objects = engine.ScrubConfig().Objects
+		}
+		results := engine.Scrub(repositories, objects)
+		resp = payloadResponse("Scrub results:", formatScrub(results), ScrubPayload{Results: results})
+
+	case "lifecycle-apply":
+		var args LifecycleArgs
+		if err := json.Unmarshal([]byte(msg.Args), &args); err != nil {
+			resp = Response{Status: "error", Code: ErrCodeInvalidArgs, Message: fmt.Sprintf("Invalid lifecycle arguments: %v", err)}
+			break
+		}
+		repositories := engine.Repositories()
+		if args.Repository != "" {
+			repository := engine.FindRepository(args.Repository)
+			if repository == nil {
+				resp = Response{Status: "error", Code: ErrCodeNotFound, Message: fmt.Sprintf("Repository not configured: %s", args.Repository)}
+				break
+			}
+			repositories = []*Repository{repository}
+		}
+		rules := make(map[string]string, len(repositories))
+		var failures []string
+		for _, repository := range repositories {
+			rule, err := repository.ApplyLifecycle(args.Rules, args.DryRun)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", repository.Path, err))
+				continue
+			}
+			rules[repository.Path] = rule
+		}
+		if len(failures) > 0 {
+			resp = Response{Status: "error", Message: "Failed to apply lifecycle rules:", Data: strings.Join(failures, "\n")}
+		} else if args.DryRun {
+			resp = payloadResponse("Lifecycle rules that would be written:", formatLifecycle(rules), LifecyclePayload{Rules: rules, DryRun: true})
+		} else {
+			resp = payloadResponse("Applied lifecycle rules:", formatLifecycle(rules), LifecyclePayload{Rules: rules})
+		}
+
+	case "sign-index":
+		repository := engine.FindRepository(msg.Args)
+		if repository == nil {
+			resp = Response{Status: "error", Code: ErrCodeNotFound, Message: fmt.Sprintf("Repository not configured: %s", msg.Args)}
+			break
+		}
+		signed, err := repository.SignIndex()
+		if err != nil {
+			resp = Response{Status: "error", Message: fmt.Sprintf("Failed to sign index: %v", err), Data: strings.Join(signed, "\n")}
+			break
+		}
+		resp = Response{Status: "success", Message: fmt.Sprintf("Signed %d index objects of %s", len(signed), repository.Path), Data: strings.Join(signed, "\n")}
+
+	case "confirm-deletions":
+		repository := engine.FindRepository(msg.Args)
+		if repository == nil {
+			resp = Response{Status: "error", Code: ErrCodeNotFound, Message: fmt.Sprintf("Repository not configured: %s", msg.Args)}
+			break
+		}
+		release, ok := engine.reserveRequestedSync()
+		if !ok {
+			resp = Response{Status: "error", Code: ErrCodeBusy, Message: fmt.Sprintf("Too many requested syncs in progress, at most %d run at once", engine.SocketConfig().MaxConcurrentSyncs)}
+			break
+		}
+		repository.ConfirmDeletions()
+		engine.SyncRepository(repository, release)
+		resp = Response{Status: "success", Message: fmt.Sprintf("Sync of %s started, deleting the files removed locally", repository.Path)}
+
+	case "move":
+		var args MoveArgs
+		if err := json.Unmarshal([]byte(msg.Args), &args); err != nil {
+			resp = Response{Status: "error", Code: ErrCodeInvalidArgs, Message: fmt.Sprintf("Invalid move arguments: %v", err)}
+			break
+		}
+		done, err := engine.MoveRepository(args.From, args.To)
+		if err != nil {
+			done = append(done, err.Error())
+			resp = Response{Status: "error", Message: "Failed to move repository:", Data: strings.Join(done, "\n")}
+		} else {
+			resp = Response{Status: "success", Message: fmt.Sprintf("Moved %s to %s:", args.From, args.To), Data: strings.Join(done, "\n")}
+		}
+
+	case "pause":
+		engine.Pause()
+		resp = Response{Status: "success", Message: "Syncing paused"}
+
+	case "skip", "unskip":
+		repository := engine.FindRepository(msg.Args)
+		if repository == nil {
+			resp = Response{Status: "error", Code: ErrCodeNotFound, Message: fmt.Sprintf("Repository not configured: %s", msg.Args)}
+			break
+		}
+		skip := msg.Command == "skip"
+		engine.SetSkipped(repository, skip)
+		if skip {
+			resp = Response{Status: "success", Message: fmt.Sprintf("Skipping %s until unskipped", repository.Path)}
+		} else {
+			resp = Response{Status: "success", Message: fmt.Sprintf("No longer skipping %s", repository.Path)}
+		}
+
+	case "resume":
+		engine.Resume()
+		resp = Response{Status: "success", Message: "Syncing resumed"}
+
+	case "restore":
+		var args RestoreArgs
+		if err := json.Unmarshal([]byte(msg.Args), &args); err != nil {
+			resp = Response{Status: "error", Code: ErrCodeInvalidArgs, Message: fmt.Sprintf("Invalid restore arguments: %v", err)}
+			break
+		}
+		repository := engine.FindRepository(args.Repository)
+		if repository == nil {
+			resp = Response{Status: "error", Code: ErrCodeNotFound, Message: fmt.Sprintf("Repository not configured: %s", args.Repository)}
+			break
+		}
+		restored, err := repository.Restore(args.Pattern)
+		if err != nil {
+			resp = Response{Status: "error", Message: err.Error()}
+		} else {
+			resp = payloadResponse(
+				fmt.Sprintf("Restored %d file(s):", len(restored)),
+				strings.Join(restored, "\n"),
+				RestorePayload{Files: restored})
+		}
+
+	case "purge":
+		var args PurgeArgs
+		if err := json.Unmarshal([]byte(msg.Args), &args); err != nil {
+			resp = Response{Status: "error", Code: ErrCodeInvalidArgs, Message: fmt.Sprintf("Invalid purge arguments: %v", err)}
+			break
+		}
+		repository := engine.FindRepository(args.Repository)
+		if repository == nil {
+			resp = Response{Status: "error", Code: ErrCodeNotFound, Message: fmt.Sprintf("Repository not configured: %s", args.Repository)}
+			break
+		}
+		purged, err := repository.Purge(args.Pattern, args.DryRun)
+		if err != nil {
+			resp = Response{Status: "error", Message: err.Error()}
+			break
+		}
+		message := fmt.Sprintf("Purged %d file(s):", len(purged))
+		if args.DryRun {
+			message = fmt.Sprintf("Would purge %d file(s):", len(purged))
+		}
+		resp = payloadResponse(message, strings.Join(purged, "\n"), PurgePayload{Files: purged, DryRun: args.DryRun})
+
+	case "which":
+		var args WhichArgs
+		if err := json.Unmarshal([]byte(msg.Args), &args); err != nil {
+			resp = Response{Status: "error", Code: ErrCodeInvalidArgs, Message: fmt.Sprintf("Invalid which arguments: %v", err)}
+			break
+		}
+		repository := engine.FindRepository(args.Repository)
+		if repository == nil {
+			resp = Response{Status: "error", Code: ErrCodeNotFound, Message: fmt.Sprintf("Repository not configured: %s", args.Repository)}
+			break
+		}
+		which, err := repository.Which(args.File)
+		if err != nil {
+			resp = Response{Status: "error", Message: err.Error()}
+			break
+		}
+		resp = payloadResponse(formatWhich(which), "", which)
+
+	case "snapshot", "snapshot-list", "snapshot-restore":
+		var args SnapshotArgs
+		if err := json.Unmarshal([]byte(msg.Args), &args); err != nil {
+			resp = Response{Status: "error", Code: ErrCodeInvalidArgs, Message: fmt.Sprintf("Invalid snapshot arguments: %v", err)}
+			break
+		}
+		repository := engine.FindRepository(args.Repository)
+		if repository == nil {
+			resp = Response{Status: "error", Code: ErrCodeNotFound, Message: fmt.Sprintf("Repository not configured: %s", args.Repository)}
+			break
+		}
+		switch msg.Command {
+		case "snapshot":
+			snapshot, err := repository.TakeSnapshot()
+			if err != nil {
+				resp = Response{Status: "error", Message: err.Error()}
+				break
+			}
+			resp = payloadResponse(
+				fmt.Sprintf("Took snapshot %s of %d file(s), %s", snapshot.Name, snapshot.Files, formatBytes(snapshot.Size)),
+				"", SnapshotsPayload{Snapshots: []SnapshotInfo{snapshot}})
+		case "snapshot-list":
+			snapshots, err := repository.ListSnapshots()
+			if err != nil {
+				resp = Response{Status: "error", Message: err.Error()}
+				break
+			}
+			resp = payloadResponse(fmt.Sprintf("%d snapshot(s) of %s:", len(snapshots), repository.Path), formatSnapshots(snapshots), SnapshotsPayload{Snapshots: snapshots})
+		case "snapshot-restore":
+			if args.Name == "" || !filepath.IsAbs(args.Target) {
+				resp = Response{Status: "error", Code: ErrCodeInvalidArgs, Message: "Invalid snapshot arguments: the snapshot and an absolute directory are needed"}
+				break
+			}
+			name, files, err := repository.RestoreSnapshot(args.Name, args.Target)
+			if err != nil {
+				resp = Response{Status: "error", Message: err.Error()}
+				break
+			}
+			resp = Response{Status: "success", Message: fmt.Sprintf("Restored %d file(s) of snapshot %s to %s", files, name, args.Target)}
+		}
+
+	case "conflicts":
+		conflicts := fileConflicts.list()
+		resp = payloadResponse(fmt.Sprintf("%d unresolved conflict(s):", len(conflicts)), formatConflicts(conflicts), ConflictsPayload{Conflicts: conflicts})
+
+	case "resolve-conflict":
+		var args ResolveConflictArgs
+		if err := json.Unmarshal([]byte(msg.Args), &args); err != nil {
+			resp = Response{Status: "error", Code: ErrCodeInvalidArgs, Message: fmt.Sprintf("Invalid resolve arguments: %v", err)}
+			break
+		}
+		repository := engine.RepositoryOf(args.Path)
+		if repository == nil {
+			resp = Response{Status: "error", Code: ErrCodeNotFound, Message: fmt.Sprintf("Not in a configured repository: %s", args.Path)}
+			break
+		}
+		conflict, err := repository.ResolveConflict(args.Path, args.Keep)
+		if err != nil {
+			resp = Response{Status: "error", Message: err.Error()}
+			break
+		}
+		resp = Response{Status: "success", Message: fmt.Sprintf("Kept the %s version of %s", args.Keep, filepath.Join(conflict.Repository, filepath.FromSlash(conflict.File)))}
+
+	case "plan":
+		repository := engine.FindRepository(msg.Args)
+		if repository == nil {
+			resp = Response{Status: "error", Code: ErrCodeNotFound, Message: fmt.Sprintf("Repository not configured: %s", msg.Args)}
+			break
+		}
+		plan, err := repository.Plan()
+		if err != nil {
+			resp = Response{Status: "error", Message: err.Error()}
+		} else {
+			resp = payloadResponse("Planned changes for next sync:", formatPlan(plan), plan)
+		}
+
 	default:
-		resp = Response{Status: "error", Message: "Unknown command"}
+		resp = Response{Status: "error", Code: ErrCodeUnknownCommand, Message: "Unknown command"}
 	}
 
-	encoder := json.NewEncoder(conn)
-	encoder.Encode(resp)
+	if resp.Status == "error" && resp.Code == "" {
+		resp.Code = ErrCodeFailed
+	}
+	return resp
 }
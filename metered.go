@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// Actions on a metered network
+const (
+	MeteredPause    = "pause"
+	MeteredThrottle = "throttle"
+)
+
+const (
+	// How long a check of whether the network is metered is reused
+	meteredCheckInterval = time.Minute
+	defaultThrottleRate  = 128 * 1024
+)
+
+type MeteredConfig struct {
+	// What to do on a metered network or personal hotspot, "pause" or
+	// "throttle". Syncing is unaffected when empty.
+	Action string `json:"action"`
+	// Bytes per second each transfer is limited to while throttled
+	ThrottleRate int64 `json:"throttle_bytes_per_second"`
+	// Shell command that exits with 0 on a metered network, replacing the
+	// detection of the system
+	Command string `json:"command"`
+}
+
+func (config MeteredConfig) validate() error {
+	switch config.Action {
+	case "", MeteredPause, MeteredThrottle:
+	default:
+		return fmt.Errorf("metered_network.action must be %q or %q, got %q", MeteredPause, MeteredThrottle, config.Action)
+	}
+	if config.ThrottleRate < 0 {
+		return fmt.Errorf("metered_network.throttle_bytes_per_second can't be negative")
+	}
+	return nil
+}
+
+// Reports whether the network is metered, by the configured command or else
+// by the detection of the system. Networks that can't be checked count as
+// unmetered.
+func checkMetered(config MeteredConfig) (bool, error) {
+	if config.Command == "" {
+		return systemNetworkMetered()
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", config.Command)
+	} else {
+		cmd = exec.Command("sh", "-c", config.Command)
+	}
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Whether the network is metered, rechecked at most every
+// meteredCheckInterval and shared by the syncs of all repositories
+func (s *SyncEngine) networkMetered(config MeteredConfig) bool {
+	s.meteredMu.Lock()
+	defer s.meteredMu.Unlock()
+	if !s.meteredAt.IsZero() && time.Since(s.meteredAt) < meteredCheckInterval {
+		return s.metered
+	}
+
+	metered, err := checkMetered(config)
+	if err != nil {
+		slog.Error("Failed to check whether the network is metered", "error", err)
+	}
+	if metered != s.metered {
+		if metered {
+			slog.Info("On a metered network", "action", config.Action)
+		} else {
+			slog.Info("No longer on a metered network")
+		}
+	}
+	s.metered = metered
+	s.meteredAt = time.Now()
+	return metered
+}
+
+// Limits reads to rate bytes per second, until ctx is done
+type throttledReader struct {
+	ctx    context.Context
+	reader io.Reader
+	rate   int64
+	start  time.Time
+	read   int64
+}
+
+func newThrottledReader(ctx context.Context, reader io.Reader, rate int64) io.Reader {
+	if rate <= 0 {
+		return reader
+	}
+	return &throttledReader{ctx: ctx, reader: reader, rate: rate, start: time.Now()}
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	// Reads at most a second's worth at once, so the rate stays even
+	if int64(len(p)) > r.rate {
+		p = p[:r.rate]
+	}
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	wait := time.Duration(float64(r.read)/float64(r.rate)*float64(time.Second)) - time.Since(r.start)
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.ctx.Done():
+			return n, r.ctx.Err()
+		}
+	}
+	return n, err
+}
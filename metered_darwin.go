@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// The default gateway of an iPhone personal hotspot
+const iPhoneHotspotGateway = "172.20.10.1"
+
+// Detects personal hotspots: an iPhone by the address of its gateway, and an
+// Android phone by the ANDROID_METERED option of its DHCP offer
+func systemNetworkMetered() (bool, error) {
+	output, err := exec.Command("route", "-n", "get", "default").Output()
+	if err != nil {
+		// No default route, so there is no network to be metered
+		return false, nil
+	}
+	var iface string
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "gateway":
+			if strings.TrimSpace(value) == iPhoneHotspotGateway {
+				return true, nil
+			}
+		case "interface":
+			iface = strings.TrimSpace(value)
+		}
+	}
+	if iface == "" {
+		return false, nil
+	}
+	packet, err := exec.Command("ipconfig", "getpacket", iface).Output()
+	if err != nil {
+		return false, nil
+	}
+	return strings.Contains(string(packet), "ANDROID_METERED"), nil
+}
@@ -0,0 +1,9 @@
+//go:build !darwin && !windows
+
+package main
+
+// Metered networks aren't detected, they can be reported by
+// metered_network.command instead
+func systemNetworkMetered() (bool, error) {
+	return false, nil
+}
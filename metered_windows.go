@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// Reads the cost of the internet connection from the Windows Runtime, as set
+// for metered Wi-Fi, cellular and hotspot connections
+const networkCostScript = `[void][Windows.Networking.Connectivity.NetworkInformation,Windows.Networking.Connectivity,ContentType=WindowsRuntime]
+$connection = [Windows.Networking.Connectivity.NetworkInformation]::GetInternetConnectionProfile()
+if ($connection) { $connection.GetConnectionCost().NetworkCostType }`
+
+func systemNetworkMetered() (bool, error) {
+	output, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", networkCostScript).Output()
+	if err != nil {
+		return false, commandError(err)
+	}
+	// Unrestricted or Unknown otherwise
+	switch strings.TrimSpace(string(output)) {
+	case "Fixed", "Variable":
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Permission bits given in the config as an octal string, like "0640"
+type FileMode os.FileMode
+
+func (mode *FileMode) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("expected an octal mode like \"0640\", got %s", data)
+	}
+	bits, err := strconv.ParseUint(text, 8, 32)
+	if err != nil || bits > 0777 {
+		return fmt.Errorf("invalid mode %q, expected an octal mode like \"0640\"", text)
+	}
+	*mode = FileMode(bits)
+	return nil
+}
+
+func (mode FileMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(mode.String())
+}
+
+func (mode FileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(mode))
+}
+
+// Modes files and directories created by downloads get. Existing files keep
+// their mode when replaced.
+type CreationModes struct {
+	File os.FileMode
+	Dir  os.FileMode
+	// Set when the modes come from the config, and are then applied as they
+	// are rather than through the umask of the process
+	Exact bool
+}
+
+var defaultCreationModes = CreationModes{File: 0644, Dir: 0755}
+
+func newCreationModes(repoConfig *RepositoryConfig) CreationModes {
+	modes := defaultCreationModes
+	if repoConfig.FileMode != nil {
+		modes.File = os.FileMode(*repoConfig.FileMode)
+		modes.Exact = true
+	}
+	if repoConfig.DirMode != nil {
+		modes.Dir = os.FileMode(*repoConfig.DirMode)
+		modes.Exact = true
+	}
+	if repoConfig.Umask != nil {
+		modes.File &^= os.FileMode(*repoConfig.Umask)
+		modes.Dir &^= os.FileMode(*repoConfig.Umask)
+		modes.Exact = true
+	}
+	return modes
+}
+
+// Creates a directory and its missing parents with the directory mode
+func (modes CreationModes) mkdirAll(dir string) error {
+	var created []string
+	for missing := dir; ; missing = filepath.Dir(missing) {
+		if _, err := os.Stat(missing); err == nil || filepath.Dir(missing) == missing {
+			break
+		}
+		created = append(created, missing)
+	}
+	if err := os.MkdirAll(dir, modes.Dir); err != nil {
+		return err
+	}
+	if modes.Exact {
+		for _, createdDir := range created {
+			if err := os.Chmod(createdDir, modes.Dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Mode a file written to filePath gets: the mode of the file it replaces,
+// or the file mode for a new one
+func (modes CreationModes) fileMode(filePath string) (os.FileMode, bool) {
+	if info, err := os.Stat(filePath); err == nil {
+		return info.Mode().Perm(), false
+	}
+	return modes.File, true
+}
+
+// Sets the mode of a file just created, which the umask of the process may
+// have narrowed
+func (modes CreationModes) applyFileMode(file *os.File, mode os.FileMode, created bool) error {
+	if !created || !modes.Exact {
+		return nil
+	}
+	return file.Chmod(mode)
+}
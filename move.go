@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type MoveArgs struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Moves a configured repository to another path, reusing its prefix so that
+// nothing is uploaded again. The directory is moved too unless it already
+// was. Returns what was done.
+func moveRepository(config *Config, from, to string) ([]string, error) {
+	from, to = filepath.Clean(from), filepath.Clean(to)
+	key := configuredRepositoryKey(config, from)
+	if key == "" {
+		return nil, fmt.Errorf("repository not configured: %s", from)
+	}
+	if configuredRepositoryKey(config, to) != "" {
+		return nil, fmt.Errorf("repository already configured: %s", to)
+	}
+
+	var done []string
+	if info, err := os.Stat(to); os.IsNotExist(err) {
+		if _, err := os.Stat(from); err != nil {
+			return nil, fmt.Errorf("neither %s nor %s exists", from, to)
+		}
+		if err := os.Rename(from, to); err != nil {
+			return nil, fmt.Errorf("failed to move repository: %w", err)
+		}
+		done = append(done, fmt.Sprintf("Moved %s to %s", from, to))
+	} else if err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", to)
+	}
+
+	files, err := moveConfigRepository(key, to)
+	if err != nil {
+		return done, err
+	}
+	for _, file := range files {
+		done = append(done, fmt.Sprintf("Updated %s", file))
+	}
+	return done, nil
+}
+
+// Returns the key a repository is configured under, which may differ from
+// its cleaned path, or "" when it isn't configured
+func configuredRepositoryKey(config *Config, repoPath string) string {
+	for key := range config.Repositories {
+		if filepath.Clean(key) == repoPath {
+			return key
+		}
+	}
+	return ""
+}
+
+// Renames a repository in the config files that define it, including drop-in
+// and secrets files. Files are edited as text, keeping their comments and
+// layout, and each edit is checked by parsing the result. Returns the files
+// changed.
+func moveConfigRepository(from, to string) ([]string, error) {
+	configPath, err := ConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	files, err := configFiles(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	type edit struct {
+		path string
+		data []byte
+	}
+	var edits []edit
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		before, err := repositorySections(file, data, from)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", file, err)
+		}
+		if len(before) == 0 {
+			continue
+		}
+		edited := renameConfigKey(data, from, to)
+		after, err := repositorySections(file, edited, to)
+		if err != nil || len(after) != len(before) || configHasRepository(file, edited, from) {
+			return nil, fmt.Errorf("couldn't rename %s to %s in %s, edit it by hand", from, to, file)
+		}
+		edits = append(edits, edit{path: file, data: edited})
+	}
+	if len(edits) == 0 {
+		return nil, fmt.Errorf("repository %s not found in the config files", from)
+	}
+
+	// Only written once every file could be edited
+	var changed []string
+	for _, edit := range edits {
+		if err := writeFileAtomic(edit.path, edit.data); err != nil {
+			return changed, fmt.Errorf("failed to write config file: %w", err)
+		}
+		changed = append(changed, edit.path)
+	}
+	return changed, nil
+}
+
+// The config file, its drop-ins and its secrets file
+func configFiles(configPath string) ([]string, error) {
+	files := []string{configPath}
+	entries, err := os.ReadDir(dropInDir(configPath))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read config directory: %w", err)
+	}
+	var dropIns []string
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if !entry.IsDir() && (ext == ".json" || ext == ".yaml" || ext == ".yml" || ext == ".toml") {
+			dropIns = append(dropIns, filepath.Join(dropInDir(configPath), entry.Name()))
+		}
+	}
+	sort.Strings(dropIns)
+	files = append(files, dropIns...)
+
+	data, err := readConfigFile(configPath, false)
+	if err != nil {
+		return nil, err
+	}
+	var secrets struct {
+		SecretsFile string `json:"secrets_file"`
+	}
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if secrets.SecretsFile != "" {
+		secretsPath, err := expandConfigPath(configPath, secrets.SecretsFile)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, secretsPath)
+	}
+	return files, nil
+}
+
+// Returns the repositories sections of a config file, at the top level and
+// in its profiles, that hold the repository
+func repositorySections(file string, data []byte, repoPath string) ([]string, error) {
+	data, err := configToJSON(file, data)
+	if err != nil {
+		return nil, err
+	}
+	var document struct {
+		Repositories map[string]any `json:"repositories"`
+		Profiles     map[string]struct {
+			Repositories map[string]any `json:"repositories"`
+		} `json:"profiles"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	var sections []string
+	if _, ok := document.Repositories[repoPath]; ok {
+		sections = append(sections, "repositories")
+	}
+	for name, profile := range document.Profiles {
+		if _, ok := profile.Repositories[repoPath]; ok {
+			sections = append(sections, "profiles."+name+".repositories")
+		}
+	}
+	return sections, nil
+}
+
+func configHasRepository(file string, data []byte, repoPath string) bool {
+	sections, err := repositorySections(file, data, repoPath)
+	return err == nil && len(sections) > 0
+}
+
+// Renames a key in a JSON, YAML or TOML document: quoted with double or
+// single quotes, or bare as YAML allows, and followed by what ends a key in
+// these formats
+func renameConfigKey(data []byte, from, to string) []byte {
+	quoted := func(s string) string {
+		encoded, _ := json.Marshal(s)
+		return string(encoded)
+	}
+	forms := [][2]string{
+		{quoted(from), quoted(to)},
+		{"'" + from + "'", "'" + to + "'"},
+		{from, quoted(to)},
+	}
+	text := string(data)
+	for _, form := range forms {
+		pattern := regexp.MustCompile(`(?m)(^|[\s{,\[.])` + regexp.QuoteMeta(form[0]) + `(\s*[:=\].])`)
+		text = pattern.ReplaceAllStringFunc(text, func(match string) string {
+			groups := pattern.FindStringSubmatch(match)
+			return groups[1] + form[1] + groups[2]
+		})
+	}
+	return []byte(text)
+}
+
+// Replaces a file without ever leaving it half written, keeping its mode
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Mod times are kept in nanoseconds since the epoch, so that a file modified
+// twice within a second is seen as changed. Indexes and state written by
+// older versions hold whole seconds.
+
+// Smaller values are seconds: as nanoseconds they'd be in the first minutes
+// of 1970, as seconds they are before the year 33000
+const secondsModTimeLimit = 1e12
+
+// Mod time of a file as stored in the index
+func modTimeOf(info os.FileInfo) int64 {
+	return info.ModTime().UnixNano()
+}
+
+// Converts a mod time that may have been stored in seconds to nanoseconds
+func modTimeNanos(modTime int64) int64 {
+	if modTime > -secondsModTimeLimit && modTime < secondsModTimeLimit {
+		return modTime * int64(time.Second)
+	}
+	return modTime
+}
+
+func modTimeToTime(modTime int64) time.Time {
+	return time.Unix(0, modTimeNanos(modTime))
+}
+
+// Compares two mod times like cmp.Compare. A mod time without a fraction of a
+// second was most likely stored in seconds by an older version or by a file
+// system with no finer precision, and is compared to the second, so that
+// upgrading doesn't make every file look changed.
+func compareModTime(a, b int64) int {
+	a, b = modTimeNanos(a), modTimeNanos(b)
+	if a%int64(time.Second) == 0 || b%int64(time.Second) == 0 {
+		a, b = time.Unix(0, a).Unix(), time.Unix(0, b).Unix()
+	}
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func sameModTime(a, b int64) bool {
+	return compareModTime(a, b) == 0
+}
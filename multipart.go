@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Files at least this large are uploaded in parts
+	multipartThreshold = 64 << 20
+	multipartPartSize  = 16 << 20
+	// Most parts S3 accepts in an upload
+	multipartMaxParts = 10000
+	// Uploads left unfinished for longer are forgotten; a bucket lifecycle
+	// rule aborting incomplete multipart uploads frees their parts
+	multipartMaxAge = 7 * 24 * time.Hour
+)
+
+// A multipart upload in progress, kept in the state directory so that an
+// upload interrupted by a lost connection or a restart resumes from its last
+// part instead of from zero
+type multipartUpload struct {
+	UploadID string `json:"upload_id"`
+	// The file the parts were read from, which must be unchanged to resume
+	Size     int64 `json:"size"`
+	ModTime  int64 `json:"mod_time"`
+	PartSize int64 `json:"part_size"`
+	// ETags of the uploaded parts by part number
+	Parts     map[int]string `json:"parts"`
+	StartedAt time.Time      `json:"started_at"`
+}
+
+type multipartStore struct {
+	mu      sync.Mutex
+	loaded  bool
+	uploads map[string]*multipartUpload
+}
+
+var multipartUploads = &multipartStore{}
+
+func multipartStatePath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "uploads.json"), nil
+}
+
+// Returns a copy of the upload recorded for key, or nil
+func (store *multipartStore) get(key string) *multipartUpload {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.load()
+	upload, ok := store.uploads[key]
+	if !ok {
+		return nil
+	}
+	copied := *upload
+	copied.Parts = make(map[int]string, len(upload.Parts))
+	for part, etag := range upload.Parts {
+		copied.Parts[part] = etag
+	}
+	return &copied
+}
+
+func (store *multipartStore) start(key string, upload *multipartUpload) {
+	store.update(func() {
+		copied := *upload
+		copied.Parts = make(map[int]string)
+		store.uploads[key] = &copied
+	})
+}
+
+func (store *multipartStore) completePart(key string, part int, etag string) {
+	store.update(func() {
+		if upload, ok := store.uploads[key]; ok {
+			upload.Parts[part] = etag
+		}
+	})
+}
+
+func (store *multipartStore) remove(key string) {
+	store.update(func() {
+		delete(store.uploads, key)
+	})
+}
+
+func (store *multipartStore) update(change func()) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.load()
+	change()
+	for key, upload := range store.uploads {
+		if time.Since(upload.StartedAt) > multipartMaxAge {
+			delete(store.uploads, key)
+		}
+	}
+	if err := store.save(); err != nil {
+		// The upload goes on, it just can't be resumed
+		slog.Warn("Failed to save multipart upload state", "error", err)
+	}
+}
+
+func (store *multipartStore) load() {
+	if store.loaded {
+		return
+	}
+	store.loaded = true
+	store.uploads = make(map[string]*multipartUpload)
+	statePath, err := multipartStatePath()
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &store.uploads); err != nil {
+		slog.Warn("Ignoring unreadable multipart upload state", "file", statePath, "error", err)
+		store.uploads = make(map[string]*multipartUpload)
+	}
+}
+
+func (store *multipartStore) save() error {
+	statePath, err := multipartStatePath()
+	if err != nil {
+		return err
+	}
+	if len(store.uploads) == 0 {
+		if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(store.uploads)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(statePath, data)
+}
+
+// Parts are large enough for the file to fit in multipartMaxParts
+func multipartPartSizeFor(size int64) int64 {
+	partSize := int64(multipartPartSize)
+	if minimum := (size + multipartMaxParts - 1) / multipartMaxParts; minimum > partSize {
+		partSize = minimum
+	}
+	return partSize
+}
+
+// Uploads a large file in parts, resuming the upload recorded for it when
+// the file is unchanged since it started
+func (s3 *S3Client) putMultipart(data []byte, headers map[string]string, modTime time.Time, slashPath string) error {
+	fullPath := path.Join(s3.Prefix, slashPath)
+	key := s3.Endpoint + "/" + s3.Bucket + "/" + fullPath
+	size := int64(len(data))
+
+	upload := multipartUploads.get(key)
+	if upload != nil && (upload.Size != size || modTimeNanos(upload.ModTime) != modTime.UnixNano()) {
+		// Its parts are of an older version of the file
+		s3.abortMultipart(fullPath, upload.UploadID)
+		multipartUploads.remove(key)
+		upload = nil
+	}
+	resumed := upload != nil
+	if resumed {
+		slog.Info("Resuming upload", "file", slashPath, "parts", len(upload.Parts))
+	} else {
+		uploadID, err := s3.createMultipart(fullPath, headers)
+		if err != nil {
+			return fmt.Errorf("failed to start upload of %s: %w", slashPath, err)
+		}
+		upload = &multipartUpload{
+			UploadID:  uploadID,
+			Size:      size,
+			ModTime:   modTime.UnixNano(),
+			PartSize:  multipartPartSizeFor(size),
+			Parts:     make(map[int]string),
+			StartedAt: time.Now(),
+		}
+		multipartUploads.start(key, upload)
+	}
+
+	for part, offset := 1, int64(0); offset < size; part, offset = part+1, offset+upload.PartSize {
+		if _, ok := upload.Parts[part]; ok {
+			continue
+		}
+		end := min(offset+upload.PartSize, size)
+		resp, err := s3.request("PUT", fullPath, data[offset:end], nil, map[string]string{
+			"partNumber": strconv.Itoa(part),
+			"uploadId":   upload.UploadID,
+		})
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == 404 && resumed {
+			// The upload expired or was aborted, so it starts over
+			multipartUploads.remove(key)
+			return s3.putMultipart(data, headers, modTime, slashPath)
+		}
+		if resp.StatusCode != 200 {
+			return fmt.Errorf("failed to upload part %d of %s: %s", part, slashPath, resp.Body)
+		}
+		upload.Parts[part] = resp.Headers["Etag"]
+		multipartUploads.completePart(key, part, upload.Parts[part])
+	}
+
+	if err := s3.completeMultipart(fullPath, upload); err != nil {
+		return fmt.Errorf("failed to complete upload of %s: %w", slashPath, err)
+	}
+	multipartUploads.remove(key)
+	return nil
+}
+
+// Starts an upload in parts of an object with the headers of Put
+func (s3 *S3Client) createMultipart(fullPath string, headers map[string]string) (string, error) {
+	resp, err := s3.request("POST", fullPath, nil, headers, map[string]string{"uploads": ""})
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("%s", resp.Body)
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp.Body, &result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("unexpected response: %s", resp.Body)
+	}
+	return result.UploadID, nil
+}
+
+func (s3 *S3Client) completeMultipart(fullPath string, upload *multipartUpload) error {
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	var request struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}
+	for part := 1; part <= len(upload.Parts); part++ {
+		request.Parts = append(request.Parts, completedPart{PartNumber: part, ETag: upload.Parts[part]})
+	}
+	payload, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := s3.request("POST", fullPath, payload, nil, map[string]string{"uploadId": upload.UploadID})
+	if err != nil {
+		return err
+	}
+	// S3 may report an error with a 200 once it started assembling the parts
+	var result struct {
+		XMLName xml.Name
+	}
+	if resp.StatusCode != 200 || xml.Unmarshal(resp.Body, &result) == nil && result.XMLName.Local == "Error" {
+		return fmt.Errorf("%s", resp.Body)
+	}
+	return nil
+}
+
+// Frees the parts of an upload that won't be completed
+func (s3 *S3Client) abortMultipart(fullPath, uploadID string) {
+	resp, err := s3.request("DELETE", fullPath, nil, nil, map[string]string{"uploadId": uploadID})
+	if err == nil && resp.StatusCode != 204 && resp.StatusCode != 404 {
+		err = fmt.Errorf("%s", resp.Body)
+	}
+	if err != nil {
+		slog.Warn("Failed to abort upload", "key", fullPath, "error", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Event types that trigger a desktop notification unless configured otherwise
+var defaultNotificationEvents = map[string]bool{
+	EventSyncFailed:  true,
+	EventConflict:    true,
+	EventScrubFailed: true,
+}
+
+type NotificationConfig struct {
+	// Event type to whether it triggers a notification, e.g. {"sync_completed": true}
+	Events map[string]bool `json:"events"`
+	// Syncs of a repository in a row that must fail before a notification,
+	// so that a transient failure stays quiet
+	FailureThreshold int `json:"failure_threshold"`
+}
+
+const defaultFailureThreshold = 3
+
+func (config NotificationConfig) Enabled(eventType string) bool {
+	if enabled, ok := config.Events[eventType]; ok {
+		return enabled
+	}
+	return defaultNotificationEvents[eventType]
+}
+
+// Shows desktop notifications for sync events as configured. A failing
+// repository notifies once it failed failure_threshold syncs in a row, and
+// then once until its error changes or it recovers.
+func runNotifier(engine *SyncEngine) {
+	events, unsubscribe := engine.Events().Subscribe()
+	defer unsubscribe()
+
+	lastErrors := make(map[string]string)
+	for event := range events {
+		switch event.Type {
+		case EventSyncCompleted:
+			delete(lastErrors, event.Repository)
+		case EventSyncFailed:
+			// Failures outside of syncs, like a missing path, notify right away
+			if event.Failures > 0 && event.Failures < engine.NotificationConfig().FailureThreshold {
+				continue
+			}
+			if lastErrors[event.Repository] == event.Message {
+				continue
+			}
+			lastErrors[event.Repository] = event.Message
+		}
+		if !engine.NotificationConfig().Enabled(event.Type) {
+			continue
+		}
+
+		title, body := notificationText(event)
+		if err := showNotification(title, body); err != nil {
+			slog.Debug("Failed to show desktop notification", "error", err)
+		}
+	}
+}
+
+func notificationText(event Event) (string, string) {
+	switch event.Type {
+	case EventSyncFailed:
+		if event.Failures > 1 {
+			return "Reposy sync failed", fmt.Sprintf("%s failed %d syncs in a row: %s", event.Repository, event.Failures, event.Message)
+		}
+		return "Reposy sync failed", fmt.Sprintf("%s: %s", event.Repository, event.Message)
+	case EventConflict:
+		return "Reposy conflict", fmt.Sprintf("%s: %s", event.Repository, event.Message)
+	case EventScrubFailed:
+		return "Reposy remote damaged", fmt.Sprintf("%s: %s", event.Repository, event.Message)
+	default:
+		return "Reposy " + strings.ReplaceAll(event.Type, "_", " "), strings.TrimSpace(event.Repository + " " + event.File)
+	}
+}
+
+func showNotification(title, body string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptString(body), appleScriptString(title))
+		cmd = exec.Command("osascript", "-e", script)
+	case "windows":
+		script := fmt.Sprintf(windowsToastScript, powershellString(title), powershellString(body))
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	default:
+		cmd = exec.Command("notify-send", "--app-name=Reposy", title, body)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, output)
+	}
+	return nil
+}
+
+const windowsToastScript = `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$texts = $template.GetElementsByTagName("text")
+$texts.Item(0).AppendChild($template.CreateTextNode(%s)) | Out-Null
+$texts.Item(1).AppendChild($template.CreateTextNode(%s)) | Out-Null
+$toast = [Windows.UI.Notifications.ToastNotification]::new($template)
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier("Reposy").Show($toast)
+`
+
+func appleScriptString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+func powershellString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
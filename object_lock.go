@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// In a bucket with Object Lock, versions of objects can't be deleted or
+// overwritten until their retention ends. Each file, chunk and tombstone
+// written is then given a retention, and files are never deleted from the
+// remote, only marked as tombstones, so that every version stays
+// recoverable. The objects of the index aren't locked as they are rewritten
+// at every sync.
+type ObjectLockConfig struct {
+	// "GOVERNANCE" or "COMPLIANCE", objects not being locked when empty
+	Mode string `json:"mode"`
+	// How long each object written is retained
+	Retention Interval `json:"retention"`
+}
+
+const (
+	HEADER_OBJECT_LOCK_MODE  = "x-amz-object-lock-mode"
+	HEADER_OBJECT_LOCK_UNTIL = "x-amz-object-lock-retain-until-date"
+)
+
+func (lock ObjectLockConfig) enabled() bool {
+	return lock.Mode != ""
+}
+
+func (lock ObjectLockConfig) validate() error {
+	switch lock.Mode {
+	case "":
+		return nil
+	case "GOVERNANCE", "COMPLIANCE":
+	default:
+		return fmt.Errorf("object_lock.mode must be GOVERNANCE or COMPLIANCE, got %q", lock.Mode)
+	}
+	if lock.Retention <= 0 {
+		return fmt.Errorf("object_lock.retention must be set with object_lock.mode")
+	}
+	return nil
+}
+
+func (s3 *S3Client) objectLocked() bool {
+	return s3.ObjectLock.enabled()
+}
+
+// Adds the retention of an object written to its headers, when objects are
+// locked
+func (s3 *S3Client) lockHeaders(headers map[string]string) {
+	if !s3.ObjectLock.enabled() {
+		return
+	}
+	headers[HEADER_OBJECT_LOCK_MODE] = s3.ObjectLock.Mode
+	headers[HEADER_OBJECT_LOCK_UNTIL] = time.Now().Add(time.Duration(s3.ObjectLock.Retention)).UTC().Format(time.RFC3339)
+}
+
+// S3 rejects any PUT to a bucket with Object Lock without a Content-MD5,
+// whether the object has a retention of its own or gets the bucket's default
+func (s3 *S3Client) withContentMD5(method string, payload []byte, headers map[string]string) map[string]string {
+	if !s3.ObjectLock.enabled() || method != "PUT" {
+		return headers
+	}
+	if _, ok := headers["Content-MD5"]; ok {
+		return headers
+	}
+	withMD5 := make(map[string]string, len(headers)+1)
+	for name, value := range headers {
+		withMD5[name] = value
+	}
+	sum := md5.Sum(payload)
+	withMD5["Content-MD5"] = base64.StdEncoding.EncodeToString(sum[:])
+	return withMD5
+}
+
+// Whether the remote of the repository keeps locked objects, which are then
+// never deleted
+func (repo *Repository) objectLocked() bool {
+	locker, ok := repo.Client.(interface{ objectLocked() bool })
+	return ok && locker.objectLocked()
+}
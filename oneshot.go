@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type ScheduleSyncArgs struct {
+	// All repositories when empty
+	Repository string    `json:"repository,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// A sync scheduled once with 'reposy sync --at', on top of the repository's
+// interval or schedule
+type oneShotSync struct {
+	at    time.Time
+	timer *time.Timer
+}
+
+// Parses the time of 'reposy sync --at': a time of day, taken as its next
+// occurrence, or a date and time
+func parseSyncAt(text string, now time.Time) (time.Time, error) {
+	if minute, err := parseTimeOfDay(text); err == nil {
+		year, month, day := now.Date()
+		at := time.Date(year, month, day, 0, minute, 0, 0, now.Location())
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return at, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02T15:04", time.RFC3339} {
+		if at, err := time.ParseInLocation(layout, text, now.Location()); err == nil {
+			if !at.After(now) {
+				return time.Time{}, fmt.Errorf("%s is in the past", text)
+			}
+			return at, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s, use HH:MM or YYYY-MM-DD HH:MM", text)
+}
+
+// ScheduleSync syncs a repository once at the given time, replacing the
+// one-shot sync it had scheduled. The sync waits for one in progress to end.
+func (s *SyncEngine) ScheduleSync(repository *Repository, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		return
+	}
+	if previous, ok := s.oneShots[repository.Path]; ok {
+		previous.timer.Stop()
+	}
+	repoPath := repository.Path
+	shot := &oneShotSync{at: at}
+	shot.timer = time.AfterFunc(time.Until(at), func() {
+		s.mu.Lock()
+		if s.oneShots[repoPath] != shot || s.shuttingDown {
+			s.mu.Unlock()
+			return
+		}
+		delete(s.oneShots, repoPath)
+		s.running.Add(1)
+		s.mu.Unlock()
+		defer s.running.Done()
+
+		// Looked up again, as a reload may have replaced the repository
+		if repository := s.FindRepository(repoPath); repository != nil {
+			repository.logger.Info("Running scheduled sync", "at", at)
+			s.syncRepository(repository, true, nil)
+		}
+	})
+	s.oneShots[repoPath] = shot
+}
+
+// When the one-shot sync of a repository is scheduled, zero if none is
+func (s *SyncEngine) scheduledSync(repoPath string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if shot, ok := s.oneShots[repoPath]; ok {
+		return shot.at
+	}
+	return time.Time{}
+}
+
+// Cancels the one-shot syncs, called with the engine's lock held
+func (s *SyncEngine) cancelOneShots() {
+	for repoPath, shot := range s.oneShots {
+		shot.timer.Stop()
+		delete(s.oneShots, repoPath)
+	}
+}
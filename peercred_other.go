@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// The peer of a connection isn't known outside Linux
+func peerUID(conn net.Conn) (int, bool) {
+	return 0, false
+}
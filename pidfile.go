@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func writePidFile() error {
+	return os.WriteFile(pidFilePath(), []byte(strconv.Itoa(os.Getpid())+"\n"), 0600)
+}
+
+func removePidFile() {
+	os.Remove(pidFilePath())
+}
+
+func readPidFile() (int, error) {
+	data, err := os.ReadFile(pidFilePath())
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid file %s: %w", pidFilePath(), err)
+	}
+	return pid, nil
+}
+
+// Returns the pid recorded in the pid file if that process is still alive
+// and runs reposy
+func daemonPid() (int, bool) {
+	pid, err := readPidFile()
+	if err != nil {
+		return 0, false
+	}
+	if !processAlive(pid) || !processIsReposy(pid) {
+		return pid, false
+	}
+	return pid, true
+}
+
+// Kills a sync service that no longer answers IPC and cleans up after it
+func killDaemon(pid int) error {
+	if !processIsReposy(pid) {
+		return fmt.Errorf("process %d isn't a reposy sync service", pid)
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := process.Kill(); err != nil {
+		return err
+	}
+	removePidFile()
+	if _, err := removeStaleSocket(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	// How long a check of the power source is reused
+	batteryCheckInterval       = time.Minute
+	defaultBatterySyncInterval = Interval(30 * time.Minute)
+)
+
+type BatteryConfig struct {
+	// Charge in percent below which syncing on battery is reduced, never
+	// when 0
+	Threshold int `json:"threshold"`
+	// Time between syncs while reduced, 30 minutes by default
+	SyncInterval Interval `json:"sync_interval"`
+	// Uploads larger than this wait until plugged in, none when 0
+	MaxUploadSize int64 `json:"max_upload_bytes"`
+}
+
+func (config BatteryConfig) validate() error {
+	if config.Threshold < 0 || config.Threshold > 100 {
+		return fmt.Errorf("battery.threshold must be a percentage from 0 to 100, got %d", config.Threshold)
+	}
+	if config.MaxUploadSize < 0 {
+		return fmt.Errorf("battery.max_upload_bytes can't be negative")
+	}
+	return nil
+}
+
+// Power source of the machine
+type powerState struct {
+	onBattery bool
+	// Battery charge in percent, when on battery
+	percent int
+}
+
+// Whether the machine is on battery below the configured threshold, checked
+// at most every batteryCheckInterval. Returns the battery charge too.
+func (s *SyncEngine) lowBattery(config BatteryConfig) (bool, int) {
+	if config.Threshold == 0 {
+		return false, 0
+	}
+	s.powerMu.Lock()
+	defer s.powerMu.Unlock()
+	if s.powerAt.IsZero() || time.Since(s.powerAt) >= batteryCheckInterval {
+		power, err := systemPowerState()
+		if err != nil {
+			slog.Error("Failed to check the power source", "error", err)
+		}
+		if power.onBattery != s.power.onBattery {
+			if power.onBattery {
+				slog.Info("On battery", "percent", power.percent)
+			} else {
+				slog.Info("Plugged in")
+			}
+		}
+		s.power = power
+		s.powerAt = time.Now()
+	}
+	return s.power.onBattery && s.power.percent < config.Threshold, s.power.percent
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var batteryPercentPattern = regexp.MustCompile(`(\d+)%;`)
+
+// Parses pmset, which prints e.g.
+//
+//	Now drawing from 'Battery Power'
+//	 -InternalBattery-0 (id=1234567)	85%; discharging; 4:10 remaining present: true
+func systemPowerState() (powerState, error) {
+	output, err := exec.Command("pmset", "-g", "batt").Output()
+	if err != nil {
+		return powerState{}, commandError(err)
+	}
+	text := string(output)
+	if !strings.Contains(text, "'Battery Power'") {
+		return powerState{}, nil
+	}
+	power := powerState{onBattery: true}
+	if match := batteryPercentPattern.FindStringSubmatch(text); match != nil {
+		power.percent, _ = strconv.Atoi(match[1])
+	}
+	return power, nil
+}
@@ -0,0 +1,55 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Reads the power supplies the kernel exposes in sysfs. Machines without a
+// battery are never on battery.
+func systemPowerState() (powerState, error) {
+	supplies, err := filepath.Glob("/sys/class/power_supply/*")
+	if err != nil {
+		return powerState{}, err
+	}
+	var power powerState
+	batteries := 0
+	for _, supply := range supplies {
+		switch readSysfs(supply, "type") {
+		case "Mains", "USB":
+			if readSysfs(supply, "online") == "1" {
+				return powerState{}, nil
+			}
+		case "Battery":
+			if readSysfs(supply, "scope") == "Device" {
+				// The battery of a mouse or keyboard
+				continue
+			}
+			percent, err := strconv.Atoi(readSysfs(supply, "capacity"))
+			if err != nil {
+				continue
+			}
+			if readSysfs(supply, "status") == "Discharging" {
+				power.onBattery = true
+			}
+			power.percent += percent
+			batteries++
+		}
+	}
+	if batteries > 0 {
+		power.percent /= batteries
+	}
+	return power, nil
+}
+
+func readSysfs(dir, name string) string {
+	content, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
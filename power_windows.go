@@ -0,0 +1,38 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                 = syscall.NewLazyDLL("kernel32.dll")
+	procGetSystemPowerStatus = kernel32.NewProc("GetSystemPowerStatus")
+)
+
+// https://learn.microsoft.com/en-us/windows/win32/api/winbase/ns-winbase-system_power_status
+type systemPowerStatus struct {
+	ACLineStatus        byte
+	BatteryFlag         byte
+	BatteryLifePercent  byte
+	SystemStatusFlag    byte
+	BatteryLifeTime     uint32
+	BatteryFullLifeTime uint32
+}
+
+const (
+	acLineOffline         = 0
+	batteryPercentUnknown = 255
+)
+
+func systemPowerState() (powerState, error) {
+	var status systemPowerStatus
+	ret, _, err := procGetSystemPowerStatus.Call(uintptr(unsafe.Pointer(&status)))
+	if ret == 0 {
+		return powerState{}, err
+	}
+	if status.ACLineStatus != acLineOffline || status.BatteryLifePercent == batteryPercentUnknown {
+		return powerState{}, nil
+	}
+	return powerState{onBattery: true, percent: int(status.BatteryLifePercent)}, nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Objects larger than a part are downloaded with ranged GETs, this many at a
+// time, so that a large file isn't limited to what one connection gets
+// through a high-latency link
+const (
+	rangedDownloadPartSize = 16 << 20
+	rangedDownloadParallel = 4
+)
+
+// Files being downloaded are written next to their final path under this
+// suffix, and only moved there once complete. Local files with it are never
+// synced. See download_resume.go for how they are resumed.
+const partialDownloadSuffix = ".reposy-partial"
+
+// GetToFile downloads a file into file, returning its size. The first part
+// of the object is requested with a range, and when the object turns out to
+// be larger, the file is preallocated to its size and the other parts are
+// downloaded concurrently and written at their offset. Objects stored
+// compressed or as chunks are downloaded in parts too, but decoded in memory.
+// A download of parts into file that was cut short is resumed, fetching only
+// the parts it misses.
+func (s3 *S3Client) GetToFile(slashPath string, file *os.File) (int64, error) {
+	fullPath := path.Join(s3.Prefix, slashPath)
+	partialKey := file.Name()
+	if download := partialDownloads.get(partialKey); download != nil {
+		info, err := file.Stat()
+		if download.Key == fullPath && err == nil && info.Size() == download.Size {
+			slog.Info("Resuming download", "file", slashPath, "parts", len(download.Parts))
+			err := s3.getRanges(slashPath, fullPath, download, file, partialKey)
+			if err == nil {
+				partialDownloads.remove(partialKey)
+				return download.Size, nil
+			}
+			if !errors.Is(err, errObjectChanged) {
+				return 0, err
+			}
+		}
+		// The parts are of another object or version, so it starts over
+		partialDownloads.remove(partialKey)
+	}
+	if err := file.Truncate(0); err != nil {
+		return 0, err
+	}
+
+	resp, err := s3.request("GET", fullPath, nil, map[string]string{"Range": fmt.Sprintf("bytes=0-%d", rangedDownloadPartSize-1)}, nil)
+	if err != nil {
+		return 0, err
+	}
+	if isArchived(resp) {
+		return 0, &archivedError{Keys: []string{fullPath}}
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		// The range was ignored, the whole object was sent
+	case 206:
+		total, err := contentRangeTotal(resp.Headers["Content-Range"])
+		if err != nil {
+			return 0, fmt.Errorf("failed to download file %s: %w", slashPath, err)
+		}
+		if total > int64(len(resp.Body)) {
+			download := &partialDownload{
+				Key:       fullPath,
+				ETag:      resp.Headers["Etag"],
+				Size:      total,
+				PartSize:  int64(len(resp.Body)),
+				Parts:     map[int64]bool{0: true},
+				StartedAt: time.Now(),
+			}
+			if resp.Headers[http.CanonicalHeaderKey(HEADER_ENCODING)] != "" {
+				// Decoded once complete, so it can't be resumed
+				buffer := make([]byte, total)
+				copy(buffer, resp.Body)
+				if err := s3.getRanges(slashPath, fullPath, download, bufferWriter(buffer), ""); err != nil {
+					return 0, err
+				}
+				resp.Body = buffer
+				break
+			}
+			// Only reserves the size, the file stays sparse until written
+			if err := file.Truncate(total); err != nil {
+				return 0, fmt.Errorf("failed to preallocate %s: %w", partialKey, err)
+			}
+			if _, err := file.WriteAt(resp.Body, 0); err != nil {
+				return 0, err
+			}
+			partialDownloads.start(partialKey, download)
+			if err := s3.getRanges(slashPath, fullPath, download, file, partialKey); err != nil {
+				return 0, err
+			}
+			partialDownloads.remove(partialKey)
+			return total, nil
+		}
+	default:
+		return 0, fmt.Errorf("failed to download file %s: %s", slashPath, resp.Body)
+	}
+
+	content, err := s3.decodeObject(slashPath, resp.Headers, resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.Write(content); err != nil {
+		return 0, err
+	}
+	return int64(len(content)), nil
+}
+
+var errObjectChanged = errors.New("the object changed on the remote while it was downloaded")
+
+// Downloads the parts of an object that download misses and writes them at
+// their offset, recording them under partialKey unless it is empty
+func (s3 *S3Client) getRanges(slashPath, fullPath string, download *partialDownload, dst io.WriterAt, partialKey string) error {
+	// The parts must all be of the version the first part came from
+	headers := map[string]string{}
+	if download.ETag != "" {
+		headers["If-Match"] = download.ETag
+	}
+	offsets := make(chan int64)
+	var mu sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	var wg sync.WaitGroup
+	for range rangedDownloadParallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for offset := range offsets {
+				if failed() {
+					continue
+				}
+				end := min(offset+download.PartSize, download.Size) - 1
+				partHeaders := map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", offset, end)}
+				for name, value := range headers {
+					partHeaders[name] = value
+				}
+				resp, err := s3.request("GET", fullPath, nil, partHeaders, nil)
+				if err == nil && resp.StatusCode == 412 {
+					err = fmt.Errorf("%s: %w", slashPath, errObjectChanged)
+				} else if err == nil && (resp.StatusCode != 206 || int64(len(resp.Body)) != end-offset+1) {
+					err = fmt.Errorf("failed to download bytes %d-%d of %s: status %d", offset, end, slashPath, resp.StatusCode)
+				}
+				if err == nil {
+					_, err = dst.WriteAt(resp.Body, offset)
+				}
+				if err != nil {
+					fail(err)
+					continue
+				}
+				if partialKey != "" {
+					partialDownloads.completePart(partialKey, offset)
+				}
+			}
+		}()
+	}
+	for offset := int64(0); offset < download.Size; offset += download.PartSize {
+		if !download.Parts[offset] {
+			offsets <- offset
+		}
+	}
+	close(offsets)
+	wg.Wait()
+	return firstErr
+}
+
+// Total size of the object in a Content-Range header like "bytes 0-99/1000"
+func contentRangeTotal(contentRange string) (int64, error) {
+	_, total, ok := strings.Cut(contentRange, "/")
+	if !ok || total == "*" {
+		return 0, fmt.Errorf("unexpected Content-Range %q", contentRange)
+	}
+	return strconv.ParseInt(total, 10, 64)
+}
+
+type bufferWriter []byte
+
+func (buffer bufferWriter) WriteAt(p []byte, offset int64) (int, error) {
+	if offset+int64(len(p)) > int64(len(buffer)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(buffer[offset:], p), nil
+}
+
+// Downloads a file into a partial file next to it, checks it against its
+// SHA-256 in the index and moves it into place, returning its size
+func (repo *Repository) downloadToFile(getter interface {
+	GetToFile(slashPath string, file *os.File) (int64, error)
+}, slashPath string, remoteItem *RemoteItem) (int64, error) {
+	fullLocalPath := repo.localPath(slashPath)
+	partialPath := filepath.Join(filepath.Dir(fullLocalPath), "."+filepath.Base(fullLocalPath)+partialDownloadSuffix)
+	mode, _ := repo.Modes.fileMode(fullLocalPath)
+	// Kept while the download can be resumed
+	defer func() {
+		if !partialDownloads.has(partialPath) {
+			os.Remove(partialPath)
+		}
+	}()
+
+	for attempt := 1; ; attempt++ {
+		file, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, mode)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create file %s: %w", partialPath, err)
+		}
+		size, err := getter.GetToFile(remoteItem.objectPath(slashPath), file)
+		if err == nil && repo.Modes.Exact {
+			// The partial file may be left by a download with other modes
+			err = file.Chmod(mode)
+		}
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+		sum := ""
+		if remoteItem.SHA256 != "" {
+			hash := sha256.New()
+			_, err := file.Seek(0, io.SeekStart)
+			if err == nil {
+				_, err = io.Copy(hash, file)
+			}
+			if err != nil {
+				file.Close()
+				return 0, fmt.Errorf("failed to read file %s: %w", partialPath, err)
+			}
+			sum = hex.EncodeToString(hash.Sum(nil))
+		}
+		if err := file.Close(); err != nil {
+			return 0, fmt.Errorf("failed to write file %s: %w", partialPath, err)
+		}
+		// Files uploaded by older versions have no SHA-256 in the index
+		if sum == remoteItem.SHA256 {
+			if err := os.Rename(partialPath, fullLocalPath); err != nil {
+				return 0, fmt.Errorf("failed to write file %s: %w", fullLocalPath, err)
+			}
+			return size, nil
+		}
+		if attempt == downloadVerifyAttempts {
+			return 0, fmt.Errorf("downloaded %s doesn't match its SHA-256 in the index, the object is corrupt or truncated", slashPath)
+		}
+		repo.logger.Warn("Downloaded file doesn't match its SHA-256, downloading it again", "file", slashPath, "size", size)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ReportJSON = "json"
+	ReportCSV  = "csv"
+)
+
+type ReportArgs struct {
+	// All repositories when empty
+	Repository string    `json:"repository,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+// ReportPayload lists the transfers and errors of a period, for records of
+// where copies of the code are
+type ReportPayload struct {
+	Since   time.Time     `json:"since"`
+	Until   time.Time     `json:"until"`
+	Entries []ReportEntry `json:"entries"`
+}
+
+// One file transferred or deleted, or a sync that failed. Uploads and
+// changes to the remote come from the audit log, with their sizes, the
+// changes to local files from the history of sync runs.
+type ReportEntry struct {
+	Time       time.Time `json:"time"`
+	Repository string    `json:"repository"`
+	Remote     string    `json:"remote,omitempty"`
+	Action     string    `json:"action"`
+	Path       string    `json:"path,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Actions reported besides those of the audit log
+const (
+	ReportDownload   = "download"
+	ReportRemove     = "remove"
+	ReportSyncFailed = "sync_failed"
+)
+
+// Parses the start of the period of 'reposy report': a duration back from
+// now, in days with "d", weeks with "w" or any Go duration, or a date
+func parseSince(text string, now time.Time) (time.Time, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if number, ok := strings.CutSuffix(text, suffix); ok {
+			if n, err := strconv.Atoi(number); err == nil && n >= 0 {
+				return now.Add(-time.Duration(n) * unit), nil
+			}
+		}
+	}
+	if duration, err := time.ParseDuration(text); err == nil && duration >= 0 {
+		return now.Add(-duration), nil
+	}
+	if date, err := time.ParseInLocation(time.DateOnly, text, now.Location()); err == nil {
+		return date, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %s, use a duration like 7d, 2w or 12h, or a date like 2024-01-31", text)
+}
+
+// Report lists what the audit log and the history recorded since a time
+func (s *SyncEngine) Report(args ReportArgs) (ReportPayload, error) {
+	return buildReport(s.audit, s.history, args)
+}
+
+// LocalReport reads the audit log and the history from the state directory
+// to build the report, which is how 'reposy report' gets it: a report of a
+// long period can be too large for a response of the sync service.
+func LocalReport(args ReportArgs) (ReportPayload, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return ReportPayload{}, err
+	}
+	audit := &AuditLog{path: filepath.Join(dir, auditLogFile)}
+	history := &History{path: filepath.Join(dir, historyFile)}
+	return buildReport(audit, history, args)
+}
+
+func buildReport(audit *AuditLog, history *History, args ReportArgs) (ReportPayload, error) {
+	report := ReportPayload{Since: args.Since, Until: time.Now(), Entries: make([]ReportEntry, 0)}
+	included := func(repository string, t time.Time) bool {
+		return !t.Before(args.Since) && (args.Repository == "" || repository == args.Repository)
+	}
+
+	if audit != nil {
+		entries, err := audit.Entries()
+		if err != nil {
+			return report, err
+		}
+		for _, entry := range entries {
+			if entry.Action == AuditIndexWrite || !included(entry.Repository, entry.Time) {
+				continue
+			}
+			report.Entries = append(report.Entries, ReportEntry{
+				Time:       entry.Time,
+				Repository: entry.Repository,
+				Remote:     entry.Remote,
+				Action:     entry.Action,
+				Path:       entry.Path,
+				Size:       entry.Size,
+				Error:      entry.Error,
+			})
+		}
+	}
+
+	if history != nil {
+		runs, err := history.Runs(args.Repository, "")
+		if err != nil {
+			return report, err
+		}
+		for _, run := range runs {
+			if !included(run.Repository, run.FinishedAt) {
+				continue
+			}
+			for _, file := range run.Downloaded {
+				report.Entries = append(report.Entries, ReportEntry{Time: run.FinishedAt, Repository: run.Repository, Action: ReportDownload, Path: file})
+			}
+			for _, file := range run.Removed {
+				report.Entries = append(report.Entries, ReportEntry{Time: run.FinishedAt, Repository: run.Repository, Action: ReportRemove, Path: file})
+			}
+			if run.Error != "" {
+				report.Entries = append(report.Entries, ReportEntry{Time: run.FinishedAt, Repository: run.Repository, Action: ReportSyncFailed, Error: run.Error})
+			}
+		}
+	}
+
+	sort.SliceStable(report.Entries, func(i, j int) bool {
+		return report.Entries[i].Time.Before(report.Entries[j].Time)
+	})
+	return report, nil
+}
+
+func writeReport(w io.Writer, report ReportPayload, format string) error {
+	switch format {
+	case ReportJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(report)
+	case ReportCSV:
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"time", "repository", "remote", "action", "path", "size", "error"})
+		for _, entry := range report.Entries {
+			writer.Write([]string{
+				entry.Time.Format(time.RFC3339), entry.Repository, entry.Remote, entry.Action,
+				entry.Path, strconv.FormatInt(entry.Size, 10), entry.Error,
+			})
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	return fmt.Errorf("invalid report format %s, use %s or %s", format, ReportJSON, ReportCSV)
+}
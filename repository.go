@@ -1,127 +1,662 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
-	"strconv"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Repository struct {
-	Path           string
-	Status         SyncStatus
-	Client         Client
-	LastLocalFiles map[string]*FileItem
-	IgnoreCase     bool
+	Path   string
+	Client Client
+	// Guards status and retries, which are read while a sync runs
+	mu     sync.Mutex
+	status SyncStatus
+	// Held by Sync, Plan and Restore, which share the client and lastLocal
+	syncMu sync.Mutex
+	// Set by Close, after which Sync does nothing
+	closed     bool
+	IgnoreCase bool
+	// Longest a sync may take before its transfers are cancelled
+	Timeout time.Duration
+	// When the repository syncs by itself, always when nil
+	Schedule *Schedule
+	// Whether the git metadata of a linked worktree is synced
+	WorktreeMetadata bool
+	// Patterns of files in .git that aren't synced
+	GitExcludes []string
+	// How files are listed, GitBackendAuto when empty
+	GitBackend string
+	// Transient working tree files not synced, from temp_excludes
+	TempExcludes []string
+	// Working tree files never synced, from temp_excludes and
+	// global_excludes
+	Excludes gitIgnore
+	// Which way files are synced, DirectionBoth, DirectionPush,
+	// DirectionPull, DirectionMirror or DirectionArchive
+	Direction string
+	logger    *slog.Logger
+	events    *EventBus
+	history   *History
+	audit     *AuditLog
+	tracer    *Tracer
+	// Local files as of the last successful sync
+	lastLocal *localListing
+	// Record of the sync in progress
+	run *SyncRun
+	// Cancelled when the sync in progress times out
+	ctx context.Context
+	// Limits of the next syncs, set by the engine
+	limits SyncLimits
+	// Files that failed to sync, by slash path
+	retries map[string]*RetryItem
+	// How an empty remote is seeded
+	Seed SeedConfig
+	// Files uploaded by the seed of the sync in progress, with their
+	// modtimes
+	seeded map[string]*RemoteItem
+	// Hard links of the last listing, by path to the file they link to
+	hardLinks map[string]string
+	// Hard links the sync in progress downloads once the other files are
+	pendingLinks map[string]*RemoteItem
+	// Space the downloads held back by the sync in progress need, see
+	// diskspace.go
+	diskShortage *DiskShortage
+	// Working tree files of the last listing, see worktree_cache.go. Held
+	// by syncMu.
+	worktree *worktreeCache
+	// Paths written or removed since the last listing. Guarded by mu.
+	touched map[string]bool
+	// Where the git metadata is, as of the last listing
+	git *gitLayout
+	// Syncs deleting more files are held back until confirmed
+	DeletionLimit DeletionLimit
+	// Where local files deleted remotely go
+	Trash TrashConfig
+	// Set by ConfirmDeletions for the next sync
+	deletionsConfirmed bool
+	// Files transferred at once by a sync, and bytes of files the uploads
+	// may hold in memory, unlimited when 0
+	UploadConcurrency   int
+	DownloadConcurrency int
+	MaxInflightBytes    int64
+	// Whether scrubs hash the local files too
+	VerifyLocal bool
+	// Whether extended attributes are uploaded and restored with files, and
+	// POSIX ACLs with them
+	Xattrs     bool
+	XattrsACLs bool
+	// Time between scheduled snapshots, none when 0, and how many are kept
+	SnapshotInterval time.Duration
+	SnapshotKeep     int
+	// Whether the config skips the repository, which is then listed but
+	// never synced, unless 'reposy unskip' overrides it
+	Skip bool
+	// Modes of the files and directories downloads create
+	Modes CreationModes
+	// Files whose content no longer matches the SHA-256 they were synced
+	// with though their modtime is the same, by slash path with that modtime.
+	// They aren't uploaded until modified again. Guarded by mu.
+	damaged map[string]int64
 }
 
 type FileItem struct {
 	FilePath  string
 	ModTime   int64
 	Tombstone bool
+	// The file it is hard-linked to, see hardlink.go
+	Link string
+	// Changed since it was last synced, so a newer remote version conflicts
+	Edited bool
 }
 
 type RemoteItem struct {
 	ModTime   int64  `json:"mod_time"`
 	Tombstone bool   `json:"tombstone,omitempty"`
 	SHA256    string `json:"sha256,omitempty"`
+	// The file whose object holds the content of this hard link
+	Link string `json:"link,omitempty"`
+	// The machine that last changed the file, see machine.go
+	MachineID   string `json:"machine_id,omitempty"`
+	MachineName string `json:"machine_name,omitempty"`
+	// Size of the file, 0 when empty or written before sizes were recorded
+	Size int64 `json:"size,omitempty"`
+}
+
+// The path of the object holding the content of a file
+func (item *RemoteItem) objectPath(slashPath string) string {
+	if item.Link != "" {
+		return item.Link
+	}
+	return slashPath
+}
+
+// SyncPlan lists what the next sync of a repository would do
+type SyncPlan struct {
+	Repository string `json:"repository"`
+	// Set when the plan is against the cached index of an unreachable remote
+	Offline   bool     `json:"offline,omitempty"`
+	Upload    []string `json:"upload,omitempty"`
+	Tombstone []string `json:"tombstone,omitempty"`
+	Delete    []string `json:"delete,omitempty"`
+	Download  []string `json:"download,omitempty"`
+	Remove    []string `json:"remove,omitempty"`
 }
 
 const FETCH_HEAD = ".git/FETCH_HEAD"
 
+// Directions a repository syncs in. Push never changes local files, pull
+// never writes to the remote. Mirror pushes too, and makes the remote match
+// the local files exactly, deleting remote files right away rather than
+// leaving tombstones. Archive pushes without ever deleting remote files, they
+// are only deleted by Purge.
+const (
+	DirectionBoth    = "both"
+	DirectionPush    = "push"
+	DirectionPull    = "pull"
+	DirectionMirror  = "mirror"
+	DirectionArchive = "archive"
+)
+
+// Files modified more recently are only read once they are this old, to
+// tell whether they are still being written
+const stableReadAge = 500 * time.Millisecond
+
+// Times a file whose content doesn't match its SHA-256 is downloaded before
+// the download fails and is left to the retries of later syncs
+const downloadVerifyAttempts = 2
+
 type Client interface {
-	List() (map[string]*RemoteItem, error)
+	Index() (*IndexManifest, error)
+	List(index *IndexManifest, shard, shards int) (map[string]*RemoteItem, error)
 	Put(data []byte, modTime time.Time, slashPath string) error
 	Get(slashPath string) ([]byte, error)
 	Delete(slashPath string) error
 	MarkTombstone(slashPath string) error
-	Finish(remoteFiles map[string]*RemoteItem, changed bool) error
+	PutShard(index *IndexManifest, shard, shards int, items map[string]*RemoteItem) error
+	PutDelta(index *IndexManifest, changes map[string]*RemoteItem) error
+	Finish(index *IndexManifest, shards int) error
+	GetSeed() (map[string]*RemoteItem, error)
+	PutSeed(items map[string]*RemoteItem) error
+	DeleteSeed() error
 }
 
-func NewRepository(repoPath string, config *Config, repoConfig *RepositoryConfig) *Repository {
-	client := NewClient(config, repoConfig)
-	return &Repository{
-		Path:       repoPath,
-		Client:     client,
-		IgnoreCase: *repoConfig.IgnoreCase,
+func NewRepository(repoPath string, config *Config, repoConfig *RepositoryConfig) (*Repository, error) {
+	client, err := NewClient(config, repoConfig)
+	if err != nil {
+		return nil, fmt.Errorf("repository %s: %w", repoPath, err)
+	}
+	// global_excludes come last, so that they can negate temp_excludes
+	excludes, err := compileExcludes(append(slices.Clone(repoConfig.TempExcludes), config.GlobalExcludes...))
+	if err != nil {
+		return nil, err
+	}
+	snapshotInterval, err := parseSnapshotSchedule(repoConfig.SnapshotSchedule)
+	if err != nil {
+		return nil, err
 	}
+	return &Repository{
+		Path:                repoPath,
+		Client:              client,
+		IgnoreCase:          *repoConfig.IgnoreCase,
+		Timeout:             time.Duration(*repoConfig.SyncTimeout),
+		Schedule:            repoConfig.Schedule,
+		WorktreeMetadata:    repoConfig.WorktreeMetadata,
+		GitExcludes:         repoConfig.GitExcludes,
+		TempExcludes:        repoConfig.TempExcludes,
+		GitBackend:          repoConfig.GitBackend,
+		Excludes:            excludes,
+		Direction:           repoConfig.Direction,
+		Seed:                config.Seed,
+		DeletionLimit:       *repoConfig.DeletionLimit,
+		Trash:               config.Trash,
+		UploadConcurrency:   max(repoConfig.UploadConcurrency, 1),
+		DownloadConcurrency: max(repoConfig.DownloadConcurrency, 1),
+		MaxInflightBytes:    repoConfig.MaxInflightBytes,
+		VerifyLocal:         repoConfig.VerifyLocal,
+		Xattrs:              repoConfig.Xattrs,
+		XattrsACLs:          repoConfig.XattrsACLs,
+		SnapshotInterval:    snapshotInterval,
+		SnapshotKeep:        repoConfig.SnapshotKeep,
+		Skip:                repoConfig.Skip,
+		Modes:               newCreationModes(repoConfig),
+		logger:              slog.Default().With("repo", repoPath),
+	}, nil
 }
 
-func NewClient(config *Config, repoConfig *RepositoryConfig) Client {
+func NewClient(config *Config, repoConfig *RepositoryConfig) (Client, error) {
 	switch repoConfig.Type {
 	case "s3":
 		return NewS3Client(config, repoConfig)
 	default:
-		log.Fatal("Unsupported remote type: " + repoConfig.Type)
-		return nil
+		return nil, fmt.Errorf("unsupported remote type: %s", repoConfig.Type)
 	}
 }
 
+// Close removes the files the repository keeps on disk between syncs, once
+// no sync, plan or restore uses them
+func (repo *Repository) Close() {
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+	repo.lastLocal.Close()
+	repo.lastLocal = nil
+	repo.closed = true
+}
+
+// Status returns a copy of the sync status
+func (repo *Repository) Status() SyncStatus {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return repo.status
+}
+
+// SyncLimits hold back syncs on a metered network or on battery. The zero
+// value doesn't limit anything.
+type SyncLimits struct {
+	// Bytes per second each transfer is limited to
+	Throttle int64
+	// Larger files aren't uploaded
+	MaxUploadSize int64
+}
+
+// SetLimits sets the limits of the next syncs
+func (repo *Repository) SetLimits(limits SyncLimits) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.limits = limits
+}
+
+func (repo *Repository) syncLimits() SyncLimits {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return repo.limits
+}
+
+func (repo *Repository) updateStatus(update func(status *SyncStatus)) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	update(&repo.status)
+}
+
+// Sync syncs the repository once. A panic during the sync is recovered and
+// recorded as a failed sync, so it can't bring down the other repositories.
 func (repo *Repository) Sync() {
-	log.Printf("Starting sync for: %s", repo.Path)
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+	if repo.closed {
+		return
+	}
+	if repo.rootMissing() {
+		message := fmt.Sprintf("Repository path is missing: %s", repo.Path)
+		missing := repo.Status().Missing
+		repo.updateStatus(func(status *SyncStatus) {
+			status.Missing = true
+			status.Error = message
+			status.ErrorAt = time.Now()
+		})
+		// Reported once, not on every sync interval
+		if !missing {
+			repo.logger.Error(message)
+			repo.emit(Event{Type: EventSyncFailed, Message: message})
+		}
+		return
+	}
+	if until := clientCircuitOpenUntil(repo.Client); !until.IsZero() {
+		// Reported once by the circuit, not on every sync interval
+		repo.updateStatus(func(status *SyncStatus) {
+			status.CircuitOpenUntil = until
+			status.Error = fmt.Sprintf("Remote unavailable after repeated failures, next attempt at %s", until.Format(time.TimeOnly))
+			status.ErrorAt = time.Now()
+		})
+		return
+	}
+
+	repo.logger.Info("Starting sync")
+	repo.emit(Event{Type: EventSyncStarted})
 	// Mark as in progress
-	status := &repo.Status
-	status.InProgress = true
-	status.Error = ""
+	startedAt := time.Now()
+	repo.updateStatus(func(status *SyncStatus) {
+		status.InProgress = true
+		status.Error = ""
+		status.Missing = false
+		status.CircuitOpenUntil = time.Time{}
+		status.StartedAt = startedAt
+		status.CurrentFile = ""
+		status.Queued = 0
+		status.BytesTransferred = 0
+	})
+	repo.run = &SyncRun{Repository: repo.Path, StartedAt: startedAt}
+	ctx, cancel := context.WithTimeout(context.Background(), repo.Timeout)
+	defer cancel()
+	repo.ctx = ctx
+	setClientContext(repo.Client, ctx)
+	setClientThrottle(repo.Client, repo.syncLimits().Throttle)
+	span := repo.tracer.Start("sync", "reposy.repository", repo.Path)
+	setClientTraceParent(repo.Client, span)
+
+	failure := ""
+	fail := func(message string) {
+		failure = message
+		repo.updateStatus(func(status *SyncStatus) {
+			status.Error = message
+			status.ErrorAt = time.Now()
+		})
+		repo.logger.Error(message)
+		repo.emit(Event{Type: EventSyncFailed, Message: message, Failures: repo.Status().FailureStreak + 1})
+	}
 
 	defer func() {
-		status.InProgress = false
-		status.LastSync = time.Now()
+		setClientTraceParent(repo.Client, nil)
+		setClientContext(repo.Client, nil)
+		setClientThrottle(repo.Client, 0)
+		repo.ctx = nil
+		span.SetAttributes(
+			"reposy.files_uploaded", len(repo.run.Uploaded),
+			"reposy.files_downloaded", len(repo.run.Downloaded),
+			"reposy.files_tombstoned", len(repo.run.Tombstoned),
+			"reposy.files_removed", len(repo.run.Removed),
+			"reposy.bytes_uploaded", repo.run.BytesUploaded,
+			"reposy.bytes_downloaded", repo.run.BytesDownloaded,
+		)
+		if failure != "" {
+			span.SetError(fmt.Errorf("%s", failure))
+		}
+		span.End()
+		repo.finishRun(time.Now(), failure)
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			repo.logger.Error("Sync panicked", "stack", string(debug.Stack()))
+			fail(fmt.Sprintf("Sync panicked: %v", r))
+		}
 	}()
 
 	// Get local files
-	localFiles, err := repo.GetLocalFiles()
+	phase := span.Child("list local files")
+	localFiles, err := repo.listLocalFiles()
+	phase.SetAttributes("reposy.files", localFiles.Len())
+	phase.SetError(err)
+	phase.End()
 	if err != nil {
-		status.Error = fmt.Sprintf("Failed to get local files: %v", err)
-		log.Printf(status.Error)
+		localFiles.Close()
+		fail(fmt.Sprintf("Failed to get local files: %v", err))
 		return
 	}
+	defer localFiles.Close()
 
-	// Check removed files since last sync
-	if repo.LastLocalFiles != nil {
-		for slashPath, item := range repo.LastLocalFiles {
-			if item.Tombstone {
-				continue
-			}
-			if _, found := localFiles[slashPath]; !found {
-				localFiles[slashPath] = &FileItem{
-					FilePath:  item.FilePath,
-					ModTime:   time.Now().Unix(),
-					Tombstone: true,
-				}
-			}
+	repo.emptyTrash()
+
+	held, err := repo.checkDeletions(localFiles)
+	if err != nil {
+		fail(fmt.Sprintf("Failed to get local files: %v", err))
+		return
+	}
+	alreadyHeld := repo.Status().Deletions != nil
+	repo.updateStatus(func(status *SyncStatus) {
+		status.Deletions = held
+	})
+	if held != nil {
+		failure = fmt.Sprintf("Sync held back, it would delete %d of %d files", held.Files, held.Total)
+		repo.updateStatus(func(status *SyncStatus) {
+			status.Error = failure
+			status.ErrorAt = time.Now()
+		})
+		// Reported once, not on every sync interval
+		if !alreadyHeld {
+			repo.logger.Error(failure)
+			repo.emit(Event{Type: EventSyncFailed, Message: failure})
 		}
+		return
 	}
 
 	// Get remote files
-	remoteFiles, err := repo.GetRemoteFiles()
+	phase = span.Child("list remote files")
+	setClientTraceParent(repo.Client, phase)
+	index, err := repo.Client.Index()
+	if err == nil {
+		phase.SetAttributes("reposy.index_shards", index.Shards)
+		if offline, ok := repo.Client.(interface{ IndexOffline() bool }); ok && offline.IndexOffline() {
+			err = errIndexOffline
+		}
+	}
+	phase.SetError(err)
+	phase.End()
+	if err != nil {
+		fail(repo.failure("Failed to get remote files", err))
+		return
+	}
+
+	// An empty remote is seeded before the first sync
+	seeded, err := repo.seedState(index, localFiles)
+	if err == nil && seeded != nil {
+		phase = span.Child("seed")
+		setClientTraceParent(repo.Client, phase)
+		err = repo.seed(localFiles, seeded)
+		phase.SetAttributes("reposy.files", len(seeded))
+		phase.SetError(err)
+		phase.End()
+	}
 	if err != nil {
-		status.Error = fmt.Sprintf("Failed to get remote files: %v", err)
-		log.Printf(status.Error)
+		fail(repo.failure("Failed to seed remote", err))
 		return
 	}
+	repo.seeded = seeded
+	defer func() {
+		repo.seeded = nil
+	}()
 
 	// Compare and sync files
-	err = repo.compareAndSync(localFiles, remoteFiles)
+	phase = span.Child("transfer files")
+	setClientTraceParent(repo.Client, phase)
+	synced, err := repo.syncShards(localFiles, index)
+	phase.SetError(err)
+	phase.End()
 	if err != nil {
-		status.Error = fmt.Sprintf("Failed to sync files: %v", err)
-		log.Printf(status.Error)
+		synced.Close()
+		fail(repo.failure("Failed to sync files", err))
 		return
 	}
 
-	log.Printf("Completed sync for: %s", repo.Path)
+	if seeded != nil {
+		if err := repo.Client.DeleteSeed(); err != nil {
+			repo.logger.Error("Failed to remove seed marker", "error", err)
+		}
+	}
+
+	repo.logger.Info("Completed sync")
+	repo.emit(Event{Type: EventSyncCompleted})
+
+	repo.lastLocal.Close()
+	repo.lastLocal = synced
+}
+
+// Syncs the repository one shard of the index at a time, so only a shard of
+// the local and remote files is in memory at once. Returns the local files
+// after the sync.
+func (repo *Repository) syncShards(localFiles *localListing, index *IndexManifest) (*localListing, error) {
+	synced := newLocalListing()
+	shards := max(index.Shards, indexShardsFor(max(localFiles.Len(), repo.lastLocal.Len())))
+	if repo.Direction == DirectionPull {
+		// The index is left as it is, for a syncing machine to split
+		shards = index.Shards
+	}
+	if shards != index.Shards {
+		repo.logger.Info("Splitting remote index", "shards", shards)
+	}
+
+	// Every shard is rewritten when the index is compacted
+	compact := shards != index.Shards || index.NeedsCompaction() && repo.Direction != DirectionPull
+	delta := make(map[string]*RemoteItem)
+	failed := 0
+	var behind BehindStatus
+	repo.pendingLinks = make(map[string]*RemoteItem)
+	repo.diskShortage = nil
+	defer func() {
+		repo.pendingLinks = nil
+	}()
+	for shard := 0; shard < shards; shard++ {
+		localItems, err := repo.localShard(localFiles, shard, shards)
+		if err != nil {
+			return synced, err
+		}
+		remoteItems, err := repo.Client.List(index, shard, shards)
+		if err != nil {
+			return synced, fmt.Errorf("failed to get remote files: %w", err)
+		}
+
+		storedEntries := len(remoteItems)
+		changes, shardFailed, err := repo.compareAndSync(localItems, remoteItems, shard, shards)
+		failed += shardFailed
+		if err != nil {
+			return synced, err
+		}
+		repo.countBehind(&behind, localItems, remoteItems)
+
+		// Changes to a large shard are kept for a delta, unless there are
+		// too many of them
+		useDelta := !compact && storedEntries >= indexDeltaMinShard && len(delta)+len(changes) <= indexDeltaMaxEntries
+		if len(changes) > 0 && useDelta {
+			for slashPath, item := range changes {
+				delta[slashPath] = item
+			}
+		} else if len(changes) > 0 || shards != index.Shards || compact && index.deltaTouches(shard, shards) {
+			err = repo.Client.PutShard(index, shard, shards, remoteItems)
+			if len(changes) > 0 {
+				repo.recordMutation(AuditIndexWrite, indexShardPath(shard, shards), 0, fmt.Sprintf("index of %d entries updated after changes", len(remoteItems)), err)
+			}
+			if err != nil {
+				return synced, fmt.Errorf("failed to finish sync: %w", err)
+			}
+		}
+
+		for slashPath, item := range localItems {
+			if err := synced.Add(slashPath, item); err != nil {
+				return synced, err
+			}
+		}
+	}
+
+	shortage := repo.diskShortage
+	repo.updateStatus(func(status *SyncStatus) {
+		status.Behind = nil
+		if behind.Files > 0 {
+			status.Behind = &behind
+		}
+		status.DiskSpace = shortage
+	})
+
+	linksFailed, err := repo.downloadLinks(synced)
+	failed += linksFailed
+	if err != nil {
+		return synced, err
+	}
+
+	if len(delta) > 0 {
+		err := repo.Client.PutDelta(index, delta)
+		repo.recordMutation(AuditIndexWrite, indexDeltaPath(index.LastDelta()+1), 0, fmt.Sprintf("index delta of %d entries appended after changes", len(delta)), err)
+		if err != nil {
+			return synced, fmt.Errorf("failed to finish sync: %w", err)
+		}
+	}
+	if compact {
+		err := repo.Client.Finish(index, shards)
+		reason := fmt.Sprintf("%d index deltas compacted", len(index.deltas))
+		if shards != index.Shards {
+			reason = fmt.Sprintf("index split into %d shards", shards)
+		}
+		repo.recordMutation(AuditIndexWrite, INDEX_FILE, 0, reason, err)
+		if err != nil {
+			return synced, fmt.Errorf("failed to finish sync: %w", err)
+		}
+	}
+	if shortage != nil {
+		return synced, fmt.Errorf("insufficient disk space, downloads need %s and %s is free", formatBytes(shortage.Needed), formatBytes(shortage.Available))
+	}
+	if failed > 0 {
+		return synced, fmt.Errorf("%d file(s) failed and will be retried", failed)
+	}
+	return synced, nil
+}
+
+// Local files in a shard plus tombstones for files removed since last sync
+func (repo *Repository) localShard(localFiles *localListing, shard, shards int) (map[string]*FileItem, error) {
+	localItems, err := localFiles.Shard(shard, shards)
+	if err != nil {
+		return nil, err
+	}
+	for slashPath, item := range localItems {
+		item.Link = repo.hardLinks[slashPath]
+	}
+	lastItems, err := repo.lastLocal.Shard(shard, shards)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check removed and edited files since last sync
+	for slashPath, item := range lastItems {
+		if item.Tombstone {
+			continue
+		}
+		if localItem, found := localItems[slashPath]; found {
+			localItem.Edited = !localItem.Tombstone && !sameModTime(localItem.ModTime, item.ModTime)
+		} else {
+			localItems[slashPath] = &FileItem{
+				FilePath:  item.FilePath,
+				ModTime:   time.Now().UnixNano(),
+				Tombstone: true,
+			}
+		}
+	}
+	return localItems, nil
+}
 
-	repo.LastLocalFiles = localFiles
+// Whether the root of a repository that synced before is gone, most likely
+// moved. It isn't recreated, which would sync the repository as if all its
+// files were deleted. A repository that never synced is created by its first
+// sync instead.
+func (repo *Repository) rootMissing() bool {
+	if _, err := os.Stat(repo.Path); !os.IsNotExist(err) {
+		return false
+	}
+	if repo.lastLocal.Len() > 0 || !repo.Status().LastSync.IsZero() {
+		return true
+	}
+	if repo.history == nil {
+		return false
+	}
+	runs, err := repo.history.Runs(repo.Path, "")
+	if err != nil {
+		return false
+	}
+	for _, run := range runs {
+		if run.Error == "" {
+			return true
+		}
+	}
+	return false
 }
 
-func (repo *Repository) GetLocalFiles() (map[string]*FileItem, error) {
+// Lists the files of the repository, streaming them into a listing that
+// spills to disk for large repositories
+func (repo *Repository) listLocalFiles() (*localListing, error) {
 	repoPath := repo.Path
-	result := make(map[string]*FileItem)
+	result := newLocalListing()
+	var links hardLinkTracker
+	defer func() {
+		repo.hardLinks = links.links()
+	}()
 
 	// Check if repoPath exists
 	repoPathInfo, err := os.Stat(repoPath)
@@ -144,91 +679,96 @@ func (repo *Repository) GetLocalFiles() (map[string]*FileItem, error) {
 		return nil, fmt.Errorf("failed to read repo directory: %w", err)
 	}
 	if len(entries) == 0 {
-		return nil, nil
-	}
-
-	// Run git ls-files command to get tracked and untracked (but not ignored) files
-	cmd := exec.Command("git", "-C", repoPath, "ls-files", "--others", "--exclude-standard", "--cached")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("git ls-files command failed: %w", err)
+		return result, nil
 	}
 
-	gitLsFiles := strings.Split(string(output), "\n") // slash path
-	filePaths := make([]string, 0, len(gitLsFiles))
-	for _, filePath := range gitLsFiles {
-		if filePath == "" {
-			continue
+	addEntry := func(slashPath, filePath string, file worktreeFile) error {
+		if excludedGitPath(repo.GitExcludes, slashPath) {
+			return nil
 		}
-		if filePath[0] == '"' {
-			filePath, err = strconv.Unquote(filePath)
-			if err != nil {
-				return nil, fmt.Errorf("failed to unquote file path: %s", filePath)
-			}
+		if strings.HasSuffix(slashPath, partialDownloadSuffix) {
+			// Left by a download cut short
+			return nil
+		}
+		if file.Linked {
+			links.add(slashPath, file.Link)
 		}
-		filePath = filepath.FromSlash(filePath)
-		filePaths = append(filePaths, filePath)
+		return result.Add(slashPath, &FileItem{
+			FilePath:  filePath,
+			ModTime:   file.ModTime,
+			Tombstone: false,
+		})
 	}
-
-	// Walk through .git directory and collect file paths
-	gitPath := filepath.Join(repoPath, ".git")
-	err = filepath.Walk(gitPath, func(fullFilePath string, info os.FileInfo, err error) error {
-		if err != nil {
+	addFile := func(slashPath, filePath string) error {
+		file, ok, err := statWorktreeFile(filepath.Join(repoPath, filePath))
+		if err != nil || !ok {
 			return err
 		}
+		return addEntry(slashPath, filePath, file)
+	}
 
-		// Skip directories
-		if info.IsDir() {
+	// Tracked and untracked (but not ignored) files
+	err = repo.listWorktree(func(slashPath string, file worktreeFile) error {
+		remotePath := syncedPath(slashPath)
+		if repo.excluded(remotePath) {
 			return nil
 		}
-
-		filePath, err := filepath.Rel(repoPath, fullFilePath)
-		if err != nil {
-			return err
-		}
-
-		filePaths = append(filePaths, filePath)
-		return nil
+		return addEntry(remotePath, filepath.FromSlash(slashPath), file)
 	})
-
 	if err != nil {
-		return nil, fmt.Errorf("failed to walk .git directory: %w", err)
+		result.Close()
+		return nil, err
 	}
 
-	for _, filePath := range filePaths {
-		if filePath == "" {
-			continue
+	git, err := resolveGitLayout(repoPath)
+	if err != nil {
+		result.Close()
+		return nil, fmt.Errorf("failed to find git metadata: %w", err)
+	}
+	repo.git = git
+	if git.worktree {
+		// The metadata of a linked worktree lives outside of it, and is
+		// synced as if it were a .git directory when enabled
+		if repo.WorktreeMetadata {
+			err = git.walkWorktree(func(slashPath, fullPath string) error {
+				filePath, err := filepath.Rel(repoPath, fullPath)
+				if err != nil {
+					return err
+				}
+				return addFile(slashPath, filePath)
+			})
 		}
-
-		fullFilePath := filepath.Join(repoPath, filePath)
-		info, err := os.Stat(fullFilePath)
-		if err != nil {
+	} else {
+		// Walk through .git directory and collect file paths
+		err = filepath.Walk(git.gitDir, func(fullFilePath string, info os.FileInfo, err error) error {
 			if os.IsNotExist(err) {
-				// maybe user remove file directly, not using git
-				continue
+				// Removed by git while walking
+				return nil
+			}
+			if err != nil {
+				return err
 			}
-			return nil, fmt.Errorf("failed to stat file %s: %w", fullFilePath, err)
-		}
 
-		if !info.IsDir() {
-			slashPath := filepath.ToSlash(filePath)
-			result[slashPath] = &FileItem{
-				FilePath:  filePath,
-				ModTime:   info.ModTime().Unix(),
-				Tombstone: false,
+			// Skip directories
+			if info.IsDir() {
+				return nil
 			}
-		}
-	}
 
-	return result, nil
-}
+			filePath, err := filepath.Rel(repoPath, fullFilePath)
+			if err != nil {
+				return err
+			}
 
-func (repo *Repository) GetRemoteFiles() (map[string]*RemoteItem, error) {
-	result, err := repo.Client.List()
-	if err == nil && result == nil {
-		result = make(map[string]*RemoteItem)
+			return addFile(filepath.ToSlash(filePath), filePath)
+		})
 	}
-	return result, err
+
+	if err != nil {
+		result.Close()
+		return nil, fmt.Errorf("failed to walk .git directory: %w", err)
+	}
+
+	return result, nil
 }
 
 func ensureWritableIfExist(path string) (exist bool, err error) {
@@ -279,18 +819,63 @@ func checkFilenameConflictIgnoringCase(filePath string) (bool, error) {
 	return false, nil
 }
 
+// Splits the items that differ into those to push and those to pull, of
+// which a one-way repository keeps only its own direction
+func (repo *Repository) diffItems(localItems map[string]*FileItem, remoteItems map[string]*RemoteItem) (map[string]*FileItem, map[string]*RemoteItem) {
+	localNewerItems, remoteNewerItems := diffItems(localItems, remoteItems)
+	if repo.Direction != DirectionPull {
+		for slashPath, localItem := range relinkedItems(localItems, remoteItems) {
+			localNewerItems[slashPath] = localItem
+		}
+	}
+	switch repo.Direction {
+	case DirectionPush:
+		clear(remoteNewerItems)
+	case DirectionPull:
+		clear(localNewerItems)
+	case DirectionMirror:
+		items := mirrorItems(localItems, remoteItems)
+		for slashPath, localItem := range relinkedItems(localItems, remoteItems) {
+			items[slashPath] = localItem
+		}
+		return items, map[string]*RemoteItem{}
+	case DirectionArchive:
+		clear(remoteNewerItems)
+		maps.DeleteFunc(localNewerItems, func(slashPath string, item *FileItem) bool {
+			return item.Tombstone
+		})
+	}
+	return localNewerItems, remoteNewerItems
+}
 
-func (repo *Repository) compareAndSync(localItems map[string]*FileItem, remoteItems map[string]*RemoteItem) error {
-
-	remoteChanged := false
-
-	if localItems == nil {
-		localItems = make(map[string]*FileItem)
+// The changes that make the remote match the local files: local files that
+// differ from the remote are uploaded, whichever is newer, and every other
+// remote entry, tombstones included, is deleted, which a tombstone item marks
+func mirrorItems(localItems map[string]*FileItem, remoteItems map[string]*RemoteItem) map[string]*FileItem {
+	items := make(map[string]*FileItem)
+	for slashPath, localItem := range localItems {
+		if localItem.Tombstone {
+			continue
+		}
+		remoteItem, exists := remoteItems[slashPath]
+		if !exists || remoteItem.Tombstone || !sameModTime(remoteItem.ModTime, localItem.ModTime) {
+			items[slashPath] = localItem
+		}
 	}
-	if remoteItems == nil {
-		remoteItems = make(map[string]*RemoteItem)
+	for slashPath := range remoteItems {
+		if localItem, exists := localItems[slashPath]; !exists || localItem.Tombstone {
+			items[slashPath] = &FileItem{
+				FilePath:  filepath.FromSlash(diskPath(slashPath)),
+				ModTime:   time.Now().UnixNano(),
+				Tombstone: true,
+			}
+		}
 	}
+	return items
+}
 
+// Splits the items that differ into those to push and those to pull
+func diffItems(localItems map[string]*FileItem, remoteItems map[string]*RemoteItem) (map[string]*FileItem, map[string]*RemoteItem) {
 	localNewerItems := make(map[string]*FileItem)
 	remoteNewerItems := make(map[string]*RemoteItem)
 
@@ -306,157 +891,872 @@ func (repo *Repository) compareAndSync(localItems map[string]*FileItem, remoteIt
 		if !exists {
 			remoteNewerItems[slashPath] = remoteItem
 		} else {
-			if localItem.ModTime > remoteItem.ModTime {
+			switch compareModTime(localItem.ModTime, remoteItem.ModTime) {
+			case 1:
 				localNewerItems[slashPath] = localItem
-			} else if localItem.ModTime < remoteItem.ModTime {
+			case -1:
 				remoteNewerItems[slashPath] = remoteItem
 			}
 		}
 	}
+	return localNewerItems, remoteNewerItems
+}
 
-	for slashPath, localItem := range localNewerItems {
-		if localItem.Tombstone {
-			log.Printf("Marking remote file as tombstone: %s", slashPath)
-			err := repo.Client.MarkTombstone(slashPath)
-			if err != nil {
-				return fmt.Errorf("failed to mark remote file as tombstone: %w", err)
-			}
-			remoteItems[slashPath] = &RemoteItem{
-				ModTime:   localItem.ModTime,
-				Tombstone: true,
+// Plan computes what the next sync would do without changing anything
+func (repo *Repository) Plan() (*SyncPlan, error) {
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+
+	localFiles, err := repo.listLocalFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get local files: %w", err)
+	}
+	defer localFiles.Close()
+	index, err := repo.Client.Index()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get remote files: %w", err)
+	}
+
+	plan := &SyncPlan{Repository: repo.Path}
+	for shard := 0; shard < index.Shards; shard++ {
+		localItems, err := repo.localShard(localFiles, shard, index.Shards)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get local files: %w", err)
+		}
+		remoteItems, err := repo.Client.List(index, shard, index.Shards)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get remote files: %w", err)
+		}
+
+		localNewerItems, remoteNewerItems := repo.diffItems(localItems, remoteItems)
+		for slashPath, localItem := range localNewerItems {
+			if localItem.Tombstone && repo.Direction == DirectionMirror && !repo.objectLocked() {
+				plan.Delete = append(plan.Delete, slashPath)
+			} else if localItem.Tombstone {
+				plan.Tombstone = append(plan.Tombstone, slashPath)
+			} else {
+				plan.Upload = append(plan.Upload, slashPath)
 			}
-			remoteChanged = true
-		} else {
-			localFilePath := filepath.Join(repo.Path, localItem.FilePath)
-			fileInfo, err := os.Stat(localFilePath)
-			if err != nil {
-				return err
+		}
+		for slashPath, remoteItem := range remoteNewerItems {
+			if remoteItem.Tombstone {
+				if _, exists := localItems[slashPath]; exists {
+					plan.Remove = append(plan.Remove, slashPath)
+				}
+			} else {
+				plan.Download = append(plan.Download, slashPath)
 			}
+		}
+	}
+	sort.Strings(plan.Upload)
+	sort.Strings(plan.Tombstone)
+	sort.Strings(plan.Delete)
+	sort.Strings(plan.Download)
+	sort.Strings(plan.Remove)
+	if offline, ok := repo.Client.(interface{ IndexOffline() bool }); ok {
+		plan.Offline = offline.IndexOffline()
+	}
+	return plan, nil
+}
 
-			if fileInfo.IsDir() {
-				log.Fatal("can not upload directory: " + localFilePath)
-			}
+// Returns the error of the sync in progress once it is cancelled
+func (repo *Repository) cancelled() error {
+	if repo.ctx == nil {
+		return nil
+	}
+	return repo.ctx.Err()
+}
 
-			data, err := os.ReadFile(localFilePath)
-			if err != nil {
-				return err
+// Syncs the files of one shard of the index. Returns the entries of the remote
+// index that changed, nil for removed ones, and how many files failed to sync.
+func (repo *Repository) compareAndSync(localItems map[string]*FileItem, remoteItems map[string]*RemoteItem, shard, shards int) (changes map[string]*RemoteItem, failed int, err error) {
+	changes = make(map[string]*RemoteItem)
+	localNewerItems, remoteNewerItems := repo.diffItems(localItems, remoteItems)
+	repo.checkDiskSpace(remoteNewerItems)
+
+	queued := len(localNewerItems) + len(remoteNewerItems)
+	repo.updateStatus(func(status *SyncStatus) {
+		status.Queued = queued
+	})
+
+	// A failed file doesn't stop the sync of the others, it is retried by a
+	// later sync instead
+	pending := make(map[string]bool, queued)
+	for slashPath := range localNewerItems {
+		pending[slashPath] = true
+	}
+	for slashPath := range remoteNewerItems {
+		pending[slashPath] = true
+	}
+	repo.pruneRetries(pending, shard, shards)
+	maxUploadSize := repo.syncLimits().MaxUploadSize
+
+	// Bytes left to upload, counted down as uploads finish or are skipped
+	sizes := make(map[string]int64, len(localNewerItems))
+	var bytesPending int64
+	for slashPath, localItem := range localNewerItems {
+		if localItem.Tombstone {
+			continue
+		}
+		if fileInfo, err := os.Stat(filepath.Join(repo.Path, localItem.FilePath)); err == nil && !fileInfo.IsDir() {
+			sizes[slashPath] = fileInfo.Size()
+			bytesPending += fileInfo.Size()
+		}
+	}
+	repo.updateStatus(func(status *SyncStatus) {
+		status.BytesPending = bytesPending
+	})
+	uploaded := func(slashPath string) {
+		repo.updateStatus(func(status *SyncStatus) {
+			status.BytesPending -= sizes[slashPath]
+		})
+	}
+
+	uploads := newTransferPool(repo.UploadConcurrency)
+	budget := newByteBudget(repo.MaxInflightBytes)
+	for slashPath, localItem := range localNewerItems {
+		if err := repo.cancelled(); err != nil {
+			uploads.Wait()
+			return changes, failed, err
+		}
+		if uploads.Err() != nil {
+			break
+		}
+		repo.updateStatus(func(status *SyncStatus) {
+			status.CurrentFile = slashPath
+			status.Queued--
+		})
+		if repo.retryPending(slashPath) {
+			uploads.locked(func() { failed++ })
+			uploaded(slashPath)
+			continue
+		}
+		if repo.isDamaged(slashPath, localItem) {
+			repo.logger.Warn("Upload skipped, the file looks damaged on disk", "file", slashPath)
+			uploaded(slashPath)
+			continue
+		}
+		uploads.Go(func() {
+			defer uploaded(slashPath)
+			fileFailed := func(action string, err error) {
+				repo.queueRetry(slashPath, action, err)
+				uploads.locked(func() { failed++ })
 			}
+			if localItem.Tombstone && repo.Direction == DirectionMirror && !repo.objectLocked() {
+				repo.logger.Info("Deleting remote file", "file", slashPath)
+				err := repo.Client.Delete(slashPath)
+				repo.recordMutation(AuditDelete, slashPath, 0, "not in the local mirror", err)
+				if err != nil {
+					fileFailed("delete", err)
+					return
+				}
+				repo.clearRetry(slashPath)
+				uploads.locked(func() {
+					delete(remoteItems, slashPath)
+					changes[slashPath] = nil
+				})
+				repo.emit(Event{Type: EventFileDeleted, File: slashPath})
+			} else if localItem.Tombstone {
+				repo.logger.Info("Marking remote file as tombstone", "file", slashPath)
+				err := repo.Client.MarkTombstone(slashPath)
+				repo.recordMutation(AuditTombstone, slashPath, 0, "deleted locally", err)
+				if err != nil {
+					fileFailed("tombstone", err)
+					return
+				}
+				repo.clearRetry(slashPath)
+				uploads.locked(func() {
+					remoteItems[slashPath] = &RemoteItem{
+						ModTime:     localItem.ModTime,
+						Tombstone:   true,
+						MachineID:   thisMachine().ID,
+						MachineName: thisMachine().Name,
+					}
+					changes[slashPath] = remoteItems[slashPath]
+				})
+				repo.emit(Event{Type: EventFileTombstoned, File: slashPath})
+			} else if seeded, ok := repo.seeded[slashPath]; ok && sameModTime(seeded.ModTime, localItem.ModTime) {
+				// Uploaded by the seed
+				uploads.locked(func() {
+					remoteItems[slashPath] = seeded
+					changes[slashPath] = seeded
+				})
+			} else {
+				localFilePath := filepath.Join(repo.Path, localItem.FilePath)
+				fileInfo, err := os.Stat(localFilePath)
+				if err != nil {
+					fileFailed("upload", err)
+					return
+				}
+
+				if fileInfo.IsDir() {
+					uploads.fail(fmt.Errorf("can not upload directory: %s", localFilePath))
+					return
+				}
+				if maxUploadSize > 0 && fileInfo.Size() > maxUploadSize {
+					// Uploaded by a sync once plugged in
+					repo.logger.Info("Upload deferred, on battery", "file", slashPath, "size", fileInfo.Size())
+					return
+				}
 
-			localSHA256 := ""
-			if slashPath == FETCH_HEAD {
 				// the modtime of FETCH_HEAD file will be changed when git fetch
 				// so we use sha256 instead of modtime to check if file is changed
-				remoteItem := remoteItems[slashPath]
-				if remoteItem != nil && !remoteItem.Tombstone {
-					localSHA256 = fmt.Sprintf("%x", sha256.Sum256(data))
+				var remoteItem *RemoteItem
+				uploads.locked(func() { remoteItem = remoteItems[slashPath] })
+				compareSHA256 := slashPath == FETCH_HEAD && remoteItem != nil && !remoteItem.Tombstone
+				if compareSHA256 && remoteItem.SHA256 != "" && fileChecksums.get(localFilePath, fileInfo) == remoteItem.SHA256 {
+					// unchanged since hashed, skip file without reading it
+					return
+				}
+
+				budget.acquire(fileInfo.Size())
+				defer budget.release(fileInfo.Size())
+				data, stable, err := readStableFile(localFilePath, fileInfo)
+				if err != nil {
+					fileFailed("upload", err)
+					return
+				}
+				if !stable {
+					// Uploaded by the next sync, once written
+					repo.logger.Info("Upload deferred, file is being written", "file", slashPath)
+					return
+				}
+
+				// Recorded in the index to verify downloads against
+				localSHA256 := contentSHA256(data)
+				if compareSHA256 {
+					fileChecksums.put(localFilePath, fileInfo, localSHA256)
 					if localSHA256 == remoteItem.SHA256 {
 						// skip file
-						continue
+						return
 					}
 				}
-			}
 
-			log.Printf("Uploading local file: %s", localItem.FilePath)
-			err = repo.Client.Put(data, fileInfo.ModTime(), slashPath)
+				if localItem.Link != "" {
+					// Its content is uploaded with the file it links to
+					repo.logger.Info("Recording hard link", "file", slashPath, "to", localItem.Link)
+					repo.clearRetry(slashPath)
+					uploads.locked(func() {
+						remoteItems[slashPath] = &RemoteItem{
+							ModTime:     localItem.ModTime,
+							SHA256:      localSHA256,
+							Link:        localItem.Link,
+							MachineID:   thisMachine().ID,
+							MachineName: thisMachine().Name,
+						}
+						changes[slashPath] = remoteItems[slashPath]
+					})
+					return
+				}
 
-			if err != nil {
-				return fmt.Errorf("failed to upload file %s: %w", slashPath, err)
-			}
-			remoteItems[slashPath] = &RemoteItem{
-				ModTime:   localItem.ModTime,
-				Tombstone: false,
-				SHA256:    localSHA256,
+				repo.logger.Info("Uploading local file", "file", slashPath, "size", fileInfo.Size())
+				if putter, ok := repo.Client.(interface {
+					PutWithAttrs(data []byte, modTime time.Time, slashPath string, attrs FileAttrs) error
+				}); ok && repo.Xattrs {
+					err = putter.PutWithAttrs(data, fileInfo.ModTime(), slashPath, repo.localAttrs(slashPath, localFilePath))
+				} else {
+					err = repo.Client.Put(data, fileInfo.ModTime(), slashPath)
+				}
+				repo.recordMutation(AuditUpload, slashPath, int64(len(data)), uploadReason(slashPath, localItem, remoteItem), err)
+
+				if err != nil {
+					fileFailed("upload", err)
+					return
+				}
+				repo.clearRetry(slashPath)
+				uploads.locked(func() {
+					remoteItems[slashPath] = &RemoteItem{
+						ModTime:     localItem.ModTime,
+						Tombstone:   false,
+						SHA256:      localSHA256,
+						MachineID:   thisMachine().ID,
+						MachineName: thisMachine().Name,
+						Size:        int64(len(data)),
+					}
+					changes[slashPath] = remoteItems[slashPath]
+				})
+				repo.updateStatus(func(status *SyncStatus) {
+					status.BytesTransferred += int64(len(data))
+				})
+				repo.emit(Event{Type: EventFileUploaded, File: slashPath, Size: int64(len(data))})
 			}
-			remoteChanged = true
-		}
+		})
+	}
+	if err := uploads.Wait(); err != nil {
+		return changes, failed, err
 	}
 
+	downloads := newTransferPool(repo.DownloadConcurrency)
 	for slashPath, remoteItem := range remoteNewerItems {
-
-		filePath := filepath.FromSlash(slashPath)
-		fullLocalPath := filepath.Join(repo.Path, filePath)
-
-		if (repo.IgnoreCase) {
-			conflict, err := checkFilenameConflictIgnoringCase(fullLocalPath)
-			if err != nil {
-				return fmt.Errorf("failed to check case-insensitive filename conflicts of %s: %w", slashPath, err)
-			}
-			if conflict {
-				log.Printf("Skipping remote file: %s, because there is case-insensitive filename conflict in local directory", slashPath)
-				continue
-			}
+		if err := repo.cancelled(); err != nil {
+			downloads.Wait()
+			return changes, failed, err
+		}
+		if downloads.Err() != nil {
+			break
+		}
+		repo.updateStatus(func(status *SyncStatus) {
+			status.CurrentFile = slashPath
+			status.Queued--
+		})
+		if repo.retryPending(slashPath) {
+			downloads.locked(func() { failed++ })
+			continue
 		}
 
-		if !remoteItem.Tombstone {
-			// download remote file
-			log.Printf("Downloading remote file: %s", slashPath)
-			data, err := repo.Client.Get(slashPath)
-			if err != nil {
-				return fmt.Errorf("failed to download file %s: %w", slashPath, err)
-			}
-
-			// create parent dir if not exists
-			parentDir := filepath.Dir(fullLocalPath)
-			err = os.MkdirAll(parentDir, 0755)
-			if err != nil {
-				return fmt.Errorf("failed to create parent dir %s: %w", parentDir, err)
+		if !repo.syncsRemotePath(slashPath) {
+			continue
+		}
+		downloads.Go(func() {
+			fileFailed := func(action string, err error) {
+				repo.queueRetry(slashPath, action, err)
+				downloads.locked(func() { failed++ })
 			}
+			filePath := repo.localFilePath(slashPath)
+			fullLocalPath := repo.localPath(slashPath)
 
-			_, err = ensureWritableIfExist(fullLocalPath)
-			if err != nil {
-				return fmt.Errorf("failed to ensure writable for file %s: %w", fullLocalPath, err)
+			if repo.IgnoreCase {
+				conflict, err := checkFilenameConflictIgnoringCase(fullLocalPath)
+				if err != nil {
+					downloads.fail(fmt.Errorf("failed to check case-insensitive filename conflicts of %s: %w", slashPath, err))
+					return
+				}
+				if conflict {
+					repo.logger.Warn("Skipping remote file because of case-insensitive filename conflict in local directory", "file", slashPath)
+					repo.emit(Event{
+						Type:    EventConflict,
+						File:    slashPath,
+						Message: fmt.Sprintf("skipped %s, it conflicts with a local file differing only in case", slashPath),
+					})
+					return
+				}
 			}
 
-			err = os.WriteFile(fullLocalPath, data, 0644)
-			if err != nil {
-				return fmt.Errorf("failed to write file %s: %w", fullLocalPath, err)
-			}
-			// change modtime
-			err = os.Chtimes(fullLocalPath, time.Now(), time.Unix(remoteItem.ModTime, 0))
-			if err != nil {
-				return fmt.Errorf("failed to change modtime of file %s: %w", fullLocalPath, err)
-			}
-			localItems[slashPath] = &FileItem{
-				FilePath:  filePath,
-				ModTime:   remoteItem.ModTime,
-				Tombstone: false,
-			}
-		} else {
-			exists, err := ensureWritableIfExist(fullLocalPath)
-			if err != nil {
-				return fmt.Errorf("failed to ensure writable for file %s: %w", fullLocalPath, err)
-			}
-			if exists {
-				log.Printf("Removing local file: %s", filePath)
-				err = os.Remove(fullLocalPath)
+			if !remoteItem.Tombstone {
+				var localItem *FileItem
+				downloads.locked(func() { localItem = localItems[slashPath] })
+				if localItem != nil && localItem.Edited {
+					conflict, err := repo.keepConflictCopy(slashPath, localItem, remoteItem)
+					if err != nil {
+						fileFailed("download", err)
+						return
+					}
+					repo.logger.Warn("Kept local changes as a conflict copy", "file", slashPath, "copy", conflict.Copy)
+					repo.emit(Event{
+						Type:    EventConflict,
+						File:    slashPath,
+						Message: fmt.Sprintf("%s changed on both sides, the local version is kept as %s", slashPath, conflict.Copy),
+					})
+				}
+				if remoteItem.Link != "" {
+					// Linked once the file it links to is downloaded too
+					downloads.locked(func() {
+						delete(localItems, slashPath)
+						repo.pendingLinks[slashPath] = remoteItem
+					})
+					return
+				}
+				err := repo.downloadFile(slashPath, remoteItem)
 				if err != nil {
-					return fmt.Errorf("failed to remove file %s: %w", fullLocalPath, err)
+					fileFailed("download", err)
+					return
 				}
+				repo.clearRetry(slashPath)
+				downloads.locked(func() {
+					localItems[slashPath] = &FileItem{
+						FilePath:  filePath,
+						ModTime:   remoteItem.ModTime,
+						Tombstone: false,
+					}
+				})
+			} else {
+				exists, err := ensureWritableIfExist(fullLocalPath)
+				if err != nil {
+					fileFailed("remove", fmt.Errorf("failed to ensure writable for file %s: %w", fullLocalPath, err))
+					return
+				}
+				if exists {
+					trashPath, err := repo.trashFile(slashPath)
+					if err != nil {
+						fileFailed("remove", err)
+						return
+					}
+					repo.logger.Info("Removed local file", "file", slashPath, "trash", trashPath)
+					repo.emit(Event{Type: EventFileRemoved, File: slashPath})
+				}
+				repo.clearRetry(slashPath)
+				downloads.locked(func() { delete(localItems, slashPath) })
 			}
-			delete(localItems, slashPath)
-		}
+		})
+	}
+	if err := downloads.Wait(); err != nil {
+		return changes, failed, err
 	}
 
-	// Remove outdated tombstone files in remote
+	// Remove outdated tombstone files in remote, which are kept with object
+	// lock
 	for slashPath, remoteItem := range remoteItems {
-		if remoteItem.Tombstone {
+		if remoteItem.Tombstone && repo.Direction != DirectionPull && repo.Direction != DirectionArchive && !repo.objectLocked() {
 			// Check if tombstone is older than 30 days
-			if time.Now().Unix()-remoteItem.ModTime > 30*24*60*60 {
-				log.Printf("Removing outdated tombstone file: %s", slashPath)
+			if time.Since(modTimeToTime(remoteItem.ModTime)) > 30*24*time.Hour {
+				repo.logger.Info("Removing outdated tombstone file", "file", slashPath)
 				err := repo.Client.Delete(slashPath)
+				repo.recordMutation(AuditDelete, slashPath, 0, "tombstone older than 30 days", err)
 				if err != nil {
-					log.Printf("failed to delete tombstone file %s: %v", slashPath, err)
+					repo.logger.Error("Failed to delete tombstone file", "file", slashPath, "error", err)
 				} else {
 					delete(remoteItems, slashPath)
-					remoteChanged = true
+					changes[slashPath] = nil
+					repo.emit(Event{Type: EventTombstonePurge, File: slashPath})
 				}
 			}
 		}
 	}
-	err := repo.Client.Finish(remoteItems, remoteChanged)
+	return changes, failed, nil
+}
+
+// Reads a file for upload. It isn't stable, and shouldn't be uploaded yet,
+// when its size or modtime change while it settles or is read, as when
+// another process is still writing it.
+func readStableFile(filePath string, fileInfo os.FileInfo) ([]byte, bool, error) {
+	if age := time.Since(fileInfo.ModTime()); age < stableReadAge {
+		time.Sleep(stableReadAge - age)
+		settled, err := os.Stat(filePath)
+		if err != nil {
+			return nil, false, err
+		}
+		if !sameFileState(fileInfo, settled) {
+			return nil, false, nil
+		}
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, false, err
+	}
+	after, err := os.Stat(filePath)
+	if err != nil {
+		return nil, false, err
+	}
+	stable := sameFileState(fileInfo, after) && int64(len(data)) == after.Size()
+	return data, stable, nil
+}
+
+func sameFileState(a, b os.FileInfo) bool {
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// Returns the local path of a slash path, which in a linked worktree is
+// outside of the repository for its git metadata
+func (repo *Repository) localPath(slashPath string) string {
+	if repo.git != nil {
+		if localPath, ok := repo.git.localPath(slashPath); ok {
+			return localPath
+		}
+	}
+	return filepath.Join(repo.Path, repo.localFilePath(slashPath))
+}
+
+// Path of a file relative to the repository, as kept in the local index
+func (repo *Repository) localFilePath(slashPath string) string {
+	return filepath.FromSlash(diskPath(slashPath))
+}
+
+// Whether a remote file belongs in the repository. Excluded git files and
+// the .git file of a linked worktree are never synced, nor the metadata of
+// the worktree unless enabled, nor files matching global_excludes or
+// temp_excludes.
+func (repo *Repository) syncsRemotePath(slashPath string) bool {
+	if slashPath == ".git" || excludedGitPath(repo.GitExcludes, slashPath) || repo.excluded(slashPath) {
+		return false
+	}
+	if repo.git != nil && repo.git.worktree && !repo.WorktreeMetadata {
+		return !strings.HasPrefix(slashPath, ".git/")
+	}
+	return true
+}
+
+// Whether a working tree file matches global_excludes or temp_excludes,
+// even when git tracks it. Files in .git are excluded by git_excludes instead.
+func (repo *Repository) excluded(slashPath string) bool {
+	return !strings.HasPrefix(slashPath, ".git/") && repo.Excludes.excludes(slashPath)
+}
+
+func (repo *Repository) downloadFile(slashPath string, remoteItem *RemoteItem) error {
+	defer repo.touch(slashPath)
+	fullLocalPath := repo.localPath(slashPath)
+
+	repo.logger.Info("Downloading remote file", "file", slashPath)
+	// create parent dir if not exists
+	parentDir := filepath.Dir(fullLocalPath)
+	err := repo.Modes.mkdirAll(parentDir)
+	if err != nil {
+		return fmt.Errorf("failed to create parent dir %s: %w", parentDir, err)
+	}
+
+	_, err = ensureWritableIfExist(fullLocalPath)
 	if err != nil {
-		return fmt.Errorf("failed to finish sync: %w", err)
+		return fmt.Errorf("failed to ensure writable for file %s: %w", fullLocalPath, err)
 	}
 
+	var size int64
+	if getter, ok := repo.Client.(interface {
+		GetToFile(slashPath string, file *os.File) (int64, error)
+	}); ok {
+		size, err = repo.downloadToFile(getter, slashPath, remoteItem)
+	} else {
+		size, err = repo.downloadInMemory(slashPath, remoteItem)
+	}
+	var archived *archivedError
+	if errors.As(err, &archived) {
+		return repo.requestRestore(slashPath, archived)
+	}
+	if err != nil {
+		return err
+	}
+	if repo.Xattrs {
+		repo.restoreAttrs(slashPath, remoteItem.objectPath(slashPath))
+	}
+	// change modtime
+	err = os.Chtimes(fullLocalPath, time.Now(), modTimeToTime(remoteItem.ModTime))
+	if err != nil {
+		return fmt.Errorf("failed to change modtime of file %s: %w", fullLocalPath, err)
+	}
+	repo.updateStatus(func(status *SyncStatus) {
+		status.BytesTransferred += size
+	})
+	repo.emit(Event{Type: EventFileDownloaded, File: slashPath, Size: size})
 	return nil
 }
+
+// Downloads a file with Get and writes it, for clients that can't download
+// into a file
+func (repo *Repository) downloadInMemory(slashPath string, remoteItem *RemoteItem) (int64, error) {
+	fullLocalPath := repo.localPath(slashPath)
+	var data []byte
+	for attempt := 1; ; attempt++ {
+		var err error
+		data, err = repo.Client.Get(remoteItem.objectPath(slashPath))
+		var archived *archivedError
+		if errors.As(err, &archived) {
+			return 0, err
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to download file %s: %w", slashPath, err)
+		}
+		// Files uploaded by older versions have no SHA-256 in the index
+		if remoteItem.SHA256 == "" || contentSHA256(data) == remoteItem.SHA256 {
+			break
+		}
+		if attempt == downloadVerifyAttempts {
+			return 0, fmt.Errorf("downloaded %s doesn't match its SHA-256 in the index, the object is corrupt or truncated", slashPath)
+		}
+		repo.logger.Warn("Downloaded file doesn't match its SHA-256, downloading it again", "file", slashPath, "size", len(data))
+	}
+
+	mode, created := repo.Modes.fileMode(fullLocalPath)
+	file, err := os.OpenFile(fullLocalPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err == nil {
+		_, err = file.Write(data)
+		if err == nil {
+			err = repo.Modes.applyFileMode(file, mode, created)
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to write file %s: %w", fullLocalPath, err)
+	}
+	return int64(len(data)), nil
+}
+
+func (repo *Repository) emit(event Event) {
+	event.Repository = repo.Path
+	if repo.run != nil {
+		// Transfers running at once emit concurrently
+		repo.mu.Lock()
+		repo.run.record(event)
+		repo.mu.Unlock()
+	}
+	repo.events.Publish(event)
+}
+
+// Records a change made to the remote in the audit log
+func (repo *Repository) recordMutation(action, slashPath string, size int64, reason string, err error) {
+	if repo.audit == nil {
+		return
+	}
+	entry := AuditEntry{
+		Time:       time.Now(),
+		Repository: repo.Path,
+		Remote:     remoteName(repo.Client),
+		Action:     action,
+		Path:       slashPath,
+		Size:       size,
+		Reason:     reason,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if err := repo.audit.Record(entry); err != nil {
+		repo.logger.Error("Failed to write audit log", "error", err)
+	}
+}
+
+// Hex SHA-256 of a file's content, as recorded in the index
+func contentSHA256(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func uploadReason(slashPath string, localItem *FileItem, remoteItem *RemoteItem) string {
+	switch {
+	case remoteItem == nil:
+		return "new local file"
+	case remoteItem.Tombstone:
+		return "local file recreated after remote deletion"
+	case slashPath == FETCH_HEAD:
+		return "content changed"
+	case compareModTime(remoteItem.ModTime, localItem.ModTime) > 0:
+		return "remote file newer than the local mirror"
+	}
+	return "local file newer than remote"
+}
+
+// Describes why a sync failed. Errors after the sync timed out are reported
+// as the timeout, since they are likely caused by it.
+func (repo *Repository) failure(message string, err error) string {
+	if errors.Is(repo.cancelled(), context.DeadlineExceeded) {
+		return fmt.Sprintf("Sync timed out after %s", repo.Timeout)
+	}
+	return fmt.Sprintf("%s: %v", message, err)
+}
+
+// Stops the requests a client makes once ctx is done, if the client
+// supports it
+func setClientContext(client Client, ctx context.Context) {
+	if cancellable, ok := client.(interface{ setContext(context.Context) }); ok {
+		cancellable.setContext(ctx)
+	}
+}
+
+// Limits the transfers of a client to rate bytes per second, if the client
+// supports it
+func setClientThrottle(client Client, rate int64) {
+	if throttled, ok := client.(interface{ setThrottle(int64) }); ok {
+		throttled.setThrottle(rate)
+	}
+}
+
+// Nests the requests a client makes in a span, if the client is traced
+func setClientTraceParent(client Client, span *Span) {
+	if traced, ok := client.(interface{ setTraceParent(*Span) }); ok {
+		traced.setTraceParent(span)
+	}
+}
+
+// Identifies the remote of a client in logs, e.g. s3://bucket/prefix/
+func remoteName(client Client) string {
+	if s3, ok := client.(*S3Client); ok {
+		return fmt.Sprintf("s3://%s/%s", s3.Bucket, s3.Prefix)
+	}
+	return ""
+}
+
+// Records the sync run that just ended in the status and the history
+func (repo *Repository) finishRun(finishedAt time.Time, failure string) {
+	run := repo.run
+	repo.run = nil
+	run.FinishedAt = finishedAt
+	run.Error = failure
+
+	stats := run.stats()
+	repo.updateStatus(func(status *SyncStatus) {
+		status.InProgress = false
+		status.LastSync = finishedAt
+		status.CurrentFile = ""
+		status.Queued = 0
+		status.BytesPending = 0
+		status.LastRun = stats
+		status.Total.Add(stats)
+		if failure != "" {
+			status.FailureStreak++
+		} else {
+			status.FailureStreak = 0
+		}
+	})
+
+	if repo.history == nil {
+		return
+	}
+	if err := repo.history.Append(run); err != nil {
+		repo.logger.Error("Failed to record sync history", "error", err)
+	}
+}
+
+// SignIndex signs the objects of the remote index with the index key as
+// they are, returning their paths
+func (repo *Repository) SignIndex() ([]string, error) {
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+
+	signer, ok := repo.Client.(interface{ SignIndex() ([]string, error) })
+	if !ok {
+		return nil, fmt.Errorf("the remote of %s can not be signed", repo.Path)
+	}
+	signed, err := signer.SignIndex()
+	for _, slashPath := range signed {
+		repo.recordMutation(AuditIndexWrite, slashPath, 0, "signed with the index key", nil)
+	}
+	return signed, err
+}
+
+// Restore downloads the remote files matching pattern, bypassing the sync
+// comparison. Pattern is a slash path relative to the repository root and may
+// contain glob characters.
+func (repo *Repository) Restore(pattern string) ([]string, error) {
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+
+	pattern = strings.TrimPrefix(path.Clean(filepath.ToSlash(pattern)), "/")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+	}
+
+	if git, err := resolveGitLayout(repo.Path); err == nil {
+		repo.git = git
+	}
+	index, err := repo.Client.Index()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get remote files: %w", err)
+	}
+
+	matched := make([]string, 0)
+	matchedItems := make(map[string]*RemoteItem)
+	deleted := 0
+	for shard := 0; shard < index.Shards; shard++ {
+		remoteItems, err := repo.Client.List(index, shard, index.Shards)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get remote files: %w", err)
+		}
+		for slashPath, remoteItem := range remoteItems {
+			if ok, _ := path.Match(pattern, slashPath); !ok || !repo.syncsRemotePath(slashPath) {
+				continue
+			}
+			if remoteItem.Tombstone {
+				deleted++
+				continue
+			}
+			matched = append(matched, slashPath)
+			matchedItems[slashPath] = remoteItem
+		}
+	}
+	if len(matched) == 0 {
+		if deleted > 0 {
+			return nil, fmt.Errorf("%s is deleted on remote", pattern)
+		}
+		return nil, fmt.Errorf("no remote file matches %s", pattern)
+	}
+	sort.Strings(matched)
+
+	for _, slashPath := range matched {
+		remoteItem := matchedItems[slashPath]
+		if err := repo.downloadFile(slashPath, remoteItem); err != nil {
+			return nil, err
+		}
+		// keep the restored file from being treated as removed on next sync
+		if repo.lastLocal != nil {
+			err := repo.lastLocal.Add(slashPath, &FileItem{
+				FilePath:  repo.localFilePath(slashPath),
+				ModTime:   remoteItem.ModTime,
+				Tombstone: false,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return matched, nil
+}
+
+// Purge deletes the remote files of an archive that are no longer local and
+// match pattern, all of them when empty, along with any tombstones. Returns
+// the files, which with dryRun set are only listed.
+func (repo *Repository) Purge(pattern string, dryRun bool) ([]string, error) {
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+
+	if repo.Direction != DirectionArchive {
+		return nil, fmt.Errorf("%s is not an archive, its deletions are synced", repo.Path)
+	}
+	if repo.objectLocked() && !dryRun {
+		return nil, fmt.Errorf("the remote of %s has object lock, its files can't be purged", repo.Path)
+	}
+	if pattern != "" {
+		pattern = strings.TrimPrefix(path.Clean(filepath.ToSlash(pattern)), "/")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+	}
+	// A missing repository would purge the whole archive
+	if repo.rootMissing() {
+		return nil, fmt.Errorf("repository path is missing: %s", repo.Path)
+	}
+
+	localFiles, err := repo.listLocalFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get local files: %w", err)
+	}
+	defer localFiles.Close()
+	index, err := repo.Client.Index()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get remote files: %w", err)
+	}
+
+	purged := make([]string, 0)
+	for shard := 0; shard < index.Shards; shard++ {
+		localItems, err := localFiles.Shard(shard, index.Shards)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get local files: %w", err)
+		}
+		remoteItems, err := repo.Client.List(index, shard, index.Shards)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get remote files: %w", err)
+		}
+
+		removed := 0
+		var deleteErr error
+		for slashPath := range remoteItems {
+			if _, exists := localItems[slashPath]; exists {
+				continue
+			}
+			if ok, _ := path.Match(pattern, slashPath); pattern != "" && !ok {
+				continue
+			}
+			if !dryRun {
+				repo.logger.Info("Purging remote file", "file", slashPath)
+				deleteErr = repo.Client.Delete(slashPath)
+				repo.recordMutation(AuditDelete, slashPath, 0, "purged from archive", deleteErr)
+				if deleteErr != nil {
+					break
+				}
+				delete(remoteItems, slashPath)
+				removed++
+			}
+			purged = append(purged, slashPath)
+		}
+		// The files deleted so far are dropped from the index even when one
+		// failed
+		if removed > 0 {
+			err := repo.Client.PutShard(index, shard, index.Shards, remoteItems)
+			repo.recordMutation(AuditIndexWrite, indexShardPath(shard, index.Shards), 0, fmt.Sprintf("index of %d entries updated after purge", len(remoteItems)), err)
+			if err != nil {
+				return nil, fmt.Errorf("failed to update index: %w", err)
+			}
+		}
+		if deleteErr != nil {
+			return nil, fmt.Errorf("failed to purge remote files: %w", deleteErr)
+		}
+	}
+	sort.Strings(purged)
+	return purged, nil
+}
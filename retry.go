@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Backoff of files that failed to sync, doubling with each attempt. A file is
+// retried by the first sync after its backoff has passed.
+const (
+	retryBaseDelay = 30 * time.Second
+	retryMaxDelay  = time.Hour
+)
+
+// RetryItem is a file that failed to sync and will be retried
+type RetryItem struct {
+	Path      string    `json:"path"`
+	Action    string    `json:"action"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	NextRetry time.Time `json:"next_retry"`
+	// Set while the file waits for the restore of its objects from an archive
+	// tier
+	Restore *RestoreProgress `json:"restore,omitempty"`
+}
+
+// Records a failed attempt to sync a file
+func (repo *Repository) queueRetry(slashPath, action string, err error) {
+	repo.logger.Error("Failed to sync file, will retry", "file", slashPath, "action", action, "error", err)
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if repo.retries == nil {
+		repo.retries = make(map[string]*RetryItem)
+	}
+	item, ok := repo.retries[slashPath]
+	if !ok {
+		item = &RetryItem{Path: slashPath}
+		repo.retries[slashPath] = item
+	}
+	item.Action = action
+	item.Attempts++
+	item.LastError = err.Error()
+	if item.trackRestore(err) {
+		return
+	}
+	delay := retryBaseDelay << min(item.Attempts-1, 10)
+	item.NextRetry = time.Now().Add(min(delay, retryMaxDelay))
+}
+
+// Reports whether a file that failed before is still backing off
+func (repo *Repository) retryPending(slashPath string) bool {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	item, ok := repo.retries[slashPath]
+	return ok && time.Now().Before(item.NextRetry)
+}
+
+func (repo *Repository) clearRetry(slashPath string) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	delete(repo.retries, slashPath)
+}
+
+// Drops files of an index shard from the retry queue that no longer need
+// syncing, e.g. because they were changed back or synced from another machine
+func (repo *Repository) pruneRetries(pending map[string]bool, shard, shards int) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	for slashPath := range repo.retries {
+		if indexShard(slashPath, shards) == shard && !pending[slashPath] {
+			delete(repo.retries, slashPath)
+		}
+	}
+}
+
+// RetryQueue returns the files waiting to be retried, sorted by path
+func (repo *Repository) RetryQueue() []RetryItem {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	queue := make([]RetryItem, 0, len(repo.retries))
+	for _, item := range repo.retries {
+		queue = append(queue, *item)
+	}
+	sort.Slice(queue, func(i, j int) bool {
+		return queue[i].Path < queue[j].Path
+	})
+	return queue
+}
+
+// RetryPolicy retries S3 requests that fail with a network error or a
+// retryable status within a sync, before the file is left to a later sync.
+// Set in the s3 section and overridden by a repository, a setting by setting.
+type RetryPolicy struct {
+	// Attempts of a request, 1 for no retries
+	Attempts int `json:"attempts"`
+	// Delay before the first retry, doubling with each attempt up to the cap
+	BaseDelay Interval `json:"base_delay"`
+	MaxDelay  Interval `json:"max_delay"`
+	// HTTP statuses worth retrying
+	Statuses []int `json:"statuses"`
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	Attempts:  3,
+	BaseDelay: Interval(500 * time.Millisecond),
+	MaxDelay:  Interval(10 * time.Second),
+	Statuses:  []int{408, 429, 500, 502, 503, 504},
+}
+
+func (policy RetryPolicy) validate() error {
+	if policy.Attempts < 0 || policy.BaseDelay < 0 || policy.MaxDelay < 0 {
+		return fmt.Errorf("retry.attempts, retry.base_delay and retry.max_delay can't be negative")
+	}
+	for _, status := range policy.Statuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("retry.statuses must be HTTP statuses, got %d", status)
+		}
+	}
+	return nil
+}
+
+// Fills the settings left unset from defaults
+func (policy RetryPolicy) withDefaults(defaults RetryPolicy) RetryPolicy {
+	if policy.Attempts == 0 {
+		policy.Attempts = defaults.Attempts
+	}
+	if policy.BaseDelay == 0 {
+		policy.BaseDelay = defaults.BaseDelay
+	}
+	if policy.MaxDelay == 0 {
+		policy.MaxDelay = defaults.MaxDelay
+	}
+	if policy.Statuses == nil {
+		policy.Statuses = defaults.Statuses
+	}
+	return policy
+}
+
+func (policy RetryPolicy) equal(other RetryPolicy) bool {
+	return policy.Attempts == other.Attempts && policy.BaseDelay == other.BaseDelay &&
+		policy.MaxDelay == other.MaxDelay && slices.Equal(policy.Statuses, other.Statuses)
+}
+
+// Whether a request that got resp or err is worth another attempt. Requests
+// cancelled with their sync aren't.
+func (policy RetryPolicy) retryable(resp *httpResponse, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	return slices.Contains(policy.Statuses, resp.StatusCode)
+}
+
+// Delay before the retry following attempt
+func (policy RetryPolicy) delay(attempt int) time.Duration {
+	delay := time.Duration(policy.BaseDelay) << min(attempt-1, 20)
+	return min(delay, time.Duration(policy.MaxDelay))
+}
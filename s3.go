@@ -2,18 +2,22 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
 	"net/http"
 	"net/url"
 	"path"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -21,6 +25,15 @@ import (
 const HEADER_LOCAL_MODIFIED = "x-amz-meta-local-modified"
 const HEADER_TOMBSTONE = "x-amz-meta-tombstone"
 
+// "gzip" on objects stored compressed, which are decompressed on download
+const HEADER_ENCODING = "x-amz-meta-reposy-encoding"
+
+// SHA-256 and size of the file an object holds, checked by the scrub
+const (
+	HEADER_SHA256 = "x-amz-meta-reposy-sha256"
+	HEADER_SIZE   = "x-amz-meta-reposy-size"
+)
+
 const INDEX_FILE = ".reposyindex"
 
 type S3Config struct {
@@ -30,10 +43,64 @@ type S3Config struct {
 	Region          string `json:"region"`
 	AccessKeyID     string `json:"access_key_id"`
 	SecretAccessKey string `json:"secret_access_key"`
+	// Name of the credentials stored with `reposy credentials set`
+	Credentials string `json:"credentials"`
+	// Uploads files gzipped, unless they look compressed already
+	Compress bool `json:"compress"`
+	// Stores files as chunks shared by every file and repository of the
+	// bucket, see dedup.go
+	Dedup bool `json:"dedup"`
+	// How failed requests are retried
+	Retry RetryPolicy `json:"retry"`
+	// Secret the index is signed with, the same on every machine syncing
+	// the repository, see index_signing.go
+	IndexKey string `json:"index_key"`
+	// Retention of the objects written to a bucket with Object Lock, see
+	// object_lock.go
+	ObjectLock ObjectLockConfig `json:"object_lock"`
+	// Headers sent, and signed, with every request, e.g. the tenant or
+	// routing headers a gateway requires. Those of a repository are added to
+	// those of the s3 section.
+	ExtraHeaders map[string]string `json:"extra_headers"`
 }
 
 type S3Client struct {
 	S3Config
+
+	// Span the requests are nested in, while a sync is traced
+	traceParent *Span
+	// Cancels the requests of a sync that timed out, nil outside syncs
+	ctx context.Context
+	// Bytes per second each request is limited to, unlimited when 0
+	throttle int64
+	// Index objects by path, as last downloaded or written
+	indexCache map[string]*cachedIndexObject
+	// Set when the index was last read from the cache on disk, see
+	// index_cache.go
+	indexOffline bool
+}
+
+// An index object kept to skip downloading and decoding it again while its
+// ETag is unchanged. Its entries are copied before they are handed out.
+type cachedIndexObject struct {
+	etag string
+	// Set for INDEX_FILE
+	manifest *IndexManifest
+	// Set for shards and deltas
+	items      map[string]*RemoteItem
+	generation int
+}
+
+func (s3 *S3Client) setTraceParent(span *Span) {
+	s3.traceParent = span
+}
+
+func (s3 *S3Client) setContext(ctx context.Context) {
+	s3.ctx = ctx
+}
+
+func (s3 *S3Client) setThrottle(rate int64) {
+	s3.throttle = rate
 }
 
 type httpResponse struct {
@@ -42,14 +109,26 @@ type httpResponse struct {
 	Body       []byte
 }
 
-func NewS3Client(config *Config, repoConfig *RepositoryConfig) *S3Client {
+func NewS3Client(config *Config, repoConfig *RepositoryConfig) (*S3Client, error) {
 	client := S3Client{}
 	if err := json.Unmarshal(repoConfig.Raw, &client); err != nil {
-		log.Fatalf("Failed to unmarshal S3 config: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal S3 config: %w", err)
 	}
 
 	client.Prefix = strings.Trim(client.Prefix, "/") + "/"
 
+	// Keys set for the repository take precedence over the defaults of the
+	// s3 section, whether they come from the config or the keychain
+	if err := loadStoredCredentials(&client.S3Config); err != nil {
+		return nil, err
+	}
+	defaults := config.S3
+	if client.AccessKeyID == "" || client.SecretAccessKey == "" {
+		if err := loadStoredCredentials(&defaults); err != nil {
+			return nil, err
+		}
+	}
+
 	if client.Endpoint == "" {
 		client.Endpoint = config.S3.Endpoint
 	}
@@ -59,51 +138,151 @@ func NewS3Client(config *Config, repoConfig *RepositoryConfig) *S3Client {
 	if client.Region == "" {
 		client.Region = config.S3.Region
 	}
+	client.Compress = client.Compress || config.S3.Compress
+	client.Dedup = client.Dedup || config.S3.Dedup
+	if err := client.Retry.validate(); err != nil {
+		return nil, err
+	}
+	client.Retry = client.Retry.withDefaults(config.S3.Retry).withDefaults(defaultRetryPolicy)
+	if client.IndexKey == "" {
+		client.IndexKey = config.S3.IndexKey
+	}
+	if !client.ObjectLock.enabled() {
+		client.ObjectLock = config.S3.ObjectLock
+	}
+	if err := client.ObjectLock.validate(); err != nil {
+		return nil, err
+	}
+	for name, value := range config.S3.ExtraHeaders {
+		if _, ok := client.ExtraHeaders[name]; !ok {
+			if client.ExtraHeaders == nil {
+				client.ExtraHeaders = make(map[string]string)
+			}
+			client.ExtraHeaders[name] = value
+		}
+	}
+	for name, value := range client.ExtraHeaders {
+		if err := validateExtraHeader(name); err != nil {
+			return nil, err
+		}
+		resolved, err := resolveConfigValue(value)
+		if err != nil {
+			return nil, err
+		}
+		client.ExtraHeaders[name] = resolved
+	}
 	if client.AccessKeyID == "" {
-		client.AccessKeyID = config.S3.AccessKeyID
+		client.AccessKeyID = defaults.AccessKeyID
 	}
 	if client.SecretAccessKey == "" {
-		client.SecretAccessKey = config.S3.SecretAccessKey
+		client.SecretAccessKey = defaults.SecretAccessKey
 	}
-	return &client
-}
 
-func (s3 *S3Client) List() (map[string]*RemoteItem, error) {
-	// Download and parse index file from S3
-	// indexKey := path.Join(s3.Prefix, INDEX_FILE)
-	content, err := s3.Get(INDEX_FILE)
-	if err != nil {
-		if exist, err := s3.Exist(INDEX_FILE); !exist && err == nil {
-			return make(map[string]*RemoteItem), nil
+	for _, field := range []*string{&client.Endpoint, &client.Bucket, &client.Region, &client.AccessKeyID, &client.SecretAccessKey, &client.IndexKey} {
+		value, err := resolveConfigValue(*field)
+		if err != nil {
+			return nil, err
 		}
-		return nil, fmt.Errorf("failed to download index file: %v", err)
+		*field = value
 	}
+	if client.IndexKey != "" && len(client.IndexKey) < indexKeyMinLength {
+		return nil, fmt.Errorf("index_key must be at least %d characters long", indexKeyMinLength)
+	}
+	if client.directoryBucket() {
+		if err := client.useDirectoryBucket(); err != nil {
+			return nil, err
+		}
+	}
+	return &client, nil
+}
 
-	// Create a gzip reader
-	gzReader, err := gzip.NewReader(bytes.NewReader(content))
+// Index reads the manifest of the remote index and its deltas, along with the
+// entries of an index that isn't sharded
+func (s3 *S3Client) Index() (*IndexManifest, error) {
+	s3.indexOffline = false
+	object, err := s3.getIndexObject(INDEX_FILE, func(content []byte) (*cachedIndexObject, error) {
+		manifest, err := parseIndexManifest(content)
+		return &cachedIndexObject{manifest: manifest}, err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gzip reader: %v", err)
+		return nil, err
+	}
+	if object == nil {
+		return &IndexManifest{Shards: 1, items: make(map[string]*RemoteItem)}, nil
+	}
+	index := &IndexManifest{
+		Shards:     object.manifest.Shards,
+		Generation: object.manifest.Generation,
+	}
+	if object.manifest.items != nil {
+		index.items = maps.Clone(object.manifest.items)
 	}
-	defer gzReader.Close()
 
-	// Read and decode JSON content
-	var fileItems map[string]*RemoteItem
-	decoder := json.NewDecoder(gzReader)
-	if err := decoder.Decode(&fileItems); err != nil {
-		return nil, fmt.Errorf("failed to decode index file content: %v", err)
+	// deltas are numbered from the generation on, until one is missing
+	for delta := index.Generation + 1; ; delta++ {
+		object, err := s3.getIndexObject(indexDeltaPath(delta), decodeIndexObject)
+		if err != nil {
+			return nil, err
+		}
+		if object == nil {
+			break
+		}
+		index.deltas = append(index.deltas, object.items)
+	}
+	if index.items != nil {
+		index.applyDeltas(index.items, 0, index.Generation)
 	}
+	return index, nil
+}
 
-	return fileItems, nil
+// List returns the entries of a shard of the index. When shards is more than
+// the index has, the stored shard is split.
+func (s3 *S3Client) List(index *IndexManifest, shard, shards int) (map[string]*RemoteItem, error) {
+	items := index.items
+	if items == nil {
+		stored := shard % index.Shards
+		shardPath := indexShardPath(stored, index.Shards)
+		object, err := s3.getIndexObject(shardPath, decodeIndexObject)
+		if err != nil {
+			return nil, err
+		}
+		if object == nil {
+			return nil, fmt.Errorf("index shard %s is missing", shardPath)
+		}
+		items = maps.Clone(object.items)
+		index.applyDeltas(items, stored, object.generation)
+	}
+	if shards == index.Shards {
+		return items, nil
+	}
+	return splitIndexShard(items, shard, shards), nil
 }
 
 func (s3 *S3Client) Put(data []byte, modTime time.Time, slashPath string) error {
-	if slashPath == INDEX_FILE {
+	return s3.put(data, modTime, slashPath, map[string]string{})
+}
+
+// Uploads a file with headers, to which its metadata is added
+func (s3 *S3Client) put(data []byte, modTime time.Time, slashPath string, headers map[string]string) error {
+	if isIndexPath(slashPath) {
 		return nil
 	}
-
-	var headers = map[string]string{
-		HEADER_LOCAL_MODIFIED: fmt.Sprintf("%d", modTime.Unix()),
-		HEADER_TOMBSTONE:      "0",
+	headers[HEADER_LOCAL_MODIFIED] = fmt.Sprintf("%d", modTime.UnixNano())
+	headers[HEADER_TOMBSTONE] = "0"
+	headers[HEADER_SHA256] = contentSHA256(data)
+	headers[HEADER_SIZE] = strconv.Itoa(len(data))
+	s3.lockHeaders(headers)
+	if s3.Dedup && len(data) >= dedupMinSize {
+		return s3.putChunked(data, headers, slashPath)
+	}
+	if len(data) >= multipartThreshold {
+		return s3.putMultipart(data, headers, modTime, slashPath)
+	}
+	if s3.Compress {
+		if compressed, ok := compressPayload(slashPath, data); ok {
+			data = compressed
+			headers[HEADER_ENCODING] = "gzip"
+		}
 	}
 
 	fullPath := path.Join(s3.Prefix, slashPath)
@@ -123,11 +302,24 @@ func (s3 *S3Client) Get(slashPath string) (content []byte, err error) {
 		return nil, err
 	}
 
+	if isArchived(resp) {
+		return nil, &archivedError{Keys: []string{fullPath}}
+	}
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("failed to download file %s: %s", slashPath, resp.Body)
 	}
+	return s3.decodeObject(slashPath, resp.Headers, resp.Body)
+}
 
-	return resp.Body, nil
+// Turns the body of an object back into the content of its file
+func (s3 *S3Client) decodeObject(slashPath string, headers map[string]string, body []byte) ([]byte, error) {
+	switch headers[http.CanonicalHeaderKey(HEADER_ENCODING)] {
+	case "gzip":
+		return decompressPayload(slashPath, body)
+	case "chunks":
+		return s3.getChunked(slashPath, body)
+	}
+	return body, nil
 }
 
 func (s3 *S3Client) Exist(slashPath string) (bool, error) {
@@ -148,9 +340,10 @@ func (s3 *S3Client) Exist(slashPath string) (bool, error) {
 // mark file in s3 as tombstone
 func (s3 *S3Client) MarkTombstone(slashPath string) error {
 	var headers = map[string]string{
-		HEADER_LOCAL_MODIFIED: fmt.Sprintf("%d", time.Now().Unix()),
+		HEADER_LOCAL_MODIFIED: fmt.Sprintf("%d", time.Now().UnixNano()),
 		HEADER_TOMBSTONE:      "1",
 	}
+	s3.lockHeaders(headers)
 
 	fullPath := path.Join(s3.Prefix, slashPath)
 	resp, err := s3.request("PUT", fullPath, nil, headers, nil)
@@ -171,35 +364,232 @@ func (s3 *S3Client) Delete(slashPath string) error {
 	return err
 }
 
-func (s3 *S3Client) Finish(meta map[string]*RemoteItem, changed bool) error {
-	if !changed {
-		return nil
+// PutShard writes a shard of the index, including the deltas of index
+func (s3 *S3Client) PutShard(index *IndexManifest, shard, shards int, items map[string]*RemoteItem) error {
+	content, err := encodeIndexShard(items, index.LastDelta())
+	if err != nil {
+		return err
 	}
+	object := &cachedIndexObject{items: maps.Clone(items), generation: index.LastDelta()}
+	if shards == 1 {
+		object = &cachedIndexObject{manifest: &IndexManifest{Shards: 1, Generation: index.LastDelta(), items: object.items}}
+	}
+	return s3.putIndex(indexShardPath(shard, shards), content, object, false)
+}
 
-	metaBytes, err := json.Marshal(meta)
+// Times a delta is appended after another machine appended one first
+const indexDeltaAttempts = 10
+
+// PutDelta appends changes to the index as its next delta. When another
+// machine appended that delta first, index is read again and the changes are
+// appended after its last delta.
+func (s3 *S3Client) PutDelta(index *IndexManifest, changes map[string]*RemoteItem) error {
+	content, err := encodeIndexShard(changes, 0)
 	if err != nil {
-		return fmt.Errorf("failed to marshal meta: %v", err)
+		return err
 	}
+	for attempt := 1; ; attempt++ {
+		err := s3.putIndex(indexDeltaPath(index.LastDelta()+1), content, &cachedIndexObject{items: maps.Clone(changes)}, true)
+		if !errors.Is(err, errIndexObjectExists) || attempt >= indexDeltaAttempts {
+			return err
+		}
+		slog.Info("Index delta appended by another machine, appending after it", "delta", index.LastDelta()+1)
+		latest, err := s3.Index()
+		if err != nil {
+			return err
+		}
+		*index = *latest
+	}
+}
 
-	var buf bytes.Buffer
-	gzWriter := gzip.NewWriter(&buf)
-	if _, err = gzWriter.Write(metaBytes); err != nil {
-		gzWriter.Close()
-		return fmt.Errorf("failed to write meta to gzip writer: %v", err)
+// GetSeed returns the files listed by the partial-seed marker, nil when there
+// is none
+func (s3 *S3Client) GetSeed() (map[string]*RemoteItem, error) {
+	resp, err := s3.request("GET", path.Join(s3.Prefix, SEED_FILE), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == 404 {
+		return nil, nil
 	}
-	if err = gzWriter.Close(); err != nil {
-		return fmt.Errorf("failed to close gzip writer: %v", err)
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to get %s: %s", SEED_FILE, resp.Body)
+	}
+	if err := s3.verifyIndex(SEED_FILE, resp); err != nil {
+		return nil, err
+	}
+	items, _, err := decodeIndexShard(resp.Body)
+	return items, err
+}
+
+// PutSeed writes the partial-seed marker, listing the files seeded so far
+func (s3 *S3Client) PutSeed(items map[string]*RemoteItem) error {
+	content, err := encodeIndexShard(items, 0)
+	if err != nil {
+		return err
+	}
+	resp, err := s3.request("PUT", path.Join(s3.Prefix, SEED_FILE), content, s3.indexHeaders(SEED_FILE, content), nil)
+	if err == nil && resp.StatusCode != 200 {
+		err = fmt.Errorf("failed to put %s: %s", SEED_FILE, resp.Body)
 	}
+	return err
+}
+
+// DeleteSeed removes the partial-seed marker once the index is written
+func (s3 *S3Client) DeleteSeed() error {
+	return s3.Delete(SEED_FILE)
+}
+
+var errIndexObjectExists = errors.New("index object already exists")
 
+// Writes an index object, only when it doesn't exist yet with exclusive
+func (s3 *S3Client) putIndex(slashPath string, content []byte, object *cachedIndexObject, exclusive bool) error {
+	headers := s3.indexHeaders(slashPath, content)
+	if exclusive {
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers["If-None-Match"] = "*"
+	}
 	// put to s3 directly without using .Put()
-	fullPath := path.Join(s3.Prefix, INDEX_FILE)
-	resp, err := s3.request("PUT", fullPath, buf.Bytes(), nil, nil)
+	resp, err := s3.request("PUT", path.Join(s3.Prefix, slashPath), content, headers, nil)
 
-	if err == nil && resp.StatusCode != 200 {
-		return fmt.Errorf("failed to put %s: %s", INDEX_FILE, resp.Body)
+	if err == nil && exclusive && resp.StatusCode == 412 {
+		err = fmt.Errorf("%s: %w", slashPath, errIndexObjectExists)
+	} else if err == nil && resp.StatusCode != 200 {
+		err = fmt.Errorf("failed to put %s: %s", slashPath, resp.Body)
+	}
+	if err != nil {
+		s3.forgetIndexObject(slashPath)
+		return err
 	}
+	s3.cacheIndexObject(slashPath, resp, object)
+	if object.etag != "" {
+		s3.saveIndexObject(slashPath, object.etag, content)
+	}
+	return nil
+}
 
-	return err
+// Downloads an index object unless the cached copy is current, returning nil
+// when it doesn't exist. The copy cached on disk is used when the remote
+// can't be reached.
+func (s3 *S3Client) getIndexObject(slashPath string, decode func([]byte) (*cachedIndexObject, error)) (*cachedIndexObject, error) {
+	cached := s3.indexCache[slashPath]
+	if cached == nil {
+		cached = s3.loadIndexObject(slashPath, decode)
+	}
+	var headers map[string]string
+	if cached != nil {
+		headers = map[string]string{"If-None-Match": cached.etag}
+	}
+	resp, err := s3.request("GET", path.Join(s3.Prefix, slashPath), nil, headers, nil)
+	if err != nil || resp.StatusCode >= 500 {
+		// Only an unreachable manifest makes the whole index read from the
+		// cache, objects missing from it, like deltas written since, being
+		// taken as not existing
+		if cached != nil && slashPath == INDEX_FILE || s3.indexOffline {
+			if !s3.indexOffline {
+				slog.Warn("Remote unreachable, reading the cached index", "host", s3.host(), "error", err)
+			}
+			s3.indexOffline = true
+			// a shard that isn't cached can't be taken as empty like a
+			// delta, its entries would be missing from the plan
+			if cached == nil && !strings.HasPrefix(slashPath, INDEX_DELTA_DIR+"/") {
+				return nil, fmt.Errorf("index shard %s isn't cached: %w", slashPath, errIndexOffline)
+			}
+			return cached, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%s", resp.Body)
+		}
+		return nil, fmt.Errorf("failed to download %s: %v", slashPath, err)
+	}
+	switch resp.StatusCode {
+	case 200:
+	case 304:
+		if s3.indexCache == nil {
+			s3.indexCache = make(map[string]*cachedIndexObject)
+		}
+		s3.indexCache[slashPath] = cached
+		return cached, nil
+	case 404:
+		s3.forgetIndexObject(slashPath)
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("failed to download %s: %s", slashPath, resp.Body)
+	}
+
+	if err := s3.verifyIndex(slashPath, resp); err != nil {
+		return nil, err
+	}
+	object, err := decode(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	s3.cacheIndexObject(slashPath, resp, object)
+	if object.etag != "" {
+		s3.saveIndexObject(slashPath, object.etag, resp.Body)
+	}
+	return object, nil
+}
+
+func (s3 *S3Client) cacheIndexObject(slashPath string, resp *httpResponse, object *cachedIndexObject) {
+	etag := resp.Headers["Etag"]
+	if etag == "" {
+		delete(s3.indexCache, slashPath)
+		return
+	}
+	if s3.indexCache == nil {
+		s3.indexCache = make(map[string]*cachedIndexObject)
+	}
+	object.etag = etag
+	s3.indexCache[slashPath] = object
+}
+
+func decodeIndexObject(content []byte) (*cachedIndexObject, error) {
+	items, generation, err := decodeIndexShard(content)
+	return &cachedIndexObject{items: items, generation: generation}, err
+}
+
+// Finish commits an index that was compacted or resharded after its shards
+// are written, and removes the shards and deltas it replaces
+func (s3 *S3Client) Finish(index *IndexManifest, shards int) error {
+	if shards > 1 {
+		manifest, err := json.Marshal(&IndexManifest{Shards: shards, Generation: index.LastDelta()})
+		if err != nil {
+			return fmt.Errorf("failed to marshal index manifest: %v", err)
+		}
+		object := &cachedIndexObject{manifest: &IndexManifest{Shards: shards, Generation: index.LastDelta()}}
+		if err := s3.putIndex(INDEX_FILE, manifest, object, false); err != nil {
+			return err
+		}
+	}
+
+	if index.Shards > 1 && shards != index.Shards {
+		for shard := 0; shard < index.Shards; shard++ {
+			shardPath := indexShardPath(shard, index.Shards)
+			s3.forgetIndexObject(shardPath)
+			if err := s3.Delete(shardPath); err != nil {
+				return fmt.Errorf("failed to remove old index shard: %w", err)
+			}
+		}
+	}
+	for delta := index.Generation + 1; delta <= index.LastDelta(); delta++ {
+		deltaPath := indexDeltaPath(delta)
+		s3.forgetIndexObject(deltaPath)
+		if err := s3.Delete(deltaPath); err != nil {
+			return fmt.Errorf("failed to remove compacted index delta: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s3 *S3Client) host() string {
+	return fmt.Sprintf("%s.%s", s3.Bucket, s3.Endpoint)
+}
+
+func (s3 *S3Client) circuit() *circuitBreaker {
+	return circuitFor(s3.host())
 }
 
 func (s3 *S3Client) request(method string, slashPath string, payload []byte, headers map[string]string, uriParams map[string]string) (*httpResponse, error) {
@@ -212,21 +602,78 @@ func (s3 *S3Client) request(method string, slashPath string, payload []byte, hea
 		pathWithParams += "?" + query.Encode()
 	}
 
-	return _s3Request(
-		method,
-		pathWithParams,
-		payload,
-		s3.AccessKeyID,
-		s3.SecretAccessKey,
-		s3.Region,
-		fmt.Sprintf("%s.%s", s3.Bucket, s3.Endpoint),
-		headers)
-
+	host := s3.host()
+	circuit := s3.circuit()
+	if !circuit.allow() {
+		return nil, errCircuitOpen
+	}
+	span := s3.traceParent.Child("S3 "+method,
+		"http.request.method", method,
+		"server.address", host,
+		"url.path", "/"+strings.TrimPrefix(slashPath, "/"),
+		"http.request.body.size", len(payload),
+	).AsClient()
+	ctx := s3.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	headers = s3.withContentMD5(method, payload, headers)
+	headers = s3.withExtraHeaders(headers)
+	var resp *httpResponse
+	var err error
+	for attempt := 1; ; attempt++ {
+		accessKey, secretKey, service := s3.AccessKeyID, s3.SecretAccessKey, "s3"
+		if s3.directoryBucket() {
+			var session *expressSession
+			if session, err = s3.expressSession(ctx); err != nil {
+				break
+			}
+			accessKey, secretKey, service = session.AccessKeyID, session.SecretAccessKey, "s3express"
+			if headers == nil {
+				headers = make(map[string]string)
+			}
+			headers[HEADER_S3_SESSION_TOKEN] = session.Token
+		}
+		resp, err = _s3Request(
+			ctx,
+			s3.throttle,
+			method,
+			pathWithParams,
+			payload,
+			accessKey,
+			secretKey,
+			s3.Region,
+			service,
+			host,
+			headers)
+		if attempt >= s3.Retry.Attempts || !s3.Retry.retryable(resp, err) {
+			span.SetAttributes("reposy.attempts", attempt)
+			break
+		}
+		delay := s3.Retry.delay(attempt)
+		slog.Debug("Retrying S3 request", "method", method, "key", slashPath, "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		circuit.cancelProbe()
+	} else {
+		circuit.record(err == nil && resp.StatusCode < 500)
+	}
+	if resp != nil {
+		span.SetAttributes("http.response.status_code", resp.StatusCode, "http.response.body.size", len(resp.Body))
+		if resp.StatusCode >= 400 {
+			span.SetError(fmt.Errorf("%s %s: status %d", method, slashPath, resp.StatusCode))
+		}
+	}
+	span.SetError(err)
+	span.End()
+	return resp, err
 }
 
-func _s3Request(method string, uri string, payload []byte, awsAccessKey string, awsSecretKey string, region string, host string, headers map[string]string) (*httpResponse, error) {
-	const service = "s3"
-
+func _s3Request(ctx context.Context, throttle int64, method string, uri string, payload []byte, awsAccessKey string, awsSecretKey string, region string, service string, host string, headers map[string]string) (*httpResponse, error) {
 	if !strings.HasPrefix(uri, "/") {
 		uri = "/" + uri
 	}
@@ -267,6 +714,9 @@ func _s3Request(method string, uri string, payload []byte, awsAccessKey string,
 	amzDate := t.Format("20060102T150405Z")
 	dateStamp := t.Format("20060102")
 
+	// the request is signed and sent with its own copy of the headers, the
+	// caller's being sent again as they were when it retries
+	headers = maps.Clone(headers)
 	if headers == nil {
 		headers = make(map[string]string)
 	}
@@ -323,20 +773,31 @@ func _s3Request(method string, uri string, payload []byte, awsAccessKey string,
 
 	headers["Authorization"] = authorizationHeader
 
-	client := http.Client{}
+	start := time.Now()
+	client := s3HTTPClient()
 	url := "https://" + host + canonicalURI
 	if canonicalQueryString != "" {
 		url += "?" + canonicalQueryString
 	}
-	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	var body io.Reader = bytes.NewReader(payload)
+	if len(payload) > 0 {
+		body = newThrottledReader(ctx, body, throttle)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
+	// Lost when the body is throttled
+	req.ContentLength = int64(len(payload))
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
 	resp, err := client.Do(req)
 	if err != nil {
+		if debugHTTP {
+			slog.Info("S3 request failed", "method", method, "key", parsedURI.Path, "host", host,
+				"latency", time.Since(start), "authorization", redactAuthorization(authorizationHeader), "error", err)
+		}
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -347,14 +808,56 @@ func _s3Request(method string, uri string, payload []byte, awsAccessKey string,
 		respHeaders[k] = v[0]
 	}
 
-	respBody, err := io.ReadAll(resp.Body)
+	respBody, err := io.ReadAll(newThrottledReader(ctx, resp.Body, throttle))
 	if err != nil {
 		return nil, err
 	}
 
+	if debugHTTP {
+		attrs := []any{
+			"method", method,
+			"key", parsedURI.Path,
+			"host", host,
+			"status", respStatus,
+			"latency", time.Since(start),
+			"request_id", resp.Header.Get("x-amz-request-id"),
+			"host_id", resp.Header.Get("x-amz-id-2"),
+			"authorization", redactAuthorization(authorizationHeader),
+		}
+		if respStatus >= 400 {
+			// S3 explains signature mismatches in the error body, which can be
+			// compared with the canonical request signed here
+			attrs = append(attrs, "response", string(respBody), "canonical_request", canonicalRequest)
+		}
+		slog.Info("S3 request", attrs...)
+	}
+
 	return &httpResponse{respStatus, respHeaders, respBody}, nil
 }
 
+// Keeps the credential scope and signed headers of an Authorization header,
+// which help diagnose signature errors, but hides the access key and signature
+func redactAuthorization(header string) string {
+	parts := strings.Split(header, ",")
+	for i, part := range parts {
+		if prefix, credential, ok := strings.Cut(part, "Credential="); ok {
+			accessKey, scope, _ := strings.Cut(credential, "/")
+			parts[i] = prefix + "Credential=" + maskSecret(accessKey) + "/" + scope
+		} else if strings.HasPrefix(part, "Signature=") {
+			parts[i] = "Signature=REDACTED"
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Shows just enough of a key to tell which one is used
+func maskSecret(secret string) string {
+	if len(secret) <= 8 {
+		return "****"
+	}
+	return secret[:4] + "****" + secret[len(secret)-4:]
+}
+
 func sign(key []byte, msg string) []byte {
 	h := hmac.New(sha256.New, key)
 	h.Write([]byte(msg))
@@ -398,3 +901,31 @@ var noEscape [256]bool = func() [256]bool {
 	}
 	return ne
 }()
+
+// Headers set by every request itself, which extra_headers can't replace
+var reservedHeaders = []string{"authorization", "host", "x-amz-date", "x-amz-content-sha256", "content-length"}
+
+func validateExtraHeader(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+		return fmt.Errorf("invalid extra_headers name %q", name)
+	}
+	if slices.Contains(reservedHeaders, strings.ToLower(name)) {
+		return fmt.Errorf("extra_headers can't set %s, it is set by every request", name)
+	}
+	return nil
+}
+
+// Adds the extra headers to those of a request, which keep precedence
+func (s3 *S3Client) withExtraHeaders(headers map[string]string) map[string]string {
+	if len(s3.ExtraHeaders) == 0 {
+		return headers
+	}
+	merged := make(map[string]string, len(headers)+len(s3.ExtraHeaders))
+	for name, value := range s3.ExtraHeaders {
+		merged[name] = value
+	}
+	for name, value := range headers {
+		merged[name] = value
+	}
+	return merged
+}
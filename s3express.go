@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directory buckets of S3 Express One Zone, named like
+// "name--usw2-az1--x-s3", live in a single availability zone and are served
+// by its zonal endpoint. Requests to them are signed for the s3express
+// service with the short-lived credentials of a session, which CreateSession
+// hands out for the keys of the repository.
+const directoryBucketSuffix = "--x-s3"
+
+const HEADER_S3_SESSION_TOKEN = "x-amz-s3session-token"
+
+// Sessions are created again this long before they expire, which they do
+// after 5 minutes
+const expressSessionMargin = time.Minute
+
+type expressSession struct {
+	AccessKeyID     string    `xml:"Credentials>AccessKeyId"`
+	SecretAccessKey string    `xml:"Credentials>SecretAccessKey"`
+	Token           string    `xml:"Credentials>SessionToken"`
+	Expiration      time.Time `xml:"Credentials>Expiration"`
+}
+
+// Sessions by bucket host and access key, shared by the repositories of a
+// bucket
+var expressSessions = struct {
+	sync.Mutex
+	byKey map[string]*expressSession
+}{byKey: make(map[string]*expressSession)}
+
+func (s3 *S3Client) directoryBucket() bool {
+	return strings.HasSuffix(s3.Bucket, directoryBucketSuffix)
+}
+
+// Availability zone ID of a directory bucket, e.g. "usw2-az1"
+func (s3 *S3Client) directoryBucketZone() string {
+	name := strings.TrimSuffix(s3.Bucket, directoryBucketSuffix)
+	if i := strings.LastIndex(name, "--"); i >= 0 {
+		return name[i+2:]
+	}
+	return ""
+}
+
+// Points the client to the zonal endpoint of its directory bucket, unless the
+// endpoint is one already, and rejects the settings directory buckets don't
+// support
+func (s3 *S3Client) useDirectoryBucket() error {
+	zone := s3.directoryBucketZone()
+	if zone == "" {
+		return fmt.Errorf("directory bucket %s has no availability zone, it should be named like name--usw2-az1--x-s3", s3.Bucket)
+	}
+	if !strings.HasPrefix(s3.Endpoint, "s3express-") {
+		if s3.Region == "" {
+			return fmt.Errorf("region must be set for directory bucket %s", s3.Bucket)
+		}
+		s3.Endpoint = fmt.Sprintf("s3express-%s.%s.amazonaws.com", zone, s3.Region)
+	}
+	if s3.ObjectLock.enabled() {
+		return fmt.Errorf("directory bucket %s doesn't support object_lock", s3.Bucket)
+	}
+	return nil
+}
+
+// Returns the session requests to the directory bucket are signed with,
+// creating one when there is none or it is about to expire
+func (s3 *S3Client) expressSession(ctx context.Context) (*expressSession, error) {
+	key := s3.host() + "/" + s3.AccessKeyID
+	expressSessions.Lock()
+	defer expressSessions.Unlock()
+	if session, ok := expressSessions.byKey[key]; ok && time.Until(session.Expiration) > expressSessionMargin {
+		return session, nil
+	}
+
+	headers := map[string]string{"x-amz-create-session-mode": "ReadWrite"}
+	resp, err := _s3Request(ctx, 0, "GET", "/?session", nil, s3.AccessKeyID, s3.SecretAccessKey, s3.Region, "s3express", s3.host(), headers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session for %s: %w", s3.Bucket, err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to create session for %s: %s", s3.Bucket, resp.Body)
+	}
+	var session expressSession
+	if err := xml.Unmarshal(resp.Body, &session); err != nil || session.Token == "" {
+		return nil, fmt.Errorf("unexpected session of %s: %s", s3.Bucket, resp.Body)
+	}
+	expressSessions.byKey[key] = &session
+	return &session, nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule restricts when a repository syncs by itself, to time windows such
+// as "Mon-Fri 09:00-19:00", or to the times of a cron expression instead of
+// every sync interval. Syncs requested with 'reposy sync' always run.
+type Schedule struct {
+	Windows []string `json:"windows,omitempty"`
+	Cron    string   `json:"cron,omitempty"`
+
+	windows []syncWindow
+	cron    *cronSchedule
+}
+
+func (schedule *Schedule) UnmarshalJSON(data []byte) error {
+	var spec struct {
+		Windows []string `json:"windows"`
+		Cron    string   `json:"cron"`
+	}
+	if err := decodeStrict(data, &spec); err != nil {
+		return err
+	}
+	parsed, err := parseSchedule(spec.Windows, spec.Cron)
+	if err != nil {
+		return err
+	}
+	*schedule = *parsed
+	return nil
+}
+
+func parseSchedule(windows []string, cron string) (*Schedule, error) {
+	schedule := &Schedule{Windows: windows, Cron: cron}
+	for _, text := range windows {
+		window, err := parseSyncWindow(text)
+		if err != nil {
+			return nil, fmt.Errorf("schedule window %q: %w", text, err)
+		}
+		schedule.windows = append(schedule.windows, window)
+	}
+	if cron != "" {
+		parsed, err := parseCron(cron)
+		if err != nil {
+			return nil, fmt.Errorf("schedule cron %q: %w", cron, err)
+		}
+		schedule.cron = parsed
+	}
+	return schedule, nil
+}
+
+func (schedule *Schedule) String() string {
+	if schedule == nil {
+		return ""
+	}
+	parts := append([]string(nil), schedule.Windows...)
+	if schedule.Cron != "" {
+		parts = append(parts, "cron "+schedule.Cron)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Allows reports whether t falls in one of the windows, or true without
+// windows
+func (schedule *Schedule) Allows(t time.Time) bool {
+	if schedule == nil || len(schedule.windows) == 0 {
+		return true
+	}
+	for _, window := range schedule.windows {
+		if window.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Timed reports whether the repository syncs at the times of a cron
+// expression rather than every sync interval
+func (schedule *Schedule) Timed() bool {
+	return schedule != nil && schedule.cron != nil
+}
+
+// Next returns the first time after t the cron expression matches
+func (schedule *Schedule) Next(t time.Time) time.Time {
+	return schedule.cron.next(t)
+}
+
+// A time of day range on some days of the week. Ranges ending before they
+// start run past midnight, into the next day.
+type syncWindow struct {
+	days       [7]bool
+	start, end int // minutes since midnight
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseSyncWindow(text string) (syncWindow, error) {
+	var window syncWindow
+	fields := strings.Fields(text)
+	switch len(fields) {
+	case 1:
+		for day := range window.days {
+			window.days[day] = true
+		}
+	case 2:
+		if err := parseWeekdays(fields[0], &window.days); err != nil {
+			return window, err
+		}
+		fields = fields[1:]
+	default:
+		return window, fmt.Errorf(`expected e.g. "Mon-Fri 09:00-19:00"`)
+	}
+
+	start, end, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return window, fmt.Errorf("expected a time range like 09:00-19:00, got %s", fields[0])
+	}
+	var err error
+	if window.start, err = parseTimeOfDay(start); err != nil {
+		return window, err
+	}
+	if window.end, err = parseTimeOfDay(end); err != nil {
+		return window, err
+	}
+	if window.start == window.end {
+		return window, fmt.Errorf("empty time range %s", fields[0])
+	}
+	return window, nil
+}
+
+// Parses days like "Mon-Fri" or "Sat,Sun"
+func parseWeekdays(text string, days *[7]bool) error {
+	for _, part := range strings.Split(strings.ToLower(text), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from := weekdayIndex(first)
+		to := from
+		if isRange {
+			to = weekdayIndex(last)
+		}
+		if from < 0 || to < 0 {
+			return fmt.Errorf("unknown day in %s, use Mon, Tue, Wed, Thu, Fri, Sat or Sun", text)
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func weekdayIndex(name string) int {
+	for index, weekday := range weekdayNames {
+		if strings.HasPrefix(name, weekday) {
+			return index
+		}
+	}
+	return -1
+}
+
+func parseTimeOfDay(text string) (int, error) {
+	parsed, err := time.Parse("15:04", text)
+	if err != nil {
+		if text == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("invalid time %s, use HH:MM", text)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+func (window syncWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := int(t.Weekday())
+	if window.start < window.end {
+		return window.days[day] && minute >= window.start && minute < window.end
+	}
+	// Past midnight, the window started the day before
+	return window.days[day] && minute >= window.start ||
+		window.days[(day+6)%7] && minute < window.end
+}
+
+// A standard 5 field cron expression: minute, hour, day of month, month and
+// day of week, each a *, or a list of values and ranges with optional steps
+type cronSchedule struct {
+	minutes, hours, daysOfMonth, months, daysOfWeek uint64
+	// Whether day of month and day of week are *. When both are restricted,
+	// a day matching either matches, as in cron
+	anyDayOfMonth, anyDayOfWeek bool
+}
+
+var monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+
+func parseCron(text string) (*cronSchedule, error) {
+	fields := strings.Fields(text)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields: minute hour day-of-month month day-of-week")
+	}
+	var cron cronSchedule
+	var err error
+	if cron.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if cron.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if cron.daysOfMonth, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if cron.months, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if cron.daysOfWeek, err = parseCronField(fields[4], 0, 7, weekdayNames); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	// 7 is Sunday too
+	if cron.daysOfWeek&(1<<7) != 0 {
+		cron.daysOfWeek |= 1
+	}
+	cron.anyDayOfMonth = strings.HasPrefix(fields[2], "*")
+	cron.anyDayOfWeek = strings.HasPrefix(fields[4], "*")
+	now := time.Now()
+	if !cron.next(now).Before(now.AddDate(5, 0, 0)) {
+		return nil, fmt.Errorf("never matches")
+	}
+	return &cron, nil
+}
+
+// Parses a cron field into a bit set of the values it matches. Names, when
+// given, stand for the values from min on.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	value := func(text string) (int, error) {
+		for index, name := range names {
+			if strings.EqualFold(text, name) {
+				return min + index, nil
+			}
+		}
+		number, err := strconv.Atoi(text)
+		if err != nil || number < min || number > max {
+			return 0, fmt.Errorf("invalid value %s, expected %d-%d", text, min, max)
+		}
+		return number, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeText, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %s", stepText)
+			}
+		}
+		from, to := min, max
+		if rangeText != "*" {
+			first, last, isRange := strings.Cut(rangeText, "-")
+			var err error
+			if from, err = value(first); err != nil {
+				return 0, err
+			}
+			to = from
+			if isRange {
+				if to, err = value(last); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				to = max
+			}
+			if to < from {
+				return 0, fmt.Errorf("invalid range %s", rangeText)
+			}
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (cron *cronSchedule) matchesDay(t time.Time) bool {
+	dayOfMonth := cron.daysOfMonth&(1<<t.Day()) != 0
+	dayOfWeek := cron.daysOfWeek&(1<<int(t.Weekday())) != 0
+	switch {
+	case cron.anyDayOfMonth && cron.anyDayOfWeek:
+		return true
+	case cron.anyDayOfMonth:
+		return dayOfWeek
+	case cron.anyDayOfWeek:
+		return dayOfMonth
+	}
+	return dayOfMonth || dayOfWeek
+}
+
+// Returns the first minute after t the expression matches, searching up to
+// a few years ahead for expressions like February 30 that never match
+func (cron *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if cron.months&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cron.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if cron.hours&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if cron.minutes&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return limit
+}
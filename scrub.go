@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A scrub checks a few remote objects of each repository against the index
+// at a time, going on where the previous scrub stopped, so that objects lost
+// or damaged on the remote are found before they are needed by a restore.
+type ScrubConfig struct {
+	// Time between scrubs, never scrubbing when 0
+	Interval Interval `json:"interval"`
+	// Objects checked per repository by each scrub
+	Objects int `json:"objects"`
+}
+
+const defaultScrubObjects = 100
+
+// Outcome of the last scrub of a repository
+type ScrubResult struct {
+	At      time.Time `json:"at"`
+	Checked int       `json:"checked"`
+	// Files in the index whose object is gone, or is a tombstone
+	Missing []string `json:"missing,omitempty"`
+	// Files whose object doesn't hold the content the index records
+	Corrupt []string `json:"corrupt,omitempty"`
+	// Local files whose content changed though their modtime didn't, with
+	// verify_local
+	Damaged []string `json:"damaged,omitempty"`
+	// Chunks no file referred to any more, deleted once the scrub went
+	// through the whole index
+	ChunksCollected int    `json:"chunks_collected,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+func (result ScrubResult) Healthy() bool {
+	return result.Error == "" && len(result.Missing) == 0 && len(result.Corrupt) == 0 && len(result.Damaged) == 0
+}
+
+type ScrubArgs struct {
+	// All repositories when empty
+	Repository string `json:"repository,omitempty"`
+	// scrub.objects of the config when 0
+	Objects int `json:"objects,omitempty"`
+}
+
+type ScrubPayload struct {
+	Results map[string]ScrubResult `json:"results"`
+}
+
+// What the metadata of a remote object says about the file it holds
+type objectInfo struct {
+	Exists    bool
+	Tombstone bool
+	// Empty for objects uploaded before they were recorded
+	SHA256 string
+	// -1 when unknown
+	Size int64
+	// Bytes stored, which is the size only for objects stored as they are
+	StoredSize int64
+	Encoding   string
+}
+
+// Stat reads the metadata of the object of a file
+func (s3 *S3Client) Stat(slashPath string) (objectInfo, error) {
+	resp, err := s3.request("HEAD", path.Join(s3.Prefix, slashPath), nil, nil, nil)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	switch resp.StatusCode {
+	case 200:
+	case 404:
+		return objectInfo{}, nil
+	default:
+		return objectInfo{}, fmt.Errorf("failed to check %s: status %d", slashPath, resp.StatusCode)
+	}
+	header := func(name string) string {
+		return resp.Headers[http.CanonicalHeaderKey(name)]
+	}
+	info := objectInfo{
+		Exists:     true,
+		Tombstone:  header(HEADER_TOMBSTONE) == "1",
+		SHA256:     header(HEADER_SHA256),
+		Size:       -1,
+		StoredSize: -1,
+		Encoding:   header(HEADER_ENCODING),
+	}
+	if size, err := strconv.ParseInt(header(HEADER_SIZE), 10, 64); err == nil {
+		info.Size = size
+	}
+	if size, err := strconv.ParseInt(header("Content-Length"), 10, 64); err == nil {
+		info.StoredSize = size
+	}
+	return info, nil
+}
+
+// Scrub checks the objects of up to objects files of the index, starting
+// after those checked by the previous scrub
+func (repo *Repository) Scrub(objects int) ScrubResult {
+	result := ScrubResult{At: time.Now()}
+	stater, ok := repo.Client.(interface {
+		Stat(slashPath string) (objectInfo, error)
+	})
+	if !ok {
+		result.Error = "the remote can not be scrubbed"
+		return result
+	}
+	chunkChecker, _ := repo.Client.(interface {
+		CheckChunks(objectPath string) (missing, corrupt bool, err error)
+	})
+
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+	if repo.closed {
+		result.Error = "the repository is no longer synced"
+		return result
+	}
+
+	if git, err := resolveGitLayout(repo.Path); err == nil {
+		repo.git = git
+	}
+	index, err := repo.Client.Index()
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to get remote files: %v", err)
+		return result
+	}
+	items := make(map[string]*RemoteItem)
+	for shard := 0; shard < index.Shards; shard++ {
+		remoteItems, err := repo.Client.List(index, shard, index.Shards)
+		if err != nil {
+			result.Error = fmt.Sprintf("failed to get remote files: %v", err)
+			return result
+		}
+		for slashPath, item := range remoteItems {
+			if !item.Tombstone {
+				items[slashPath] = item
+			}
+		}
+	}
+	paths := sortedKeys(items)
+	if len(paths) == 0 {
+		return result
+	}
+
+	// Goes on after the last file checked, from the start once past the end
+	cursor := scrubCursors.get(repo.Path)
+	start := sort.SearchStrings(paths, cursor)
+	if start < len(paths) && paths[start] == cursor {
+		start++
+	}
+	start %= len(paths)
+	last := ""
+	for i := 0; i < min(objects, len(paths)); i++ {
+		slashPath := paths[(start+i)%len(paths)]
+		item := items[slashPath]
+		info, err := stater.Stat(item.objectPath(slashPath))
+		if err != nil {
+			result.Error = err.Error()
+			break
+		}
+		result.Checked++
+		last = slashPath
+		switch {
+		case !info.Exists || info.Tombstone:
+			result.Missing = append(result.Missing, slashPath)
+		case info.SHA256 != "" && item.SHA256 != "" && info.SHA256 != item.SHA256:
+			result.Corrupt = append(result.Corrupt, slashPath)
+		case info.Encoding == "" && info.Size >= 0 && info.StoredSize >= 0 && info.Size != info.StoredSize:
+			// Truncated, or replaced by something else
+			result.Corrupt = append(result.Corrupt, slashPath)
+		case info.Encoding == "chunks" && chunkChecker != nil:
+			missing, corrupt, err := chunkChecker.CheckChunks(item.objectPath(slashPath))
+			if err != nil {
+				result.Error = err.Error()
+			} else if missing {
+				result.Missing = append(result.Missing, slashPath)
+			} else if corrupt {
+				result.Corrupt = append(result.Corrupt, slashPath)
+			}
+		}
+		if result.Error != "" {
+			break
+		}
+		if repo.VerifyLocal && repo.syncsRemotePath(slashPath) {
+			damaged, err := repo.verifyLocalFile(slashPath, item)
+			if err != nil {
+				result.Error = err.Error()
+				break
+			}
+			if damaged {
+				result.Damaged = append(result.Damaged, slashPath)
+			}
+		}
+	}
+	if last != "" {
+		scrubCursors.set(repo.Path, last)
+	}
+	// Once every time the scrub went through the whole index
+	if result.Error == "" && start+result.Checked >= len(paths) {
+		collected, err := repo.collectChunks(items)
+		if err != nil {
+			result.Error = fmt.Sprintf("failed to collect unused chunks: %v", err)
+		} else if collected > 0 {
+			result.ChunksCollected = collected
+			repo.logger.Info("Deleted chunks no file refers to any more", "chunks", collected)
+		}
+	}
+
+	for _, slashPath := range result.Missing {
+		repo.logger.Error("Scrub found a file missing on the remote", "file", slashPath)
+	}
+	for _, slashPath := range result.Corrupt {
+		repo.logger.Error("Scrub found a corrupt file on the remote", "file", slashPath)
+	}
+	for _, slashPath := range result.Damaged {
+		repo.logger.Error("Scrub found a local file changed without its modtime changing, it may be damaged on disk", "file", slashPath)
+	}
+	if !result.Healthy() {
+		repo.emit(Event{Type: EventScrubFailed, Message: result.summary()})
+	}
+	return result
+}
+
+func (result ScrubResult) summary() string {
+	if result.Error != "" {
+		return fmt.Sprintf("scrub failed: %s", result.Error)
+	}
+	summary := fmt.Sprintf("scrub checked %d files, %d missing and %d corrupt on the remote", result.Checked, len(result.Missing), len(result.Corrupt))
+	if len(result.Damaged) > 0 {
+		summary += fmt.Sprintf(", %d damaged locally", len(result.Damaged))
+	}
+	return summary + ", see 'reposy scrub'"
+}
+
+// Scrubs every repository each scrub interval until stopped
+func (s *SyncEngine) scrubLoop(config ScrubConfig, stop chan struct{}) {
+	defer s.running.Done()
+	ticker := time.NewTicker(time.Duration(config.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Scrub(nil, config.Objects)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Scrub scrubs the given repositories, or all those not skipped when nil,
+// recording the results in their status
+func (s *SyncEngine) Scrub(repositories []*Repository, objects int) map[string]ScrubResult {
+	if repositories == nil {
+		for _, repository := range s.Repositories() {
+			if !s.Skipped(repository) {
+				repositories = append(repositories, repository)
+			}
+		}
+	}
+	results := make(map[string]ScrubResult, len(repositories))
+	for _, repository := range repositories {
+		result := repository.Scrub(objects)
+		repository.updateStatus(func(status *SyncStatus) {
+			status.Scrub = &result
+		})
+		results[repository.Path] = result
+	}
+	return results
+}
+
+// How far the scrub of each repository went, kept in the state directory by
+// repository path
+type scrubCursorStore struct {
+	mu      sync.Mutex
+	loaded  bool
+	cursors map[string]string
+}
+
+var scrubCursors = &scrubCursorStore{}
+
+func scrubStatePath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "scrub.json"), nil
+}
+
+// Slash path of the last file scrubbed in a repository
+func (store *scrubCursorStore) get(repoPath string) string {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.load()
+	return store.cursors[repoPath]
+}
+
+func (store *scrubCursorStore) set(repoPath, slashPath string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.load()
+	store.cursors[repoPath] = slashPath
+	if err := store.save(); err != nil {
+		// The next scrub starts over
+		slog.Warn("Failed to save scrub state", "error", err)
+	}
+}
+
+func (store *scrubCursorStore) load() {
+	if store.loaded {
+		return
+	}
+	store.loaded = true
+	store.cursors = make(map[string]string)
+	statePath, err := scrubStatePath()
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &store.cursors); err != nil {
+		slog.Warn("Ignoring unreadable scrub state", "file", statePath, "error", err)
+		store.cursors = make(map[string]string)
+	}
+}
+
+func (store *scrubCursorStore) save() error {
+	statePath, err := scrubStatePath()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(store.cursors)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(statePath, data)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+const keychainSecretPrefix = "secret://keychain/"
+
+// Service name under which credentials are stored in the OS keychain
+const keychainService = "reposy"
+
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Resolves a config value: "secret://keychain/<name>" is looked up in the OS
+// keychain, "${NAME}" references are replaced by environment variables.
+// Other "$" characters are kept as they are.
+func resolveConfigValue(value string) (string, error) {
+	if name, ok := strings.CutPrefix(value, keychainSecretPrefix); ok {
+		secret, err := keychainGet(name)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s from keychain: %w", name, err)
+		}
+		return secret, nil
+	}
+
+	var missing []string
+	expanded := envVarPattern.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envVarPattern.FindStringSubmatch(ref)[1]
+		envValue, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return envValue
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// Includes the stderr of a failed command in its error
+func commandError(err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err
+}
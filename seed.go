@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The first sync of a repository whose remote is empty seeds it: files are
+// uploaded in parallel, and the remote index, written once all of them are
+// up, is replaced meanwhile by SEED_FILE, a partial-seed marker listing the
+// files uploaded so far. A seed that is interrupted resumes from it, and the
+// marker is removed once the index is written.
+const SEED_FILE = ".reposyseed"
+
+const (
+	defaultSeedConcurrency = 8
+	defaultSeedMinFiles    = 100
+	// How often the marker records the progress of a seed
+	seedCheckpointInterval = 30 * time.Second
+	// Longest the marker may take to write once a seed timed out
+	seedMarkerTimeout = 30 * time.Second
+)
+
+type SeedConfig struct {
+	// Uploads run at once while seeding
+	Concurrency int `json:"concurrency"`
+	// Repositories with fewer files sync one file at a time as usual
+	MinFiles int `json:"min_files"`
+}
+
+func (config SeedConfig) validate() error {
+	if config.Concurrency < 0 || config.MinFiles < 0 {
+		return fmt.Errorf("seed.concurrency and seed.min_files can't be negative")
+	}
+	return nil
+}
+
+// SeedProgress counts the files of a seed in progress
+type SeedProgress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// Returns the files uploaded by an interrupted seed, or by none an empty map
+// when the remote should be seeded, and nil when it shouldn't
+func (repo *Repository) seedState(index *IndexManifest, localFiles *localListing) (map[string]*RemoteItem, error) {
+	if repo.Direction == DirectionPull {
+		return nil, nil
+	}
+	seeded, err := repo.Client.GetSeed()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seed marker: %w", err)
+	}
+	if seeded != nil {
+		return seeded, nil
+	}
+	empty := index.Shards == 1 && len(index.items) == 0
+	if !empty || localFiles.Len() < repo.Seed.MinFiles {
+		return nil, nil
+	}
+	return make(map[string]*RemoteItem), nil
+}
+
+type seedResult struct {
+	slashPath string
+	item      *FileItem
+	size      int64
+	sha256    string
+	// Left to the sync that follows
+	skipped bool
+	err     error
+}
+
+// Uploads the local files not yet in seeded, adding them to it. Files that
+// fail are left to the sync that follows, which retries them as usual.
+func (repo *Repository) seed(localFiles *localListing, seeded map[string]*RemoteItem) error {
+	repo.logger.Info("Seeding remote", "files", localFiles.Len(), "uploaded", len(seeded))
+	if err := repo.Client.PutSeed(seeded); err != nil {
+		return fmt.Errorf("failed to write seed marker: %w", err)
+	}
+
+	// Files are listed shard by shard, as large listings are on disk
+	shards := indexShardsFor(localFiles.Len())
+	var pending []seedResult
+	for shard := 0; shard < shards; shard++ {
+		items, err := localFiles.Shard(shard, shards)
+		if err != nil {
+			return err
+		}
+		for slashPath, item := range items {
+			if uploaded, ok := seeded[slashPath]; ok && sameModTime(uploaded.ModTime, item.ModTime) {
+				continue
+			}
+			pending = append(pending, seedResult{slashPath: slashPath, item: item})
+		}
+	}
+	repo.updateStatus(func(status *SyncStatus) {
+		status.Seed = SeedProgress{Done: localFiles.Len() - len(pending), Total: localFiles.Len()}
+		status.Queued = len(pending)
+	})
+	defer repo.updateStatus(func(status *SyncStatus) {
+		status.Seed = SeedProgress{}
+	})
+
+	jobs := make(chan seedResult)
+	results := make(chan seedResult)
+	var workers sync.WaitGroup
+	for i := 0; i < max(repo.Seed.Concurrency, 1); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				results <- repo.seedFile(job)
+			}
+		}()
+	}
+	go func() {
+		for _, job := range pending {
+			if repo.cancelled() != nil {
+				break
+			}
+			jobs <- job
+		}
+		close(jobs)
+		workers.Wait()
+		close(results)
+	}()
+
+	checkpoint := time.Now()
+	for result := range results {
+		repo.updateStatus(func(status *SyncStatus) {
+			status.Queued--
+			status.CurrentFile = result.slashPath
+		})
+		if result.skipped {
+			continue
+		}
+		repo.recordMutation(AuditUpload, result.slashPath, result.size, "seeding remote", result.err)
+		if result.err != nil {
+			repo.logger.Warn("Failed to seed file, leaving it to the sync", "file", result.slashPath, "error", result.err)
+			continue
+		}
+		seeded[result.slashPath] = &RemoteItem{ModTime: result.item.ModTime, SHA256: result.sha256, MachineID: thisMachine().ID, MachineName: thisMachine().Name, Size: result.size}
+		repo.updateStatus(func(status *SyncStatus) {
+			status.Seed.Done++
+			status.BytesTransferred += result.size
+		})
+		repo.emit(Event{Type: EventFileUploaded, File: result.slashPath, Size: result.size})
+
+		if time.Since(checkpoint) >= seedCheckpointInterval {
+			if err := repo.Client.PutSeed(seeded); err != nil {
+				repo.logger.Error("Failed to write seed marker", "error", err)
+			}
+			checkpoint = time.Now()
+		}
+	}
+
+	if err := repo.cancelled(); err != nil {
+		// Whatever was uploaded is kept for the next seed, which takes a
+		// request past the timeout of the sync
+		ctx, cancel := context.WithTimeout(context.Background(), seedMarkerTimeout)
+		setClientContext(repo.Client, ctx)
+		if err := repo.Client.PutSeed(seeded); err != nil {
+			repo.logger.Error("Failed to write seed marker", "error", err)
+		}
+		setClientContext(repo.Client, repo.ctx)
+		cancel()
+		return err
+	}
+	if err := repo.Client.PutSeed(seeded); err != nil {
+		return fmt.Errorf("failed to write seed marker: %w", err)
+	}
+	repo.logger.Info("Seeded remote", "files", len(seeded))
+	return nil
+}
+
+// Uploads a file for the seed, unless the limits of the sync hold it back or
+// it is still being written
+func (repo *Repository) seedFile(job seedResult) seedResult {
+	localFilePath := filepath.Join(repo.Path, job.item.FilePath)
+	fileInfo, err := os.Stat(localFilePath)
+	if err != nil {
+		job.err = err
+		return job
+	}
+	if maxUploadSize := repo.syncLimits().MaxUploadSize; fileInfo.IsDir() || job.slashPath == FETCH_HEAD ||
+		maxUploadSize > 0 && fileInfo.Size() > maxUploadSize {
+		job.skipped = true
+		return job
+	}
+	data, stable, err := readStableFile(localFilePath, fileInfo)
+	if err != nil {
+		job.err = err
+		return job
+	}
+	if !stable {
+		job.skipped = true
+		return job
+	}
+	job.size = int64(len(data))
+	job.sha256 = contentSHA256(data)
+	job.err = repo.Client.Put(data, fileInfo.ModTime(), job.slashPath)
+	return job
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func newServiceCmd() *cobra.Command {
+	serviceCmd := &cobra.Command{
+		Use:   "service",
+		Short: "Manage the sync service with the system service manager",
+	}
+
+	var useSystemd, useLaunchd bool
+	serviceManager := func() string {
+		switch {
+		case useSystemd && useLaunchd:
+			fmt.Println("Please choose only one of --systemd and --launchd")
+			os.Exit(ExitUsage)
+		case useSystemd:
+			return "systemd"
+		case useLaunchd:
+			return "launchd"
+		}
+		fmt.Println("Please choose a service manager: --systemd or --launchd")
+		os.Exit(ExitUsage)
+		return ""
+	}
+
+	installCmd := &cobra.Command{
+		Use:   "install",
+		Short: "Install and start the sync service under the service manager",
+		Run: func(cmd *cobra.Command, args []string) {
+			var err error
+			switch serviceManager() {
+			case "systemd":
+				err = installSystemdService()
+			case "launchd":
+				err = installLaunchdService()
+			}
+			if err != nil {
+				fmt.Printf("Failed to install service: %v\n", err)
+				os.Exit(ExitFailure)
+			}
+			fmt.Println("Reposy sync service installed")
+		},
+	}
+	installCmd.Flags().BoolVar(&useSystemd, "systemd", false, "Install as a systemd user unit")
+	installCmd.Flags().BoolVar(&useLaunchd, "launchd", false, "Install as a launchd LaunchAgent (macOS)")
+
+	uninstallCmd := &cobra.Command{
+		Use:   "uninstall",
+		Short: "Stop and remove the sync service from the service manager",
+		Run: func(cmd *cobra.Command, args []string) {
+			var err error
+			switch serviceManager() {
+			case "systemd":
+				err = uninstallSystemdService()
+			case "launchd":
+				err = uninstallLaunchdService()
+			}
+			if err != nil {
+				fmt.Printf("Failed to uninstall service: %v\n", err)
+				os.Exit(ExitFailure)
+			}
+			fmt.Println("Reposy sync service uninstalled")
+		},
+	}
+	uninstallCmd.Flags().BoolVar(&useSystemd, "systemd", false, "Remove the systemd user unit")
+	uninstallCmd.Flags().BoolVar(&useLaunchd, "launchd", false, "Remove the launchd LaunchAgent (macOS)")
+
+	serviceCmd.AddCommand(installCmd, uninstallCmd)
+	return serviceCmd
+}
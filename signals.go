@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SIGTERM and SIGINT shut the daemon down gracefully, a second one exits
+// immediately. SIGHUP reloads the configuration.
+func handleSignals(engine *SyncEngine) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	shuttingDown := false
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			slog.Info("Reloading configuration", "signal", sig.String())
+			sdNotify("RELOADING=1")
+			if changes, err := engine.Restart(); err != nil {
+				slog.Error("Failed to reload configuration", "error", err)
+			} else {
+				for _, change := range changes {
+					slog.Info("Configuration changed", "change", change)
+				}
+			}
+			sdNotify("READY=1")
+			continue
+		}
+
+		if shuttingDown {
+			slog.Warn("Exiting without waiting for the sync in progress", "signal", sig.String())
+			removePidFile()
+			removeSocketFile()
+			os.Exit(1)
+		}
+		shuttingDown = true
+		slog.Info("Shutting down, waiting for the sync in progress to finish", "signal", sig.String())
+		go shutdownDaemon(engine)
+	}
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// A snapshot is the working tree of a repository at one time, as synced:
+// the files git lists, less those excluded, packed in a tar archive
+// compressed by the zstd command. Snapshots are stored in the bucket under
+// SNAPSHOT_PREFIX followed by the prefix of the repository, apart from its
+// files and index, so that they stay as they are whatever the sync does.
+const SNAPSHOT_PREFIX = "snapshots"
+
+const snapshotExt = ".tar.zst"
+
+// Names snapshots by the UTC time they were taken, so they sort by it
+const snapshotTimeLayout = "20060102T150405Z"
+
+// Time between the snapshots snapshot_schedule takes, by name. A duration of
+// an hour or more, like "12h", may be given instead.
+var snapshotSchedules = map[string]time.Duration{
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// A scheduled snapshot that failed or was skipped is tried again after this
+const snapshotRetryDelay = 15 * time.Minute
+
+func parseSnapshotSchedule(schedule string) (time.Duration, error) {
+	if schedule == "" {
+		return 0, nil
+	}
+	if interval, ok := snapshotSchedules[schedule]; ok {
+		return interval, nil
+	}
+	interval, err := time.ParseDuration(schedule)
+	if err != nil || interval < time.Hour {
+		return 0, fmt.Errorf("snapshot_schedule must be \"hourly\", \"daily\", \"weekly\" or a duration of an hour or more, got %q", schedule)
+	}
+	return interval, nil
+}
+
+type SnapshotInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	TakenAt time.Time `json:"taken_at"`
+	// Files in the archive, only known when it was just taken
+	Files int `json:"files,omitempty"`
+}
+
+type SnapshotArgs struct {
+	Repository string `json:"repository"`
+	// Snapshot to restore, "latest" for the most recent one
+	Name string `json:"name,omitempty"`
+	// Directory the snapshot is restored to, which must be empty
+	Target string `json:"target,omitempty"`
+}
+
+type SnapshotsPayload struct {
+	Snapshots []SnapshotInfo `json:"snapshots"`
+}
+
+// The remote of a repository where snapshots can be stored
+type snapshotStore interface {
+	PutSnapshot(name string, archive *os.File, size int64) error
+	ListSnapshots() ([]SnapshotInfo, error)
+	GetSnapshot(name string, w io.Writer) error
+	DeleteSnapshot(name string) error
+}
+
+func snapshotName(takenAt time.Time) string {
+	return takenAt.UTC().Format(snapshotTimeLayout) + snapshotExt
+}
+
+func (s3 *S3Client) snapshotKey(name string) string {
+	return path.Join(SNAPSHOT_PREFIX, s3.Prefix, name)
+}
+
+// PutSnapshot uploads an archive, in parts when it is large
+func (s3 *S3Client) PutSnapshot(name string, archive *os.File, size int64) error {
+	fullPath := s3.snapshotKey(name)
+	headers := map[string]string{}
+	s3.lockHeaders(headers)
+	if size < multipartThreshold {
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return err
+		}
+		resp, err := s3.request("PUT", fullPath, data, headers, nil)
+		if err == nil && resp.StatusCode != 200 {
+			err = fmt.Errorf("failed to put snapshot %s: %s", name, resp.Body)
+		}
+		return err
+	}
+
+	uploadID, err := s3.createMultipart(fullPath, headers)
+	if err != nil {
+		return fmt.Errorf("failed to start upload of snapshot %s: %w", name, err)
+	}
+	upload := &multipartUpload{UploadID: uploadID, Size: size, PartSize: multipartPartSizeFor(size), Parts: make(map[int]string)}
+	buf := make([]byte, upload.PartSize)
+	for part, offset := 1, int64(0); offset < size; part, offset = part+1, offset+upload.PartSize {
+		n, err := archive.ReadAt(buf[:min(upload.PartSize, size-offset)], offset)
+		if err != nil && err != io.EOF {
+			s3.abortMultipart(fullPath, uploadID)
+			return err
+		}
+		resp, err := s3.request("PUT", fullPath, buf[:n], nil, map[string]string{
+			"partNumber": strconv.Itoa(part),
+			"uploadId":   uploadID,
+		})
+		if err == nil && resp.StatusCode != 200 {
+			err = fmt.Errorf("failed to upload part %d of snapshot %s: %s", part, name, resp.Body)
+		}
+		if err != nil {
+			s3.abortMultipart(fullPath, uploadID)
+			return err
+		}
+		upload.Parts[part] = resp.Headers["Etag"]
+	}
+	if err := s3.completeMultipart(fullPath, upload); err != nil {
+		s3.abortMultipart(fullPath, uploadID)
+		return fmt.Errorf("failed to complete upload of snapshot %s: %w", name, err)
+	}
+	return nil
+}
+
+// ListSnapshots lists the snapshots of the repository, oldest first
+func (s3 *S3Client) ListSnapshots() ([]SnapshotInfo, error) {
+	prefix := s3.snapshotKey("") + "/"
+	var snapshots []SnapshotInfo
+	params := map[string]string{"list-type": "2", "prefix": prefix}
+	for {
+		resp, err := s3.request("GET", "", nil, nil, params)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("failed to list snapshots: %s", resp.Body)
+		}
+		var result struct {
+			Contents []struct {
+				Key  string `xml:"Key"`
+				Size int64  `xml:"Size"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := xml.Unmarshal(resp.Body, &result); err != nil {
+			return nil, fmt.Errorf("failed to parse snapshot list: %w", err)
+		}
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, prefix)
+			takenAt, err := time.Parse(snapshotTimeLayout, strings.TrimSuffix(name, snapshotExt))
+			if err != nil || !strings.HasSuffix(name, snapshotExt) {
+				// Not written by reposy
+				continue
+			}
+			snapshots = append(snapshots, SnapshotInfo{Name: name, Size: object.Size, TakenAt: takenAt})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		params["continuation-token"] = result.NextContinuationToken
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name < snapshots[j].Name
+	})
+	return snapshots, nil
+}
+
+// GetSnapshot downloads the archive of a snapshot into w, one part after the
+// other, so that only a part at a time is held in memory
+func (s3 *S3Client) GetSnapshot(name string, w io.Writer) error {
+	fullPath := s3.snapshotKey(name)
+	etag := ""
+	for offset := int64(0); ; {
+		headers := map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", offset, offset+rangedDownloadPartSize-1)}
+		if etag != "" {
+			headers["If-Match"] = etag
+		}
+		resp, err := s3.request("GET", fullPath, nil, headers, nil)
+		if err != nil {
+			return err
+		}
+		if isArchived(resp) {
+			return &archivedError{Keys: []string{fullPath}}
+		}
+		var total int64
+		switch resp.StatusCode {
+		case 200:
+			// The range was ignored, the whole object was sent
+			total = offset + int64(len(resp.Body))
+			if offset > 0 {
+				return fmt.Errorf("failed to download snapshot %s: the range was ignored", name)
+			}
+		case 206:
+			if total, err = contentRangeTotal(resp.Headers["Content-Range"]); err != nil {
+				return fmt.Errorf("failed to download snapshot %s: %w", name, err)
+			}
+		case 404:
+			return fmt.Errorf("no snapshot %s", name)
+		case 412:
+			return fmt.Errorf("snapshot %s: %w", name, errObjectChanged)
+		case 416:
+			if offset == 0 {
+				// An empty object has no range to send
+				return nil
+			}
+			fallthrough
+		default:
+			return fmt.Errorf("failed to download snapshot %s: %s", name, resp.Body)
+		}
+		if _, err := w.Write(resp.Body); err != nil {
+			return err
+		}
+		offset += int64(len(resp.Body))
+		if offset >= total || len(resp.Body) == 0 {
+			return nil
+		}
+		// The other parts must be of the version the first one came from
+		if etag == "" {
+			etag = resp.Headers["Etag"]
+		}
+	}
+}
+
+// DeleteSnapshot deletes the archive of a snapshot
+func (s3 *S3Client) DeleteSnapshot(name string) error {
+	resp, err := s3.request("DELETE", s3.snapshotKey(name), nil, nil, nil)
+	if err == nil && resp.StatusCode != 204 && resp.StatusCode != 200 {
+		err = fmt.Errorf("failed to delete snapshot %s: %s", name, resp.Body)
+	}
+	return err
+}
+
+func (repo *Repository) snapshotStore() (snapshotStore, error) {
+	store, ok := repo.Client.(snapshotStore)
+	if !ok {
+		return nil, fmt.Errorf("the remote of %s can't store snapshots", repo.Path)
+	}
+	if _, err := exec.LookPath("zstd"); err != nil {
+		return nil, fmt.Errorf("snapshots need the zstd command, which isn't in PATH")
+	}
+	return store, nil
+}
+
+// TakeSnapshot archives the working tree as it is and uploads it
+func (repo *Repository) TakeSnapshot() (SnapshotInfo, error) {
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+
+	store, err := repo.snapshotStore()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if git, err := resolveGitLayout(repo.Path); err == nil {
+		repo.git = git
+	}
+	archive, err := os.CreateTemp("", "reposy-snapshot-*"+snapshotExt)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	takenAt := time.Now().UTC().Truncate(time.Second)
+	snapshot := SnapshotInfo{Name: snapshotName(takenAt), TakenAt: takenAt}
+	if snapshot.Files, err = repo.writeSnapshot(archive); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("failed to archive %s: %w", repo.Path, err)
+	}
+	if snapshot.Size, err = archive.Seek(0, io.SeekEnd); err != nil {
+		return SnapshotInfo{}, err
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := store.PutSnapshot(snapshot.Name, archive, snapshot.Size); err != nil {
+		return SnapshotInfo{}, err
+	}
+	repo.logger.Info("Took snapshot", "snapshot", snapshot.Name, "files", snapshot.Files, "size", snapshot.Size)
+	return snapshot, nil
+}
+
+// Writes the synced files of the working tree to w as a tar.zst archive,
+// returning how many there are
+func (repo *Repository) writeSnapshot(w io.Writer) (int, error) {
+	var stderr bytes.Buffer
+	zstd := exec.Command("zstd", "-q", "-c", "-T0")
+	zstd.Stdout = w
+	zstd.Stderr = &stderr
+	input, err := zstd.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := zstd.Start(); err != nil {
+		return 0, fmt.Errorf("zstd command failed: %w", err)
+	}
+
+	archive := tar.NewWriter(input)
+	files := 0
+	err = repo.lsFiles(func(slashPath string) error {
+		remotePath := syncedPath(slashPath)
+		if !repo.syncsRemotePath(remotePath) {
+			return nil
+		}
+		added, err := addSnapshotFile(archive, filepath.Join(repo.Path, filepath.FromSlash(slashPath)), remotePath)
+		if added {
+			files++
+		}
+		return err
+	})
+	if err == nil {
+		err = archive.Close()
+	}
+	input.Close()
+	if waitErr := zstd.Wait(); err == nil && waitErr != nil {
+		err = fmt.Errorf("zstd command failed: %w: %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+	return files, err
+}
+
+// Adds a regular file or symlink to the archive, skipping what is gone or
+// anything else
+func addSnapshotFile(archive *tar.Writer, fullPath, slashPath string) (bool, error) {
+	info, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	var link string
+	switch {
+	case info.Mode().IsRegular():
+	case info.Mode()&os.ModeSymlink != 0:
+		if link, err = os.Readlink(fullPath); err != nil {
+			return false, err
+		}
+	default:
+		return false, nil
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return false, err
+	}
+	header.Name = slashPath
+	if err := archive.WriteHeader(header); err != nil {
+		return false, err
+	}
+	if link != "" {
+		return true, nil
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	// A file growing meanwhile is cut to the size in the header
+	if _, err := io.CopyN(archive, file, header.Size); err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", fullPath, err)
+	}
+	return true, nil
+}
+
+// ListSnapshots lists the snapshots of the repository, oldest first
+func (repo *Repository) ListSnapshots() ([]SnapshotInfo, error) {
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+
+	store, ok := repo.Client.(snapshotStore)
+	if !ok {
+		return nil, fmt.Errorf("the remote of %s can't store snapshots", repo.Path)
+	}
+	return store.ListSnapshots()
+}
+
+// PruneSnapshots deletes the snapshots of the repository but the keep most
+// recent ones, whether scheduled or not, and returns their names
+func (repo *Repository) PruneSnapshots(keep int) ([]string, error) {
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+
+	store, ok := repo.Client.(snapshotStore)
+	if !ok {
+		return nil, fmt.Errorf("the remote of %s can't store snapshots", repo.Path)
+	}
+	snapshots, err := store.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	var pruned []string
+	for _, snapshot := range snapshots[:max(len(snapshots)-keep, 0)] {
+		if err := store.DeleteSnapshot(snapshot.Name); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, snapshot.Name)
+	}
+	return pruned, nil
+}
+
+// Takes the snapshots of a repository every snapshot_schedule, counting
+// from the last one, and prunes those beyond snapshot_keep
+func (s *SyncEngine) snapshotLoop(repository *Repository, stop chan struct{}) {
+	defer s.running.Done()
+	next := time.Now()
+	if snapshots, err := repository.ListSnapshots(); err != nil {
+		repository.logger.Warn("Failed to list snapshots", "error", err)
+	} else if len(snapshots) > 0 {
+		next = snapshots[len(snapshots)-1].TakenAt.Add(repository.SnapshotInterval)
+	}
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+
+		next = time.Now().Add(snapshotRetryDelay)
+		s.mu.Lock()
+		paused := s.paused
+		s.mu.Unlock()
+		if paused || s.Skipped(repository) {
+			continue
+		}
+		if config := s.MeteredConfig(); config.Action == MeteredPause && s.networkMetered(config) {
+			continue
+		}
+		if _, err := repository.TakeSnapshot(); err != nil {
+			repository.logger.Error("Scheduled snapshot failed", "error", err)
+			continue
+		}
+		next = time.Now().Add(repository.SnapshotInterval)
+		if repository.SnapshotKeep > 0 {
+			pruned, err := repository.PruneSnapshots(repository.SnapshotKeep)
+			if len(pruned) > 0 {
+				repository.logger.Info("Pruned snapshots", "snapshots", pruned)
+			}
+			if err != nil {
+				repository.logger.Error("Failed to prune snapshots", "error", err)
+			}
+		}
+	}
+}
+
+// RestoreSnapshot extracts a snapshot into target, an empty or missing
+// directory apart from the repository, and returns its name and the number of
+// files restored
+func (repo *Repository) RestoreSnapshot(name, target string) (string, int, error) {
+	repo.syncMu.Lock()
+	defer repo.syncMu.Unlock()
+
+	store, err := repo.snapshotStore()
+	if err != nil {
+		return "", 0, err
+	}
+	if name == "latest" {
+		snapshots, err := store.ListSnapshots()
+		if err != nil {
+			return "", 0, err
+		}
+		if len(snapshots) == 0 {
+			return "", 0, fmt.Errorf("%s has no snapshots", repo.Path)
+		}
+		name = snapshots[len(snapshots)-1].Name
+	} else if !strings.HasSuffix(name, snapshotExt) {
+		name += snapshotExt
+	}
+
+	if rel, err := filepath.Rel(repo.Path, target); err == nil && filepath.IsLocal(rel) {
+		return "", 0, fmt.Errorf("%s is in the repository, restore snapshots apart from it", target)
+	}
+	if entries, err := os.ReadDir(target); err == nil && len(entries) > 0 {
+		return "", 0, fmt.Errorf("%s isn't empty", target)
+	} else if err != nil && !os.IsNotExist(err) {
+		return "", 0, err
+	}
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return "", 0, err
+	}
+
+	// The archive is extracted while it is downloaded
+	reader, writer := io.Pipe()
+	downloaded := make(chan error, 1)
+	go func() {
+		err := store.GetSnapshot(name, writer)
+		writer.CloseWithError(err)
+		downloaded <- err
+	}()
+	files, err := extractSnapshot(reader, target)
+	reader.CloseWithError(errExtractionStopped)
+	if downloadErr := <-downloaded; downloadErr != nil && !errors.Is(downloadErr, errExtractionStopped) {
+		if files == 0 {
+			os.Remove(target)
+		}
+		return "", files, downloadErr
+	}
+	if err != nil {
+		return "", files, fmt.Errorf("failed to extract snapshot %s: %w", name, err)
+	}
+	repo.logger.Info("Restored snapshot", "snapshot", name, "target", target, "files", files)
+	return name, files, nil
+}
+
+var errExtractionStopped = errors.New("the snapshot extraction stopped")
+
+// Extracts a tar.zst archive into target, returning the number of files
+func extractSnapshot(r io.Reader, target string) (int, error) {
+	var stderr bytes.Buffer
+	zstd := exec.Command("zstd", "-q", "-d", "-c")
+	zstd.Stdin = r
+	zstd.Stderr = &stderr
+	output, err := zstd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := zstd.Start(); err != nil {
+		return 0, fmt.Errorf("zstd command failed: %w", err)
+	}
+
+	files := 0
+	err = func() error {
+		archive := tar.NewReader(output)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			slashPath := path.Clean(header.Name)
+			if !filepath.IsLocal(filepath.FromSlash(slashPath)) {
+				return fmt.Errorf("unsafe path %s in archive", header.Name)
+			}
+			localPath := filepath.FromSlash(diskPath(slashPath))
+			// The archive comes from the bucket, so its entries are kept from
+			// writing through the symlinks it created
+			if err := checkSnapshotPath(target, localPath); err != nil {
+				return err
+			}
+			fullPath := filepath.Join(target, localPath)
+			if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+				return err
+			}
+			switch header.Typeflag {
+			case tar.TypeReg:
+				if err := extractSnapshotFile(archive, header, fullPath); err != nil {
+					return err
+				}
+			case tar.TypeSymlink:
+				linked := path.Join(path.Dir(slashPath), filepath.ToSlash(header.Linkname))
+				if filepath.IsAbs(header.Linkname) || path.IsAbs(header.Linkname) || !filepath.IsLocal(filepath.FromSlash(linked)) {
+					slog.Warn("Skipping snapshot symlink pointing outside of it", "file", slashPath, "link", header.Linkname)
+					continue
+				}
+				if err := os.Symlink(header.Linkname, fullPath); err != nil {
+					return err
+				}
+			default:
+				continue
+			}
+			files++
+		}
+	}()
+	if err != nil {
+		// Stops zstd writing to a pipe no one reads anymore
+		zstd.Process.Kill()
+		zstd.Wait()
+		return files, err
+	}
+	if err := zstd.Wait(); err != nil {
+		return files, fmt.Errorf("zstd command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return files, nil
+}
+
+// Fails when a directory of an entry, or the entry itself, exists as a
+// symlink under target
+func checkSnapshotPath(target, localPath string) error {
+	current := target
+	for _, name := range strings.Split(localPath, string(filepath.Separator)) {
+		current = filepath.Join(current, name)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("unsafe path %s in archive, %s is a symlink", filepath.ToSlash(localPath), current)
+		}
+	}
+	return nil
+}
+
+func extractSnapshotFile(archive io.Reader, header *tar.Header, fullPath string) error {
+	file, err := os.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, archive); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(fullPath, header.ModTime, header.ModTime)
+}
+
+// One line per snapshot, oldest first
+func formatSnapshots(snapshots []SnapshotInfo) string {
+	var sb strings.Builder
+	for _, snapshot := range snapshots {
+		sb.WriteString(fmt.Sprintf("%s  %s  %s\n", snapshot.Name, snapshot.TakenAt.Local().Format("2006-01-02 15:04:05"), formatBytes(snapshot.Size)))
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+func newSnapshotCmd() *cobra.Command {
+	repoArg := func(arg string) string {
+		repoPath, err := filepath.Abs(arg)
+		if err != nil {
+			fmt.Printf("Invalid repository path: %v\n", err)
+			os.Exit(ExitUsage)
+		}
+		return repoPath
+	}
+
+	snapshotCmd := &cobra.Command{
+		Use:   "snapshot <repo>",
+		Short: "Upload an archive of the working tree of a repository, to restore it as a whole later",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			encodedArgs, _ := json.Marshal(SnapshotArgs{Repository: repoArg(args[0])})
+			printResponse(sendCommand("snapshot", string(encodedArgs)), ExitFailure)
+		},
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list <repo>",
+		Short: "List the snapshots of a repository, oldest first",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			requireDaemon()
+			encodedArgs, _ := json.Marshal(SnapshotArgs{Repository: repoArg(args[0])})
+			printResponse(sendCommand("snapshot-list", string(encodedArgs)), ExitFailure)
+		},
+	}
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore <repo> <snapshot> <dir>",
+		Short: "Extract a snapshot, or the latest one, into an empty directory",
+		Long: `Extract a snapshot of a repository into an empty or missing directory,
+leaving the repository and its remote as they are. <snapshot> is a name
+given by 'reposy snapshot list', or "latest".`,
+		Args: cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			target, err := filepath.Abs(args[2])
+			if err != nil {
+				fmt.Printf("Invalid directory: %v\n", err)
+				os.Exit(ExitUsage)
+			}
+			requireDaemon()
+			encodedArgs, _ := json.Marshal(SnapshotArgs{Repository: repoArg(args[0]), Name: args[1], Target: target})
+			printResponse(sendCommand("snapshot-restore", string(encodedArgs)), ExitFailure)
+		},
+	}
+
+	snapshotCmd.AddCommand(listCmd, restoreCmd)
+	return snapshotCmd
+}
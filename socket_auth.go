@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// Restricts who may use the socket of the sync service, for machines shared
+// with other users or services. The socket is only accessible to its owner
+// by default.
+type SocketConfig struct {
+	// Secret every request must carry. The CLI reads it from the config, or
+	// from REPOSY_SOCKET_TOKEN.
+	Token string `json:"token"`
+	// Users allowed to connect besides the owner of the sync service, which
+	// makes the socket accessible to everyone for the check to apply. Only
+	// supported on Linux, where the peer of a connection is known.
+	AllowedUIDs []int `json:"allowed_uids"`
+	// Commands refused over the socket, e.g. "shutdown" and "remove"
+	DisabledCommands []string `json:"disabled_commands"`
+	// Syncs requested with the sync command that may run at once, further
+	// requests being refused until one ends
+	MaxConcurrentSyncs int `json:"max_concurrent_syncs"`
+}
+
+const defaultMaxConcurrentSyncs = 4
+
+// Commands the sync service answers, those handled by dispatchCommand and
+// those streamed or answered by the connection itself
+var socketCommands = []string{
+	"ping", "status", "health", "restart", "profile", "history", "report", "stats",
+	"sync", "schedule-sync", "scrub", "lifecycle-apply", "sign-index", "confirm-deletions",
+	"move", "pause", "skip", "unskip", "resume", "restore", "purge", "which",
+	"snapshot", "snapshot-list", "snapshot-restore", "conflicts", "resolve-conflict", "plan",
+	"shutdown", "events", "watch",
+}
+
+// Requests a connection may have in progress at once
+const maxConnectionRequests = 32
+
+func (config SocketConfig) validate() error {
+	if len(config.AllowedUIDs) > 0 && runtime.GOOS != "linux" {
+		return fmt.Errorf("socket.allowed_uids is only supported on Linux")
+	}
+	if config.MaxConcurrentSyncs < 0 {
+		return fmt.Errorf("socket.max_concurrent_syncs can't be negative")
+	}
+	for _, command := range config.DisabledCommands {
+		if !slices.Contains(socketCommands, command) {
+			return fmt.Errorf("socket.disabled_commands has unknown command %q", command)
+		}
+		if command == "ping" {
+			return fmt.Errorf("socket.disabled_commands can't disable ping, which is always answered")
+		}
+	}
+	return nil
+}
+
+func (config SocketConfig) equal(other SocketConfig) bool {
+	return config.Token == other.Token &&
+		config.MaxConcurrentSyncs == other.MaxConcurrentSyncs &&
+		slices.Equal(config.AllowedUIDs, other.AllowedUIDs) &&
+		slices.Equal(config.DisabledCommands, other.DisabledCommands)
+}
+
+// Whether the user at the other end of a connection may use the socket. The
+// peer is allowed when it can't be known, the socket permissions then being
+// what keeps others out.
+func (config SocketConfig) allowsPeer(conn net.Conn) (bool, int) {
+	uid, known := peerUID(conn)
+	if !known || uid == os.Getuid() {
+		return true, uid
+	}
+	return slices.Contains(config.AllowedUIDs, uid), uid
+}
+
+// Checks the token and command of a request received over the socket. Pings
+// are always answered, being how liveness is probed.
+func (config SocketConfig) authorize(command, token string) *Response {
+	if command == "ping" {
+		return nil
+	}
+	if config.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) != 1 {
+		return &Response{Status: "error", Code: ErrCodeUnauthorized, Message: "Invalid or missing socket token, set REPOSY_SOCKET_TOKEN or socket.token in the config"}
+	}
+	return config.allowCommand(command)
+}
+
+// Refuses the commands of disabled_commands, whether they come over the
+// socket or the HTTP API, whose requests carry the HTTP token instead
+func (config SocketConfig) allowCommand(command string) *Response {
+	if slices.Contains(config.DisabledCommands, command) {
+		return &Response{Status: "error", Code: ErrCodeDisabled, Message: fmt.Sprintf("Command %s is disabled by socket.disabled_commands", command)}
+	}
+	return nil
+}
+
+var clientSocketToken = sync.OnceValue(func() string {
+	if token := os.Getenv("REPOSY_SOCKET_TOKEN"); token != "" {
+		return token
+	}
+	// The sync service rejects the requests if the config can't be read
+	config, err := LoadConfig(configProfile)
+	if err != nil {
+		return ""
+	}
+	return config.Socket.Token
+})
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// Largest files listed by 'reposy stats'
+	statsLargestFiles = 10
+	// Days of growth listed per remote
+	statsGrowthDays = 30
+)
+
+// StatsPayload aggregates the sync history and the audit log. Sizes are of
+// the files as uploaded, before compression and deduplication.
+type StatsPayload struct {
+	Remotes      []RemoteStats     `json:"remotes"`
+	Largest      []FileStats       `json:"largest_files"`
+	Repositories []RepositoryStats `json:"repositories"`
+}
+
+type RemoteStats struct {
+	Remote string `json:"remote"`
+	Files  int    `json:"files"`
+	Bytes  int64  `json:"bytes"`
+	// Bytes stored at the end of each day files changed, up to
+	// statsGrowthDays days back
+	Growth []GrowthPoint `json:"growth,omitempty"`
+}
+
+type GrowthPoint struct {
+	Date  string `json:"date"`
+	Bytes int64  `json:"bytes"`
+}
+
+type FileStats struct {
+	Repository string    `json:"repository"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+type RepositoryStats struct {
+	Repository      string    `json:"repository"`
+	Since           time.Time `json:"since"`
+	Runs            int       `json:"runs"`
+	FailedRuns      int       `json:"failed_runs"`
+	FilesUploaded   int       `json:"files_uploaded"`
+	FilesDownloaded int       `json:"files_downloaded"`
+	FilesDeleted    int       `json:"files_deleted"`
+	BytesUploaded   int64     `json:"bytes_uploaded"`
+	BytesDownloaded int64     `json:"bytes_downloaded"`
+	// Files changed per day since the first recorded run
+	ChurnPerDay float64 `json:"churn_files_per_day"`
+}
+
+// Stats aggregates what the history and the audit log recorded
+func (s *SyncEngine) Stats() (StatsPayload, error) {
+	stats := StatsPayload{
+		Remotes:      make([]RemoteStats, 0),
+		Largest:      make([]FileStats, 0),
+		Repositories: make([]RepositoryStats, 0),
+	}
+	if s.audit != nil {
+		entries, err := s.audit.Entries()
+		if err != nil {
+			return stats, err
+		}
+		stats.Remotes, stats.Largest = remoteStats(entries, time.Now())
+	}
+	if s.history != nil {
+		runs, err := s.history.Runs("", "")
+		if err != nil {
+			return stats, err
+		}
+		stats.Repositories = repositoryStats(runs, time.Now())
+	}
+	return stats, nil
+}
+
+// Replays the changes made to remotes to tell what each of them holds
+func remoteStats(entries []AuditEntry, now time.Time) ([]RemoteStats, []FileStats) {
+	type remoteState struct {
+		stats  RemoteStats
+		files  map[string]FileStats
+		growth map[string]int64
+	}
+	remotes := make(map[string]*remoteState)
+	since := now.AddDate(0, 0, -statsGrowthDays).Format(time.DateOnly)
+	for _, entry := range entries {
+		if entry.Error != "" || entry.Action == AuditIndexWrite || entry.Remote == "" {
+			continue
+		}
+		remote, ok := remotes[entry.Remote]
+		if !ok {
+			remote = &remoteState{
+				stats:  RemoteStats{Remote: entry.Remote},
+				files:  make(map[string]FileStats),
+				growth: make(map[string]int64),
+			}
+			remotes[entry.Remote] = remote
+		}
+		remote.stats.Bytes -= remote.files[entry.Path].Size
+		delete(remote.files, entry.Path)
+		if entry.Action == AuditUpload {
+			remote.files[entry.Path] = FileStats{
+				Repository: entry.Repository,
+				Path:       entry.Path,
+				Size:       entry.Size,
+				UploadedAt: entry.Time,
+			}
+			remote.stats.Bytes += entry.Size
+		}
+		if date := entry.Time.Local().Format(time.DateOnly); date >= since {
+			remote.growth[date] = remote.stats.Bytes
+		}
+	}
+
+	result := make([]RemoteStats, 0, len(remotes))
+	largest := make([]FileStats, 0)
+	for _, remote := range remotes {
+		remote.stats.Files = len(remote.files)
+		for date, bytes := range remote.growth {
+			remote.stats.Growth = append(remote.stats.Growth, GrowthPoint{Date: date, Bytes: bytes})
+		}
+		sort.Slice(remote.stats.Growth, func(i, j int) bool {
+			return remote.stats.Growth[i].Date < remote.stats.Growth[j].Date
+		})
+		result = append(result, remote.stats)
+		for _, file := range remote.files {
+			largest = append(largest, file)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Remote < result[j].Remote })
+	sort.Slice(largest, func(i, j int) bool { return largest[i].Size > largest[j].Size })
+	return result, largest[:min(len(largest), statsLargestFiles)]
+}
+
+func repositoryStats(runs []SyncRun, now time.Time) []RepositoryStats {
+	byRepository := make(map[string]*RepositoryStats)
+	for _, run := range runs {
+		stats, ok := byRepository[run.Repository]
+		if !ok {
+			stats = &RepositoryStats{Repository: run.Repository, Since: run.StartedAt}
+			byRepository[run.Repository] = stats
+		}
+		stats.Runs++
+		if run.Error != "" {
+			stats.FailedRuns++
+		}
+		stats.FilesUploaded += len(run.Uploaded)
+		stats.FilesDownloaded += len(run.Downloaded)
+		stats.FilesDeleted += len(run.Tombstoned) + len(run.Removed)
+		stats.BytesUploaded += run.BytesUploaded
+		stats.BytesDownloaded += run.BytesDownloaded
+	}
+
+	result := make([]RepositoryStats, 0, len(byRepository))
+	for _, stats := range byRepository {
+		// At least a day, so a repository synced for an hour doesn't look busy
+		days := max(now.Sub(stats.Since).Hours()/24, 1)
+		stats.ChurnPerDay = float64(stats.FilesUploaded+stats.FilesDownloaded+stats.FilesDeleted) / days
+		result = append(result, *stats)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Repository < result[j].Repository })
+	return result
+}
+
+func printStats(stats StatsPayload) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REMOTE\tFILES\tSIZE\tGROWTH")
+	for _, remote := range stats.Remotes {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", remote.Remote, remote.Files, formatBytes(remote.Bytes), formatGrowth(remote.Growth))
+	}
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LARGEST FILE\tSIZE\tUPLOADED")
+	for _, file := range stats.Largest {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", filepath.Join(file.Repository, filepath.FromSlash(file.Path)), formatBytes(file.Size), file.UploadedAt.Local().Format(time.DateTime))
+	}
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tSINCE\tRUNS\tFAILED\tUP\tDOWN\tDELETED\tCHURN/DAY")
+	for _, repo := range stats.Repositories {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d (%s)\t%d (%s)\t%d\t%.1f\n",
+			repo.Repository, repo.Since.Local().Format(time.DateOnly), repo.Runs, repo.FailedRuns,
+			repo.FilesUploaded, formatBytes(repo.BytesUploaded),
+			repo.FilesDownloaded, formatBytes(repo.BytesDownloaded),
+			repo.FilesDeleted, repo.ChurnPerDay)
+	}
+	w.Flush()
+}
+
+// Change in size over the growth period
+func formatGrowth(growth []GrowthPoint) string {
+	if len(growth) < 2 {
+		return "-"
+	}
+	first, last := growth[0], growth[len(growth)-1]
+	change := last.Bytes - first.Bytes
+	sign := "+"
+	if change < 0 {
+		sign, change = "-", -change
+	}
+	return fmt.Sprintf("%s%s since %s", sign, formatBytes(change), first.Date)
+}
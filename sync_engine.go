@@ -2,27 +2,209 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
 type SyncEngine struct {
+	// Guards the fields below that change while the engine runs
+	mu           sync.Mutex
 	repositories []*Repository
-	syncTicker   *time.Ticker
-	stopChan     chan struct{}
-	syncing      bool
+	// Closed to stop the periodic sync loops, nil while they aren't running
+	stopChan chan struct{}
+	paused   bool
+	// Skip flags set with 'reposy skip' and 'reposy unskip', by repository
+	// path, kept across reloads until the skip setting of the repository
+	// changes in the config
+	skipOverrides map[string]bool
+	httpConfig    HTTPConfig
+	socketConfig  SocketConfig
+	// Syncs requested over the socket or the HTTP API still running
+	requestedSyncs int
+	notifyConfig   NotificationConfig
+	// What to do on a metered network
+	meteredConfig MeteredConfig
+	batteryConfig BatteryConfig
+	scrubConfig   ScrubConfig
+	events        *EventBus
+	history       *History
+	audit         *AuditLog
+	tracer        *Tracer
+	syncInterval  time.Duration
+	startedAt     time.Time
+	config        *Config
+
+	// Active config profile, and the state kept for each profile across
+	// reloads and profile switches
+	profile       string
+	profileStates map[string]*profileState
+
+	// Held while syncing a repository path, by path
+	pathLocks map[string]*sync.Mutex
+	// Syncs scheduled once with 'reposy sync --at', by repository path
+	oneShots map[string]*oneShotSync
+	// Sync loops and the syncs started by SyncAll, waited for by Shutdown
+	running      sync.WaitGroup
+	shuttingDown bool
+
+	// Whether the network is metered, as of meteredAt
+	meteredMu sync.Mutex
+	meteredAt time.Time
+	metered   bool
+	// Power source of the machine, as of powerAt
+	powerMu sync.Mutex
+	powerAt time.Time
+	power   powerState
+
+	// Serializes reloads and shutdown
+	reloadMu sync.Mutex
+}
+
+type profileState struct {
+	paused   bool
+	statuses map[string]SyncStatus
 }
 
 type SyncStatus struct {
 	LastSync   time.Time
 	InProgress bool
 	Error      string
+	// When Error was set
+	ErrorAt time.Time
+	// When the repository syncs by itself next, zero if unknown
+	NextSync time.Time
+	// Whether the repository path is gone since it last synced
+	Missing bool
+	// Deletions holding syncs back until confirmed
+	Deletions *HeldDeletions
+	// Result of the last scrub of the remote, nil before the first
+	Scrub *ScrubResult
+	// Set while syncs are skipped because the remote keeps failing
+	CircuitOpenUntil time.Time
+	// Syncs in a row that failed, zero once one succeeds
+	FailureStreak int
+	// Progress of the seed in progress, zero otherwise
+	Seed SeedProgress
+	// Files changed on other machines the last sync left newer on the
+	// remote, nil when there are none
+	Behind *BehindStatus
+	// Set when the last sync held back downloads that didn't fit on disk
+	DiskSpace *DiskShortage
+
+	// Progress of the sync in progress
+	StartedAt        time.Time
+	CurrentFile      string
+	Queued           int
+	BytesTransferred int64
+	// Bytes of the files queued for upload
+	BytesPending int64
+
+	// Transfers of the last finished sync, and of all syncs since the sync
+	// service started
+	LastRun TransferStats
+	Total   TransferStats
+}
+
+// TransferStats counts the files and bytes moved by one or more syncs
+type TransferStats struct {
+	FilesUploaded   int           `json:"files_uploaded"`
+	FilesDownloaded int           `json:"files_downloaded"`
+	FilesTombstoned int           `json:"files_tombstoned"`
+	BytesUploaded   int64         `json:"bytes_uploaded"`
+	BytesDownloaded int64         `json:"bytes_downloaded"`
+	Duration        time.Duration `json:"duration_ns"`
 }
 
-func NewSyncEngine() (*SyncEngine, error) {
-	engine := SyncEngine{}
-	err := engine.stopAndLoadConfig()
+func (stats *TransferStats) Add(other TransferStats) {
+	stats.FilesUploaded += other.FilesUploaded
+	stats.FilesDownloaded += other.FilesDownloaded
+	stats.FilesTombstoned += other.FilesTombstoned
+	stats.BytesUploaded += other.BytesUploaded
+	stats.BytesDownloaded += other.BytesDownloaded
+	stats.Duration += other.Duration
+}
+
+// Average throughput over the time spent syncing
+func (stats TransferStats) BytesPerSecond() float64 {
+	if stats.Duration <= 0 {
+		return 0
+	}
+	return float64(stats.BytesUploaded+stats.BytesDownloaded) / stats.Duration.Seconds()
+}
+
+// RepositorySnapshot is the progress of a repository as streamed by `status --watch`
+type RepositorySnapshot struct {
+	Path             string    `json:"path"`
+	LastSync         time.Time `json:"last_sync"`
+	InProgress       bool      `json:"in_progress"`
+	Error            string    `json:"error,omitempty"`
+	Missing          bool      `json:"missing,omitempty"`
+	CurrentFile      string    `json:"current_file,omitempty"`
+	Queued           int       `json:"queued"`
+	BytesTransferred int64     `json:"bytes_transferred"`
+	BytesPending     int64     `json:"bytes_pending"`
+	// When the error happened
+	ErrorAt *time.Time `json:"error_at,omitempty"`
+	// When the repository syncs by itself next, unless paused
+	NextSync *time.Time `json:"next_sync,omitempty"`
+	// Last scrub of the remote, if any
+	Scrub *ScrubResult `json:"scrub,omitempty"`
+	// One-shot sync scheduled with 'reposy sync --at'
+	ScheduledSync  *time.Time `json:"scheduled_sync,omitempty"`
+	BytesPerSecond float64    `json:"bytes_per_second"`
+	// When the repository syncs by itself, if restricted
+	Schedule string `json:"schedule,omitempty"`
+	// "push" or "pull" for a one-way repository
+	Direction string `json:"direction,omitempty"`
+	// Progress of the first sync of an empty remote
+	Seed *SeedProgress `json:"seed,omitempty"`
+	// Deletions past the deletion limit, waiting to be confirmed
+	HeldDeletions *HeldDeletions `json:"held_deletions,omitempty"`
+	// Whether the repository is skipped, by its config or 'reposy skip'
+	Skipped bool `json:"skipped,omitempty"`
+	// Files another machine changed that the local copies are behind
+	Behind *BehindStatus `json:"behind,omitempty"`
+	// Space the downloads held back by the last sync needed
+	DiskSpace *DiskShortage `json:"disk_space,omitempty"`
+	// Until when syncs are skipped because the remote keeps failing
+	CircuitOpenUntil *time.Time `json:"circuit_open_until,omitempty"`
+	// Syncs in a row that failed, and whether they reached the
+	// notifications.failure_threshold
+	FailureStreak int  `json:"failure_streak,omitempty"`
+	Failing       bool `json:"failing,omitempty"`
+
+	LastRun TransferStats `json:"last_run"`
+	Total   TransferStats `json:"total"`
+
+	// Files that failed to sync and will be retried
+	Retries []RetryItem `json:"retries"`
+}
+
+func NewSyncEngine(profile string) (*SyncEngine, error) {
+	engine := SyncEngine{
+		events:        NewEventBus(),
+		startedAt:     time.Now(),
+		profileStates: make(map[string]*profileState),
+		pathLocks:     make(map[string]*sync.Mutex),
+		oneShots:      make(map[string]*oneShotSync),
+		skipOverrides: make(map[string]bool),
+	}
+	history, err := OpenHistory()
+	if err != nil {
+		slog.Error("Sync history is disabled", "error", err)
+	} else {
+		engine.history = history
+	}
+	audit, err := OpenAuditLog()
+	if err != nil {
+		slog.Error("Audit log is disabled", "error", err)
+	} else {
+		engine.audit = audit
+	}
+	_, err = engine.stopAndLoadConfig(profile)
 	if err != nil {
 		return nil, err
 	}
@@ -30,111 +212,697 @@ func NewSyncEngine() (*SyncEngine, error) {
 	return &engine, nil
 }
 
+// Start syncs all repositories, then keeps syncing them every sync
+// interval until stopped. It does nothing when already started.
 func (s *SyncEngine) Start() {
-	// Initial sync for all repositories
-	s.SyncAll()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopChan != nil || s.shuttingDown {
+		return
+	}
+	stop := make(chan struct{})
+	s.stopChan = stop
+	for _, repository := range s.repositories {
+		s.running.Add(1)
+		go s.run(repository, s.syncInterval, stop)
+		if repository.SnapshotInterval > 0 {
+			s.running.Add(1)
+			go s.snapshotLoop(repository, stop)
+		}
+	}
+	if s.scrubConfig.Interval > 0 {
+		s.running.Add(1)
+		go s.scrubLoop(s.scrubConfig, stop)
+	}
+}
 
-	// Start periodic sync
-	go func() {
-		for {
-			select {
-			case <-s.syncTicker.C:
-				s.SyncAll()
-			case <-s.stopChan:
-				s.syncTicker.Stop()
-				return
+// The periodic sync loop of a repository. Each repository has its own loop,
+// so a sync that hangs only holds up its own repository. The ticker and stop
+// channel are owned by the loop, so a restarted engine never shares them
+// with a loop that is shutting down.
+func (s *SyncEngine) run(repository *Repository, interval time.Duration, stop chan struct{}) {
+	defer s.running.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	nextTick := time.Now().Add(interval)
+	schedule := repository.Schedule
+
+	// Initial sync, after the sync of the repository a reload replaced ends.
+	// Repositories on a cron schedule wait for its next time instead.
+	if !schedule.Timed() && schedule.Allows(time.Now()) {
+		s.syncRepository(repository, true, stop)
+	}
+
+	for {
+		ticks := ticker.C
+		var timer *time.Timer
+		next := nextSyncTime(schedule, nextTick, interval)
+		if schedule.Timed() {
+			timer = time.NewTimer(time.Until(next))
+			ticks = timer.C
+		}
+		repository.updateStatus(func(status *SyncStatus) {
+			status.NextSync = next
+		})
+		select {
+		case now := <-ticks:
+			nextTick = now.Add(interval)
+			if !schedule.Allows(now) || s.deferredOnBattery(repository) {
+				continue
+			}
+			s.syncRepository(repository, false, stop)
+		case <-stop:
+			if timer != nil {
+				timer.Stop()
 			}
+			return
 		}
-	}()
+	}
+}
+
+// When a repository syncs by itself next, given its schedule and the next
+// tick of the sync interval. Ticks outside of the sync windows are skipped,
+// up to a week ahead.
+func nextSyncTime(schedule *Schedule, nextTick time.Time, interval time.Duration) time.Time {
+	if schedule.Timed() {
+		return schedule.Next(time.Now())
+	}
+	for t := nextTick; t.Before(nextTick.Add(7 * 24 * time.Hour)); t = t.Add(interval) {
+		if schedule.Allows(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Syncs a repository unless stop is closed. With wait set, it waits for the
+// sync of the same path in progress to end instead of skipping.
+func (s *SyncEngine) syncRepository(repository *Repository, wait bool, stop chan struct{}) {
+	lock := s.pathLock(repository.Path)
+	if wait {
+		lock.Lock()
+	} else if !lock.TryLock() {
+		repository.logger.Info("Sync already in progress")
+		return
+	}
+	defer lock.Unlock()
+
+	select {
+	case <-stop:
+		return
+	default:
+	}
+	s.mu.Lock()
+	paused := s.paused
+	s.mu.Unlock()
+	if paused {
+		repository.logger.Info("Sync skipped, syncing is paused")
+		return
+	}
+	if s.Skipped(repository) {
+		repository.logger.Debug("Sync skipped, the repository is skipped")
+		return
+	}
+	var limits SyncLimits
+	if config := s.MeteredConfig(); config.Action != "" && s.networkMetered(config) {
+		if config.Action == MeteredPause {
+			repository.logger.Info("Sync skipped, the network is metered")
+			return
+		}
+		limits.Throttle = config.ThrottleRate
+	}
+	if config := s.BatteryConfig(); config.MaxUploadSize > 0 {
+		if low, _ := s.lowBattery(config); low {
+			limits.MaxUploadSize = config.MaxUploadSize
+		}
+	}
+	repository.SetLimits(limits)
+	repository.Sync()
+}
+
+// Whether the periodic sync of a repository waits because the battery is
+// low and the battery sync interval hasn't passed since its last sync
+func (s *SyncEngine) deferredOnBattery(repository *Repository) bool {
+	config := s.BatteryConfig()
+	if low, _ := s.lowBattery(config); !low {
+		return false
+	}
+	return time.Since(repository.Status().LastSync) < time.Duration(config.SyncInterval)
+}
+
+// Returns the lock held while syncing a path, shared by the repositories of
+// the path across reloads so their syncs never overlap
+func (s *SyncEngine) pathLock(path string) *sync.Mutex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lock, ok := s.pathLocks[path]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.pathLocks[path] = lock
+	}
+	return lock
 }
 
 func (s *SyncEngine) IsSyncing() bool {
-	return s.syncing
+	for _, repository := range s.Repositories() {
+		if repository.Status().InProgress {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SyncEngine) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = true
+}
+
+func (s *SyncEngine) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = false
+}
+
+// Whether a repository is skipped, by 'reposy skip' or else by its config
+func (s *SyncEngine) Skipped(repository *Repository) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if skip, ok := s.skipOverrides[repository.Path]; ok {
+		return skip
+	}
+	return repository.Skip
+}
+
+// SetSkipped skips a repository, or stops skipping it, until the service
+// stops. A sync in progress isn't interrupted.
+func (s *SyncEngine) SetSkipped(repository *Repository, skip bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if skip == repository.Skip {
+		delete(s.skipOverrides, repository.Path)
+	} else {
+		s.skipOverrides[repository.Path] = skip
+	}
 }
 
+// SyncAll syncs every repository concurrently and waits for the syncs to
+// end. Repositories already syncing are skipped.
 func (s *SyncEngine) SyncAll() {
-	if s.syncing {
-		log.Println("Sync already in progress")
+	s.mu.Lock()
+	if s.shuttingDown {
+		s.mu.Unlock()
 		return
 	}
-	s.syncing = true
-	defer func() {
-		s.syncing = false
+	repositories := s.repositories
+	s.running.Add(len(repositories))
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, repository := range repositories {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.running.Done()
+			s.syncRepository(repository, false, nil)
+		}()
+	}
+	wg.Wait()
+}
+
+// SyncRepository starts a sync of a repository in the background, unless it
+// is already syncing, and calls done, if not nil, once it ended
+func (s *SyncEngine) SyncRepository(repository *Repository, done func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		if done != nil {
+			done()
+		}
+		return
+	}
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		if done != nil {
+			defer done()
+		}
+		s.syncRepository(repository, false, nil)
 	}()
+}
 
-	for _, repository := range s.repositories {
-		repository.Sync()
+// Reserves one of the syncs requested over the socket or the HTTP API that
+// may run at once, so that a script requesting syncs in a loop can't pile
+// them up. Returns false when socket.max_concurrent_syncs are running.
+func (s *SyncEngine) reserveRequestedSync() (func(), bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.requestedSyncs >= s.socketConfig.MaxConcurrentSyncs {
+		return nil, false
 	}
+	s.requestedSyncs++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.requestedSyncs--
+		})
+	}, true
 }
 
 func (s *SyncEngine) Stop() {
-	if s.syncTicker != nil {
-		s.syncTicker.Stop()
-	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop()
+}
+
+func (s *SyncEngine) stop() {
 	if s.stopChan != nil {
 		close(s.stopChan)
+		s.stopChan = nil
+	}
+}
+
+// Shutdown stops syncing and waits for the syncs in progress to finish
+func (s *SyncEngine) Shutdown() {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.mu.Lock()
+	s.stop()
+	s.cancelOneShots()
+	s.shuttingDown = true
+	s.mu.Unlock()
+
+	s.running.Wait()
+	s.tracer.Shutdown()
+	for _, repository := range s.Repositories() {
+		repository.Close()
 	}
 }
 
-func (s *SyncEngine) Restart() error {
-	s.Stop()
-	err := s.stopAndLoadConfig()
+// Restart reloads the configuration and restarts syncing, returning what
+// changed. When the new configuration is invalid, the engine keeps running
+// with the previous one.
+func (s *SyncEngine) Restart() ([]string, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	return s.reload(s.Profile())
+}
+
+// SwitchProfile restarts syncing with another config profile. The paused
+// flag and sync status of each profile are kept for when it is switched back.
+func (s *SyncEngine) SwitchProfile(profile string) ([]string, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	return s.reload(profile)
+}
+
+// MoveRepository moves a repository to another path, along with its config
+// and sync status, and restarts syncing. See moveRepository.
+func (s *SyncEngine) MoveRepository(from, to string) ([]string, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	repository := s.FindRepository(from)
+	if repository == nil {
+		return nil, fmt.Errorf("repository not configured: %s", from)
+	}
+	s.mu.Lock()
+	config := s.config
+	s.mu.Unlock()
+
+	// The directory isn't moved from under a sync
+	lock := s.pathLock(repository.Path)
+	lock.Lock()
+	done, err := moveRepository(config, from, to)
+	lock.Unlock()
 	if err != nil {
-		return err
+		return done, err
+	}
+
+	changes, err := s.stopAndLoadConfig(s.Profile())
+	if err != nil {
+		return done, err
+	}
+	if moved := s.FindRepository(to); moved != nil {
+		saved := repository.Status()
+		moved.updateStatus(func(status *SyncStatus) {
+			status.LastSync = saved.LastSync
+			status.LastRun = saved.LastRun
+			status.Total = saved.Total
+		})
 	}
 	s.Start()
-	return nil
+	return append(done, changes...), nil
 }
 
-func (s *SyncEngine) stopAndLoadConfig() error {
-	s.Stop()
-	config, err := LoadConfig()
+func (s *SyncEngine) reload(profile string) ([]string, error) {
+	changes, err := s.stopAndLoadConfig(profile)
 	if err != nil {
-		return fmt.Errorf("failed to load config: %w", err)
+		return nil, err
 	}
+	s.Start()
+	return changes, nil
+}
 
+func (s *SyncEngine) Profile() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.profile
+}
+
+// Loads the config and replaces the running one, returning the changes
+// compared to the config replaced. The caller holds reloadMu.
+func (s *SyncEngine) stopAndLoadConfig(profile string) ([]string, error) {
+	config, err := LoadConfig(profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	tracer := NewTracer(config.Tracing)
 	repositories := make([]*Repository, 0, len(config.Repositories))
 	for localPath, repoConfig := range config.Repositories {
-		if repoConfig.Skip {
+		repo, err := NewRepository(localPath, config, repoConfig)
+		if err != nil && repoConfig.Skip {
+			// A skipped repository may be left incomplete, e.g. without
+			// credentials on this machine
+			slog.Warn("Skipped repository left out", "repository", localPath, "error", err)
 			continue
 		}
-		repo := NewRepository(localPath, config, repoConfig)
+		if err != nil {
+			tracer.Shutdown()
+			return nil, err
+		}
+		repo.events = s.events
+		repo.history = s.history
+		repo.audit = s.audit
+		repo.tracer = tracer
 		repositories = append(repositories, repo)
 	}
+
+	if err := setupLogger(config.LogFormat, config.LogLevel); err != nil {
+		return nil, fmt.Errorf("failed to set up logger: %w", err)
+	}
+
+	var changes []string
+	if s.config != nil {
+		if profile != s.profile {
+			changes = append(changes, fmt.Sprintf("Profile: %q -> %q", s.profile, profile))
+		}
+		changes = append(changes, diffConfig(s.config, s.repositories, config, repositories)...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Only stop once the new configuration is known to be valid
+	s.stop()
+	// exports the spans of the previous config in the background
+	go s.tracer.Shutdown()
+	s.tracer = tracer
+	s.saveProfileState()
+	s.profile = profile
+	s.restoreProfileState(repositories)
+
+	// Skip overrides are dropped with their repository, or when the config
+	// changed its skip setting
+	skips := make(map[string]bool, len(repositories))
+	for _, repository := range s.repositories {
+		skips[repository.Path] = repository.Skip
+	}
+	overrides := make(map[string]bool)
+	for _, repository := range repositories {
+		skip, ok := s.skipOverrides[repository.Path]
+		if previous, existed := skips[repository.Path]; ok && existed && previous == repository.Skip {
+			overrides[repository.Path] = skip
+		}
+	}
+	s.skipOverrides = overrides
+
+	// The repositories replaced are closed once their sync in progress ends
+	for _, repository := range s.repositories {
+		go repository.Close()
+	}
 	s.repositories = repositories
-	s.syncTicker = time.NewTicker(time.Duration(config.SyncInterval) * time.Second)
-	s.stopChan = make(chan struct{})
+	s.config = config
+	s.httpConfig = config.HTTP
+	s.socketConfig = config.Socket
+	s.notifyConfig = config.Notifications
+	s.meteredConfig = config.Metered
+	s.batteryConfig = config.Battery
+	s.scrubConfig = config.Scrub
+	setS3Transport(config.Transport)
+	// Checked again, as the command may have changed
+	s.meteredMu.Lock()
+	s.meteredAt = time.Time{}
+	s.meteredMu.Unlock()
+	s.syncInterval = time.Duration(config.SyncInterval)
 
-	return nil
+	return changes, nil
 }
 
-func (s *SyncEngine) GetStatus() string {
-	var sb strings.Builder
+func (s *SyncEngine) saveProfileState() {
+	state := &profileState{paused: s.paused, statuses: make(map[string]SyncStatus)}
+	for _, repository := range s.repositories {
+		state.statuses[repository.Path] = repository.Status()
+	}
+	s.profileStates[s.profile] = state
+}
 
-	if len(s.repositories) == 0 {
-		return "No repositories configured"
+func (s *SyncEngine) restoreProfileState(repositories []*Repository) {
+	state, ok := s.profileStates[s.profile]
+	if !ok {
+		s.paused = false
+		return
+	}
+	s.paused = state.paused
+	for _, repository := range repositories {
+		if saved, ok := state.statuses[repository.Path]; ok {
+			repository.updateStatus(func(status *SyncStatus) {
+				status.LastSync = saved.LastSync
+				status.Error = saved.Error
+				status.ErrorAt = saved.ErrorAt
+				status.LastRun = saved.LastRun
+				status.Total = saved.Total
+			})
+		}
 	}
+}
 
-	for _, repository := range s.repositories {
-		status := &repository.Status
-		sb.WriteString(fmt.Sprintf("Repository: %s\n", repository.Path))
+// FindRepository returns the configured repository rooted at repoPath
+func (s *SyncEngine) FindRepository(repoPath string) *Repository {
+	repoPath = filepath.Clean(repoPath)
+	for _, repository := range s.Repositories() {
+		if filepath.Clean(repository.Path) == repoPath {
+			return repository
+		}
+	}
+	return nil
+}
 
-		if status.LastSync.IsZero() {
-			sb.WriteString("  Never synced\n")
-		} else {
-			sb.WriteString(fmt.Sprintf("  Last sync: %s\n", status.LastSync.Format(time.RFC3339)))
+// Returns the repository a file is in, or nil
+func (s *SyncEngine) RepositoryOf(filePath string) *Repository {
+	for _, repository := range s.Repositories() {
+		rel, err := filepath.Rel(repository.Path, filePath)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return repository
 		}
+	}
+	return nil
+}
 
+// Repositories returns the repositories of the running configuration
+func (s *SyncEngine) Repositories() []*Repository {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.repositories
+}
+
+func (s *SyncEngine) History() *History {
+	return s.history
+}
+
+func (s *SyncEngine) Events() *EventBus {
+	return s.events
+}
+
+func (s *SyncEngine) Snapshot() []RepositorySnapshot {
+	repositories := s.Repositories()
+	threshold := s.NotificationConfig().FailureThreshold
+	snapshots := make([]RepositorySnapshot, 0, len(repositories))
+	for _, repository := range repositories {
+		status := repository.Status()
+		snapshot := RepositorySnapshot{
+			Path:       repository.Path,
+			Schedule:   repository.Schedule.String(),
+			Direction:  oneWayDirection(repository.Direction),
+			LastSync:   status.LastSync,
+			InProgress: status.InProgress,
+			Error:      status.Error,
+			Missing:    status.Missing,
+			LastRun:    status.LastRun,
+			Total:      status.Total,
+			Retries:    repository.RetryQueue(),
+
+			FailureStreak: status.FailureStreak,
+			Failing:       status.FailureStreak > 0 && status.FailureStreak >= threshold,
+		}
+		snapshot.HeldDeletions = status.Deletions
+		snapshot.Scrub = status.Scrub
+		if status.Error != "" && !status.ErrorAt.IsZero() {
+			snapshot.ErrorAt = &status.ErrorAt
+		}
+		if !status.NextSync.IsZero() {
+			snapshot.NextSync = &status.NextSync
+		}
+		if at := s.scheduledSync(repository.Path); !at.IsZero() {
+			snapshot.ScheduledSync = &at
+		}
+		if !status.CircuitOpenUntil.IsZero() {
+			snapshot.CircuitOpenUntil = &status.CircuitOpenUntil
+		}
+		snapshot.Behind = status.Behind
+		snapshot.DiskSpace = status.DiskSpace
+		snapshot.Skipped = s.Skipped(repository)
 		if status.InProgress {
-			sb.WriteString("  Status: In progress\n")
-		} else if status.Error != "" {
-			sb.WriteString(fmt.Sprintf("  Status: Error - %s\n", status.Error))
-		} else {
-			sb.WriteString("  Status: Idle\n")
+			snapshot.CurrentFile = status.CurrentFile
+			snapshot.Queued = status.Queued
+			snapshot.BytesTransferred = status.BytesTransferred
+			snapshot.BytesPending = status.BytesPending
+			if status.Seed.Total > 0 {
+				seed := status.Seed
+				snapshot.Seed = &seed
+			}
+			if elapsed := time.Since(status.StartedAt).Seconds(); elapsed > 0 {
+				snapshot.BytesPerSecond = float64(status.BytesTransferred) / elapsed
+			}
 		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots
+}
 
-		sb.WriteString("\n")
+func oneWayDirection(direction string) string {
+	if direction == DirectionBoth {
+		return ""
 	}
+	return direction
+}
+
+func (s *SyncEngine) NotificationConfig() NotificationConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.notifyConfig
+}
+
+// What to do on a metered network, as configured
+func (s *SyncEngine) MeteredConfig() MeteredConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.meteredConfig
+}
+
+// How the remotes are scrubbed, as configured
+func (s *SyncEngine) ScrubConfig() ScrubConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scrubConfig
+}
+
+// How to sync on battery, as configured
+func (s *SyncEngine) BatteryConfig() BatteryConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batteryConfig
+}
 
-	return sb.String()
+// HTTP API settings of the config the engine was started with
+func (s *SyncEngine) HTTPConfig() HTTPConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.httpConfig
+}
+
+func (s *SyncEngine) SocketConfig() SocketConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.socketConfig
+}
+
+func (s *SyncEngine) StatusPayload() StatusPayload {
+	s.mu.Lock()
+	profile, paused, meteredConfig, batteryConfig := s.profile, s.paused, s.meteredConfig, s.batteryConfig
+	s.mu.Unlock()
+	payload := StatusPayload{
+		Profile:      profile,
+		Paused:       paused,
+		Repositories: s.Snapshot(),
+	}
+	if meteredConfig.Action != "" && s.networkMetered(meteredConfig) {
+		payload.Metered = meteredConfig.Action
+		payload.ThrottleRate = meteredConfig.ThrottleRate
+	}
+	if low, percent := s.lowBattery(batteryConfig); low {
+		payload.Battery = &BatteryPayload{
+			Percent:       percent,
+			SyncInterval:  batteryConfig.SyncInterval,
+			MaxUploadSize: batteryConfig.MaxUploadSize,
+		}
+	}
+	return payload
+}
+
+// Health reports repositories whose last sync failed, or which have not
+// synced within twice the sync interval
+func (s *SyncEngine) Health() HealthPayload {
+	s.mu.Lock()
+	repositories, paused, syncInterval, meteredConfig, batteryConfig := s.repositories, s.paused, s.syncInterval, s.meteredConfig, s.batteryConfig
+	s.mu.Unlock()
+	// Syncs paused on a metered network aren't overdue either, nor are those
+	// spaced out on battery
+	if meteredConfig.Action == MeteredPause && s.networkMetered(meteredConfig) {
+		paused = true
+	}
+	if low, _ := s.lowBattery(batteryConfig); low {
+		syncInterval = max(syncInterval, time.Duration(batteryConfig.SyncInterval))
+	}
+
+	health := HealthPayload{Healthy: true}
+	for _, repository := range repositories {
+		if s.Skipped(repository) {
+			continue
+		}
+		status := repository.Status()
+		if status.Error != "" && !status.InProgress {
+			health.Problems = append(health.Problems, fmt.Sprintf("%s: last sync failed: %s", repository.Path, status.Error))
+			continue
+		}
+		if scrub := status.Scrub; scrub != nil && !scrub.Healthy() {
+			health.Problems = append(health.Problems, fmt.Sprintf("%s: %s", repository.Path, scrub.summary()))
+		}
+		// Outside its schedule, or just after a window opened, a repository
+		// isn't expected to have synced
+		schedule := repository.Schedule
+		if paused || !schedule.Allows(time.Now()) || !schedule.Allows(time.Now().Add(-2*syncInterval)) {
+			continue
+		}
+		lastSync := status.LastSync
+		if lastSync.IsZero() {
+			lastSync = s.startedAt
+		}
+		overdue := time.Since(lastSync) > 2*syncInterval
+		if schedule.Timed() {
+			// A sync interval past the time it should have synced at
+			overdue = time.Since(schedule.Next(lastSync)) > syncInterval
+		}
+		if overdue {
+			health.Problems = append(health.Problems, fmt.Sprintf("%s: not synced for %s", repository.Path, time.Since(lastSync).Round(time.Second)))
+		}
+	}
+	health.Healthy = len(health.Problems) == 0
+	return health
+}
+
+func (s *SyncEngine) GetStatus() string {
+	return formatStatus(s.StatusPayload())
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// reposy-<instance>.service for named instances
+var systemdUnitName = "reposy.service"
+
+const systemdUnitTemplate = `[Unit]
+Description=Reposy repository sync service
+After=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+WatchdogSec=60
+
+[Install]
+WantedBy=default.target
+`
+
+// sdNotify sends a state change to systemd, it is a no-op when the
+// daemon is not supervised by systemd.
+// https://www.freedesktop.org/software/systemd/man/sd_notify.html
+func sdNotify(state string) error {
+	notifySocket := os.Getenv("NOTIFY_SOCKET")
+	if notifySocket == "" {
+		return nil
+	}
+	conn, err := net.Dial("unixgram", notifySocket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Returns the watchdog interval configured by systemd, or 0 if disabled
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Keeps the systemd watchdog fed as long as the daemon still answers IPC
+func runSdWatchdog() {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := pingDaemon(); err != nil {
+			slog.Warn("Skipping watchdog notification, sync service does not answer", "error", err)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			slog.Error("Failed to notify systemd watchdog", "error", err)
+		}
+	}
+}
+
+func systemdUnitPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".config", "systemd", "user", systemdUnitName), nil
+}
+
+func installSystemdService() error {
+	execPath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+	unitPath, err := systemdUnitPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(unitPath), 0755); err != nil {
+		return fmt.Errorf("failed to create unit directory: %w", err)
+	}
+	args, err := daemonArgs()
+	if err != nil {
+		return err
+	}
+	execStart := strconv.Quote(execPath)
+	for _, arg := range args {
+		execStart += " " + strconv.Quote(arg)
+	}
+	unit := fmt.Sprintf(systemdUnitTemplate, execStart)
+	if err := os.WriteFile(unitPath, []byte(unit), 0644); err != nil {
+		return fmt.Errorf("failed to write unit file: %w", err)
+	}
+	fmt.Printf("Wrote %s\n", unitPath)
+
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", "--now", systemdUnitName)
+}
+
+func uninstallSystemdService() error {
+	unitPath, err := systemdUnitPath()
+	if err != nil {
+		return err
+	}
+	if err := systemctl("disable", "--now", systemdUnitName); err != nil {
+		return err
+	}
+	if err := os.Remove(unitPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove unit file: %w", err)
+	}
+	fmt.Printf("Removed %s\n", unitPath)
+	return systemctl("daemon-reload")
+}
+
+func systemctl(args ...string) error {
+	cmd := exec.Command("systemctl", append([]string{"--user"}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("systemctl --user %v failed: %w", args, err)
+	}
+	return nil
+}
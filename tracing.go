@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spans are exported in batches of this size, or every tracingFlushInterval
+const (
+	tracingBatchSize     = 512
+	tracingFlushInterval = 5 * time.Second
+	tracingQueueLimit    = 8192
+)
+
+// OTLP span kinds and status codes, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+	spanStatusError  = 2
+)
+
+type TracingConfig struct {
+	// OTLP/HTTP collector, e.g. "http://localhost:4318". Falls back to the
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variable; tracing is disabled
+	// when neither is set.
+	Endpoint string            `json:"endpoint"`
+	Headers  map[string]string `json:"headers"`
+}
+
+// Tracer records spans of sync runs and S3 requests and exports them to an
+// OpenTelemetry collector with the OTLP/HTTP JSON encoding. A nil Tracer
+// records nothing.
+type Tracer struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	mu      sync.Mutex
+	pending []*Span
+	flush   chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewTracer returns nil when no collector is configured
+func NewTracer(config TracingConfig) *Tracer {
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if endpoint == "" {
+		return nil
+	}
+	tracer := &Tracer{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers: config.Headers,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		flush:   make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go tracer.run()
+	return tracer
+}
+
+// Shutdown exports the spans still pending and stops the exporter
+func (t *Tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+}
+
+// Start begins a root span, the first span of a new trace
+func (t *Tracer) Start(name string, attrs ...any) *Span {
+	if t == nil {
+		return nil
+	}
+	span := &Span{tracer: t, name: name, kind: spanKindInternal, start: time.Now()}
+	rand.Read(span.traceID[:])
+	rand.Read(span.spanID[:])
+	span.SetAttributes(attrs...)
+	return span
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.flush:
+		case <-t.stop:
+			t.export()
+			return
+		}
+		t.export()
+	}
+}
+
+func (t *Tracer) finish(span *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= tracingQueueLimit {
+		return // the collector is unreachable, drop spans rather than grow
+	}
+	t.pending = append(t.pending, span)
+	if len(t.pending) >= tracingBatchSize {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) export() {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	for len(spans) > 0 {
+		batch := spans[:min(len(spans), tracingBatchSize)]
+		spans = spans[len(batch):]
+		if err := t.send(batch); err != nil {
+			slog.Warn("Failed to export trace spans", "spans", len(batch), "error", err)
+		}
+	}
+}
+
+func (t *Tracer) send(spans []*Span) error {
+	encoded := make([]map[string]any, 0, len(spans))
+	for _, span := range spans {
+		encoded = append(encoded, span.otlp())
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes([]any{"service.name", "reposy"}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/likang/reposy"},
+				"spans": encoded,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+// Span is a timed operation within a trace. All methods are no-ops on a nil
+// Span, so callers don't need to check whether tracing is enabled.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []any
+	err      string
+}
+
+// Child begins a span nested in this one
+func (s *Span) Child(name string, attrs ...any) *Span {
+	if s == nil {
+		return nil
+	}
+	child := &Span{tracer: s.tracer, traceID: s.traceID, parentID: s.spanID, name: name, kind: spanKindInternal, start: time.Now()}
+	rand.Read(child.spanID[:])
+	child.SetAttributes(attrs...)
+	return child
+}
+
+// AsClient marks the span as a request to a remote service
+func (s *Span) AsClient() *Span {
+	if s != nil {
+		s.kind = spanKindClient
+	}
+	return s
+}
+
+// Attributes are given as alternating keys and values, like slog
+func (s *Span) SetAttributes(attrs ...any) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, attrs...)
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.err = err.Error()
+}
+
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.tracer.finish(s)
+}
+
+func (s *Span) otlp() map[string]any {
+	encoded := map[string]any{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		encoded["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != "" {
+		encoded["status"] = map[string]any{"code": spanStatusError, "message": s.err}
+	}
+	return encoded
+}
+
+func otlpAttributes(attrs []any) []map[string]any {
+	encoded := make([]map[string]any, 0, len(attrs)/2)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		key, ok := attrs[i].(string)
+		if !ok {
+			continue
+		}
+		var value map[string]any
+		switch v := attrs[i+1].(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, map[string]any{"key": key, "value": value})
+	}
+	return encoded
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+)
+
+// Runs the file transfers of a sync, up to a number at once. The transfers
+// update the maps and counters of the sync holding the pool's lock.
+type transferPool struct {
+	mu    sync.Mutex
+	wg    sync.WaitGroup
+	slots chan struct{}
+	// First error that stops the sync
+	err error
+}
+
+// A pool of concurrency 1 runs transfers in the caller's goroutine
+func newTransferPool(concurrency int) *transferPool {
+	pool := &transferPool{}
+	if concurrency > 1 {
+		pool.slots = make(chan struct{}, concurrency)
+	}
+	return pool
+}
+
+func (pool *transferPool) Go(transfer func()) {
+	if pool.slots == nil {
+		transfer()
+		return
+	}
+	pool.slots <- struct{}{}
+	pool.wg.Add(1)
+	go func() {
+		defer func() {
+			<-pool.slots
+			pool.wg.Done()
+		}()
+		transfer()
+	}()
+}
+
+// Waits for the transfers started, returning the error that stopped them
+func (pool *transferPool) Wait() error {
+	pool.wg.Wait()
+	return pool.Err()
+}
+
+func (pool *transferPool) locked(update func()) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	update()
+}
+
+func (pool *transferPool) fail(err error) {
+	pool.locked(func() {
+		if pool.err == nil {
+			pool.err = err
+		}
+	})
+}
+
+func (pool *transferPool) Err() error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.err
+}
+
+// Limits the bytes of files held in memory by the uploads in flight. A file
+// larger than the whole budget waits for the others to finish.
+type byteBudget struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	max      int64
+	inflight int64
+}
+
+// A budget of 0 bytes is unlimited
+func newByteBudget(max int64) *byteBudget {
+	budget := &byteBudget{max: max}
+	budget.cond = sync.NewCond(&budget.mu)
+	return budget
+}
+
+func (budget *byteBudget) acquire(n int64) {
+	if budget.max <= 0 {
+		return
+	}
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	for budget.inflight > 0 && budget.inflight+n > budget.max {
+		budget.cond.Wait()
+	}
+	budget.inflight += n
+}
+
+func (budget *byteBudget) release(n int64) {
+	if budget.max <= 0 {
+		return
+	}
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	budget.inflight -= n
+	budget.cond.Broadcast()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How connections to S3 are made. Every repository shares one transport, so
+// that requests to the same host reuse its open connections, over HTTP/2
+// when the endpoint supports it, instead of connecting for each object.
+type TransportConfig struct {
+	// Idle connections kept open per host for the next requests
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host"`
+	// Time allowed to connect, and again to complete the TLS handshake
+	DialTimeout Interval `json:"dial_timeout"`
+	// DNS server endpoints are resolved with instead of the system's, as
+	// "host:port"
+	Resolver string `json:"resolver"`
+	// Addresses connected to for endpoint hosts, bypassing DNS, e.g. for a
+	// private VPC endpoint. TLS is still verified against the host.
+	Pin map[string]string `json:"pin"`
+}
+
+const (
+	defaultMaxIdleConnsPerHost = 32
+	defaultDialTimeout         = Interval(10 * time.Second)
+)
+
+func (config TransportConfig) validate() error {
+	if config.MaxIdleConnsPerHost < 0 || config.DialTimeout < 0 {
+		return fmt.Errorf("transport.max_idle_conns_per_host and transport.dial_timeout can't be negative")
+	}
+	if config.Resolver != "" {
+		if _, _, err := net.SplitHostPort(config.Resolver); err != nil {
+			return fmt.Errorf("transport.resolver must be a host:port, got %q", config.Resolver)
+		}
+	}
+	for host, address := range config.Pin {
+		if net.ParseIP(address) == nil {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				return fmt.Errorf("transport.pin of %s must be an IP address or IP:port, got %q", host, address)
+			}
+		}
+	}
+	return nil
+}
+
+func (config TransportConfig) equal(other TransportConfig) bool {
+	return config.MaxIdleConnsPerHost == other.MaxIdleConnsPerHost &&
+		config.DialTimeout == other.DialTimeout &&
+		config.Resolver == other.Resolver &&
+		maps.Equal(config.Pin, other.Pin)
+}
+
+// Connects to the address pinned for the host dialed, if any, resolving
+// hosts with the configured resolver
+func (config TransportConfig) dialContext() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(config.DialTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+	if config.Resolver != "" {
+		resolver := config.Resolver
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{Timeout: time.Duration(config.DialTimeout)}).DialContext(ctx, network, resolver)
+			},
+		}
+	}
+	pins := maps.Clone(config.Pin)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if pinned, ok := pins[host]; ok {
+			if net.ParseIP(pinned) != nil {
+				addr = net.JoinHostPort(pinned, port)
+			} else {
+				addr = pinned
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+func (config TransportConfig) withDefaults() TransportConfig {
+	if config.MaxIdleConnsPerHost == 0 {
+		config.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaultDialTimeout
+	}
+	return config
+}
+
+var s3HTTP = struct {
+	sync.Mutex
+	config TransportConfig
+	client *http.Client
+}{}
+
+func newS3Transport(config TransportConfig) *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           config.dialContext(),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          0,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   time.Duration(config.DialTimeout),
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// Replaces the transport of S3 requests when its config changed, closing the
+// idle connections of the previous one
+func setS3Transport(config TransportConfig) {
+	config = config.withDefaults()
+	s3HTTP.Lock()
+	defer s3HTTP.Unlock()
+	if s3HTTP.client != nil && s3HTTP.config.equal(config) {
+		return
+	}
+	if s3HTTP.client != nil {
+		s3HTTP.client.CloseIdleConnections()
+	}
+	s3HTTP.config = config
+	s3HTTP.client = &http.Client{Transport: newS3Transport(config)}
+}
+
+// The client S3 requests are sent with, with the default transport until one
+// is set from the config
+func s3HTTPClient() *http.Client {
+	s3HTTP.Lock()
+	defer s3HTTP.Unlock()
+	if s3HTTP.client == nil {
+		s3HTTP.config = TransportConfig{}.withDefaults()
+		s3HTTP.client = &http.Client{Transport: newS3Transport(s3HTTP.config)}
+	}
+	return s3HTTP.client
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Local files deleted because of a remote tombstone are moved to the trash,
+// $XDG_DATA_HOME/reposy/trash/<repo>/<time>/<path>, rather than removed, so
+// that a bad remote state can't destroy local work. Each sync empties the
+// trash of the files kept longer than the retention.
+type TrashConfig struct {
+	// How long trashed files are kept, files are removed right away when
+	// negative
+	Retention Interval `json:"retention"`
+}
+
+const (
+	defaultTrashRetention = Interval(30 * 24 * time.Hour)
+	// Names the directory of the files trashed at a time
+	trashTimeLayout = "20060102-150405"
+)
+
+// Directory of the files a repository trashed, named after its path
+func trashDirFor(repoPath string) (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	name := strings.Trim(strings.NewReplacer(`/`, "-", `\`, "-", ":", "").Replace(filepath.Clean(repoPath)), "-")
+	return filepath.Join(dir, "trash", name), nil
+}
+
+// Moves a local file to the trash, or removes it when the trash is disabled.
+// Returns where the file went, "" when removed.
+func (repo *Repository) trashFile(slashPath string) (string, error) {
+	defer repo.touch(slashPath)
+	fullLocalPath := repo.localPath(slashPath)
+	if repo.Trash.Retention < 0 {
+		return "", os.Remove(fullLocalPath)
+	}
+	dir, err := trashDirFor(repo.Path)
+	if err != nil {
+		return "", err
+	}
+	trashPath := filepath.Join(dir, time.Now().Format(trashTimeLayout), filepath.FromSlash(diskPath(slashPath)))
+	// A file trashed twice within a second keeps both copies
+	base := trashPath
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(trashPath); os.IsNotExist(err) {
+			break
+		}
+		trashPath = fmt.Sprintf("%s.%d", base, i)
+	}
+	if err := os.MkdirAll(filepath.Dir(trashPath), 0700); err != nil {
+		return "", fmt.Errorf("failed to create trash directory: %w", err)
+	}
+	if err := os.Rename(fullLocalPath, trashPath); err == nil {
+		return trashPath, nil
+	}
+	// The trash may be on another file system than the repository
+	if err := copyFile(fullLocalPath, trashPath); err != nil {
+		os.Remove(trashPath)
+		return "", fmt.Errorf("failed to move %s to trash: %w", slashPath, err)
+	}
+	return trashPath, os.Remove(fullLocalPath)
+}
+
+// Copies a file with its mode and modification time
+func copyFile(from, to string) error {
+	info, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(to, time.Now(), info.ModTime())
+}
+
+// Removes the files trashed longer ago than the retention
+func (repo *Repository) emptyTrash() {
+	if repo.Trash.Retention < 0 {
+		return
+	}
+	dir, err := trashDirFor(repo.Path)
+	if err != nil {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(repo.Trash.Retention))
+	for _, entry := range entries {
+		trashedAt, err := time.ParseInLocation(trashTimeLayout, entry.Name(), time.Local)
+		if err != nil || trashedAt.After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			repo.logger.Warn("Failed to empty trash", "dir", entry.Name(), "error", err)
+			continue
+		}
+		repo.logger.Info("Emptied trash", "dir", entry.Name())
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	// Most recent errors and log lines shown by the dashboard
+	tuiMaxErrors   = 8
+	tuiMaxLogLines = 15
+	// How much of the end of the log is searched for them
+	tuiLogTailBytes = 256 << 10
+)
+
+// State of the full-screen dashboard, updated by the daemon streams and the
+// keyboard and drawn after every change
+type dashboard struct {
+	mu       sync.Mutex
+	repos    []RepositorySnapshot
+	errors   []Event
+	selected int
+	paused   bool
+	showLogs bool
+	// Outcome of the last command sent from a keybinding
+	notice string
+	redraw chan struct{}
+}
+
+func (d *dashboard) update(change func()) {
+	d.mu.Lock()
+	change()
+	d.mu.Unlock()
+	select {
+	case d.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// Runs the dashboard until quit with q or Ctrl-C
+func runDashboard() error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("reposy tui needs a terminal")
+	}
+
+	d := &dashboard{redraw: make(chan struct{}, 1)}
+	var status StatusPayload
+	if decodePayload(sendCommand("status", ""), &status) {
+		d.paused = status.Paused
+	}
+
+	snapshots, err := dialDaemon()
+	if err != nil {
+		return err
+	}
+	defer snapshots.Close()
+	events, err := dialDaemon()
+	if err != nil {
+		return err
+	}
+	defer events.Close()
+
+	streamErr := make(chan error, 2)
+	go func() {
+		streamErr <- snapshots.Stream("watch", "", func(frame ResponseFrame) bool {
+			d.update(func() {
+				d.repos = frame.Snapshot
+				d.selected = min(d.selected, max(len(d.repos)-1, 0))
+			})
+			return true
+		})
+	}()
+	go func() {
+		streamErr <- events.Stream("events", "", func(frame ResponseFrame) bool {
+			if event := frame.Event; event.Type == EventSyncFailed || event.Type == EventConflict {
+				d.update(func() {
+					d.errors = append(d.errors, *event)
+					if len(d.errors) > tuiMaxErrors {
+						d.errors = d.errors[len(d.errors)-tuiMaxErrors:]
+					}
+				})
+			}
+			return true
+		})
+	}()
+
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, oldState)
+	// Switch to the alternate screen and hide the cursor until done
+	fmt.Print("\033[?1049h\033[?25l")
+	defer fmt.Print("\033[?25h\033[?1049l")
+
+	keys := make(chan string)
+	go readKeys(keys)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		d.draw()
+		select {
+		case err := <-streamErr:
+			return fmt.Errorf("status stream ended: %w", err)
+		case key, ok := <-keys:
+			if !ok || key == "q" || key == "\x03" {
+				return nil
+			}
+			d.handleKey(key)
+		case <-d.redraw:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sends keys pressed, arrow keys as "up" and "down", until stdin closes
+func readKeys(keys chan<- string) {
+	defer close(keys)
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil {
+			return
+		}
+		key := string(r)
+		if r == '\033' && reader.Buffered() >= 2 {
+			seq := make([]byte, 2)
+			reader.Read(seq)
+			switch string(seq) {
+			case "[A":
+				key = "up"
+			case "[B":
+				key = "down"
+			default:
+				continue
+			}
+		}
+		keys <- key
+	}
+}
+
+func (d *dashboard) handleKey(key string) {
+	d.mu.Lock()
+	var repoPath string
+	if d.selected < len(d.repos) {
+		repoPath = d.repos[d.selected].Path
+	}
+	paused := d.paused
+	d.mu.Unlock()
+
+	switch key {
+	case "up", "k":
+		d.update(func() { d.selected = max(d.selected-1, 0) })
+	case "down", "j":
+		d.update(func() { d.selected = min(d.selected+1, max(len(d.repos)-1, 0)) })
+	case "s":
+		if repoPath != "" {
+			d.notify(sendCommand("sync", repoPath))
+		}
+	case "a":
+		d.notify(sendCommand("sync", ""))
+	case "p":
+		command := "pause"
+		if paused {
+			command = "resume"
+		}
+		resp := sendCommand(command, "")
+		d.update(func() {
+			if resp.Status == "success" {
+				d.paused = !paused
+			}
+		})
+		d.notify(resp)
+	case "l":
+		d.update(func() { d.showLogs = !d.showLogs })
+	}
+}
+
+func (d *dashboard) notify(resp Response) {
+	d.update(func() { d.notice = resp.Message })
+}
+
+func (d *dashboard) draw() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+
+	var lines []string
+	title := fmt.Sprintf("Reposy, %s", time.Now().Format(time.TimeOnly))
+	if d.paused {
+		title += " - paused"
+	}
+	lines = append(lines, title, "")
+	lines = append(lines, fmt.Sprintf("  %-40s %-14s %6s %10s %10s  %s", "REPOSITORY", "STATE", "QUEUE", "DONE", "SPEED", "CURRENT FILE"))
+	for i, repo := range d.repos {
+		marker := " "
+		if i == d.selected {
+			marker = ">"
+		}
+		lines = append(lines, fmt.Sprintf("%s %-40s %-14s %6d %10s %8s/s  %s",
+			marker, repo.Path, dashboardState(repo), repo.Queued+len(repo.Retries),
+			formatBytes(repo.BytesTransferred), formatBytes(int64(repo.BytesPerSecond)), repo.CurrentFile))
+	}
+	if len(d.repos) == 0 {
+		lines = append(lines, "  No repositories configured")
+	}
+
+	lines = append(lines, "", "Recent errors:")
+	if len(d.errors) == 0 {
+		lines = append(lines, "  None")
+	}
+	for i := len(d.errors) - 1; i >= 0; i-- {
+		event := d.errors[i]
+		lines = append(lines, fmt.Sprintf("  %s %s: %s", event.Time.Format(time.TimeOnly), event.Repository, event.Message))
+	}
+
+	if d.showLogs && d.selected < len(d.repos) {
+		repoPath := d.repos[d.selected].Path
+		lines = append(lines, "", fmt.Sprintf("Log of %s:", repoPath))
+		for _, line := range tailLog(repoPath, tuiMaxLogLines) {
+			lines = append(lines, "  "+line)
+		}
+	}
+
+	if d.notice != "" {
+		lines = append(lines, "", d.notice)
+	}
+	footer := "j/k select  s sync  a sync all  p pause/resume  l logs  q quit"
+
+	var sb strings.Builder
+	// Move the cursor home and clear the screen
+	sb.WriteString("\033[H\033[2J")
+	for i, line := range lines {
+		if i >= height-2 {
+			break
+		}
+		sb.WriteString(truncateLine(line, width))
+		sb.WriteString("\r\n")
+	}
+	sb.WriteString(fmt.Sprintf("\033[%d;1H%s", height, truncateLine(footer, width)))
+	fmt.Print(sb.String())
+}
+
+func dashboardState(repo RepositorySnapshot) string {
+	switch {
+	case repo.InProgress && repo.Seed != nil && repo.Seed.Total > 0:
+		return fmt.Sprintf("seeding %d%%", repo.Seed.Done*100/repo.Seed.Total)
+	case repo.InProgress:
+		return "syncing"
+	case repo.Missing:
+		return "missing"
+	case repo.CircuitOpenUntil != nil:
+		return "remote down"
+	case repo.HeldDeletions != nil:
+		return "held back"
+	case repo.Failing:
+		return fmt.Sprintf("failing (%d)", repo.FailureStreak)
+	case repo.Error != "":
+		return "error"
+	case repo.LastSync.IsZero():
+		return "never synced"
+	}
+	return "synced " + repo.LastSync.Format(time.TimeOnly)
+}
+
+func truncateLine(line string, width int) string {
+	runes := []rune(line)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return line
+}
+
+// Returns the last lines of the sync service log about a repository, read
+// from the end of the log only
+func tailLog(repoPath string, n int) []string {
+	file, err := os.Open(logPath)
+	if err != nil {
+		return []string{fmt.Sprintf("Failed to read %s: %v", logPath, err)}
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil && info.Size() > tuiLogTailBytes {
+		file.Seek(info.Size()-tuiLogTailBytes, io.SeekStart)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return []string{fmt.Sprintf("Failed to read %s: %v", logPath, err)}
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.Contains(line, repoPath) {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
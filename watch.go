@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Redraws a live table of sync progress on every snapshot streamed by the daemon
+func watchStatusTable() error {
+	client, err := dialDaemon()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.Stream("watch", "", func(frame ResponseFrame) bool {
+		// clear screen and move the cursor home
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("Reposy sync status, %s (Ctrl-C to quit)\n\n", time.Now().Format(time.TimeOnly))
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "REPOSITORY\tSTATE\tQUEUE\tTRANSFERRED\tSPEED\tCURRENT FILE")
+		for _, repo := range frame.Snapshot {
+			state := "idle"
+			if repo.InProgress {
+				state = "syncing"
+				if seed := repo.Seed; seed != nil && seed.Total > 0 {
+					state = fmt.Sprintf("seeding %d%%", seed.Done*100/seed.Total)
+				}
+			} else if repo.Error != "" {
+				state = "error"
+			} else if repo.LastSync.IsZero() {
+				state = "never synced"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s/s\t%s\n",
+				repo.Path, state, repo.Queued,
+				formatBytes(repo.BytesTransferred), formatBytes(int64(repo.BytesPerSecond)),
+				repo.CurrentFile)
+		}
+		w.Flush()
+		return true
+	})
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
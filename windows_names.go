@@ -0,0 +1,92 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+)
+
+// Files synced from macOS or Linux may have names Windows can't create:
+// names with one of <>:"\|?* or a control character, names ending with a
+// dot or a space, and device names such as CON or NUL.txt. On Windows, such
+// characters are written to disk mapped to the Unicode private use area, at
+// windowsNameEscape plus the character, as Cygwin and macOS SMB shares do,
+// and so is the first letter of device names. Local names are mapped back
+// when listed, so files keep their names on the remote and on other
+// machines, and the local index keeps the name each file has on disk.
+const windowsNameEscape = 0xF000
+
+// Whether file names are mapped, only where the file system needs it
+var windowsNames = runtime.GOOS == "windows"
+
+const windowsReservedChars = `<>:"\|?*`
+
+var windowsDeviceNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Maps a name that Windows can't create to one it can, leaving others as
+// they are
+func encodeWindowsName(name string) string {
+	if name == "." || name == ".." {
+		return name
+	}
+	var sb strings.Builder
+	for i, r := range name {
+		last := i == len(name)-1
+		if r < 0x20 || strings.ContainsRune(windowsReservedChars, r) || last && (r == '.' || r == ' ') {
+			sb.WriteRune(windowsNameEscape + r)
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	encoded := sb.String()
+	base, _, _ := strings.Cut(encoded, ".")
+	if windowsDeviceNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		encoded = string(rune(windowsNameEscape+rune(encoded[0]))) + encoded[1:]
+	}
+	return encoded
+}
+
+// Maps the characters encodeWindowsName escaped back
+func decodeWindowsName(name string) string {
+	if !strings.ContainsFunc(name, windowsEscaped) {
+		return name
+	}
+	return strings.Map(func(r rune) rune {
+		if windowsEscaped(r) {
+			return r - windowsNameEscape
+		}
+		return r
+	}, name)
+}
+
+func windowsEscaped(r rune) bool {
+	return r > windowsNameEscape && r < windowsNameEscape+0x80
+}
+
+func mapPathNames(slashPath string, mapName func(string) string) string {
+	names := strings.Split(slashPath, "/")
+	for i, name := range names {
+		names[i] = mapName(name)
+	}
+	return strings.Join(names, "/")
+}
+
+// Slash path a file synced as slashPath has on disk, relative to the
+// repository
+func diskPath(slashPath string) string {
+	if !windowsNames {
+		return slashPath
+	}
+	return mapPathNames(slashPath, encodeWindowsName)
+}
+
+// Slash path a file is synced as, from the one it has on disk
+func syncedPath(diskSlashPath string) string {
+	if !windowsNames {
+		return diskSlashPath
+	}
+	return mapPathNames(diskSlashPath, decodeWindowsName)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Listing every file of a large repository with git ls-files and stating
+// each one on every sync costs more than the sync itself when little
+// changed. The working tree files of the last listing are kept instead, and
+// only the paths git status reports, along with those it reported last time
+// and those the sync wrote, are listed again. Files git sees as unchanged are
+// taken from the last listing. Everything is listed again every
+// worktreeRelistInterval, whenever git status fails, and when something else
+// than the sync wrote the git index since, as a checkout does.
+const worktreeRelistInterval = time.Hour
+
+// More paths to check than this are faster to list all over again
+const worktreeMaxRefresh = 1000
+
+// A working tree file as it was listed
+type worktreeFile struct {
+	ModTime int64
+	// The file it is a hard link to, if linked is set
+	Link   hardLinkID
+	Linked bool
+}
+
+type worktreeCache struct {
+	files map[string]worktreeFile
+	// Paths git status reported at the last listing
+	changed  map[string]bool
+	listedAt time.Time
+	// The git index after the last git status, which may have written it
+	index gitIndexState
+}
+
+type gitIndexState struct {
+	ModTime int64
+	Size    int64
+}
+
+func readGitIndexState(repoPath string) gitIndexState {
+	git, err := resolveGitLayout(repoPath)
+	if err != nil {
+		return gitIndexState{}
+	}
+	info, err := os.Stat(filepath.Join(git.gitDir, "index"))
+	if err != nil {
+		return gitIndexState{}
+	}
+	return gitIndexState{ModTime: modTimeOf(info), Size: info.Size()}
+}
+
+func statWorktreeFile(fullPath string) (worktreeFile, bool, error) {
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// maybe user remove file directly, not using git
+			return worktreeFile{}, false, nil
+		}
+		return worktreeFile{}, false, fmt.Errorf("failed to stat file %s: %w", fullPath, err)
+	}
+	if info.IsDir() {
+		return worktreeFile{}, false, nil
+	}
+	link, linked := hardLinkOf(info)
+	return worktreeFile{ModTime: modTimeOf(info), Link: link, Linked: linked}, true, nil
+}
+
+// Records paths the sync wrote or removed, to list them again though git
+// status may not report them. Like the paths git reports, they are the names
+// files have on disk.
+func (repo *Repository) touch(slashPaths ...string) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if repo.touched == nil {
+		repo.touched = make(map[string]bool)
+	}
+	for _, slashPath := range slashPaths {
+		repo.touched[diskPath(slashPath)] = true
+	}
+}
+
+func (repo *Repository) takeTouched() map[string]bool {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	touched := repo.touched
+	repo.touched = nil
+	return touched
+}
+
+// Lists the working tree files, tracked and untracked but not ignored, from
+// the last listing when it can be brought up to date
+func (repo *Repository) listWorktree(add func(slashPath string, file worktreeFile) error) error {
+	touched := repo.takeTouched()
+	cache := repo.worktree
+	repo.worktree = nil
+	canRefresh := repo.GitBackend != GitBackendBuiltin
+	if canRefresh {
+		if _, err := exec.LookPath("git"); err != nil {
+			canRefresh = false
+		}
+	}
+	if !canRefresh {
+		return repo.lsFiles(func(slashPath string) error {
+			file, ok, err := statWorktreeFile(repo.localPath(slashPath))
+			if err != nil || !ok {
+				return err
+			}
+			return add(slashPath, file)
+		})
+	}
+
+	if cache != nil && readGitIndexState(repo.Path) != cache.index {
+		cache = nil
+	}
+	changed, err := gitStatusPaths(repo.Path)
+	if err != nil {
+		repo.logger.Warn("git status failed, listing every file", "error", err)
+		cache = nil
+	}
+	next := &worktreeCache{
+		files:    make(map[string]worktreeFile),
+		changed:  changed,
+		listedAt: time.Now(),
+		index:    readGitIndexState(repo.Path),
+	}
+	if cache != nil && time.Since(cache.listedAt) < worktreeRelistInterval {
+		next.listedAt = cache.listedAt
+		if refreshed, err := repo.refreshWorktree(cache, changed, touched, next); err != nil {
+			return err
+		} else if refreshed {
+			repo.worktree = next
+			for slashPath, file := range next.files {
+				if err := add(slashPath, file); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		next.files = make(map[string]worktreeFile)
+		next.listedAt = time.Now()
+	}
+
+	err = repo.lsFiles(func(slashPath string) error {
+		file, ok, err := statWorktreeFile(repo.localPath(slashPath))
+		if err != nil || !ok {
+			return err
+		}
+		next.files[slashPath] = file
+		return add(slashPath, file)
+	})
+	if err != nil {
+		return err
+	}
+	if changed != nil {
+		repo.worktree = next
+	}
+	return nil
+}
+
+// Brings the files of the last listing up to date into next, stating again
+// the paths that may have changed. Returns false when there are too many of
+// them.
+func (repo *Repository) refreshWorktree(cache *worktreeCache, changed, touched map[string]bool, next *worktreeCache) (bool, error) {
+	refresh := make(map[string]bool, len(changed)+len(cache.changed)+len(touched))
+	for _, paths := range []map[string]bool{changed, cache.changed, touched} {
+		for slashPath := range paths {
+			refresh[slashPath] = true
+		}
+	}
+	if len(refresh) > worktreeMaxRefresh {
+		return false, nil
+	}
+
+	// Paths git status doesn't report anymore are clean when tracked, and
+	// ignored or gone otherwise
+	var unreported []string
+	for slashPath := range refresh {
+		if !changed[slashPath] {
+			unreported = append(unreported, slashPath)
+		}
+	}
+	tracked, err := gitTrackedPaths(repo.Path, unreported)
+	if err != nil {
+		repo.logger.Warn("git ls-files failed, listing every file", "error", err)
+		return false, nil
+	}
+
+	for slashPath, file := range cache.files {
+		if !refresh[slashPath] {
+			next.files[slashPath] = file
+		}
+	}
+	for slashPath := range refresh {
+		if !changed[slashPath] && !tracked[slashPath] {
+			continue
+		}
+		file, ok, err := statWorktreeFile(repo.localPath(slashPath))
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			next.files[slashPath] = file
+		}
+	}
+	return true, nil
+}
+
+// Paths git status reports as changed against the index, deleted ones
+// included, or untracked
+func gitStatusPaths(repoPath string) (map[string]bool, error) {
+	output, err := exec.Command("git", "-C", repoPath, "status", "--porcelain=v1", "-z", "--untracked-files=all", "--no-renames").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git status command failed: %w", commandError(err))
+	}
+	paths := make(map[string]bool)
+	for _, entry := range bytes.Split(output, []byte{0}) {
+		if len(entry) < 4 {
+			continue
+		}
+		// "XY path", where XY is the status in the index and the tree
+		paths[strings.TrimSuffix(string(entry[3:]), "/")] = true
+	}
+	return paths, nil
+}
+
+// Which of paths git tracks
+func gitTrackedPaths(repoPath string, paths []string) (map[string]bool, error) {
+	tracked := make(map[string]bool)
+	if len(paths) == 0 {
+		return tracked, nil
+	}
+	args := []string{"-C", repoPath, "--literal-pathspecs", "ls-files", "-z", "--cached", "--"}
+	output, err := exec.Command("git", append(args, paths...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files command failed: %w", commandError(err))
+	}
+	for _, slashPath := range bytes.Split(output, []byte{0}) {
+		if len(slashPath) > 0 {
+			tracked[filepath.ToSlash(string(slashPath))] = true
+		}
+	}
+	return tracked, nil
+}
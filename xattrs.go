@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+)
+
+// Extended attributes of a file, like Finder tags, the quarantine flag or
+// POSIX ACLs, which are kept in the xattrs "system.posix_acl_access" and
+// "system.posix_acl_default" on Linux. With "xattrs" on a repository, they
+// are stored with the object of each file uploaded and set on the file
+// downloaded. Which attributes are synced and how they are read depends on
+// the platform, see xattrs_unix.go.
+type FileAttrs map[string][]byte
+
+// ACLs grant access to the files they are set on, so that anyone able to
+// write to the bucket could open up the files of a machine restoring them.
+// They are left out unless "xattrs_acls" is set as well.
+var aclXattrs = []string{"system.posix_acl_access", "system.posix_acl_default"}
+
+// Drops the ACLs of attrs unless the repository syncs them
+func (repo *Repository) syncedAttrs(attrs FileAttrs) FileAttrs {
+	if !repo.XattrsACLs {
+		for _, name := range aclXattrs {
+			delete(attrs, name)
+		}
+	}
+	return attrs
+}
+
+// The attributes of an object, as base64 of their JSON
+const HEADER_XATTRS = "x-amz-meta-reposy-xattrs"
+
+// S3 allows 2 KB of user metadata per object, the other headers included.
+// Attributes that don't fit are left out, the largest first.
+const maxXattrsHeader = 1536
+
+func encodeFileAttrs(slashPath string, attrs FileAttrs) string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return len(attrs[names[i]]) < len(attrs[names[j]])
+	})
+	kept := FileAttrs{}
+	encoded := ""
+	for _, name := range names {
+		kept[name] = attrs[name]
+		data, err := json.Marshal(kept)
+		if err != nil || base64.StdEncoding.EncodedLen(len(data)) > maxXattrsHeader {
+			delete(kept, name)
+			slog.Warn("Extended attribute too large to be synced", "file", slashPath, "attribute", name, "size", len(attrs[name]))
+			continue
+		}
+		encoded = base64.StdEncoding.EncodeToString(data)
+	}
+	return encoded
+}
+
+func decodeFileAttrs(encoded string) (FileAttrs, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var attrs FileAttrs
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+// PutWithAttrs uploads a file like Put, storing its extended attributes
+// with it
+func (s3 *S3Client) PutWithAttrs(data []byte, modTime time.Time, slashPath string, attrs FileAttrs) error {
+	headers := map[string]string{}
+	if encoded := encodeFileAttrs(slashPath, attrs); encoded != "" {
+		headers[HEADER_XATTRS] = encoded
+	}
+	return s3.put(data, modTime, slashPath, headers)
+}
+
+// GetAttrs returns the extended attributes stored with a file, nil when it
+// was uploaded without
+func (s3 *S3Client) GetAttrs(slashPath string) (FileAttrs, error) {
+	resp, err := s3.request("HEAD", path.Join(s3.Prefix, slashPath), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to get attributes of %s: status %d", slashPath, resp.StatusCode)
+	}
+	encoded := resp.Headers[http.CanonicalHeaderKey(HEADER_XATTRS)]
+	if encoded == "" {
+		return nil, nil
+	}
+	attrs, err := decodeFileAttrs(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attributes of %s: %w", slashPath, err)
+	}
+	return attrs, nil
+}
+
+// Reads the attributes of a local file to upload with it, an upload going on
+// without them when they can't be read
+func (repo *Repository) localAttrs(slashPath, localFilePath string) FileAttrs {
+	attrs, err := readFileAttrs(localFilePath)
+	if err != nil {
+		repo.logger.Warn("Failed to read extended attributes", "file", slashPath, "error", err)
+		return nil
+	}
+	return repo.syncedAttrs(attrs)
+}
+
+// Sets the attributes stored with a downloaded file on it. A file downloaded
+// without them is still synced, failures are only logged.
+func (repo *Repository) restoreAttrs(slashPath, objectPath string) {
+	getter, ok := repo.Client.(interface {
+		GetAttrs(slashPath string) (FileAttrs, error)
+	})
+	if !ok {
+		return
+	}
+	attrs, err := getter.GetAttrs(objectPath)
+	attrs = repo.syncedAttrs(attrs)
+	if err == nil && len(attrs) > 0 {
+		err = writeFileAttrs(repo.localPath(slashPath), attrs)
+	}
+	if err != nil {
+		repo.logger.Warn("Failed to restore extended attributes", "file", slashPath, "error", err)
+	}
+}
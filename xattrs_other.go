@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// Extended attributes are only synced on Linux and macOS
+const xattrsSupported = false
+
+func readFileAttrs(filePath string) (FileAttrs, error) {
+	return nil, nil
+}
+
+func writeFileAttrs(filePath string, attrs FileAttrs) error {
+	return errors.New("extended attributes aren't supported on this platform")
+}
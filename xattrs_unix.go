@@ -0,0 +1,73 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const xattrsSupported = true
+
+// On Linux, the attributes of other namespaces than "user" need privileges
+// or belong to the file system, but ACLs are synced when the repository
+// allows it, see aclXattrs. On macOS, the resource fork is too large to be
+// stored with the object.
+func syncedXattr(name string) bool {
+	if runtime.GOOS == "linux" {
+		return strings.HasPrefix(name, "user.") || name == "system.posix_acl_access" || name == "system.posix_acl_default"
+	}
+	return name != "com.apple.ResourceFork"
+}
+
+func readFileAttrs(filePath string) (FileAttrs, error) {
+	size, err := unix.Listxattr(filePath, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	list := make([]byte, size)
+	size, err = unix.Listxattr(filePath, list)
+	if err != nil {
+		return nil, err
+	}
+	attrs := FileAttrs{}
+	for _, name := range bytes.Split(list[:size], []byte{0}) {
+		if len(name) == 0 || !syncedXattr(string(name)) {
+			continue
+		}
+		valueSize, err := unix.Getxattr(filePath, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, valueSize)
+		valueSize, err = unix.Getxattr(filePath, string(name), value)
+		if err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = value[:valueSize]
+	}
+	return attrs, nil
+}
+
+func writeFileAttrs(filePath string, attrs FileAttrs) error {
+	var errs []error
+	for name, value := range attrs {
+		if !syncedXattr(name) {
+			continue
+		}
+		if err := unix.Setxattr(filePath, name, value, 0); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}